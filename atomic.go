@@ -0,0 +1,80 @@
+package ent
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Atomic holds an ent which can be read and replaced by many goroutines at once, without locks.
+//
+// This enables copy-on-write use of ents: readers Load an ent which they must treat as
+// immutable while writers modify a copy, for example made with the generated Clone method,
+// and then Store it or swap it in with CompareAndSwap or Update.
+//
+// The zero value holds no ent (Load returns nil.)
+type Atomic struct {
+	p unsafe.Pointer // *Ent
+}
+
+// NewAtomic returns a new Atomic holding e
+func NewAtomic(e Ent) *Atomic {
+	a := &Atomic{}
+	a.Store(e)
+	return a
+}
+
+// Load returns the current ent, or nil if a holds no ent.
+// The ent returned must not be modified.
+func (a *Atomic) Load() Ent {
+	p := atomic.LoadPointer(&a.p)
+	if p == nil {
+		return nil
+	}
+	return *(*Ent)(p)
+}
+
+// Store replaces the current ent with e.
+// Once stored, e must not be modified.
+func (a *Atomic) Store(e Ent) {
+	atomic.StorePointer(&a.p, unsafe.Pointer(&e))
+}
+
+// CompareAndSwap replaces the current ent with next if the current ent is old.
+// Returns true if the ent was replaced.
+func (a *Atomic) CompareAndSwap(old, next Ent) bool {
+	p := atomic.LoadPointer(&a.p)
+	if p == nil {
+		if old != nil {
+			return false
+		}
+	} else if *(*Ent)(p) != old {
+		return false
+	}
+	return atomic.CompareAndSwapPointer(&a.p, p, unsafe.Pointer(&next))
+}
+
+// Update calls f with the current ent and replaces it with the ent f returns, unless f returns
+// an error. f should return a modified copy and must not modify the ent it is passed.
+// If the current ent is replaced by someone else while f runs, f is called again with the new
+// current ent.
+//
+// Example:
+//
+//   err := a.Update(func(cur ent.Ent) (ent.Ent, error) {
+//     acc := cur.(*Account).Clone()
+//     acc.SetName("Robin")
+//     return acc, nil
+//   })
+//
+func (a *Atomic) Update(f func(cur Ent) (Ent, error)) error {
+	for {
+		cur := a.Load()
+		next, err := f(cur)
+		if err != nil {
+			return err
+		}
+		if a.CompareAndSwap(cur, next) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BatchSaver is implemented by storages which can save several ents more efficiently than by
+// calling Save for each ent, for example by pipelining requests. Used by SaveAll.
+type BatchSaver interface {
+	// SaveBatch saves ents[i] with fields[i] and is otherwise equivalent to calling Save for
+	// each ent. On success versions[i] is the new version of ents[i] and errs is nil.
+	// Otherwise errs has the same length as ents and errs[i] is the error of ents[i], or nil if
+	// ents[i] was saved.
+	SaveBatch(ents []Ent, fields []FieldSet) (versions []uint64, errs []error)
+}
+
+// SaveAllErr is returned by SaveAll when one or more ents could not be saved
+type SaveAllErr struct {
+	Ents []Ent   // ents which were not saved
+	Errs []error // Errs[i] is the error of Ents[i]
+}
+
+// Unwrap returns the error of the first ent which could not be saved
+func (e *SaveAllErr) Unwrap() error { return e.Errs[0] }
+
+func (e *SaveAllErr) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "failed to save %d ents: ", len(e.Ents))
+	for i, err := range e.Errs {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s %d: %v", e.Ents[i].EntTypeName(), e.Ents[i].Id(), err)
+	}
+	return sb.String()
+}
+
+// SaveAll saves all changed ents, grouped by storage. Ents without changes are skipped.
+// Storages which implement BatchSaver save their ents in one batch, others one ent at a time.
+//
+// Each ent is saved with the same version checks as SaveEnt. In case some ents can't be
+// saved, for example because of a version conflict, the others are still saved and a
+// *SaveAllErr identifying the failed ents is returned. A BatchSaver may instead save its batch
+// atomically (e.g. mem.EntStorage), in which case none of the ents of that storage are saved.
+// Use errors.Is(err, ErrVersionConflict) to check the error of the first failed ent.
+func SaveAll(ents ...Ent) error {
+	type storageBatch struct {
+		storage Storage
+		saves   []*entSave
+	}
+	var batches []*storageBatch
+	var errEnts []Ent
+	var errs []error
+	fail := func(e Ent, err error) {
+		errEnts = append(errEnts, e)
+		errs = append(errs, err)
+	}
+
+	for _, e := range ents {
+		eb := entBase(e)
+		if eb.changes == 0 {
+			continue
+		}
+		if eb.storage == nil {
+			fail(e, eb.noStorageErr())
+			continue
+		}
+		es, err := beginSaveEnt(e)
+		if err != nil {
+			fail(e, err)
+			continue
+		}
+		var b *storageBatch
+		for _, b2 := range batches {
+			if b2.storage == eb.storage {
+				b = b2
+				break
+			}
+		}
+		if b == nil {
+			b = &storageBatch{storage: eb.storage}
+			batches = append(batches, b)
+		}
+		b.saves = append(b.saves, es)
+	}
+
+	for _, b := range batches {
+		if bs, ok := b.storage.(BatchSaver); ok {
+			batchEnts := make([]Ent, len(b.saves))
+			fields := make([]FieldSet, len(b.saves))
+			for i, es := range b.saves {
+				batchEnts[i] = es.e
+				fields[i] = es.fields
+			}
+			versions, batchErrs := bs.SaveBatch(batchEnts, fields)
+			for i, es := range b.saves {
+				var version uint64
+				var err error
+				if batchErrs != nil {
+					err = batchErrs[i]
+				}
+				if err == nil {
+					version = versions[i]
+				}
+				if err := es.end(version, err); err != nil {
+					fail(es.e, err)
+				}
+			}
+		} else {
+			for _, es := range b.saves {
+				version, err := b.storage.Save(es.e, es.fields)
+				if err := es.end(version, err); err != nil {
+					fail(es.e, err)
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &SaveAllErr{Ents: errEnts, Errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package ent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+// saveTestStorage saves ents by bumping their version, failing for ents with w < 0
+type saveTestStorage struct {
+	testStorage
+	nsaves int
+}
+
+func (s *saveTestStorage) Save(e Ent, fields FieldSet) (uint64, error) {
+	s.nsaves++
+	if e.(*sizeIndexTestEnt).w < 0 {
+		return 0, ErrVersionConflict
+	}
+	return e.Version() + 1, nil
+}
+
+// saveBatchTestStorage is a saveTestStorage which implements BatchSaver
+type saveBatchTestStorage struct {
+	saveTestStorage
+	nbatches int
+}
+
+func (s *saveBatchTestStorage) SaveBatch(ents []Ent, fields []FieldSet) ([]uint64, []error) {
+	s.nbatches++
+	versions := make([]uint64, len(ents))
+	errs := make([]error, len(ents))
+	failed := false
+	for i, e := range ents {
+		versions[i], errs[i] = s.Save(e, fields[i])
+		failed = failed || errs[i] != nil
+	}
+	if !failed {
+		errs = nil
+	}
+	return versions, errs
+}
+
+func TestSaveAll(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s1 := &saveTestStorage{}
+	s2 := &saveBatchTestStorage{}
+	mkent := func(s Storage, w int) *sizeIndexTestEnt {
+		e := &sizeIndexTestEnt{w: w}
+		SetEntBaseFieldsAfterLoad(e, s, 1, 1)
+		e.SetEntFieldChanged(0)
+		return e
+	}
+	a, b, c := mkent(s1, 1), mkent(s2, 2), mkent(s2, 3)
+	unchanged := mkent(s2, 4)
+	unchanged.changes = 0
+
+	assert.NoErr("SaveAll", SaveAll(a, b, unchanged, c))
+	assert.Eq("saves", s1.nsaves+s2.nsaves, 3)
+	assert.Eq("batches", s2.nbatches, 1)
+	assert.Eq("version", b.Version(), uint64(2))
+	assert.Eq("unchanged version", unchanged.Version(), uint64(1))
+	assert.Eq("no changes after save", a.HasUnsavedChanges(), false)
+
+	// errors are reported per ent and don't prevent other ents from being saved
+	a, b, c = mkent(s1, -1), mkent(s2, 2), mkent(s2, -3)
+	noStorage := mkent(nil, 5)
+	err := SaveAll(a, b, c, noStorage)
+	var saveErr *SaveAllErr
+	assert.Eq("SaveAllErr", errors.As(err, &saveErr), true)
+	assert.Eq("failed ents", len(saveErr.Ents), 3)
+	assert.Eq("no storage", saveErr.Ents[0], Ent(noStorage))
+	assert.Eq("no storage", saveErr.Errs[0], ErrNoStorage)
+	assert.Eq("conflict", saveErr.Ents[1], Ent(a))
+	assert.Eq("conflict", saveErr.Ents[2], Ent(c))
+	assert.Eq("errors.Is", errors.Is(saveErr.Errs[2], ErrVersionConflict), true)
+	assert.Eq("saved", b.Version(), uint64(2))
+	assert.Eq("not saved", c.Version(), uint64(1))
+	assert.Eq("not saved", c.HasUnsavedChanges(), true)
+}
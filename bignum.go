@@ -0,0 +1,94 @@
+package ent
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// EncodeBigInt encodes v as a decimal string, or as "" if v is nil.
+// Index keys (i.e. when c is an IndexKeyEncoder) are encoded with BigIntIndexKey so that they
+// sort like the values do.
+// entgen uses this function for fields of type *big.Int.
+func EncodeBigInt(c Encoder, v *big.Int) {
+	if kc, ok := c.(*IndexKeyEncoder); ok {
+		kc.Str(BigIntIndexKey(v))
+	} else if v == nil {
+		c.Str("")
+	} else {
+		c.Str(v.Text(10))
+	}
+}
+
+// DecodeBigInt decodes a value encoded with EncodeBigInt. Returns nil for "" and invalid values.
+// entgen uses this function for fields of type *big.Int.
+func DecodeBigInt(c Decoder) *big.Int {
+	s := c.Str()
+	if s == "" {
+		return nil
+	}
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// EncodeBigRat encodes v as a string "a/b", or as "" if v is nil.
+// entgen uses this function for fields of type *big.Rat.
+func EncodeBigRat(c Encoder, v *big.Rat) {
+	if v == nil {
+		c.Str("")
+	} else {
+		c.Str(v.String())
+	}
+}
+
+// DecodeBigRat decodes a value encoded with EncodeBigRat. Returns nil for "" and invalid values.
+// entgen uses this function for fields of type *big.Rat.
+func DecodeBigRat(c Decoder) *big.Rat {
+	s := c.Str()
+	if s == "" {
+		return nil
+	}
+	v, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// BigIntIndexKey returns a representation of v which sorts lexicographically like the values
+// do, making range queries over big.Int indexes possible.
+//
+// The key of a non-negative number is "1", followed by the number of hexadecimal digits as
+// 8 hexadecimal digits, followed by the digits. The key of a negative number is "0" followed by
+// the same but with every digit inverted, so that larger magnitudes sort first.
+// The key of nil is "", which sorts before any number.
+func BigIntIndexKey(v *big.Int) string {
+	if v == nil {
+		return ""
+	}
+	digits := []byte(new(big.Int).Abs(v).Text(16))
+	b := make([]byte, 0, 1+8+len(digits))
+	if v.Sign() < 0 {
+		b = append(b, '0')
+		b = append(b, fmt.Sprintf("%08x", 0xffffffff-uint32(len(digits)))...)
+		for _, d := range digits {
+			b = append(b, hexDigits[15-hexDigitValue(d)])
+		}
+	} else {
+		b = append(b, '1')
+		b = append(b, fmt.Sprintf("%08x", uint32(len(digits)))...)
+		b = append(b, digits...)
+	}
+	return string(b)
+}
+
+const hexDigits = "0123456789abcdef"
+
+func hexDigitValue(d byte) byte {
+	if d >= 'a' {
+		return d - 'a' + 10
+	}
+	return d - '0'
+}
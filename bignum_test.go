@@ -0,0 +1,68 @@
+package ent
+
+import (
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestBigIntIndexKey(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var nums []*big.Int
+	for _, s := range []string{
+		"-340282366920938463463374607431768211456", "-65536", "-256", "-255", "-16", "-15", "-1",
+		"0", "1", "15", "16", "255", "256", "65536", "340282366920938463463374607431768211456",
+	} {
+		v, ok := new(big.Int).SetString(s, 10)
+		assert.Eq("SetString "+s, ok, true)
+		nums = append(nums, v)
+	}
+	keys := make([]string, len(nums))
+	for i, v := range nums {
+		keys[i] = BigIntIndexKey(v)
+	}
+	assert.Eq("keys sort like values", sort.StringsAreSorted(keys), true)
+	assert.Eq("nil sorts first", BigIntIndexKey(nil) < keys[0], true)
+	assert.Eq("zero", BigIntIndexKey(big.NewInt(0)), "1000000010")
+	assert.Eq("negative", BigIntIndexKey(big.NewInt(-1)), "0fffffffee")
+}
+
+func TestBigNumCodec(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	n, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+
+	c := &JsonEncoder{}
+	c.BeginEnt(1)
+	c.Key("n")
+	EncodeBigInt(c, n)
+	c.Key("nil")
+	EncodeBigInt(c, nil)
+	c.Key("r")
+	EncodeBigRat(c, big.NewRat(-6, 4))
+	c.Key("nilr")
+	EncodeBigRat(c, nil)
+	c.EndEnt()
+	assert.NoErr("encode", c.Err())
+
+	d := NewJsonDecoder(c.Bytes())
+	d.DictHeader()
+	d.Key()
+	d.Uint(64)
+	assert.Eq("key", d.Key(), "n")
+	assert.Eq("n", DecodeBigInt(d).Cmp(n), 0)
+	assert.Eq("key", d.Key(), "nil")
+	assert.Eq("nil", DecodeBigInt(d) == nil, true)
+	assert.Eq("key", d.Key(), "r")
+	assert.Eq("r", DecodeBigRat(d).String(), "-3/2")
+	assert.Eq("key", d.Key(), "nilr")
+	assert.Eq("nilr", DecodeBigRat(d) == nil, true)
+	assert.NoErr("decode", d.Err())
+
+	// index keys
+	var kc IndexKeyEncoder
+	kc.Reset(1)
+	EncodeBigInt(&kc, big.NewInt(255))
+	assert.Eq("index key", string(kc.b.Bytes()), "100000002ff")
+}
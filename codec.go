@@ -0,0 +1,312 @@
+package ent
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Encoder is the interface for ent field encoders.
+// ent.JsonEncoder is an example of an implementation.
+//
+// An ent is encoded as BeginEnt, followed by a Key call and a value for each field, followed by
+// EndEnt. A value is either a single call to Str, Blob, Int, Uint, Float or Bool, or a list or
+// dict. A list is BeginList followed by length values and EndList, and a dict is BeginDict
+// followed by length pairs of Key and a value, and EndDict. Lists and dicts may be nested.
+type Encoder interface {
+	Err() error // returns the error state of the encoder
+
+	BeginEnt(version uint64) // start encoding an ent
+	EndEnt()                 // finalize encoding of an ent
+
+	BeginList(length int) // start encoding a list of length
+	EndList()             // end encoding a list
+
+	BeginDict(length int) // start encoding a dictionary with length entries
+	EndDict()             // end encoding of a dict
+
+	Key(k string) // encode key for a field (value call should follow)
+
+	Str(v string)                 // encode a string value
+	Blob(v []byte)                // encode a raw-bytes value
+	Int(v int64, bitsize int)     // advisory size
+	Uint(v uint64, bitsize int)   // advisory size
+	Float(v float64, bitsize int) // advisory size
+	Bool(v bool)                  // encode a boolean value
+}
+
+// Decoder is the interface for ent field decoders.
+// ent.JsonDecoder is an example of an implementation.
+//
+// Values are decoded in the order they were encoded (see Encoder.) The version is decoded as
+// the value of the first key, FieldNameVersion. A list is decoded by calling ListHeader and
+// then decoding the number of values it returns or, if it returns -1, decoding values for as
+// long as More returns true. Dicts are decoded the same way, calling Key before each value.
+// Discard skips any value, including an entire list or dict.
+type Decoder interface {
+	Err() error // returns the error state of the decoder
+
+	// Key reads & returns the next key. Returns "" in case there are no more fields.
+	Key() string
+
+	ListHeader() int // decode a list header. Returns known size or -1 if unknown
+	DictHeader() int // decode a dict header. Returns known size or -1 if unknown
+
+	// More reports whether there is another element in the current list or dict being decoded.
+	// Only used when ListHeader and DictHeader returns -1.
+	More() bool
+
+	Str() string  // decode a string field
+	Blob() []byte // decode a byte array field
+	Bool() bool
+	Int(bitsize int) int64     // advisory size
+	Uint(bitsize int) uint64   // advisory size
+	Float(bitsize int) float64 // advisory size
+	Discard()                  // read and discard any value
+}
+
+// TestEncoderDecoderRoundtrip tests that data produced by an Encoder is decoded as expected
+// by a Decoder, which is useful for testing a codec of a Storage implementation.
+// It covers signed and unsigned integers of all sizes, floats of both sizes, strings, blobs,
+// booleans, nested lists and dicts, and discarding of values.
+//
+// newEncoder should return a new encoder. newDecoder is called with an encoder after an ent has
+// been encoded with it and should return a decoder of its data, positioned at the first key of
+// the ent, e.g. after calling DictHeader for a JsonDecoder.
+//
+//	ent.TestEncoderDecoderRoundtrip(t,
+//		func() ent.Encoder { return &ent.JsonEncoder{} },
+//		func(c ent.Encoder) ent.Decoder {
+//			d := ent.NewJsonDecoder(c.(*ent.JsonEncoder).Bytes())
+//			d.DictHeader()
+//			return d
+//		})
+func TestEncoderDecoderRoundtrip(
+	t testing.TB, newEncoder func() Encoder, newDecoder func(c Encoder) Decoder,
+) {
+	t.Helper()
+	const version = 3
+	c := newEncoder()
+	c.BeginEnt(version)
+	for _, tc := range codecTestCases {
+		c.Key(tc.key)
+		tc.encode(c)
+	}
+	c.EndEnt()
+	if err := c.Err(); err != nil {
+		t.Errorf("encode: %v", err)
+		return
+	}
+
+	// decode all values, and then again discarding some or all values
+	for _, discard := range []string{"none", "even", "odd", "all"} {
+		d := newDecoder(c)
+		if k := d.Key(); k != FieldNameVersion {
+			t.Errorf("[discard %s] expected first key %q, got %q", discard, FieldNameVersion, k)
+			continue
+		}
+		if v := d.Uint(64); v != version {
+			t.Errorf("[discard %s] expected version %d, got %d", discard, version, v)
+			continue
+		}
+		for i, tc := range codecTestCases {
+			if k := d.Key(); k != tc.key {
+				t.Errorf("[discard %s] expected key %q, got %q (%v)", discard, tc.key, k, d.Err())
+				break
+			}
+			if discard == "all" || (discard == "even" && i%2 == 0) || (discard == "odd" && i%2 == 1) {
+				d.Discard()
+				continue
+			}
+			if got := tc.decode(d); got != tc.want {
+				t.Errorf("[discard %s] %s: expected %s, got %s (%v)",
+					discard, tc.key, tc.want, got, d.Err())
+				break
+			}
+		}
+		if k := d.Key(); k != "" {
+			t.Errorf("[discard %s] expected end of ent, got key %q", discard, k)
+		}
+		if err := d.Err(); err != nil {
+			t.Errorf("[discard %s] decode: %v", discard, err)
+		}
+	}
+}
+
+// codecTestCase is a value encoded by encode and decoded by decode, which returns a string
+// representation of the value to be compared with want (see TestEncoderDecoderRoundtrip)
+type codecTestCase struct {
+	key    string
+	encode func(c Encoder)
+	decode func(d Decoder) string
+	want   string
+}
+
+var codecTestLongStr = strings.Repeat("long string ", 100)
+
+var codecTestCases = []codecTestCase{
+	{"int8", func(c Encoder) { c.Int(math.MinInt8, 8) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(8)) }, "-128"},
+	{"int16", func(c Encoder) { c.Int(math.MaxInt16, 16) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(16)) }, "32767"},
+	{"int32", func(c Encoder) { c.Int(math.MinInt32, 32) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(32)) }, "-2147483648"},
+	{"int64 min", func(c Encoder) { c.Int(math.MinInt64, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(64)) }, "-9223372036854775808"},
+	{"int64 max", func(c Encoder) { c.Int(math.MaxInt64, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(64)) }, "9223372036854775807"},
+	{"int zero", func(c Encoder) { c.Int(0, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Int(64)) }, "0"},
+	{"uint8", func(c Encoder) { c.Uint(math.MaxUint8, 8) },
+		func(d Decoder) string { return fmt.Sprint(d.Uint(8)) }, "255"},
+	{"uint32", func(c Encoder) { c.Uint(math.MaxUint32, 32) },
+		func(d Decoder) string { return fmt.Sprint(d.Uint(32)) }, "4294967295"},
+	{"uint64", func(c Encoder) { c.Uint(math.MaxUint64, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Uint(64)) }, "18446744073709551615"},
+	{"float32", func(c Encoder) { c.Float(-1.5, 32) },
+		func(d Decoder) string { return fmt.Sprint(float32(d.Float(32))) }, "-1.5"},
+	{"float32 max", func(c Encoder) { c.Float(math.MaxFloat32, 32) },
+		func(d Decoder) string { return fmt.Sprint(float32(d.Float(32))) }, "3.4028235e+38"},
+	{"float64", func(c Encoder) { c.Float(math.Pi, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Float(64)) }, "3.141592653589793"},
+	{"float64 small", func(c Encoder) { c.Float(-1e-300, 64) },
+		func(d Decoder) string { return fmt.Sprint(d.Float(64)) }, "-1e-300"},
+	{"bool true", func(c Encoder) { c.Bool(true) },
+		func(d Decoder) string { return fmt.Sprint(d.Bool()) }, "true"},
+	{"bool false", func(c Encoder) { c.Bool(false) },
+		func(d Decoder) string { return fmt.Sprint(d.Bool()) }, "false"},
+	{"str", func(c Encoder) { c.Str("héllo ✓ \"quoted\"\\\n\t\x00") },
+		func(d Decoder) string { return fmt.Sprintf("%q", d.Str()) },
+		fmt.Sprintf("%q", "héllo ✓ \"quoted\"\\\n\t\x00")},
+	{"str empty", func(c Encoder) { c.Str("") },
+		func(d Decoder) string { return fmt.Sprintf("%q", d.Str()) }, `""`},
+	{"str long", func(c Encoder) { c.Str(codecTestLongStr) },
+		func(d Decoder) string { return fmt.Sprint(d.Str() == codecTestLongStr) }, "true"},
+	{"blob", func(c Encoder) { c.Blob([]byte{0, 1, 0x7f, 0x80, 0xfe, 0xff}) },
+		func(d Decoder) string { return fmt.Sprint(d.Blob()) }, "[0 1 127 128 254 255]"},
+	{"blob empty", func(c Encoder) { c.Blob(nil) },
+		func(d Decoder) string { return fmt.Sprint(len(d.Blob())) }, "0"},
+	{"list", func(c Encoder) {
+		c.BeginList(3)
+		c.Int(1, 64)
+		c.Int(-2, 64)
+		c.Int(3, 64)
+		c.EndList()
+	}, func(d Decoder) string {
+		var v []int64
+		codecTestDecodeList(d, func() { v = append(v, d.Int(64)) })
+		return fmt.Sprint(v)
+	}, "[1 -2 3]"},
+	{"list empty", func(c Encoder) {
+		c.BeginList(0)
+		c.EndList()
+	}, func(d Decoder) string {
+		var v []string
+		codecTestDecodeList(d, func() { v = append(v, d.Str()) })
+		return fmt.Sprint(len(v))
+	}, "0"},
+	{"list of lists", func(c Encoder) {
+		c.BeginList(3)
+		c.BeginList(2)
+		c.Str("a")
+		c.Str("b")
+		c.EndList()
+		c.BeginList(0)
+		c.EndList()
+		c.BeginList(1)
+		c.Str("c")
+		c.EndList()
+		c.EndList()
+	}, func(d Decoder) string {
+		var v [][]string
+		codecTestDecodeList(d, func() {
+			var v2 []string
+			codecTestDecodeList(d, func() { v2 = append(v2, d.Str()) })
+			v = append(v, v2)
+		})
+		return fmt.Sprint(v)
+	}, "[[a b] [] [c]]"},
+	{"dict", func(c Encoder) {
+		c.BeginDict(2)
+		c.Key("a")
+		c.Float(0.5, 64)
+		c.Key("b")
+		c.Float(-2, 64)
+		c.EndDict()
+	}, func(d Decoder) string {
+		v := map[string]float64{}
+		codecTestDecodeDict(d, func(k string) { v[k] = d.Float(64) })
+		return fmt.Sprint(v)
+	}, "map[a:0.5 b:-2]"},
+	{"dict of lists", func(c Encoder) {
+		c.BeginDict(2)
+		c.Key("x")
+		c.BeginList(2)
+		c.Bool(true)
+		c.Bool(false)
+		c.EndList()
+		c.Key("y")
+		c.BeginList(0)
+		c.EndList()
+		c.EndDict()
+	}, func(d Decoder) string {
+		v := map[string][]bool{}
+		codecTestDecodeDict(d, func(k string) {
+			var v2 []bool
+			codecTestDecodeList(d, func() { v2 = append(v2, d.Bool()) })
+			v[k] = v2
+		})
+		return fmt.Sprint(v)
+	}, "map[x:[true false] y:[]]"},
+	{"list of dicts", func(c Encoder) {
+		c.BeginList(2)
+		c.BeginDict(1)
+		c.Key("k")
+		c.Uint(1, 64)
+		c.EndDict()
+		c.BeginDict(0)
+		c.EndDict()
+		c.EndList()
+	}, func(d Decoder) string {
+		var v []string
+		codecTestDecodeList(d, func() {
+			var keys []string
+			codecTestDecodeDict(d, func(k string) {
+				keys = append(keys, fmt.Sprintf("%s:%d", k, d.Uint(64)))
+			})
+			sort.Strings(keys)
+			v = append(v, "{"+strings.Join(keys, " ")+"}")
+		})
+		return fmt.Sprint(v)
+	}, "[{k:1} {}]"},
+	{"last", func(c Encoder) { c.Str("end") },
+		func(d Decoder) string { return d.Str() }, "end"},
+}
+
+// codecTestDecodeList calls decodeValue for each value of a list
+func codecTestDecodeList(d Decoder, decodeValue func()) {
+	if n := d.ListHeader(); n > -1 {
+		for i := 0; i < n; i++ {
+			decodeValue()
+		}
+	} else {
+		for d.More() {
+			decodeValue()
+		}
+	}
+}
+
+// codecTestDecodeDict calls decodeValue with the key of each entry of a dict
+func codecTestDecodeDict(d Decoder, decodeValue func(k string)) {
+	if n := d.DictHeader(); n > -1 {
+		for i := 0; i < n; i++ {
+			decodeValue(d.Key())
+		}
+	} else {
+		for d.More() {
+			decodeValue(d.Key())
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package ent
+
+import "testing"
+
+func TestJsonCodecRoundtrip(t *testing.T) {
+	TestEncoderDecoderRoundtrip(t,
+		func() Encoder { return &JsonEncoder{} },
+		func(c Encoder) Decoder {
+			d := NewJsonDecoder(c.(*JsonEncoder).Bytes())
+			d.DictHeader()
+			return d
+		})
+}
+
+func TestMsgpackCodecRoundtrip(t *testing.T) {
+	TestEncoderDecoderRoundtrip(t,
+		func() Encoder { return &MsgpackEncoder{} },
+		func(c Encoder) Decoder {
+			d := NewMsgpackDecoder(c.(*MsgpackEncoder).Bytes())
+			d.DictHeader()
+			return d
+		})
+}
+
+func BenchmarkJsonEncodeEnt(b *testing.B) {
+	e := &sizeIndexTestEnt{w: 640, h: 480, name: "a reasonably long name to grow the buffer"}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := JsonEncodeEnt(e, 1, 1, e.EntFields().FieldSet, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
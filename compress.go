@@ -0,0 +1,80 @@
+package ent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression selects a method for whole-record compression of encoded ents.
+// Storage implementations which support it expose a Compression option.
+type Compression byte
+
+const (
+	NoCompression   Compression = iota // store ents uncompressed
+	GzipCompression                    // compress ents with gzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case GzipCompression:
+		return "gzip"
+	}
+	return fmt.Sprintf("Compression(%d)", c)
+}
+
+// compressedDataMagic is the header of compressed data, followed by one Compression byte.
+// It starts with a zero byte, which neither JSON nor RESP data ever start with, which makes it
+// possible to mix compressed and uncompressed data in the same storage.
+const compressedDataMagic = "\x00ENTZ"
+
+// IsCompressedData returns true if data was produced by CompressData
+func IsCompressedData(data []byte) bool {
+	return len(data) > len(compressedDataMagic) &&
+		string(data[:len(compressedDataMagic)]) == compressedDataMagic
+}
+
+// CompressData compresses data (usually an encoded ent) with method c, prefixing the result
+// with a header that identifies it as compressed. With NoCompression data is returned as-is.
+func CompressData(data []byte, c Compression) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case GzipCompression:
+		var buf bytes.Buffer
+		buf.Grow(len(compressedDataMagic) + 1 + len(data)/2)
+		buf.WriteString(compressedDataMagic)
+		buf.WriteByte(byte(c))
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %v", c)
+}
+
+// DecompressData reverses CompressData. Data that is not compressed is returned as-is.
+func DecompressData(data []byte) ([]byte, error) {
+	if !IsCompressedData(data) {
+		return data, nil
+	}
+	c := Compression(data[len(compressedDataMagic)])
+	data = data[len(compressedDataMagic)+1:]
+	switch c {
+	case GzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unsupported compression %v", c)
+}
@@ -0,0 +1,241 @@
+package ent
+
+import (
+	"context"
+)
+
+// ContextStorage is implemented by storages which support cancellation and deadlines of
+// operations via context.Context. The methods are equivalent to the Storage methods of the
+// same names without the "Context" suffix.
+//
+// Storages which do not implement ContextStorage can still be used with WithContext, in which
+// case the context is only checked before each operation.
+type ContextStorage interface {
+	Storage
+	CreateContext(ctx context.Context, e Ent, fields FieldSet) (id uint64, err error)
+	SaveContext(ctx context.Context, e Ent, fields FieldSet) (version uint64, err error)
+	PutContext(ctx context.Context, e Ent, id uint64) (version uint64, err error)
+	LoadByIdContext(ctx context.Context, e Ent, id uint64) (version uint64, err error)
+	ExistsContext(ctx context.Context, entType string, id uint64) (bool, error)
+	LoadByIndexContext(
+		ctx context.Context, e Ent, x *EntIndex, key []byte, limit int, fl LookupFlags,
+	) ([]Ent, error)
+	LoadByIndexPagedContext(
+		ctx context.Context, e Ent, x *EntIndex, key, cursor []byte, limit int, fl LookupFlags,
+	) ([]Ent, []byte, error)
+	FindByIndexContext(
+		ctx context.Context, entType string, x *EntIndex, key []byte, limit int, fl LookupFlags,
+	) ([]uint64, error)
+	FindByIndexRangeContext(
+		ctx context.Context, entType string, x *EntIndex, lo, hi []byte, limit int, fl LookupFlags,
+	) ([]uint64, error)
+	FindByIndexScoreRangeContext(
+		ctx context.Context, entType string, x *EntIndex, key []byte, min, max float64, limit int,
+		fl LookupFlags,
+	) ([]uint64, error)
+	CountContext(ctx context.Context, entType string, x *EntIndex, key []byte) (int, error)
+	ListIndexKeysContext(ctx context.Context, entType string, x *EntIndex) ([][]byte, error)
+	DeleteContext(ctx context.Context, e Ent, id uint64) error
+	DeleteByIndexContext(ctx context.Context, e Ent, x *EntIndex, key []byte) (int, error)
+}
+
+// WithContext returns a storage which performs operations of s with ctx.
+// If s is a ContextStorage, ctx is passed along to it, otherwise only ctx.Err() is checked
+// before each operation.
+//
+// Ents created or loaded with the returned storage are bound to s, not to the returned storage,
+// meaning that later operations on them, like Save, do not use ctx.
+// Iteration and Begin are not affected by ctx.
+func WithContext(ctx context.Context, s Storage) Storage {
+	if s == nil {
+		return nil
+	}
+	if cs, ok := s.(*ctxStorage); ok {
+		s = cs.Storage
+	}
+	cs, _ := s.(ContextStorage)
+	return &ctxStorage{Storage: s, cs: cs, ctx: ctx}
+}
+
+// ctxStorage is the storage returned by WithContext
+type ctxStorage struct {
+	Storage                // IterateIds, IterateEnts and Begin are used as-is
+	cs      ContextStorage // nil if Storage is not a ContextStorage
+	ctx     context.Context
+}
+
+// unwrapStorage returns the storage which ents used with s should be bound to
+func unwrapStorage(s Storage) Storage {
+	if cs, ok := s.(*ctxStorage); ok {
+		return cs.Storage
+	}
+	return s
+}
+
+func (s *ctxStorage) Create(e Ent, fields FieldSet) (uint64, error) {
+	if s.cs != nil {
+		return s.cs.CreateContext(s.ctx, e, fields)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.Create(e, fields)
+}
+
+func (s *ctxStorage) Save(e Ent, fields FieldSet) (uint64, error) {
+	if s.cs != nil {
+		return s.cs.SaveContext(s.ctx, e, fields)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.Save(e, fields)
+}
+
+func (s *ctxStorage) Put(e Ent, id uint64) (uint64, error) {
+	if s.cs != nil {
+		return s.cs.PutContext(s.ctx, e, id)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.Put(e, id)
+}
+
+func (s *ctxStorage) LoadById(e Ent, id uint64) (uint64, error) {
+	if s.cs != nil {
+		return s.cs.LoadByIdContext(s.ctx, e, id)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.LoadById(e, id)
+}
+
+func (s *ctxStorage) Exists(entType string, id uint64) (bool, error) {
+	if s.cs != nil {
+		return s.cs.ExistsContext(s.ctx, entType, id)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Storage.Exists(entType, id)
+}
+
+// LoadByIdConsistent implements ConsistentLoader, reading with ctx if the storage has a
+// LoadByIdConsistentContext method (e.g. redis.EntStorage)
+func (s *ctxStorage) LoadByIdConsistent(e Ent, id uint64) (uint64, error) {
+	type consistentContextLoader interface {
+		LoadByIdConsistentContext(ctx context.Context, e Ent, id uint64) (uint64, error)
+	}
+	if cl, ok := s.Storage.(consistentContextLoader); ok {
+		return cl.LoadByIdConsistentContext(s.ctx, e, id)
+	}
+	if cl, ok := s.Storage.(ConsistentLoader); ok {
+		if err := s.ctx.Err(); err != nil {
+			return 0, err
+		}
+		return cl.LoadByIdConsistent(e, id)
+	}
+	return s.LoadById(e, id)
+}
+
+func (s *ctxStorage) LoadByIndex(
+	e Ent, x *EntIndex, key []byte, limit int, fl LookupFlags,
+) ([]Ent, error) {
+	if s.cs != nil {
+		return s.cs.LoadByIndexContext(s.ctx, e, x, key, limit, fl)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.LoadByIndex(e, x, key, limit, fl)
+}
+
+func (s *ctxStorage) LoadByIndexPaged(
+	e Ent, x *EntIndex, key, cursor []byte, limit int, fl LookupFlags,
+) ([]Ent, []byte, error) {
+	if s.cs != nil {
+		return s.cs.LoadByIndexPagedContext(s.ctx, e, x, key, cursor, limit, fl)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return s.Storage.LoadByIndexPaged(e, x, key, cursor, limit, fl)
+}
+
+func (s *ctxStorage) FindByIndex(
+	entType string, x *EntIndex, key []byte, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	if s.cs != nil {
+		return s.cs.FindByIndexContext(s.ctx, entType, x, key, limit, fl)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.FindByIndex(entType, x, key, limit, fl)
+}
+
+func (s *ctxStorage) FindByIndexRange(
+	entType string, x *EntIndex, lo, hi []byte, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	if s.cs != nil {
+		return s.cs.FindByIndexRangeContext(s.ctx, entType, x, lo, hi, limit, fl)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.FindByIndexRange(entType, x, lo, hi, limit, fl)
+}
+
+func (s *ctxStorage) FindByIndexScoreRange(
+	entType string, x *EntIndex, key []byte, min, max float64, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	if s.cs != nil {
+		return s.cs.FindByIndexScoreRangeContext(s.ctx, entType, x, key, min, max, limit, fl)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.FindByIndexScoreRange(entType, x, key, min, max, limit, fl)
+}
+
+func (s *ctxStorage) Count(entType string, x *EntIndex, key []byte) (int, error) {
+	if s.cs != nil {
+		return s.cs.CountContext(s.ctx, entType, x, key)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.Count(entType, x, key)
+}
+
+func (s *ctxStorage) ListIndexKeys(entType string, x *EntIndex) ([][]byte, error) {
+	if s.cs != nil {
+		return s.cs.ListIndexKeysContext(s.ctx, entType, x)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.ListIndexKeys(entType, x)
+}
+
+func (s *ctxStorage) Delete(e Ent, id uint64) error {
+	if s.cs != nil {
+		return s.cs.DeleteContext(s.ctx, e, id)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Storage.Delete(e, id)
+}
+
+func (s *ctxStorage) DeleteByIndex(e Ent, x *EntIndex, key []byte) (int, error) {
+	if s.cs != nil {
+		return s.cs.DeleteByIndexContext(s.ctx, e, x, key)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Storage.DeleteByIndex(e, x, key)
+}
@@ -1,8 +1,12 @@
 package ent
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -30,6 +34,36 @@ type EntBase struct {
 	// changes is a bitmap where each bit represents a struct field index.
 	// A set bit indicates that the field's value has changed since the last call to Load()
 	changes FieldSet
+
+	// fieldVersions holds the ent version at which each field was last changed, indexed by
+	// field index. Only used by ents which implement FieldVersionTracker; nil otherwise.
+	fieldVersions []uint64
+
+	// deleted is true after the ent has been deleted by DeleteEnt, until it is created or
+	// loaded again
+	deleted bool
+
+	// unknownFields holds fields which the ent type does not know about, as JSON values.
+	// Only used by ents with the "keepunknown" tag (see DecodeEntUnknownField); nil otherwise.
+	unknownFields map[string]json.RawMessage
+}
+
+// FieldVersionTracker is implemented by ents which keep track of the version at which each
+// field was last changed. entgen generates this for ents with the "fieldversions" tag on their
+// EntBase field, e.g. "ent.EntBase `account,fieldversions`".
+// The field versions are stored alongside the ent's fields under FieldNameFieldVersions.
+type FieldVersionTracker interface {
+	Ent
+	EntTracksFieldVersions()
+}
+
+// JsonNamer is implemented by ents with fields which are named differently in JSON than in
+// storage, e.g. `ent:"w" json:"width"`. entgen generates this for such ents.
+// JsonEncode, JsonDecode and JsonDecodeFields use the JSON names while storages, which use
+// JsonEncodeEnt and JsonDecodeEnt, use the storage names.
+type JsonNamer interface {
+	Ent
+	EntJsonNames() map[string]string // storage name => JSON name
 }
 
 // Fields describes fields of an ent. Available via TYPE.EntFields()
@@ -40,18 +74,52 @@ type Fields struct {
 
 var (
 	ErrNoStorage       = errors.New("no ent storage")
+	ErrDeleted         = errors.New("ent has been deleted")
 	ErrNotFound        = errors.New("ent not found")
 	ErrNotChanged      = errors.New("ent not changed")
 	ErrVersionConflict = errors.New("version conflict")
 	ErrUniqueConflict  = errors.New("unique index conflict")
 	ErrDuplicateEnt    = errors.New("duplicate ent")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrEntTooLarge     = errors.New("ent too large")
+	ErrUnsupported     = errors.New("not supported by the storage") // see StorageCaps
+
+	// ErrIndexTypeChanged is the Underlying error of an IndexConflictErr returned when the data
+	// of an index in storage is incompatible with the index, e.g. because the index has changed
+	// from unique to non-unique. The data of the index needs to be rebuilt.
+	ErrIndexTypeChanged = errors.New("index type changed")
 )
 
+// Names of the reserved fields which hold an ent's version, id and field versions in encoded
+// ents, e.g. in the JSON data stored by mem and in the hash fields of redis.
+// These are read by all encoders, decoders and storage implementations without synchronization,
+// so they must not be changed while ents are being used. Use SetReservedFieldNames to change
+// them, before any ents are encoded or decoded, e.g. in an init function.
+// Since the names are part of stored data, changing them makes existing data unreadable.
 var (
-	FieldNameVersion = "_ver"
-	FieldNameId      = "_id"
+	FieldNameVersion       = "_ver"
+	FieldNameId            = "_id"
+	FieldNameFieldVersions = "_fver"
 )
 
+var reservedFieldNamesSet int32
+
+// SetReservedFieldNames sets FieldNameId, FieldNameVersion and FieldNameFieldVersions.
+// It must be called before any ents are encoded or decoded and at most once; it panics if
+// called again or if the names are empty or not distinct.
+func SetReservedFieldNames(id, version, fieldVersions string) {
+	if id == "" || version == "" || fieldVersions == "" ||
+		id == version || id == fieldVersions || version == fieldVersions {
+		panic("ent.SetReservedFieldNames: names must be non-empty and distinct")
+	}
+	if !atomic.CompareAndSwapInt32(&reservedFieldNamesSet, 0, 1) {
+		panic("ent.SetReservedFieldNames called more than once")
+	}
+	FieldNameId = id
+	FieldNameVersion = version
+	FieldNameFieldVersions = fieldVersions
+}
+
 type Id uint64
 
 // emptyInterface is the header for an interface{} value. From go src/reflect/value.go
@@ -98,7 +166,48 @@ func (e *EntBase) IsEntFieldChanged(fieldIndex int) bool { return IsFieldChanged
 func (e *EntBase) SetEntFieldChanged(fieldIndex int)     { SetFieldChanged(e, fieldIndex) }
 func (e *EntBase) ClearEntFieldChanged(fieldIndex int)   { ClearFieldChanged(e, fieldIndex) }
 
-func (e *EntBase) EntPendingFields() FieldSet { return e.changes }
+// SetEntFieldsChanged marks all fields in fields as "having unsaved changes", for example to
+// make a following Save write fields of an ent constructed from external data.
+func (e *EntBase) SetEntFieldsChanged(fields FieldSet) { e.changes |= fields }
+
+// ClearEntChanges marks all fields as not having unsaved changes, without saving them
+func (e *EntBase) ClearEntChanges() { e.changes = 0 }
+
+// ChangedFields returns the fields which have unsaved changes, e.g. ChangedFields().Len() is the
+// number of changed fields. See IsFieldChangedByName and ChangedFieldNames for field names.
+func (e *EntBase) ChangedFields() FieldSet { return e.changes }
+
+// EntPendingFields is the same as ChangedFields
+func (e *EntBase) EntPendingFields() FieldSet { return e.ChangedFields() }
+
+// FieldVersion returns the ent version at which the field fieldIndex was last changed.
+// Returns 0 if the ent does not track field versions or the version is unknown.
+func (e *EntBase) FieldVersion(fieldIndex int) uint64 {
+	if fieldIndex < len(e.fieldVersions) {
+		return e.fieldVersions[fieldIndex]
+	}
+	return 0
+}
+
+// DecodeEntFieldVersions reads field versions encoded by EncodeFieldVersions.
+// Used by generated EntDecode methods of ents which implement FieldVersionTracker.
+// Malformed field versions are reported as an error of c (see Decoder.Err) when c is a
+// JsonDecoder or MsgpackDecoder; with other decoders they are ignored.
+func (e *EntBase) DecodeEntFieldVersions(c Decoder) {
+	fv, err := parseIdSet([]byte(c.Str()))
+	if err != nil {
+		if c, ok := c.(decodeErrorSetter); ok {
+			c.setError(fmt.Errorf("invalid field versions: %v", err))
+		}
+		fv = nil
+	}
+	e.fieldVersions = fv
+}
+
+// decodeErrorSetter is implemented by the decoders of this package
+type decodeErrorSetter interface {
+	setError(err error)
+}
 
 func (e *EntBase) EntIndexes() []EntIndex { return nil }
 func (e *EntBase) EntFields() Fields      { return Fields{} }
@@ -114,22 +223,44 @@ func IsFieldChanged(e *EntBase, fieldIndex int) bool {
 	return (e.changes & (1 << fieldIndex)) != 0
 }
 
+// IsFieldChangedByName returns true if the field with the storage name name has unsaved changes.
+// Returns false if e has no such field.
+// (This is a function rather than an EntBase method since it needs the EntFields of e.)
+func IsFieldChangedByName(e Ent, name string) bool {
+	for i, fname := range e.EntFields().Names {
+		if fname == name {
+			return IsFieldChanged(entBase(e), i)
+		}
+	}
+	return false
+}
+
+// ChangedFieldNames returns the storage names of the fields of e which have unsaved changes,
+// in field order
+func ChangedFieldNames(e Ent) []string {
+	return e.EntFields().NamesOf(entBase(e).changes)
+}
+
 // JsonEncode encodes the ent as JSON
 func JsonEncode(e Ent, indent string) ([]byte, error) {
 	// Note: Used by generated code to implement MarshalJSON
-	return JsonEncodeEnt(e, e.Id(), e.Version(), e.EntFields().FieldSet, indent)
+	return jsonEncodeEnt(e, e.Id(), e.Version(), e.EntFields().FieldSet, indent, jsonNames(e))
 }
 
 // JsonEncodeUnsaved encodes the ent as JSON, only including fields with unsaved changes
 func JsonEncodeUnsaved(e Ent, indent string) ([]byte, error) {
 	eb := entBase(e)
-	return JsonEncodeEnt(e, e.Id(), e.Version(), eb.changes, indent)
+	return jsonEncodeEnt(e, e.Id(), e.Version(), eb.changes, indent, jsonNames(e))
 }
 
-// JsonEncode encodes the ent as JSON
+// JsonDecode populates the ent from JSON data, including its id and version.
+//
+// Since the id and version are taken from data, JsonDecode (and thus the generated UnmarshalJSON
+// methods) must not be used with data from an untrusted source, like a client of an API: saving
+// the ent afterwards could overwrite any ent of the same type. Use JsonDecodeFields instead.
 func JsonDecode(e Ent, data []byte) error {
 	// Note: Used by generated code to implement UnmarshalJSON
-	id, version, err := JsonDecodeEnt(e, data)
+	id, version, err := jsonDecodeEnt(e, data, jsonStorageNames(e))
 	if err == nil {
 		eb := entBase(e)
 		eb.id = id
@@ -138,11 +269,63 @@ func JsonDecode(e Ent, data []byte) error {
 	return err
 }
 
+// JsonDecodeFields sets the fields of e which are present in the JSON object data and marks
+// them as changed. The id, version, storage and field versions of e are not changed by data,
+// which makes this suitable for applying client-submitted JSON to an ent that was loaded from
+// storage. Keys of data which are not fields of e are ignored.
+// e must implement EntMerger, which entgen generates for all ent types.
+func JsonDecodeFields(e Ent, data []byte) error {
+	m, ok := e.(EntMerger)
+	if !ok {
+		return fmt.Errorf("ent type %s does not implement ent.EntMerger", e.EntTypeName())
+	}
+
+	// find the fields present in data
+	var fields FieldSet
+	names := e.EntFields().Names
+	storageNames := jsonStorageNames(e)
+	c := NewJsonDecoder(data)
+	c.Names = storageNames
+	if c.DictHeader() != 0 {
+		for {
+			key := c.Key()
+			if key == "" {
+				break
+			}
+			for i, name := range names {
+				if name == key {
+					fields = fields.With(i)
+					break
+				}
+			}
+			c.Discard()
+		}
+	}
+	if err := c.Err(); err != nil {
+		return &JsonError{err}
+	}
+
+	// decode into a new ent and copy the fields present
+	tmp := e.EntNew()
+	if _, _, err := jsonDecodeEnt(tmp, data, storageNames); err != nil {
+		return err
+	}
+	m.EntMergeFrom(tmp, fields)
+	entBase(e).changes |= fields
+	return nil
+}
+
 func EntString(e Ent) string {
 	b, _ := Repr(e, e.EntFields().FieldSet, ReprOmitEmpty)
 	return string(b)
 }
 
+// EntStringCompact is like EntString but returns a single line, e.g. for logging
+func EntStringCompact(e Ent) string {
+	b, _ := Repr(e, e.EntFields().FieldSet, ReprOmitEmpty|ReprCompact)
+	return string(b)
+}
+
 // SetEntBaseFields sets values of EntBase fields.
 // This function is meant to be used by Storage implementation, called after a new ent has been
 // loaded or created.
@@ -150,102 +333,554 @@ func SetEntBaseFields(e Ent, s Storage, id, version uint64, changes FieldSet) {
 	eb := entBase(e)
 	eb.id = id
 	eb.version = version
-	eb.storage = s
+	eb.storage = unwrapStorage(s)
 	eb.changes = changes
+	eb.deleted = false
 }
 
 func SetEntBaseFieldsAfterLoad(e Ent, s Storage, id, version uint64) {
 	SetEntBaseFields(e, s, id, version, 0)
 }
 
+// BindStorage binds e to storage s as version of the ent with id, as if e had been loaded from
+// s, which makes an ent reconstructed from elsewhere (e.g. a cache) savable without loading it.
+// Unsaved changes of e are kept. Binding a version other than the current version in storage
+// makes the next Save of e fail with ErrVersionConflict, and binding the wrong id makes it
+// overwrite another ent.
+func BindStorage(e Ent, s Storage, id, version uint64) {
+	SetEntBaseFields(e, s, id, version, entBase(e).changes)
+}
+
+// GetStorage returns the storage which e was loaded from or created in, or nil if e has not
+// been stored yet or has been deleted. entgen uses this for the TYPE.EntStorage() method.
 func GetStorage(e Ent) Storage {
 	return entBase(e).storage
 }
 
-func GetFieldValue(e Ent, fieldIndex int) reflect.Value {
-	return reflect.ValueOf(e).Elem().Field(fieldIndex + 1)
+// EncodeFieldVersions writes the field versions of e to c, if e implements FieldVersionTracker.
+// Returns false if e does not track field versions, in which case nothing is written.
+// This function is meant to be used by Storage and Encoder implementations.
+func EncodeFieldVersions(e Ent, c Encoder) bool {
+	if _, ok := e.(FieldVersionTracker); !ok {
+		return false
+	}
+	c.Key(FieldNameFieldVersions)
+	c.Str(string(IdSet(entBase(e).fieldVersions).Encode()))
+	return true
+}
+
+// updateFieldVersions records version as the last-changed version for all fields in fields.
+// Returns the previous field versions, which the caller restores (eb.fieldVersions = prev) if
+// the operation which the update is part of fails.
+func updateFieldVersions(e Ent, fields FieldSet, version uint64) (prev []uint64, ok bool) {
+	if _, ok := e.(FieldVersionTracker); !ok {
+		return nil, false
+	}
+	eb := entBase(e)
+	prev = eb.fieldVersions
+	n := len(e.EntFields().Names)
+	fv := make([]uint64, n)
+	copy(fv, prev)
+	for i := 0; i < n; i++ {
+		if fields.Has(i) {
+			fv[i] = version
+		}
+	}
+	eb.fieldVersions = fv
+	return prev, true
+}
+
+// GetFieldValue returns the value of the field fieldIndex of e.
+// This uses reflection; generated code should access fields directly.
+func GetFieldValue(e Ent, fieldIndex int) interface{} {
+	return entFieldValue(e, fieldIndex).Interface()
+}
+
+// SetFieldValue sets the field fieldIndex of e to v and marks the field as changed.
+// Returns an error if v is not assignable to the field. v may be nil for pointer, interface,
+// slice and map fields.
+func SetFieldValue(e Ent, fieldIndex int, v interface{}) error {
+	f := entFieldValue(e, fieldIndex)
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		switch f.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			rv = reflect.Zero(f.Type()) // nil
+		}
+	}
+	if !rv.IsValid() || !rv.Type().AssignableTo(f.Type()) {
+		return fmt.Errorf("cannot assign %T to field %s.%s of type %s",
+			v, e.EntTypeName(), e.EntFields().Names[fieldIndex], f.Type())
+	}
+	f.Set(rv)
+	SetFieldChanged(entBase(e), fieldIndex)
+	return nil
+}
+
+// entFieldValue returns the settable value of the field fieldIndex of e.
+// Ent fields are usually unexported, so they are accessed via their addresses.
+func entFieldValue(e Ent, fieldIndex int) reflect.Value {
+	f := reflect.ValueOf(e).Elem().Field(fieldIndex + 1) // +1 for EntBase
+	return reflect.NewAt(f.Type(), pointer(f.UnsafeAddr())).Elem()
 }
 
 // —————————————————————————————————————————————————————————
 // CRUD
 // C = CreateEnt(Ent,Storage)
 // R = LoadEntById(Ent,Storage,id), ReloadEnt(Ent)
-// U = SaveEnt(Ent)
+// U = SaveEnt(Ent), WithEnt(Storage,Ent,id,func), PutEnt(Ent,Storage)
 // D = DeleteEnt(Ent)
+//
+// Create and load with a context by passing WithContext(ctx, storage) as the storage.
+// ReloadEntContext, SaveEntContext and DeleteEntContext use a context with the ent's storage.
+//
+// Ents can implement lifecycle hooks (BeforeCreate, AfterCreate, etc.) which are called by
+// CreateEnt, SaveEnt and DeleteEnt.
+
+// BeforeCreate is implemented by ents which want to be called before they are created by
+// CreateEnt. Returning an error aborts the creation. Called after BeforeSave.
+type BeforeCreate interface {
+	BeforeCreate() error
+}
+
+// AfterCreate is implemented by ents which want to be called after they have been created by
+// CreateEnt. Called before AfterSave.
+type AfterCreate interface {
+	AfterCreate()
+}
+
+// BeforeSave is implemented by ents which want to be called before they are created by
+// CreateEnt or saved by SaveEnt. Returning an error aborts the operation.
+// Fields changed by BeforeSave are included in the save.
+type BeforeSave interface {
+	BeforeSave() error
+}
+
+// AfterSave is implemented by ents which want to be called after they have been created by
+// CreateEnt or saved by SaveEnt.
+type AfterSave interface {
+	AfterSave()
+}
+
+// BeforeDelete is implemented by ents which want to be called before they are deleted by
+// DeleteEnt. Returning an error aborts the deletion.
+type BeforeDelete interface {
+	BeforeDelete() error
+}
+
+// AfterDelete is implemented by ents which want to be called after they have been deleted by
+// DeleteEnt. At this point the ent no longer has an id or storage.
+type AfterDelete interface {
+	AfterDelete()
+}
 
 func CreateEnt(e Ent, storage Storage) error {
 	if storage == nil {
 		return ErrNoStorage
 	}
+	if h, ok := e.(BeforeSave); ok {
+		if err := h.BeforeSave(); err != nil {
+			return err
+		}
+	}
+	if h, ok := e.(BeforeCreate); ok {
+		if err := h.BeforeCreate(); err != nil {
+			return err
+		}
+	}
 	eb := entBase(e)
+	prevfv, fvok := updateFieldVersions(e, e.EntFields().FieldSet, 1)
 	id, err := storage.Create(e, e.EntFields().FieldSet)
-	if err == nil {
-		eb.id = id
-		eb.version = 1
-		eb.storage = storage
-		eb.changes = 0
+	if err != nil {
+		if fvok {
+			eb.fieldVersions = prevfv
+		}
+		return err
 	}
-	return err
+	eb.id = id
+	eb.version = 1
+	eb.storage = unwrapStorage(storage)
+	eb.changes = 0
+	eb.deleted = false
+	if h, ok := e.(AfterCreate); ok {
+		h.AfterCreate()
+	}
+	if h, ok := e.(AfterSave); ok {
+		h.AfterSave()
+	}
+	return nil
+}
+
+// ConsistentLoader is implemented by storages which read from replicas that may lag behind
+// their primary. Used by LoadEntById with the Consistent flag.
+type ConsistentLoader interface {
+	// LoadByIdConsistent is like Storage.LoadById but reads from the primary
+	LoadByIdConsistent(e Ent, id uint64) (version uint64, err error)
 }
 
-func LoadEntById(e Ent, storage Storage, id uint64) error {
+// LoadEntById loads the ent with id from storage into e and binds e to storage.
+// With the Consistent flag, a storage which implements ConsistentLoader reads from its primary.
+func LoadEntById(e Ent, storage Storage, id uint64, flags ...LookupFlags) error {
 	if storage == nil {
 		return ErrNoStorage
 	}
 	if id == 0 {
 		return ErrNotFound
 	}
-	version, err := storage.LoadById(e, id)
+	var version uint64
+	var err error
+	if cl, ok := storage.(ConsistentLoader); ok && (mergeLookupFlags(flags)&Consistent) != 0 {
+		version, err = cl.LoadByIdConsistent(e, id)
+	} else {
+		version, err = storage.LoadById(e, id)
+	}
 	if err == nil {
 		SetEntBaseFieldsAfterLoad(e, storage, id, version)
 	}
 	return err
 }
 
+// EntExists returns true if storage has an ent of the type of e with id, without loading it,
+// e.g. to check a reference to another ent. A soft-deleted ent (see SoftDeleter) exists.
+func EntExists(e Ent, storage Storage, id uint64) (bool, error) {
+	if storage == nil {
+		return false, ErrNoStorage
+	}
+	if id == 0 {
+		return false, nil
+	}
+	return storage.Exists(e.EntTypeName(), id)
+}
+
 func ReloadEnt(e Ent) error {
 	eb := entBase(e)
 	return LoadEntById(e, eb.storage, eb.id)
 }
 
+func ReloadEntContext(ctx context.Context, e Ent) error {
+	eb := entBase(e)
+	return LoadEntById(e, WithContext(ctx, eb.storage), eb.id)
+}
+
 func SaveEnt(e Ent) error {
+	return saveEnt(e, entBase(e).storage)
+}
+
+func SaveEntContext(ctx context.Context, e Ent) error {
+	return saveEnt(e, WithContext(ctx, entBase(e).storage))
+}
+
+func saveEnt(e Ent, storage Storage) error {
 	eb := entBase(e)
-	if eb.storage == nil {
-		return ErrNoStorage
+	if storage == nil {
+		return eb.noStorageErr()
 	}
 	if eb.changes == 0 {
 		return ErrNotChanged
 	}
-	version, err := eb.storage.Save(e, eb.changes)
-	if err == nil {
-		eb.version = version
-		eb.changes = 0
+	es, err := beginSaveEnt(e)
+	if err != nil {
+		return err
 	}
-	return err
+	version, err := storage.Save(e, es.fields)
+	return es.end(version, err)
 }
 
-func DeleteEnt(e Ent) error {
+// entSave is the state of an ent being saved (see saveEnt and SaveAll)
+type entSave struct {
+	e      Ent
+	fields FieldSet // fields to save
+	prevfv []uint64 // field versions before the save
+	fvok   bool     // true if field versions were updated
+}
+
+// beginSaveEnt calls the BeforeSave hook of e and determines the fields to save
+func beginSaveEnt(e Ent) (*entSave, error) {
 	eb := entBase(e)
-	if eb.storage == nil {
+	if h, ok := e.(BeforeSave); ok {
+		if err := h.BeforeSave(); err != nil {
+			return nil, err
+		}
+	}
+	// Note: storage implementations assign version+1 to a saved ent
+	es := &entSave{e: e, fields: softDeleteFields(e, indexFields(e, eb.changes))}
+	es.prevfv, es.fvok = updateFieldVersions(e, es.fields, eb.version+1)
+	return es, nil
+}
+
+// end completes the save with the result of Storage.Save
+func (es *entSave) end(version uint64, err error) error {
+	eb := entBase(es.e)
+	if err != nil {
+		if es.fvok {
+			eb.fieldVersions = es.prevfv
+		}
+		return err
+	}
+	eb.version = version
+	eb.changes = 0
+	if h, ok := es.e.(AfterSave); ok {
+		h.AfterSave()
+	}
+	return nil
+}
+
+// PutEnt writes all fields of e to storage as the ent with the id of e, regardless of the
+// version of the ent in storage ("last writer wins"), or creates it if there is no such ent.
+// An ent without an id is created like with CreateEnt. After a successful put, e has the new
+// version and is bound to storage.
+//
+// Unlike SaveEnt, PutEnt does not check for version conflicts, meaning that changes made by
+// others are lost. It is meant for tools like bulk import and should not be used concurrently
+// with other writes to the same ents. Calls the BeforeSave and AfterSave hooks of e.
+//
+// The field versions of an ent which tracks them (see FieldVersionTracker) are set to the
+// version after the version of e for all fields, like when saving e. This is the version the
+// ent gets unless it was changed in storage since e was loaded.
+func PutEnt(e Ent, storage Storage) error {
+	if storage == nil {
 		return ErrNoStorage
 	}
-	err := eb.storage.Delete(e, e.Id())
-	if err == nil {
-		eb.id = 0
-		eb.version = 0
-		eb.storage = nil
-		eb.changes = 0
+	eb := entBase(e)
+	if eb.id == 0 {
+		return CreateEnt(e, storage)
 	}
-	return err
+	if h, ok := e.(BeforeSave); ok {
+		if err := h.BeforeSave(); err != nil {
+			return err
+		}
+	}
+	prevfv, fvok := updateFieldVersions(e, e.EntFields().FieldSet, eb.version+1)
+	version, err := storage.Put(e, eb.id)
+	if err != nil {
+		if fvok {
+			eb.fieldVersions = prevfv
+		}
+		return err
+	}
+	eb.version = version
+	eb.storage = unwrapStorage(storage)
+	eb.changes = 0
+	eb.deleted = false
+	if h, ok := e.(AfterSave); ok {
+		h.AfterSave()
+	}
+	return nil
 }
 
-// DeleteAllEntsOfType permanently DELETES ALL ents of the type of prototype
+// WithEnt performs a read-modify-write of the ent with id: it loads the ent into e, calls f
+// and saves the ent if f returns changed=true.
+// If the ent is changed by someone else before it is saved (i.e. Save fails with a version
+// conflict) then the ent is loaded again and f is called again, until the save succeeds or
+// WithEntMaxAttempts saves have failed, in which case the last ErrVersionConflict is returned.
+//
+// f must only modify the ent it is passed (which is always e) since it may be called more than
+// once. If f returns an error, WithEnt returns that error without saving the ent.
+//
+// Example:
+//
+//   err := ent.WithEnt(storage, &Account{}, id, func(e ent.Ent) (bool, error) {
+//     e.(*Account).SetName("Robin")
+//     return true, nil
+//   })
+//
+func WithEnt(storage Storage, e Ent, id uint64, f func(e Ent) (changed bool, err error)) error {
+	for attempt := 1; ; attempt++ {
+		if err := LoadEntById(e, storage, id); err != nil {
+			return err
+		}
+		changed, err := f(e)
+		if err != nil || !changed {
+			return err
+		}
+		err = saveEnt(e, storage)
+		if err == ErrNotChanged {
+			return nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= WithEntMaxAttempts {
+			return err
+		}
+	}
+}
+
+// WithEntMaxAttempts is the number of times WithEnt tries to save an ent before giving up
+var WithEntMaxAttempts = 10
+
+// EntMerger is implemented by ents which can copy field values from another ent of the same
+// type. entgen generates an EntMergeFrom method for all ent types.
+type EntMerger interface {
+	Ent
+	// EntMergeFrom copies the fields in fields from other, which has the same type as the
+	// receiver. Values are copied shallowly, e.g. slices are shared afterwards.
+	EntMergeFrom(other Ent, fields FieldSet)
+}
+
+// MergeEnt merges fresh, a more recently loaded copy of dst, into dst: fields with unsaved
+// changes in dst keep their values while all other fields adopt the values of fresh, and the
+// version of dst becomes that of fresh. Saving dst after merging saves dst's changes on top of
+// the current version of the ent, which can be used to resolve a version conflict:
+//
+//   err := a.Save()
+//   if errors.Is(err, ent.ErrVersionConflict) {
+//     fresh, _ := LoadAccountById(estore, a.Id())
+//     ent.MergeEnt(a, fresh)
+//     err = a.Save()
+//   }
+//
+// Changes made by someone else to a field which is also changed in dst are normally lost.
+// If the ents track field versions (see FieldVersionTracker), such a field instead keeps the
+// value of fresh, which has the higher field version, and dst's change to it is discarded.
+// Use ConflictingFields before merging to find out which fields that applies to.
+func MergeEnt(dst, fresh Ent) error {
+	m, ok := dst.(EntMerger)
+	if !ok {
+		return fmt.Errorf("ent type %s does not implement ent.EntMerger", dst.EntTypeName())
+	}
+	if fresh.EntTypeName() != dst.EntTypeName() {
+		return fmt.Errorf("different ent types (%s, %s)", dst.EntTypeName(), fresh.EntTypeName())
+	}
+	if fresh.Id() != dst.Id() {
+		return fmt.Errorf("different ents (#%d, #%d)", dst.Id(), fresh.Id())
+	}
+	mergeEnt(m, dst, fresh, entBase(dst).changes&^ConflictingFields(dst, fresh))
+	return nil
+}
+
+// mergeEnt merges fresh into dst, keeping the values and changes of the fields in keep
+func mergeEnt(m EntMerger, dst, fresh Ent, keep FieldSet) {
+	eb, feb := entBase(dst), entBase(fresh)
+	m.EntMergeFrom(fresh, dst.EntFields().FieldSet&^keep)
+	if feb.fieldVersions != nil {
+		fv := append([]uint64(nil), feb.fieldVersions...)
+		for i := range fv {
+			if keep.Has(i) && i < len(eb.fieldVersions) {
+				fv[i] = eb.fieldVersions[i]
+			}
+		}
+		eb.fieldVersions = fv
+	}
+	eb.changes = keep
+	eb.version = feb.version
+	if eb.storage == nil {
+		eb.storage = feb.storage
+	}
+}
+
+// ConflictingFields returns the fields with unsaved changes in dst which have also been changed
+// in fresh, a more recently loaded copy of dst, since the version of dst. Only ents which track
+// field versions (see FieldVersionTracker) can tell; for other ents the result is empty.
+func ConflictingFields(dst, fresh Ent) FieldSet {
+	if _, ok := dst.(FieldVersionTracker); !ok {
+		return 0
+	}
+	eb, feb := entBase(dst), entBase(fresh)
+	var conflicts FieldSet
+	for i, v := range feb.fieldVersions {
+		if eb.changes.Has(i) && v > eb.version {
+			conflicts |= 1 << i
+		}
+	}
+	return conflicts
+}
+
+// ReloadInto loads the current version of e from its storage, like ReloadEnt, but keeps the
+// values of fields with unsaved changes, adopting the stored values of all other fields (like
+// MergeEnt, with e's changes always winning). conflicts are the changed fields which were also
+// changed in storage since e was loaded, e.g. to let a user choose between the two values.
+// Saving e afterwards overwrites those fields with e's values.
+//
+// Only ents which track field versions (see FieldVersionTracker) know which fields changed in
+// storage. For other ents all changed fields are reported as conflicts when the stored version
+// is newer than e's.
+func ReloadInto(e Ent) (conflicts FieldSet, err error) {
+	return reloadInto(e, entBase(e).storage)
+}
+
+func ReloadIntoContext(ctx context.Context, e Ent) (conflicts FieldSet, err error) {
+	return reloadInto(e, WithContext(ctx, entBase(e).storage))
+}
+
+func reloadInto(e Ent, storage Storage) (conflicts FieldSet, err error) {
+	eb := entBase(e)
+	m, ok := e.(EntMerger)
+	if !ok {
+		return 0, fmt.Errorf("ent type %s does not implement ent.EntMerger", e.EntTypeName())
+	}
+	fresh := e.EntNew()
+	if err := LoadEntById(fresh, storage, eb.id); err != nil {
+		return 0, err
+	}
+	if _, ok := e.(FieldVersionTracker); ok {
+		conflicts = ConflictingFields(e, fresh)
+	} else if fresh.Version() > eb.version {
+		conflicts = eb.changes
+	}
+	mergeEnt(m, e, fresh, eb.changes)
+	return conflicts, nil
+}
+
+func DeleteEnt(e Ent) error {
+	return deleteEnt(e, entBase(e).storage)
+}
+
+func DeleteEntContext(ctx context.Context, e Ent) error {
+	return deleteEnt(e, WithContext(ctx, entBase(e).storage))
+}
+
+func deleteEnt(e Ent, storage Storage) error {
+	eb := entBase(e)
+	if storage == nil {
+		return eb.noStorageErr()
+	}
+	if h, ok := e.(BeforeDelete); ok {
+		if err := h.BeforeDelete(); err != nil {
+			return err
+		}
+	}
+	if err := storage.Delete(e, e.Id()); err != nil {
+		return err
+	}
+	eb.id = 0
+	eb.version = 0
+	eb.storage = nil
+	eb.changes = 0
+	eb.deleted = true
+	if h, ok := e.(AfterDelete); ok {
+		h.AfterDelete()
+	}
+	return nil
+}
+
+// noStorageErr returns the error of an operation on an ent which has no storage:
+// ErrDeleted if the ent has been deleted, otherwise ErrNoStorage (the ent was never stored.)
+func (e *EntBase) noStorageErr() error {
+	if e.deleted {
+		return ErrDeleted
+	}
+	return ErrNoStorage
+}
+
+// BulkDeleter is implemented by storages which can delete all ents of a type more efficiently
+// than by deleting each ent. Used by DeleteAllEntsOfType.
+type BulkDeleter interface {
+	// DeleteAllOfType permanently deletes all ents of the type of prototype, including their
+	// index entries
+	DeleteAllOfType(prototype Ent) error
+}
+
+// DeleteAllEntsOfType permanently DELETES ALL ents of the type of prototype.
+// Storages which implement BulkDeleter delete them in bulk, others one ent at a time.
+// Note that lifecycle hooks (e.g. BeforeDelete) are not called.
 func DeleteAllEntsOfType(s Storage, prototype Ent) error {
+	if bd, ok := s.(BulkDeleter); ok {
+		return bd.DeleteAllOfType(prototype)
+	}
 	it := s.IterateIds(prototype.EntTypeName())
 	var id uint64
-	e := prototype.EntNew()
 	for it.Next(&id) {
-		// SetEntBaseFields(e, s, id, 1, e.EntFields().FieldSet)
-		s.Delete(e, id)
+		if err := s.Delete(prototype.EntNew(), id); err != nil && err != ErrNotFound {
+			return err
+		}
 	}
 	return it.Err()
 }
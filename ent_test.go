@@ -1,6 +1,10 @@
 package ent
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/rsms/go-testutil"
@@ -10,3 +14,389 @@ func TestEntEncode(t *testing.T) {
 	assert := testutil.NewAssert(t)
 	assert.Ok("ok", true)
 }
+
+func TestSaveWithoutStorage(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &sizeIndexTestEnt{}
+	e.SetEntFieldChanged(0)
+	assert.Eq("never stored", SaveEnt(e), ErrNoStorage)
+	assert.Eq("never stored", DeleteEnt(e), ErrNoStorage)
+	assert.Eq("GetStorage", GetStorage(e), nil)
+
+	e.deleted = true // as after DeleteEnt
+	assert.Eq("deleted", SaveEnt(e), ErrDeleted)
+	assert.Eq("deleted", DeleteEnt(e), ErrDeleted)
+
+	SetEntBaseFieldsAfterLoad(e, nil, 1, 1) // as after loading the ent again
+	assert.Eq("loaded", SaveEnt(e), ErrNoStorage)
+}
+
+func TestChangedFields(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &sizeIndexTestEnt{}
+	assert.Eq("no changes", e.ChangedFields(), FieldSet(0))
+	assert.Eq("no changes", len(ChangedFieldNames(e)), 0)
+	e.SetEntFieldChanged(0)
+	e.SetEntFieldChanged(2)
+	assert.Eq("ChangedFields", e.ChangedFields(), FieldSet(1|4))
+	assert.Eq("ChangedFields().Len()", e.ChangedFields().Len(), 2)
+	assert.Eq("w changed", IsFieldChangedByName(e, "w"), true)
+	assert.Eq("h not changed", IsFieldChangedByName(e, "h"), false)
+	assert.Eq("name changed", IsFieldChangedByName(e, "name"), true)
+	assert.Eq("unknown field", IsFieldChangedByName(e, "nope"), false)
+	assert.Eq("ChangedFieldNames", strings.Join(ChangedFieldNames(e), ","), "w,name")
+
+	e.SetEntFieldsChanged(FieldSet(2))
+	assert.Eq("SetEntFieldsChanged", e.ChangedFields(), FieldSet(1|2|4))
+	e.ClearEntChanges()
+	assert.Eq("ClearEntChanges", e.ChangedFields(), FieldSet(0))
+}
+
+func (e *sizeIndexTestEnt) EntMergeFrom(other Ent, fields FieldSet) {
+	o := other.(*sizeIndexTestEnt)
+	if fields.Has(0) {
+		e.w = o.w
+	}
+	if fields.Has(1) {
+		e.h = o.h
+	}
+	if fields.Has(2) {
+		e.name = o.name
+	}
+}
+
+func TestMergeEnt(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	dst := &sizeIndexTestEnt{w: 1, h: 2, name: "a"}
+	SetEntBaseFieldsAfterLoad(dst, nil, 7, 3)
+	dst.h = 20
+	dst.SetEntFieldChanged(1)
+
+	fresh := &sizeIndexTestEnt{w: 10, h: 2, name: "b"}
+	SetEntBaseFieldsAfterLoad(fresh, nil, 7, 5)
+
+	assert.NoErr("MergeEnt", MergeEnt(dst, fresh))
+	assert.Eq("w adopted", dst.w, 10)
+	assert.Eq("h kept", dst.h, 20)
+	assert.Eq("name adopted", dst.name, "b")
+	assert.Eq("version adopted", dst.Version(), uint64(5))
+	assert.Eq("changes kept", dst.ChangedFields(), FieldSet(2))
+
+	other := &sizeIndexTestEnt{}
+	SetEntBaseFieldsAfterLoad(other, nil, 8, 1)
+	assert.Err("different ents", "different ents", MergeEnt(dst, other))
+	assert.Err("not a merger", "does not implement", MergeEnt(&multiIndexTestEnt{}, dst))
+}
+
+func TestFieldValue(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &sizeIndexTestEnt{w: 3, name: "a"}
+	assert.Eq("GetFieldValue", GetFieldValue(e, 0), 3)
+	assert.Eq("GetFieldValue", GetFieldValue(e, 2), "a")
+	assert.NoErr("SetFieldValue", SetFieldValue(e, 1, 4))
+	assert.Eq("set", e.h, 4)
+	assert.Eq("changed", e.ChangedFields(), FieldSet(2))
+	assert.Err("wrong type", "cannot assign string", SetFieldValue(e, 0, "x"))
+	assert.Err("nil", "cannot assign <nil>", SetFieldValue(e, 2, nil))
+	assert.Eq("unchanged", e.w, 3)
+}
+
+// fieldVersionTestEnt is a sizeIndexTestEnt which tracks field versions
+type fieldVersionTestEnt struct{ sizeIndexTestEnt }
+
+func (e *fieldVersionTestEnt) EntTracksFieldVersions() {}
+
+func (e *fieldVersionTestEnt) EntMergeFrom(other Ent, fields FieldSet) {
+	e.sizeIndexTestEnt.EntMergeFrom(&other.(*fieldVersionTestEnt).sizeIndexTestEnt, fields)
+}
+
+func TestMergeEntFieldVersions(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	dst := &fieldVersionTestEnt{sizeIndexTestEnt{w: 1, h: 2, name: "a"}}
+	SetEntBaseFieldsAfterLoad(dst, nil, 7, 3)
+	dst.fieldVersions = []uint64{1, 2, 3}
+	dst.w, dst.h = 10, 20
+	dst.SetEntFieldsChanged(1 | 2)
+
+	// someone else changed w and name at version 4
+	fresh := &fieldVersionTestEnt{sizeIndexTestEnt{w: 5, h: 2, name: "b"}}
+	SetEntBaseFieldsAfterLoad(fresh, nil, 7, 4)
+	fresh.fieldVersions = []uint64{4, 2, 4}
+
+	assert.Eq("ConflictingFields", ConflictingFields(dst, fresh), FieldSet(1))
+	assert.NoErr("MergeEnt", MergeEnt(dst, fresh))
+	assert.Eq("w adopted (higher field version)", dst.w, 5)
+	assert.Eq("h kept", dst.h, 20)
+	assert.Eq("name adopted", dst.name, "b")
+	assert.Eq("changes", dst.ChangedFields(), FieldSet(2))
+	assert.Eq("field versions", fmt.Sprint(dst.fieldVersions), "[4 2 4]")
+}
+
+func TestJsonDecodeFields(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &sizeIndexTestEnt{w: 1, h: 2, name: "a"}
+	SetEntBaseFieldsAfterLoad(e, nil, 7, 3)
+	e.SetEntFieldChanged(0)
+	data := []byte(`{"_id":99,"_ver":42,"h":20,"name":"b","nope":true}`)
+	assert.NoErr("JsonDecodeFields", JsonDecodeFields(e, data))
+	assert.Eq("w kept", e.w, 1)
+	assert.Eq("h", e.h, 20)
+	assert.Eq("name", e.name, "b")
+	assert.Eq("id kept", e.Id(), uint64(7))
+	assert.Eq("version kept", e.Version(), uint64(3))
+	assert.Eq("changes", e.ChangedFields(), FieldSet(1|2|4))
+	assert.Err("bad json", "json error", JsonDecodeFields(e, []byte(`{"h":`)))
+}
+
+// jsonNameTestEnt is a sizeIndexTestEnt with w named "width" in JSON
+type jsonNameTestEnt struct{ sizeIndexTestEnt }
+
+func (e *jsonNameTestEnt) EntNew() Ent                     { return &jsonNameTestEnt{} }
+func (e *jsonNameTestEnt) EntJsonNames() map[string]string { return map[string]string{"w": "width"} }
+
+func (e *jsonNameTestEnt) EntMergeFrom(other Ent, fields FieldSet) {
+	e.sizeIndexTestEnt.EntMergeFrom(&other.(*jsonNameTestEnt).sizeIndexTestEnt, fields)
+}
+
+func TestJsonNames(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &jsonNameTestEnt{sizeIndexTestEnt{w: 1, h: 2, name: "a"}}
+	SetEntBaseFieldsAfterLoad(e, nil, 7, 3)
+	data, err := JsonEncode(e, "")
+	assert.NoErr("JsonEncode", err)
+	assert.Eq("JsonEncode", string(data), `{"_ver":"3","_id":"7","width":"1","h":"2","name":"a"}`)
+	data, err = JsonEncodeEnt(e, 7, 3, e.EntFields().FieldSet, "")
+	assert.NoErr("JsonEncodeEnt", err)
+	assert.Eq("JsonEncodeEnt", string(data), `{"_ver":"3","_id":"7","w":"1","h":"2","name":"a"}`)
+
+	e2 := &jsonNameTestEnt{}
+	assert.NoErr("JsonDecode", JsonDecode(e2, []byte(`{"_id":7,"width":5,"h":6}`)))
+	assert.Eq("w", e2.w, 5)
+	assert.Eq("h", e2.h, 6)
+	assert.NoErr("JsonDecodeFields", JsonDecodeFields(e2, []byte(`{"width":9}`)))
+	assert.Eq("w", e2.w, 9)
+	assert.Eq("changes", e2.ChangedFields(), FieldSet(1))
+}
+
+func TestBindStorage(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &putTestStorage{}
+	e := &sizeIndexTestEnt{w: 1}
+	e.SetEntFieldChanged(0)
+	BindStorage(e, WithContext(context.Background(), s), 7, 3)
+	assert.Eq("id", e.Id(), uint64(7))
+	assert.Eq("version", e.Version(), uint64(3))
+	assert.Eq("storage", GetStorage(e), Storage(s))
+	assert.Eq("changes kept", e.ChangedFields(), FieldSet(1))
+}
+
+// reloadTestStorage loads fresh at version 4
+type reloadTestStorage struct {
+	testStorage
+	fresh *sizeIndexTestEnt
+}
+
+func (s *reloadTestStorage) LoadById(e Ent, id uint64) (uint64, error) {
+	s.record("LoadById %d", id)
+	e.(EntMerger).EntMergeFrom(s.fresh, s.fresh.EntFields().FieldSet)
+	return 4, nil
+}
+
+func TestReloadInto(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &reloadTestStorage{fresh: &sizeIndexTestEnt{w: 5, h: 6, name: "b"}}
+	e := &sizeIndexTestEnt{w: 1, h: 2, name: "a"}
+	SetEntBaseFieldsAfterLoad(e, s, 7, 3)
+	e.h = 20
+	e.SetEntFieldChanged(1)
+
+	conflicts, err := ReloadInto(e)
+	assert.NoErr("ReloadInto", err)
+	assert.Eq("conflicts", conflicts, FieldSet(2))
+	assert.Eq("w adopted", e.w, 5)
+	assert.Eq("h kept", e.h, 20)
+	assert.Eq("name adopted", e.name, "b")
+	assert.Eq("version", e.Version(), uint64(4))
+	assert.Eq("changes kept", e.ChangedFields(), FieldSet(2))
+
+	conflicts, err = ReloadInto(e) // same version; nothing changed in storage
+	assert.NoErr("ReloadInto", err)
+	assert.Eq("no conflicts", conflicts, FieldSet(0))
+	assert.Eq("calls", strings.Join(s.calls, ","), "LoadById 7,LoadById 7")
+}
+
+// existsTestStorage has a "sizetest" ent with id 7
+type existsTestStorage struct {
+	testStorage
+}
+
+func (s *existsTestStorage) Exists(entType string, id uint64) (bool, error) {
+	s.record("Exists %d", id)
+	return entType == "sizetest" && id == 7, nil
+}
+
+func TestEntExists(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &existsTestStorage{}
+	e := &sizeIndexTestEnt{}
+	ok, err := EntExists(e, s, 7)
+	assert.NoErr("EntExists", err)
+	assert.Eq("exists", ok, true)
+	ok, _ = EntExists(e, WithContext(context.Background(), s), 8)
+	assert.Eq("does not exist", ok, false)
+	ok, _ = EntExists(e, s, 0)
+	assert.Eq("id 0", ok, false)
+	_, err = EntExists(e, nil, 7)
+	assert.Eq("no storage", err, ErrNoStorage)
+	assert.Eq("calls", strings.Join(s.calls, ","), "Exists 7,Exists 8")
+}
+
+func TestSetReservedFieldNamesInvalid(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	for _, names := range [][3]string{{"", "v", "fv"}, {"id", "id", "fv"}, {"id", "v", "v"}} {
+		func() {
+			defer func() {
+				assert.Ok("panics", recover() != nil)
+			}()
+			SetReservedFieldNames(names[0], names[1], names[2])
+		}()
+	}
+	assert.Eq("unchanged", FieldNameId, "_id")
+}
+
+// deleteTestStorage has ents with ids, of which id 2 is deleted by someone else while iterating
+type deleteTestStorage struct {
+	testStorage
+}
+
+func (s *deleteTestStorage) Delete(e Ent, id uint64) error {
+	s.record("Delete %d", id)
+	if id == 2 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// bulkDeleteTestStorage is a deleteTestStorage which implements BulkDeleter
+type bulkDeleteTestStorage struct {
+	deleteTestStorage
+}
+
+func (s *bulkDeleteTestStorage) DeleteAllOfType(prototype Ent) error {
+	s.record("DeleteAllOfType")
+	return nil
+}
+
+func TestDeleteAllEntsOfType(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &deleteTestStorage{testStorage{ids: []uint64{1, 2, 3}}}
+	assert.NoErr("DeleteAllEntsOfType", DeleteAllEntsOfType(s, &sizeIndexTestEnt{}))
+	assert.Eq("deleted one at a time", strings.Join(s.calls, ","),
+		"IterateIds,Delete 1,Delete 2,Delete 3")
+
+	bs := &bulkDeleteTestStorage{}
+	bs.ids = []uint64{1, 2, 3}
+	assert.NoErr("DeleteAllEntsOfType", DeleteAllEntsOfType(bs, &sizeIndexTestEnt{}))
+	assert.Eq("bulk", strings.Join(bs.calls, ","), "DeleteAllOfType")
+}
+
+func TestIndexConflictErr(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	err := &IndexConflictErr{
+		Underlying: ErrUniqueConflict, EntTypeName: "account", IndexName: "email"}
+	assert.Eq("Error", err.Error(), "unique index conflict on account.email")
+	err.Key = "a@b.c"
+	assert.Eq("Error with key", err.Error(),
+		`unique index conflict on account.email (key "a@b.c")`)
+	err.ExistingId = 7
+	assert.Eq("Error with id", err.Error(),
+		`unique index conflict on account.email (key "a@b.c" taken by id 7)`)
+
+	// callers distinguish index conflicts from other errors, also when wrapped
+	var wrapped error = fmt.Errorf("create failed: %w", err)
+	assert.Eq("errors.Is", errors.Is(err, ErrUniqueConflict), true)
+	assert.Eq("errors.Is wrapped", errors.Is(wrapped, ErrUniqueConflict), true)
+	assert.Eq("errors.Is other", errors.Is(wrapped, ErrVersionConflict), false)
+	var conflict *IndexConflictErr
+	assert.Eq("errors.As", errors.As(wrapped, &conflict), true)
+	assert.Eq("errors.As id", conflict.ExistingId, uint64(7))
+
+	typeChanged := &IndexConflictErr{
+		Underlying: ErrIndexTypeChanged, EntTypeName: "account", IndexName: "email"}
+	assert.Eq("type changed", typeChanged.Error(), "index type changed: account.email")
+	assert.Eq("type changed errors.Is", errors.Is(typeChanged, ErrUniqueConflict), false)
+}
+
+// consistentTestStorage has ents of any id and implements ConsistentLoader
+type consistentTestStorage struct {
+	testStorage
+}
+
+func (s *consistentTestStorage) LoadById(e Ent, id uint64) (uint64, error) {
+	s.record("LoadById")
+	return 1, nil
+}
+
+func (s *consistentTestStorage) LoadByIdConsistent(e Ent, id uint64) (uint64, error) {
+	s.record("LoadByIdConsistent")
+	return 1, nil
+}
+
+func TestLoadEntByIdConsistent(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &consistentTestStorage{}
+	assert.NoErr("LoadEntById", LoadEntById(&sizeIndexTestEnt{}, s, 1))
+	assert.NoErr("Consistent", LoadEntById(&sizeIndexTestEnt{}, s, 1, Consistent))
+	assert.NoErr("WithContext", LoadEntById(
+		&sizeIndexTestEnt{}, WithContext(context.Background(), s), 1, Consistent))
+	assert.Eq("calls", strings.Join(s.calls, ","), "LoadById,LoadByIdConsistent,LoadByIdConsistent")
+}
+
+// putTestStorage creates ents with id 5 and puts ents at version 4, or fails with err
+type putTestStorage struct {
+	testStorage
+	err error
+}
+
+func (s *putTestStorage) Create(e Ent, fields FieldSet) (uint64, error) {
+	s.record("Create")
+	return 5, nil
+}
+
+func (s *putTestStorage) Put(e Ent, id uint64) (uint64, error) {
+	s.record("Put %d", id)
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 4, nil
+}
+
+func TestPutEnt(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &putTestStorage{}
+	e := &sizeIndexTestEnt{}
+	assert.NoErr("create", PutEnt(e, s))
+	assert.Eq("id", e.Id(), uint64(5))
+
+	SetEntBaseFieldsAfterLoad(e, nil, 7, 1) // e.g. a stale copy, not bound to s
+	e.SetEntFieldChanged(0)
+	assert.NoErr("put", PutEnt(e, s))
+	assert.Eq("version", e.Version(), uint64(4))
+	assert.Eq("storage", GetStorage(e), Storage(s))
+	assert.Eq("changes", e.ChangedFields(), FieldSet(0))
+	assert.Eq("calls", strings.Join(s.calls, ","), "Create,Put 7")
+	assert.Eq("no storage", PutEnt(e, nil), ErrNoStorage)
+
+	// all fields are written, so all field versions are updated
+	fe := &fieldVersionTestEnt{}
+	SetEntBaseFieldsAfterLoad(fe, nil, 7, 3)
+	fe.fieldVersions = []uint64{1, 2, 3}
+	assert.NoErr("put field versions", PutEnt(fe, s))
+	assert.Eq("field versions", fmt.Sprint(fe.fieldVersions), "[4 4 4]")
+
+	// restored when the put fails
+	s.err = ErrVersionConflict
+	fe.fieldVersions = []uint64{1, 2, 3}
+	assert.Eq("put error", PutEnt(fe, s), ErrVersionConflict)
+	assert.Eq("field versions restored", fmt.Sprint(fe.fieldVersions), "[1 2 3]")
+}
@@ -39,6 +39,8 @@ type Codegen struct {
 
 	generatedFunctions map[string]bool
 
+	ents []*EntInfo // all ents of the package, e.g. for resolving "ref" field tags
+
 	pos      token.Pos // best source pos for whater is currently being generated
 	posstack []token.Pos
 
@@ -52,10 +54,17 @@ type Codegen struct {
 	helperm   map[string]error
 
 	// imported packages (does not include the ent package)
-	imports []PkgImport
+	imports       []PkgImport
+	helperImports []PkgImport // packages used by helpers
+
+	// number of errors reported with logSrcErr and logSrcErrAt
+	srcErrors int
 
 	// options
 	PrivateFieldSetters bool // generate "setField" methods instead of "SetField" methods
+	Proto               bool // generate MarshalProto and UnmarshalProto methods (see ProtoFile)
+	Strict              bool // unknown field tags are errors rather than warnings
+	Query               bool // generate TYPEQuery and FindTYPEWhere (see genFindTYPEWhere)
 }
 
 func NewCodegen(pkg *Package, srcdir, entpkgPath string) *Codegen {
@@ -90,6 +99,7 @@ func (g *Codegen) flush() {
 	g.helperw.Flush()
 }
 
+// Finalize returns the source of a go file with all generated code, including helpers
 func (g *Codegen) Finalize() []byte {
 	g.flush()
 	b := g.wbuf.Bytes()
@@ -101,7 +111,34 @@ func (g *Codegen) Finalize() []byte {
 		b = append(b, helpers...)
 	}
 
-	// header
+	return g.fileSource(b, g.imports)
+}
+
+// FinalizeEnt returns the source of a go file with the code generated since the last call to
+// FinalizeEnt and resets the main write stream and its imports. Helpers are not included
+// (see FinalizeHelpers.) This is used to write the code of each ent to a separate file.
+func (g *Codegen) FinalizeEnt() []byte {
+	g.w.Flush()
+	b := g.fileSource(g.wbuf.Bytes(), g.imports)
+	g.wbuf.Reset()
+	g.imports = nil
+	return b
+}
+
+// FinalizeHelpers returns the source of a go file with all helpers, or nil if no helpers
+// were generated. Used together with FinalizeEnt.
+func (g *Codegen) FinalizeHelpers() []byte {
+	g.helperw.Flush()
+	helpers := g.helperbuf.Bytes()
+	if len(helpers) == 0 {
+		return nil
+	}
+	b := append([]byte("// ---- helpers ----\n"), helpers...)
+	return g.fileSource(b, g.helperImports)
+}
+
+// fileSource returns body prefixed by a header with package clause and imports
+func (g *Codegen) fileSource(body []byte, imports []PkgImport) []byte {
 	header := &bytes.Buffer{}
 	wf := func(format string, args ...interface{}) {
 		fmt.Fprintf(header, format, args...)
@@ -109,11 +146,11 @@ func (g *Codegen) Finalize() []byte {
 	wf("%s\n", generatedByHeaderPrefix)
 	wf("package %s\n", g.pkg.Name)
 
-	if len(g.imports) == 0 {
+	if len(imports) == 0 {
 		wf("import %#v\n", g.entpkgPath)
 	} else {
 		wf("import (\n  %#v\n", g.entpkgPath)
-		for _, im := range g.imports {
+		for _, im := range imports {
 			if im.Name != "" {
 				wf("  %s %#v\n", im.Name, im.Path)
 			} else {
@@ -123,9 +160,7 @@ func (g *Codegen) Finalize() []byte {
 		header.WriteString(")\n")
 	}
 	header.WriteByte('\n')
-	b = append(header.Bytes(), b...)
-
-	return b
+	return append(header.Bytes(), body...)
 }
 
 func (g *Codegen) logErrUnsupportedType(f *EntField) {
@@ -133,13 +168,29 @@ func (g *Codegen) logErrUnsupportedType(f *EntField) {
 }
 
 func (g *Codegen) logSrcErr(format string, args ...interface{}) {
-	logSrcErr(g.srcdir, g.pkg, g.pos, format, args...)
+	g.logSrcErrAt(g.pos, format, args...)
+}
+
+// logSrcErrAt is like logSrcErr but reports the source position pos
+func (g *Codegen) logSrcErrAt(pos token.Pos, format string, args ...interface{}) {
+	logSrcErr(g.srcdir, g.pkg, pos, format, args...)
+	g.srcErrors++
 }
 
 func (g *Codegen) logSrcWarn(format string, args ...interface{}) {
 	logSrcWarn(g.srcdir, g.pkg, g.pos, format, args...)
 }
 
+// logUnknownTag reports an unknown field tag or tag option. It's ignored with a warning unless
+// g.Strict is set, in which case it's an error which fails code generation of the ent.
+func (g *Codegen) logUnknownTag(format string, args ...interface{}) {
+	if g.Strict {
+		g.logSrcErr(format, args...)
+	} else {
+		g.logSrcWarn(format+"; ignoring", args...)
+	}
+}
+
 func (g *Codegen) pushPos(pos token.Pos) {
 	g.posstack = append(g.posstack, g.pos)
 	g.pos = pos
@@ -169,6 +220,51 @@ func isMutableRefType(typ types.Type) bool {
 	return false
 }
 
+// genFieldEqualExpr returns a boolean expression that is true when the values a and b of field
+// f's type are equal. Comparable types use ==, except for types with interface values which
+// == panics on when their dynamic values are not comparable (e.g. slices). Byte slices are
+// compared with bytes.Equal and other types with reflect.DeepEqual. Empty slices and maps are
+// considered equal regardless of being nil since they encode the same way.
+func (g *Codegen) genFieldEqualExpr(f *EntField, a, b string) string {
+	if types.Comparable(f.t.Type) && !hasInterfaceValues(f.t.Type) {
+		return a + " == " + b
+	}
+	switch t := f.t.Type.Underlying().(type) {
+	case *types.Slice:
+		if bt, ok := t.Elem().(*types.Basic); ok && bt.Kind() == types.Uint8 {
+			g.addImport("bytes")
+			return fmt.Sprintf("bytes.Equal(%s, %s)", a, b)
+		}
+		g.addImport("reflect")
+		return fmt.Sprintf("len(%s) == len(%s) && (len(%s) == 0 || reflect.DeepEqual(%s, %s))",
+			a, b, b, a, b)
+	case *types.Map:
+		g.addImport("reflect")
+		return fmt.Sprintf("len(%s) == len(%s) && (len(%s) == 0 || reflect.DeepEqual(%s, %s))",
+			a, b, b, a, b)
+	}
+	g.addImport("reflect")
+	return fmt.Sprintf("reflect.DeepEqual(%s, %s)", a, b)
+}
+
+// hasInterfaceValues returns true if values of type typ are or contain interface values, like
+// a struct with a field of interface type
+func hasInterfaceValues(typ types.Type) bool {
+	switch t := typ.Underlying().(type) {
+	case *types.Interface:
+		return true
+	case *types.Array:
+		return hasInterfaceValues(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if hasInterfaceValues(t.Field(i).Type()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // —————————————————————————————————————————————————————————————————————————————————————————
 // encode
 
@@ -186,6 +282,16 @@ func (g *Codegen) codegenEncodeField(f *EntField) error {
 func (g *Codegen) genFieldEncoder(f *EntField, cvar, valexpr string) (string, error) {
 	g.pushPos(f.t.pos)
 	defer g.popPos()
+	if f.codec != nil {
+		return fmt.Sprintf("%s(%s, %s)", f.codec.encode, cvar, valexpr), nil
+	}
+	if f.foldIndexKey {
+		// index keys are case-folded by ent.EncodeStrFolded
+		if _, cast := g.unwrapNamedType(f.t.Type); cast != "" {
+			valexpr = wrapstr(valexpr, "string")
+		}
+		return fmt.Sprintf("ent.EncodeStrFolded(%s, %s)", cvar, valexpr), nil
+	}
 	expr, err := g.encoderExpr(f.t.Type, cvar, valexpr)
 	if err == ErrUnsupportedType {
 		g.logErrUnsupportedType(f)
@@ -194,6 +300,9 @@ func (g *Codegen) genFieldEncoder(f *EntField, cvar, valexpr string) (string, er
 }
 
 func (g *Codegen) encoderExpr(typ types.Type, cvar, valexpr string) (expr string, err error) {
+	if name, err := g.bigNumCodecName(typ); name != "" || err != nil {
+		return fmt.Sprintf("ent.EncodeBig%s(%s, %s)", name, cvar, valexpr), err
+	}
 	typ, cast := g.unwrapNamedType(typ)
 	if cast != "" {
 		// flip cast
@@ -287,6 +396,10 @@ func (g *Codegen) genComplexEncoder(typ types.Type, cvar string, buf *bytes.Buff
 func (g *Codegen) codegenDecodeField(f *EntField) error {
 	g.pushPos(f.t.pos)
 	defer g.popPos()
+	if f.codec != nil {
+		g.f("  e.%s = %s(c)\n", f.sname, f.codec.decode)
+		return nil
+	}
 	expr, cast, err := g.decoderExpr(f.t.Type, "c")
 	if err != nil {
 		if err == ErrUnsupportedType {
@@ -300,6 +413,9 @@ func (g *Codegen) codegenDecodeField(f *EntField) error {
 
 // decoderExpr generates & returns a "decode" expression like "c.Int(64)"
 func (g *Codegen) decoderExpr(typ types.Type, cvar string) (expr, cast string, err error) {
+	if name, err := g.bigNumCodecName(typ); name != "" || err != nil {
+		return fmt.Sprintf("ent.DecodeBig%s(%s)", name, cvar), "", err
+	}
 	typ, cast = g.unwrapNamedType(typ)
 	switch t := typ.(type) {
 
@@ -469,10 +585,30 @@ func (g *Codegen) getOrBuildHelper(fname, cvar string, t types.Type, builder Hel
 	g.helperm[fname] = err
 	if err == nil {
 		g.helperw.Write(buf.Bytes())
+		if t != nil {
+			for _, pkgPath := range g.typeImports(t) {
+				g.helperImports = addPkgImport(g.helperImports, pkgPath)
+			}
+		}
 	}
 	return err
 }
 
+// bigNumCodecName returns "Int" for *big.Int and "Rat" for *big.Rat, which are encoded with
+// ent.EncodeBigInt and ent.EncodeBigRat, respectively. Returns "" for all other types.
+// big.Int and big.Rat values (non-pointers) are not supported since they should not be copied.
+func (g *Codegen) bigNumCodecName(typ types.Type) (string, error) {
+	if name := bigNumTypeName(typ); name != "" {
+		goType := g.goTypeName(typ)
+		g.logSrcErr("unsupported type %s; use *%s instead", goType, goType)
+		return "", ErrUnsupportedType
+	}
+	if t, ok := typ.(*types.Pointer); ok {
+		return bigNumTypeName(t.Elem()), nil
+	}
+	return "", nil
+}
+
 func (g *Codegen) unwrapNamedType(typ types.Type) (canonical types.Type, cast string) {
 	// unwrap named type (does not include aliases, which do not need casting)
 	canonical = typ
@@ -621,7 +757,11 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 	}
 
 	// compile indexes
+	srcErrors := g.srcErrors
 	fieldIndexes := g.collectFieldIndexes(e.fields)
+	if g.srcErrors > srcErrors {
+		return fmt.Errorf("invalid field tags in %s", e.sname)
+	}
 
 	g.f(
 		"// ----------------------------------------------------------------------------\n// %s\n\n",
@@ -645,22 +785,108 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 	fname := "Load" + e.sname + "ById"
 	if funcIsUndefined(fname) {
 		g.generatedFunctions[fname] = true
-		g.f("// %s loads %s with id from storage\n"+
-			"func %s(storage ent.Storage, id uint64) (*%s, error)\t{\n"+
+		g.f("// %s loads %s with id from storage.\n"+
+			"// Pass ent.Consistent to read from the primary of a storage with replicas.\n"+
+			"func %s(storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*%s, error)\t{\n"+
 			"  e := &%s{}\n"+
-			"  return e, ent.LoadEntById(e, storage, id)\n"+
+			"  return e, ent.LoadEntById(e, storage, id, fl...)\n"+
 			"}\n\n",
 			fname, e.sname,
 			fname, e.sname,
 			e.sname)
 	}
+	if fname2 := fname + "Context"; funcIsUndefined(fname2) {
+		g.generatedFunctions[fname2] = true
+		g.f("// %s is like %s but loads with ctx (see ent.WithContext)\n"+
+			"func %s(ctx context.Context, storage ent.Storage, id uint64, fl ...ent.LookupFlags) "+
+			"(*%s, error)\t{\n"+
+			"  return %s(ent.WithContext(ctx, storage), id, fl...)\n"+
+			"}\n\n",
+			fname2, fname,
+			fname2, e.sname,
+			fname)
+	}
+	g.addImport("context")
+
+	// TYPEExists(s ent.Storage, id uint64) (bool, error)
+	fname = e.sname + "Exists"
+	if funcIsUndefined(fname) {
+		g.generatedFunctions[fname] = true
+		g.f("// %s returns true if storage has %s with id, without loading it\n"+
+			"func %s(storage ent.Storage, id uint64) (bool, error)\t{\n"+
+			"  return ent.EntExists(&%s{}, storage, id)\n"+
+			"}\n\n",
+			fname, e.sname,
+			fname,
+			e.sname)
+	}
+	if fname2 := fname + "Context"; funcIsUndefined(fname2) {
+		g.generatedFunctions[fname2] = true
+		g.f("// %s is like %s but with ctx (see ent.WithContext)\n"+
+			"func %s(ctx context.Context, storage ent.Storage, id uint64) (bool, error)\t{\n"+
+			"  return %s(ent.WithContext(ctx, storage), id)\n"+
+			"}\n\n",
+			fname2, fname,
+			fname2,
+			fname)
+	}
+
+	// FindTYPEByExample(s ent.Storage, example *TYPE, limit int) ([]uint64, error)
+	// LoadTYPEByExample(s ent.Storage, example *TYPE, limit int) ([]*TYPE, error)
+	if len(e.fields) > 0 {
+		fname = "Find" + e.sname + "ByExample"
+		if funcIsUndefined(fname) {
+			g.generatedFunctions[fname] = true
+			g.f("// %s looks up ids of %s ents with field values matching those set in example.\n"+
+				"// See ent.FindIdsByExample for details.\n"+
+				"func %s(s ent.Storage, example *%s, limit int) ([]uint64, error)\t{\n"+
+				"  return ent.FindIdsByExample(s, example, limit)\n"+
+				"}\n\n",
+				fname, e.sname,
+				fname, e.sname)
+		}
+		fname = "Load" + e.sname + "ByExample"
+		if funcIsUndefined(fname) {
+			sliceCast, err := g.getEntSliceCastHelper(e)
+			if err != nil {
+				return err
+			}
+			g.generatedFunctions[fname] = true
+			g.f("// %s loads %s ents with field values matching those set in example.\n"+
+				"// See ent.FindIdsByExample for details.\n"+
+				"func %s(s ent.Storage, example *%s, limit int) ([]*%s, error)\t{\n"+
+				"  r, err := ent.LoadEntsByExample(s, example, limit)\n"+
+				"  return %s(r), err\n"+
+				"}\n\n",
+				fname, e.sname,
+				fname, e.sname, e.sname,
+				sliceCast)
+		}
+	}
 
 	// FindTYPEByINDEX
 	// LoadTYPEByINDEX
+	var lookupFuncs []string
 	for _, fx := range fieldIndexes {
+		funcsBefore := make(map[string]bool, len(g.generatedFunctions))
+		for name := range g.generatedFunctions {
+			funcsBefore[name] = true
+		}
 		if err := g.genFindTYPEByINDEX(e, fx); err != nil {
 			return err
 		}
+		for name := range g.generatedFunctions {
+			if !funcsBefore[name] && !strings.HasSuffix(name, "Context") {
+				lookupFuncs = append(lookupFuncs, name)
+			}
+		}
+	}
+
+	// FindTYPEWhere
+	if g.Query {
+		if fname := g.genFindTYPEWhere(e, fieldIndexes); fname != "" {
+			lookupFuncs = append(lookupFuncs, fname)
+		}
 	}
 
 	mname := "EntTypeName"
@@ -672,6 +898,17 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			e.sname, mname, e.name)
 	}
 
+	if e.trackFieldVersions {
+		mname = "EntTracksFieldVersions"
+		if methodMustBeUndefined(mname, "Use the \"fieldversions\" tag on EntBase field instead") {
+			generatedMethods[mname] = true
+			g.f("// %s marks %s as an ent.FieldVersionTracker\n"+
+				"func (e *%s) %s()\t{}\n\n",
+				mname, e.sname,
+				e.sname, mname)
+		}
+	}
+
 	mname = "EntStorage"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
@@ -681,6 +918,17 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			e.sname, mname)
 	}
 
+	mname = "BindStorage"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s binds the ent to storage as version of the ent with id (see ent.BindStorage)\n"+
+			"func (e *%s) %s(storage ent.Storage, id, version uint64)\t{\n"+
+			"  ent.BindStorage(e, storage, id, version)\n"+
+			"}\n\n",
+			mname,
+			e.sname, mname)
+	}
+
 	mname = "EntNew"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
@@ -702,12 +950,34 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 	mname = "UnmarshalJSON"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
-		g.f("// %s populates the ent from JSON data. Conforms to json.Unmarshaler.\n"+
+		g.f("// %s populates the ent from JSON data, including its id and version.\n"+
+			"// Conforms to json.Unmarshaler. Use ent.JsonDecodeFields for untrusted data.\n"+
 			"func (e *%s) %s(b []byte) error { return ent.JsonDecode(e, b) }\n\n",
 			mname,
 			e.sname, mname)
 	}
 
+	if g.Proto {
+		mname = "MarshalProto"
+		if methodIsUndefined(mname) {
+			generatedMethods[mname] = true
+			g.f("// %s returns a protocol buffers representation of e.\n"+
+				"// Fields which can't be represented in protocol buffers are not included.\n"+
+				"func (e *%s) %s() ([]byte, error) { return ent.ProtoEncode(e, 0b%b) }\n\n",
+				mname,
+				e.sname, mname, g.protoFieldSet(e))
+		}
+
+		mname = "UnmarshalProto"
+		if methodIsUndefined(mname) {
+			generatedMethods[mname] = true
+			g.f("// %s populates the ent from protocol buffers data.\n"+
+				"func (e *%s) %s(b []byte) error { return ent.ProtoDecode(e, b) }\n\n",
+				mname,
+				e.sname, mname)
+		}
+	}
+
 	mname = "String"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
@@ -717,6 +987,62 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			e.sname, mname)
 	}
 
+	mname = "Clone"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s returns a copy of e. Slice and map fields are copied while other fields,\n"+
+			"// like pointers, are copied shallowly. Useful with ent.Atomic for copy-on-write.\n"+
+			"func (e *%s) %s() *%s	{\n"+
+			"  c := *e\n",
+			mname,
+			e.sname, mname, e.sname)
+		for _, field := range e.fields {
+			goType := g.goTypeName(field.t.Type)
+			switch field.t.Type.Underlying().(type) {
+			case *types.Slice:
+				g.f("  if e.%s != nil {\n"+
+					"    c.%s = make(%s, len(e.%s))\n"+
+					"    copy(c.%s, e.%s)\n"+
+					"  }\n",
+					field.sname,
+					field.sname, goType, field.sname,
+					field.sname, field.sname)
+			case *types.Map:
+				g.f("  if e.%s != nil {\n"+
+					"    c.%s = make(%s, len(e.%s))\n"+
+					"    for k, v := range e.%s {\n"+
+					"      c.%s[k] = v\n"+
+					"    }\n"+
+					"  }\n",
+					field.sname,
+					field.sname, goType, field.sname,
+					field.sname,
+					field.sname)
+			}
+		}
+		g.s("  return &c\n}\n\n")
+	}
+
+	mname = "EntMergeFrom"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s copies the fields in fields from other, which must be a *%s.\n"+
+			"// Values are copied shallowly. Used by ent.MergeEnt.\n"+
+			"func (e *%s) %s(other ent.Ent, fields ent.FieldSet)	{\n"+
+			"  o := other.(*%s)\n",
+			mname, e.sname,
+			e.sname, mname,
+			e.sname)
+		for _, field := range e.fields {
+			g.f("  if fields.Has(%d) {\n"+
+				"    e.%s = o.%s\n"+
+				"  }\n",
+				field.index,
+				field.sname, field.sname)
+		}
+		g.s("}\n\n")
+	}
+
 	mname = "Create"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
@@ -725,6 +1051,16 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			mname, e.name,
 			e.sname, mname)
 	}
+	mname = "CreateContext"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s is like Create but with ctx (see ent.WithContext)\n"+
+			"func (e *%s) %s(ctx context.Context, storage ent.Storage) error\t{\n"+
+			"  return ent.CreateEnt(e, ent.WithContext(ctx, storage))\n"+
+			"}\n",
+			mname,
+			e.sname, mname)
+	}
 
 	mname = "Save"
 	if methodIsUndefined(mname) {
@@ -734,6 +1070,14 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			mname,
 			e.sname, mname)
 	}
+	mname = "SaveContext"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s is like Save but with ctx (see ent.WithContext)\n"+
+			"func (e *%s) %s(ctx context.Context) error\t{ return ent.SaveEntContext(ctx, e) }\n",
+			mname,
+			e.sname, mname)
+	}
 
 	mname = "Reload"
 	if methodIsUndefined(mname) {
@@ -743,6 +1087,14 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			mname,
 			e.sname, mname)
 	}
+	mname = "ReloadContext"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s is like Reload but with ctx (see ent.WithContext)\n"+
+			"func (e *%s) %s(ctx context.Context) error\t{ return ent.ReloadEntContext(ctx, e) }\n",
+			mname,
+			e.sname, mname)
+	}
 
 	mname = "PermanentlyDelete"
 	if methodIsUndefined(mname) {
@@ -752,14 +1104,111 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			mname,
 			e.sname, mname)
 	}
+	mname = "PermanentlyDeleteContext"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s is like PermanentlyDelete but with ctx (see ent.WithContext)\n"+
+			"func (e *%s) %s(ctx context.Context) error\t{ return ent.DeleteEntContext(ctx, e) }\n",
+			mname,
+			e.sname, mname)
+	}
 
 	mname = "Iterator"
 	if methodIsUndefined(mname) {
 		generatedMethods[mname] = true
-		g.f("// %s returns an iterator over all %s ents. Order is undefined.\n"+
-			"func (e %s) %s(s ent.Storage) ent.EntIterator\t{ return s.IterateEnts(&e) }\n",
-			mname, e.sname,
-			e.sname, mname)
+		if e.softDeleteField != nil {
+			g.f("// %s returns an iterator over all %s ents. Order is undefined.\n"+
+				"// Soft-deleted ents are skipped unless ent.IncludeDeleted is passed.\n"+
+				"func (e %s) %s(s ent.Storage, fl ...ent.LookupFlags) ent.EntIterator\t{\n"+
+				"  return ent.IterateEnts(s, &e, fl...)\n"+
+				"}\n",
+				mname, e.sname,
+				e.sname, mname)
+		} else {
+			g.f("// %s returns an iterator over all %s ents. Order is undefined.\n"+
+				"func (e %s) %s(s ent.Storage) ent.EntIterator\t{ return s.IterateEnts(&e) }\n",
+				mname, e.sname,
+				e.sname, mname)
+		}
+	}
+
+	mname = "IteratorFiltered"
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s returns an iterator over the %s ents for which keep returns true.\n"+
+			"// The ents are loaded and then filtered in memory. Order is undefined.\n", mname, e.sname)
+		if e.softDeleteField != nil {
+			g.f("// Soft-deleted ents are skipped unless ent.IncludeDeleted is passed.\n"+
+				"func (e %s) %s(s ent.Storage, keep func(*%s) bool, fl ...ent.LookupFlags) "+
+				"ent.EntIterator\t{\n"+
+				"  it := ent.IterateEnts(s, &e, fl...)\n",
+				e.sname, mname, e.sname)
+		} else {
+			g.f("func (e %s) %s(s ent.Storage, keep func(*%s) bool) ent.EntIterator\t{\n"+
+				"  it := s.IterateEnts(&e)\n",
+				e.sname, mname, e.sname)
+		}
+		g.f("  return ent.FilterEnts(it, func(e ent.Ent) bool { return keep(e.(*%s)) })\n"+
+			"}\n", e.sname)
+	}
+
+	// soft delete (ent.SoftDeleter)
+	if field := e.softDeleteField; field != nil {
+		isDeletedExpr, deleteValue, undeleteValue := "e."+field.sname, "true", "false"
+		if isTimeType(field.t.Type) {
+			pkgname := g.typePkgName(field.t.Type)
+			isDeletedExpr = "!e." + field.sname + ".IsZero()"
+			deleteValue = pkgname + ".Now()"
+			undeleteValue = pkgname + ".Time{}"
+		}
+		mname = "EntIsDeleted"
+		if methodMustBeUndefined(mname, "Use the \"softdelete\" field tag instead") {
+			generatedMethods[mname] = true
+			g.f("// %s returns true if the ent is soft-deleted. Conforms to ent.SoftDeleter.\n"+
+				"func (e *%s) %s() bool\t{ return %s }\n",
+				mname,
+				e.sname, mname, isDeletedExpr)
+		}
+		mname = "EntDeletedField"
+		if methodMustBeUndefined(mname, "Use the \"softdelete\" field tag instead") {
+			generatedMethods[mname] = true
+			g.f("// %s returns the field index of %s. Conforms to ent.SoftDeleter.\n"+
+				"func (e *%s) %s() int\t{ return %d }\n",
+				mname, field.sname,
+				e.sname, mname, field.index)
+		}
+		for _, m := range []struct{ name, value, doc string }{
+			{"Delete", deleteValue, "soft-deletes this ent in storage. Undo with Undelete."},
+			{"Undelete", undeleteValue, "restores this ent after Delete."},
+		} {
+			if methodIsUndefined(m.name) {
+				generatedMethods[m.name] = true
+				g.f("// %s %s\n"+
+					"func (e *%s) %s() error\t{\n"+
+					"  e.%s = %s\n"+
+					"  e.EntBase.SetEntFieldChanged(%d)\n"+
+					"  return ent.SaveEnt(e)\n"+
+					"}\n",
+					m.name, m.doc,
+					e.sname, m.name,
+					field.sname, m.value,
+					field.index)
+			}
+			mname = m.name + "Context"
+			if methodIsUndefined(mname) {
+				generatedMethods[mname] = true
+				g.f("// %s is like %s but with ctx (see ent.WithContext)\n"+
+					"func (e *%s) %s(ctx context.Context) error\t{\n"+
+					"  e.%s = %s\n"+
+					"  e.EntBase.SetEntFieldChanged(%d)\n"+
+					"  return ent.SaveEntContext(ctx, e)\n"+
+					"}\n",
+					mname, m.name,
+					e.sname, mname,
+					field.sname, m.value,
+					field.index)
+			}
+		}
 	}
 
 	wline()
@@ -778,8 +1227,8 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 				fieldsWithTags = append(fieldsWithTags, field)
 			}
 
-			// skip gettter if the field has a public name
-			if field.uname == field.sname {
+			// skip gettter if the field has a public name or is tagged "nogetter"
+			if field.uname == field.sname || field.noGetter {
 				continue
 			}
 
@@ -818,6 +1267,9 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 		var genConditionalSetters []*EntField
 		var genConditionalSettersSetNames []string
 		for _, field := range e.fields {
+			if field.noSetter {
+				continue
+			}
 			mname := fieldSetterPrefix + field.uname
 
 			if !methodIsUndefined(mname) {
@@ -841,10 +1293,8 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 				}
 			}
 
-			if types.Comparable(field.t.Type) {
-				genConditionalSetters = append(genConditionalSetters, field)
-				genConditionalSettersSetNames = append(genConditionalSettersSetNames, mname)
-			}
+			genConditionalSetters = append(genConditionalSetters, field)
+			genConditionalSettersSetNames = append(genConditionalSettersSetNames, mname)
 			g.f("func (e *%s) %s(v %s)\t{"+
 				" e.%s = v;"+
 				" e.EntBase.SetEntFieldChanged(%d)"+
@@ -871,7 +1321,7 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 				setMname := genConditionalSettersSetNames[i]
 				g.f("// %s sets %s only if v is different from the current value.\n"+
 					"func (e *%s) %s(v %s) bool\t{\n"+
-					"  if e.%s == v {\n"+
+					"  if %s {\n"+
 					"    return false\n"+
 					"  }\n"+
 					"  e.%s(v)\n"+
@@ -879,7 +1329,7 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 					"}\n\n",
 					mname, field.sname,
 					e.sname, mname, g.goTypeName(field.t.Type),
-					field.sname,
+					g.genFieldEqualExpr(field, "e."+field.sname, "v"),
 					setMname,
 				)
 			}
@@ -899,6 +1349,17 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 			}
 		}
 
+		// LoadREF() & SetREF() -- for fields with the "ref" tag which hold the id of another ent
+		srcErrors = g.srcErrors
+		for _, field := range e.fields {
+			if field.ref != "" {
+				g.genRefMethods(e, field, fieldSetterPrefix, methodIsUndefined, generatedMethods)
+			}
+		}
+		if g.srcErrors > srcErrors {
+			return fmt.Errorf("invalid field tags in %s", e.sname)
+		}
+
 		// EntEncode & EntDecode
 		wstr("// ---- encode & decode methods ----\n\n")
 
@@ -955,26 +1416,71 @@ func (g *Codegen) codegenEnt(e *EntInfo) error {
 		// -- EntIndexes --
 		if methodIsUndefined("EntIndexes") {
 			generatedMethods["EntIndexes"] = true
-			g.f("\n// Indexes (Name, Fields, Flags)\n")
+			g.f("\n// Indexes (Name, Fields, Flags, Where, Score)\n")
 			g.f("var ent_%s_idx = []ent.EntIndex{\n", e.sname)
 			for _, x := range fieldIndexes {
 				var flags []string
 				if (x.flags & fieldIndexUnique) != 0 {
 					flags = append(flags, "ent.EntIndexUnique")
 				}
+				if (x.flags & fieldIndexReverseLookup) != 0 {
+					flags = append(flags, "ent.EntIndexReverseLookup")
+				}
+				if (x.flags & fieldIndexMulti) != 0 {
+					flags = append(flags, "ent.EntIndexMulti")
+				}
 				if len(flags) == 0 {
 					flags = append(flags, "0")
 				}
 				fieldIndices := genFieldmap(e, x.fields)
-				g.f("{ %#v, %s, %s },\n", x.name, fieldIndices, strings.Join(flags, "|"))
+				whereIndices, scoreIndex := "0", "0"
+				if len(x.where) > 0 {
+					whereIndices = genFieldmap(e, x.where)
+				}
+				if x.score != nil {
+					scoreIndex = genFieldmap(e, []*EntField{x.score})
+				}
+				g.f("{ %#v, %s, %s, %s, %s },\n",
+					x.name, fieldIndices, strings.Join(flags, "|"), whereIndices, scoreIndex)
 			}
 			g.f("}\n\n")
+			g.s("// Symbolic index positions in ent_" + e.sname + "_idx\n")
+			g.s("const (\n")
+			for _, x := range fieldIndexes {
+				g.f("  %s\t= %d\n", indexConstName(e, x), x.index)
+			}
+			g.s(")\n\n")
 			g.f("// EntIndexes returns information about secondary indexes\n")
 			g.f("func (e *%s) EntIndexes() []ent.EntIndex { return ent_%s_idx }\n",
 				e.sname, e.sname)
 		}
 	} // if len(fieldIndexes) > 0
 
+	if log.RootLogger.Level <= log.LevelInfo {
+		// summary of indexes and their lookup functions, to make gaps easy to spot
+		var indexNames []string
+		for _, x := range fieldIndexes {
+			fieldNames := make([]string, len(x.fields))
+			for i, f := range x.fields {
+				fieldNames[i] = f.sname
+			}
+			s := x.name + "(" + strings.Join(fieldNames, ",") + ")"
+			if x.IsUnique() {
+				s += " unique"
+			}
+			if x.IsMulti() {
+				s += " multi"
+			}
+			indexNames = append(indexNames, s)
+		}
+		if len(indexNames) == 0 {
+			log.Info("%s has no indexes", e.sname)
+		} else {
+			sort.Strings(lookupFuncs)
+			log.Info("%s indexes: %s", e.sname, strings.Join(indexNames, ", "))
+			log.Info("%s index lookup functions: %s", e.sname, strings.Join(lookupFuncs, ", "))
+		}
+	}
 	if log.RootLogger.Level <= log.LevelDebug {
 		log.Debug("methods generated for %s:%s", e.sname, fmtMappedNames(generatedMethods))
 	}
@@ -1004,19 +1510,42 @@ func (g *Codegen) typePkgName(t types.Type) string {
 }
 
 func (g *Codegen) scanImportsNeededForEnt(e *EntInfo) {
+	for _, field := range e.fields {
+		for _, pkgPath := range g.typeImports(field.t.Type) {
+			g.addImport(pkgPath)
+		}
+	}
+}
+
+// typeImports returns the paths of packages that code using typ needs to import
+func (g *Codegen) typeImports(typ types.Type) []string {
 	// collect all unique named types which has package information
+	// including types of pointers and elements, e.g. *big.Int and []time.Time
 	uniqueNamedTypes := make(map[*types.Named]*types.TypeName)
-	for _, field := range e.fields {
-		if t, ok := field.t.Type.(*types.Named); ok {
+	var visit func(typ types.Type)
+	visit = func(typ types.Type) {
+		switch t := typ.(type) {
+		case *types.Named:
 			if o := t.Obj(); o != nil {
 				if o.Pkg() != nil {
 					uniqueNamedTypes[t] = o
 				}
 			}
+		case *types.Pointer:
+			visit(t.Elem())
+		case *types.Slice:
+			visit(t.Elem())
+		case *types.Array:
+			visit(t.Elem())
+		case *types.Map:
+			visit(t.Key())
+			visit(t.Elem())
 		}
 	}
+	visit(typ)
 
 	// for each unique named type...
+	var pkgPaths []string
 	ePkgPath := g.pkg.Types.Path()
 	for _, o := range uniqueNamedTypes {
 		pkg := o.Pkg() // note: never nil
@@ -1024,9 +1553,30 @@ func (g *Codegen) scanImportsNeededForEnt(e *EntInfo) {
 		// 	o.Id(), o.Name(), pkg.Name(), pkg.Path())
 		pkgPath := pkg.Path()
 		if pkgPath != ePkgPath && pkgPath != g.entpkgPath {
-			g.imports = append(g.imports, PkgImport{Path: pkgPath})
+			pkgPaths = append(pkgPaths, pkgPath)
 		}
 	}
+	return pkgPaths
+}
+
+// addImport adds pkgPath to the packages imported by the generated code
+func (g *Codegen) addImport(pkgPath string) {
+	g.imports = addPkgImport(g.imports, pkgPath)
+}
+
+// addPkgImport returns imports with pkgPath added, unless it's already in imports
+func addPkgImport(imports []PkgImport, pkgPath string) []PkgImport {
+	for _, im := range imports {
+		if im.Path == pkgPath && im.Name == "" {
+			return imports
+		}
+	}
+	return append(imports, PkgImport{Path: pkgPath})
+}
+
+// indexConstName returns the name of the constant of the position of x in ent_TYPE_idx
+func indexConstName(e *EntInfo, x *EntFieldIndex) string {
+	return "ent_" + e.sname + "_idx_" + x.name
 }
 
 func (g *Codegen) genEntFields(e *EntInfo) {
@@ -1054,6 +1604,41 @@ func (g *Codegen) genEntFields(e *EntInfo) {
 
 	g.f("// EntFields returns information about %s fields\n", e.sname)
 	g.f("func (e %s) EntFields() ent.Fields { return ent_%s_fields }\n", e.sname, e.sname)
+
+	g.genEntJsonNames(e)
+}
+
+// genEntJsonNames generates EntJsonNames (see ent.JsonNamer) for ents with fields which have a
+// json tag in addition to an ent tag, e.g. `ent:"w" json:"width"`
+func (g *Codegen) genEntJsonNames(e *EntInfo) {
+	var fields []*EntField
+	jsonNames := map[string]*EntField{} // JSON name => field
+	for _, field := range e.fields {
+		jsonName := field.name
+		if field.jsonName != "" {
+			fields = append(fields, field)
+			jsonName = field.jsonName
+		}
+		if other := jsonNames[jsonName]; other != nil {
+			e.logSrcErr(field.pos, "JSON name %q of field %s.%s is also used by field %s",
+				jsonName, e.sname, field.sname, other.sname)
+		}
+		jsonNames[jsonName] = field
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	g.f("\n// JSON names of %s fields which differ from their storage names\n", e.sname)
+	g.f("var ent_%s_jsonNames = map[string]string{\n", e.sname)
+	for _, field := range fields {
+		g.f("  %#v:\t%#v,\n", field.name, field.jsonName)
+	}
+	g.f("}\n\n")
+	g.f("// EntJsonNames returns the JSON names of %s fields which differ from their storage\n"+
+		"// names. Used by ent.JsonEncode and ent.JsonDecode (see ent.JsonNamer)\n", e.sname)
+	g.f("func (e %s) EntJsonNames() map[string]string { return ent_%s_jsonNames }\n",
+		e.sname, e.sname)
 }
 
 func genFieldmap(e *EntInfo, fields []*EntField) string {
@@ -1069,12 +1654,14 @@ func genFieldmap(e *EntInfo, fields []*EntField) string {
 
 func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 	svar, cvar, rvar, evar, errvar, tmpvar := "s", "c", "r", "e", "err", "v"
+	ctxvar := "ctx"
 	limitvar, flagsarg := "limit", "fl"
+	cursorvar, nextvar := "cursor", "next"
 
 	// package names
 	var pkgnames map[string]struct{}
 	for _, f := range fx.fields {
-		if pkgname := g.typePkgName(f.t.Type); pkgname != "" {
+		if pkgname := g.typePkgName(indexKeyType(fx, f)); pkgname != "" {
 			if pkgnames == nil {
 				pkgnames = make(map[string]struct{})
 			}
@@ -1088,7 +1675,7 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 	argchunks := make([]string, 0, len(fx.fields))
 	argnames := make([]string, 0, len(fx.fields))
 	for i, f := range fx.fields {
-		goType := g.goTypeName(f.t.Type)
+		goType := g.goTypeName(indexKeyType(fx, f))
 		if prevGoType == goType {
 			argchunks = append(argchunks[:i-1], inverseCapitalize(fx.fields[i-1].sname))
 		}
@@ -1118,11 +1705,33 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 			limitvar = "_" + limitvar
 		} else if argname == flagsarg {
 			flagsarg = "_" + flagsarg
+		} else if argname == ctxvar {
+			ctxvar = "_" + ctxvar
+		} else if argname == cursorvar {
+			cursorvar = "_" + cursorvar
+		} else if argname == nextvar {
+			nextvar = "_" + nextvar
 		}
 	}
 
+	// xref is the expression of fx in ent_TYPE_idx, e.g. "ent_Account_idx[ent_Account_idx_email]"
+	xref := fmt.Sprintf("ent_%s_idx[%s]", e.sname, indexConstName(e, fx))
+
 	// fieldIndices := genFieldmap(e, fx.fields)
 	params := strings.Join(argchunks, ", ")
+	args := strings.Join(argnames, ", ")
+
+	// genContextFunc generates a variant of function fname with a context.Context parameter.
+	// Every lookup function has such a variant, so this also records both as generated.
+	genContextFunc := func(fname, params, args, results string) {
+		g.generatedFunctions[fname] = true
+		g.generatedFunctions[fname+"Context"] = true
+		g.f("// %sContext is like %s but with ctx (see ent.WithContext)\n", fname, fname)
+		g.f("func %sContext(%s context.Context, %s ent.Storage, %s) %s\t{\n",
+			fname, ctxvar, svar, params, results)
+		g.f("  return %s(ent.WithContext(%s, %s), %s)\n", fname, ctxvar, svar, args)
+		g.s("}\n\n")
+	}
 
 	var argsComment string
 	if len(fx.fields) == 1 {
@@ -1130,17 +1739,36 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 	} else {
 		argsComment = "matching " + strings.Join(argnames, " AND ")
 	}
+	if len(fx.where) > 0 {
+		// partial index
+		var names []string
+		for _, f := range fx.where {
+			names = append(names, f.sname)
+		}
+		argsComment += " where " + strings.Join(names, " AND ")
+	}
 
-	// use an optimization where the index query is a single field that is a string or byte slice
+	// use an optimization where the index query is a single field that is a string, byte slice
+	// or byte array, e.g. a UUID (for a multi-entry index, the element type of the field)
+	keyType0 := indexKeyType(fx, fx.fields[0])
 	useSingleStringKeyOpt := len(fx.fields) == 1 &&
-		(isStringType(fx.fields[0].t.Type) || isByteSliceType(fx.fields[0].t.Type))
+		(isStringType(keyType0) || isByteSliceType(keyType0) ||
+			(isByteArrayType(keyType0) && fx.fields[0].codec == nil))
 
 	// arg0 is used by useSingleStringKeyOpt and is argnames[0] as []byte
 	var arg0 string
 	if useSingleStringKeyOpt {
 		arg0 = argnames[0]
-		if isStringType(fx.fields[0].t.Type) {
+		if fx.fields[0].foldIndexKey {
+			if _, cast := g.unwrapNamedType(keyType0); cast != "" {
+				arg0 = wrapstr(arg0, "string")
+			}
+			arg0 = "ent.FoldIndexKey(" + arg0 + ")"
+		}
+		if isStringType(keyType0) {
 			arg0 = "[]byte(" + arg0 + ")"
+		} else if isByteArrayType(keyType0) {
+			arg0 += "[:]"
 		}
 	}
 
@@ -1149,8 +1777,17 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 	if !useSingleStringKeyOpt {
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "func(%s ent.Encoder) {\n", cvar)
+		// fx.fields are in declaration order, which is the order EntEncode encodes them in and
+		// thus the order of the fields in the index key
 		for i, f := range fx.fields {
-			expr, err := g.genFieldEncoder(f, cvar, argnames[i])
+			var expr string
+			var err error
+			if fx.IsMulti() {
+				// lookup of a single element
+				expr, err = g.encoderExpr(keyType0, cvar, argnames[i])
+			} else {
+				expr, err = g.genFieldEncoder(f, cvar, argnames[i])
+			}
 			if err != nil {
 				return err
 			}
@@ -1172,14 +1809,54 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 			fname, svar, params, flagsarg, e.sname)
 		g.f("  %s := &%s{}\n", evar, e.sname)
 		if useSingleStringKeyOpt {
-			g.f("  %s := ent.LoadEntByIndexKey(%s, %s, &ent_%s_idx[%d], %s, %s)\n",
-				errvar, svar, evar, e.sname, fx.index, arg0, flagsarg)
+			g.f("  %s := ent.LoadEntByIndexKey(%s, %s, &%s, %s, %s)\n",
+				errvar, svar, evar, xref, arg0, flagsarg)
 		} else {
-			g.f("  %s := ent.LoadEntByIndex(%s, %s, &ent_%s_idx[%d], %s, %d, %s)\n",
-				errvar, svar, evar, e.sname, fx.index, flagsarg, len(fx.fields), keyEncoderCode)
+			g.f("  %s := ent.LoadEntByIndex(%s, %s, &%s, %s, %d, %s)\n",
+				errvar, svar, evar, xref, flagsarg, len(fx.fields), keyEncoderCode)
 		}
 		g.f("  return %s, %s\n", evar, errvar)
 		g.s("}\n\n")
+		genContextFunc(fname, params+", "+flagsarg+" ...ent.LookupFlags", args+", "+flagsarg+"...",
+			"(*"+e.sname+", error)")
+
+		// LoadOrCreate__By__
+		if !fx.IsMulti() && len(fx.where) == 0 {
+			fname = "LoadOrCreate" + e.sname + "By" + capitalize(fx.name)
+			initvar, createdvar := "init", "created"
+			for _, argname := range argnames {
+				if argname == initvar {
+					initvar = "_" + initvar
+				} else if argname == createdvar {
+					createdvar = "_" + createdvar
+				}
+			}
+			g.f("// %s loads %s %s or, if there is no such ent, creates it.\n"+
+				"// %s is called with the new ent, which has %s set, before it is created and\n"+
+				"// may be nil. Returns true if the ent was created.\n",
+				fname, e.sname, argsComment, initvar, strings.Join(argnames, " and "))
+			g.f("func %s(%s ent.Storage, %s, %s func(%s *%s)) (*%s, bool, error)\t{\n",
+				fname, svar, params, initvar, evar, e.sname, e.sname)
+			g.f("  %s := &%s{}\n", evar, e.sname)
+			initFunc := "func() {\n"
+			for i, f := range fx.fields {
+				initFunc += fmt.Sprintf("    %s.%s = %s\n", evar, f.sname, argnames[i])
+			}
+			initFunc += fmt.Sprintf("    if %s != nil {\n      %s(%s)\n    }\n  }",
+				initvar, initvar, evar)
+			if useSingleStringKeyOpt {
+				g.f("  %s, %s := ent.LoadOrCreate(%s, %s, &%s, %s, %s)\n",
+					createdvar, errvar, evar, svar, xref, arg0, initFunc)
+			} else {
+				g.f("  %s, %s := ent.LoadOrCreateByIndex(%s, %s, &%s, %s, %d, %s)\n",
+					createdvar, errvar,
+					evar, svar, xref, initFunc, len(fx.fields), keyEncoderCode)
+			}
+			g.f("  return %s, %s, %s\n", evar, createdvar, errvar)
+			g.s("}\n\n")
+			genContextFunc(fname, params+", "+initvar+" func("+evar+" *"+e.sname+")",
+				args+", "+initvar, "(*"+e.sname+", bool, error)")
+		}
 	} else {
 		sliceCast, err := g.getEntSliceCastHelper(e)
 		if err != nil {
@@ -1190,15 +1867,45 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 			fname, svar, params, limitvar, flagsarg, e.sname)
 		g.f("  %s := &%s{}\n", evar, e.sname)
 		if useSingleStringKeyOpt {
-			g.f("  %s, %s := ent.LoadEntsByIndexKey(%s, %s, &ent_%s_idx[%d], %s, %s, %s)\n",
-				rvar, errvar, svar, evar, e.sname, fx.index, arg0, limitvar, flagsarg)
+			g.f("  %s, %s := ent.LoadEntsByIndexKey(%s, %s, &%s, %s, %s, %s)\n",
+				rvar, errvar, svar, evar, xref, arg0, limitvar, flagsarg)
 		} else {
-			g.f("  %s, %s := ent.LoadEntsByIndex(%s, %s, &ent_%s_idx[%d], %s, %s, %d, %s)\n",
+			g.f("  %s, %s := ent.LoadEntsByIndex(%s, %s, &%s, %s, %s, %d, %s)\n",
 				rvar, errvar,
-				svar, evar, e.sname, fx.index, limitvar, flagsarg, len(fx.fields), keyEncoderCode)
+				svar, evar, xref, limitvar, flagsarg, len(fx.fields), keyEncoderCode)
 		}
 		g.f("  return %s(%s), %s\n", sliceCast, rvar, errvar)
 		g.s("}\n\n")
+		genContextFunc(fname,
+			params+", "+limitvar+" int, "+flagsarg+" ...ent.LookupFlags",
+			args+", "+limitvar+", "+flagsarg+"...",
+			"([]*"+e.sname+", error)")
+
+		// Load__By__Paged
+		fname += "Paged"
+		g.f("// %s loads a page of at most %s %s ents %s, starting after %s.\n"+
+			"// Pass a nil %s for the first page. The returned cursor is nil after the last page.\n",
+			fname, limitvar, e.sname, argsComment, cursorvar, cursorvar)
+		g.f("func %s(%s ent.Storage, %s, %s []byte, %s int, %s ...ent.LookupFlags) "+
+			"([]*%s, []byte, error)\t{\n",
+			fname, svar, params, cursorvar, limitvar, flagsarg, e.sname)
+		g.f("  %s := &%s{}\n", evar, e.sname)
+		if useSingleStringKeyOpt {
+			g.f("  %s, %s, %s := ent.LoadEntsByIndexKeyPaged(%s, %s, &%s, %s, %s, %s, %s)\n",
+				rvar, nextvar, errvar,
+				svar, evar, xref, arg0, cursorvar, limitvar, flagsarg)
+		} else {
+			g.f("  %s, %s, %s := ent.LoadEntsByIndexPaged(%s, %s, &%s, %s, %s, %s, %d, %s)\n",
+				rvar, nextvar, errvar,
+				svar, evar, xref, cursorvar, limitvar, flagsarg, len(fx.fields),
+				keyEncoderCode)
+		}
+		g.f("  return %s(%s), %s, %s\n", sliceCast, rvar, nextvar, errvar)
+		g.s("}\n\n")
+		genContextFunc(fname,
+			params+", "+cursorvar+" []byte, "+limitvar+" int, "+flagsarg+" ...ent.LookupFlags",
+			args+", "+cursorvar+", "+limitvar+", "+flagsarg+"...",
+			"([]*"+e.sname+", []byte, error)")
 	}
 
 	//
@@ -1209,23 +1916,213 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 		g.f("func %s(%s ent.Storage, %s, %s ...ent.LookupFlags) (uint64, error)\t{\n",
 			fname, svar, params, flagsarg)
 		if useSingleStringKeyOpt {
-			g.f("  return ent.FindIdByIndexKey(%s, %#v, &ent_%s_idx[%d], %s, %s)\n",
-				svar, e.name, e.sname, fx.index, arg0, flagsarg)
+			g.f("  return ent.FindIdByIndexKey(%s, %#v, &%s, %s, %s)\n",
+				svar, e.name, xref, arg0, flagsarg)
 		} else {
-			g.f("  return ent.FindIdByIndex(%s, %#v, &ent_%s_idx[%d], %s, %d, %s)\n",
-				svar, e.name, e.sname, fx.index, flagsarg, len(fx.fields), keyEncoderCode)
+			g.f("  return ent.FindIdByIndex(%s, %#v, &%s, %s, %d, %s)\n",
+				svar, e.name, xref, flagsarg, len(fx.fields), keyEncoderCode)
 		}
 		g.s("}\n\n")
+		genContextFunc(fname, params+", "+flagsarg+" ...ent.LookupFlags", args+", "+flagsarg+"...",
+			"(uint64, error)")
 	} else {
 		g.f("// %s looks up %s ids %s\n", fname, e.sname, argsComment)
 		g.f("func %s(%s ent.Storage, %s, %s int, %s ...ent.LookupFlags) ([]uint64, error)\t{\n",
 			fname, svar, params, limitvar, flagsarg)
 		if useSingleStringKeyOpt {
-			g.f("  return ent.FindIdsByIndexKey(%s, %#v, &ent_%s_idx[%d], %s, %s, %s)\n",
-				svar, e.name, e.sname, fx.index, arg0, limitvar, flagsarg)
+			g.f("  return ent.FindIdsByIndexKey(%s, %#v, &%s, %s, %s, %s)\n",
+				svar, e.name, xref, arg0, limitvar, flagsarg)
+		} else {
+			g.f("  return ent.FindIdsByIndex(%s, %#v, &%s, %s, %s, %d, %s)\n",
+				svar, e.name, xref, limitvar, flagsarg, len(fx.fields), keyEncoderCode)
+		}
+		g.s("}\n\n")
+		genContextFunc(fname,
+			params+", "+limitvar+" int, "+flagsarg+" ...ent.LookupFlags",
+			args+", "+limitvar+", "+flagsarg+"...",
+			"([]uint64, error)")
+	}
+
+	//
+	// Count__By__
+	fname = "Count" + e.sname + "By" + capitalize(fx.name)
+	g.f("// %s returns the number of %s ents %s\n", fname, e.sname, argsComment)
+	g.f("func %s(%s ent.Storage, %s) (int, error)\t{\n", fname, svar, params)
+	if useSingleStringKeyOpt {
+		g.f("  return ent.CountByIndexKey(%s, %#v, &%s, %s)\n",
+			svar, e.name, xref, arg0)
+	} else {
+		g.f("  return ent.CountByIndex(%s, %#v, &%s, %d, %s)\n",
+			svar, e.name, xref, len(fx.fields), keyEncoderCode)
+	}
+	g.s("}\n\n")
+	genContextFunc(fname, params, args, "(int, error)")
+
+	//
+	// Delete__By__
+	fname = "Delete" + e.sname + "By" + capitalize(fx.name)
+	g.f("// %s permanently deletes all %s ents %s.\n"+
+		"// Returns the number of ents deleted.\n", fname, e.sname, argsComment)
+	g.f("func %s(%s ent.Storage, %s) (int, error)\t{\n", fname, svar, params)
+	if useSingleStringKeyOpt {
+		g.f("  return ent.DeleteEntsByIndexKey(%s, &%s{}, &%s, %s)\n",
+			svar, e.sname, xref, arg0)
+	} else {
+		g.f("  return ent.DeleteEntsByIndex(%s, &%s{}, &%s, %d, %s)\n",
+			svar, e.sname, xref, len(fx.fields), keyEncoderCode)
+	}
+	g.s("}\n\n")
+	genContextFunc(fname, params, args, "(int, error)")
+
+	//
+	// Find__By__Range, Load__By__Range
+	// Only for indexes which keys sort like their values do (see ent.FindIdsByIndexKeyRange)
+	if len(fx.fields) == 1 && fx.fields[0].codec == nil &&
+		(isUnsignedIntType(fx.fields[0].t.Type) || isBigIntType(fx.fields[0].t.Type)) {
+		f := fx.fields[0]
+		goType := g.goTypeName(f.t.Type)
+		var rangeEncoderCode [2]string
+		for i, argname := range []string{"min", "max"} {
+			expr, err := g.genFieldEncoder(f, cvar, argname)
+			if err != nil {
+				return err
+			}
+			rangeEncoderCode[i] = fmt.Sprintf("func(%s ent.Encoder) { %s }", cvar, expr)
+		}
+		rangeParams := "min, max " + goType + ", " + limitvar + " int, " + flagsarg + " ...ent.LookupFlags"
+		rangeArgs := "min, max, " + limitvar + ", " + flagsarg + "..."
+
+		fname = "Find" + e.sname + "By" + capitalize(fx.name) + "Range"
+		g.f("// %s looks up %s ids with %s in the range [min, max]\n",
+			fname, e.sname, argnames[0])
+		g.f("func %s(%s ent.Storage, %s) ([]uint64, error)\t{\n", fname, svar, rangeParams)
+		g.f("  return ent.FindIdsByIndexRange(%s, %#v, &%s, %s, %s, 1,\n    %s,\n    %s)\n",
+			svar, e.name, xref, limitvar, flagsarg,
+			rangeEncoderCode[0], rangeEncoderCode[1])
+		g.s("}\n\n")
+		genContextFunc(fname, rangeParams, rangeArgs, "([]uint64, error)")
+
+		sliceCast, err := g.getEntSliceCastHelper(e)
+		if err != nil {
+			return err
+		}
+		fname = "Load" + e.sname + "By" + capitalize(fx.name) + "Range"
+		g.f("// %s loads %s ents with %s in the range [min, max]\n",
+			fname, e.sname, argnames[0])
+		g.f("func %s(%s ent.Storage, %s) ([]*%s, error)\t{\n",
+			fname, svar, rangeParams, e.sname)
+		g.f("  %s := &%s{}\n", evar, e.sname)
+		g.f("  %s, %s := ent.LoadEntsByIndexRange(%s, %s, &%s, %s, %s, 1,\n"+
+			"    %s,\n    %s)\n",
+			rvar, errvar, svar, evar, xref, limitvar, flagsarg,
+			rangeEncoderCode[0], rangeEncoderCode[1])
+		g.f("  return %s(%s), %s\n", sliceCast, rvar, errvar)
+		g.s("}\n\n")
+		genContextFunc(fname, rangeParams, rangeArgs, "([]*"+e.sname+", error)")
+	}
+
+	//
+	// Find__By__Prefix, Load__By__Prefix
+	// Only for indexes of a single string field (see ent.FindIdsByIndexKeyPrefix)
+	if len(fx.fields) == 1 && !fx.IsMulti() && fx.fields[0].codec == nil && isStringType(keyType0) {
+		prefixArg := "[]byte(prefix)"
+		if fx.fields[0].foldIndexKey {
+			prefixArg = "[]byte(ent.FoldIndexKey(prefix))"
+		}
+		prefixParams := "prefix string, " + limitvar + " int, " + flagsarg + " ...ent.LookupFlags"
+		prefixArgs := "prefix, " + limitvar + ", " + flagsarg + "..."
+		var prefixNote string
+		if fx.IsUnique() {
+			prefixNote = "// Note: the redis storage scans all keys of a unique index for this lookup.\n"
+		}
+
+		fname = "Find" + e.sname + "By" + capitalize(fx.name) + "Prefix"
+		g.f("// %s looks up %s ids with %s starting with prefix, ordered by %s\n",
+			fname, e.sname, argnames[0], argnames[0])
+		g.s(prefixNote)
+		g.f("func %s(%s ent.Storage, %s) ([]uint64, error)\t{\n", fname, svar, prefixParams)
+		g.f("  return ent.FindIdsByIndexKeyPrefix(%s, %#v, &%s, %s, %s, %s)\n",
+			svar, e.name, xref, prefixArg, limitvar, flagsarg)
+		g.s("}\n\n")
+		genContextFunc(fname, prefixParams, prefixArgs, "([]uint64, error)")
+
+		sliceCast, err := g.getEntSliceCastHelper(e)
+		if err != nil {
+			return err
+		}
+		fname = "Load" + e.sname + "By" + capitalize(fx.name) + "Prefix"
+		g.f("// %s loads %s ents with %s starting with prefix, ordered by %s\n",
+			fname, e.sname, argnames[0], argnames[0])
+		g.s(prefixNote)
+		g.f("func %s(%s ent.Storage, %s) ([]*%s, error)\t{\n",
+			fname, svar, prefixParams, e.sname)
+		g.f("  %s := &%s{}\n", evar, e.sname)
+		g.f("  %s, %s := ent.LoadEntsByIndexKeyPrefix(%s, %s, &%s, %s, %s, %s)\n",
+			rvar, errvar, svar, evar, xref, prefixArg, limitvar, flagsarg)
+		g.f("  return %s(%s), %s\n", sliceCast, rvar, errvar)
+		g.s("}\n\n")
+		genContextFunc(fname, prefixParams, prefixArgs, "([]*"+e.sname+", error)")
+	}
+
+	//
+	// Find__By__ScoreRange, Load__By__ScoreRange
+	if fx.score != nil {
+		scoreParams := params + ", min, max float64, " + limitvar + " int, " +
+			flagsarg + " ...ent.LookupFlags"
+		scoreArgs := args + ", min, max, " + limitvar + ", " + flagsarg + "..."
+
+		fname = "Find" + e.sname + "By" + capitalize(fx.name) + "ScoreRange"
+		g.f("// %s looks up %s ids %s which %s is in the range [min, max],\n"+
+			"// ordered by %s\n", fname, e.sname, argsComment, fx.score.sname, fx.score.sname)
+		g.f("func %s(%s ent.Storage, %s) ([]uint64, error)\t{\n", fname, svar, scoreParams)
+		if useSingleStringKeyOpt {
+			g.f("  return ent.FindIdsByIndexKeyScoreRange(%s, %#v, &%s, %s, min, max, "+
+				"%s, %s)\n", svar, e.name, xref, arg0, limitvar, flagsarg)
+		} else {
+			g.f("  return ent.FindIdsByIndexScoreRange(%s, %#v, &%s, min, max, %s, %s, "+
+				"%d, %s)\n", svar, e.name, xref, limitvar, flagsarg, len(fx.fields),
+				keyEncoderCode)
+		}
+		g.s("}\n\n")
+		genContextFunc(fname, scoreParams, scoreArgs, "([]uint64, error)")
+
+		sliceCast, err := g.getEntSliceCastHelper(e)
+		if err != nil {
+			return err
+		}
+		fname = "Load" + e.sname + "By" + capitalize(fx.name) + "ScoreRange"
+		g.f("// %s loads %s ents %s which %s is in the range [min, max],\n"+
+			"// ordered by %s\n", fname, e.sname, argsComment, fx.score.sname, fx.score.sname)
+		g.f("func %s(%s ent.Storage, %s) ([]*%s, error)\t{\n", fname, svar, scoreParams, e.sname)
+		g.f("  %s := &%s{}\n", evar, e.sname)
+		if useSingleStringKeyOpt {
+			g.f("  %s, %s := ent.LoadEntsByIndexKeyScoreRange(%s, %s, &%s, %s, min, max, "+
+				"%s, %s)\n", rvar, errvar, svar, evar, xref, arg0, limitvar, flagsarg)
 		} else {
-			g.f("  return ent.FindIdsByIndex(%s, %#v, &ent_%s_idx[%d], %s, %s, %d, %s)\n",
-				svar, e.name, e.sname, fx.index, limitvar, flagsarg, len(fx.fields), keyEncoderCode)
+			g.f("  %s, %s := ent.LoadEntsByIndexScoreRange(%s, %s, &%s, min, max, %s, %s, "+
+				"%d, %s)\n", rvar, errvar, svar, evar, xref, limitvar, flagsarg,
+				len(fx.fields), keyEncoderCode)
+		}
+		g.f("  return %s(%s), %s\n", sliceCast, rvar, errvar)
+		g.s("}\n\n")
+		genContextFunc(fname, scoreParams, scoreArgs, "([]*"+e.sname+", error)")
+	}
+
+	//
+	// List__Keys (keys of other indexes are encoded and not meaningful on their own)
+	if useSingleStringKeyOpt {
+		fname = "List" + e.sname + capitalize(fx.name) + "Keys"
+		g.generatedFunctions[fname] = true
+		g.f("// %s returns all %s values of %s ents, in sorted order\n",
+			fname, argnames[0], e.sname)
+		if isStringType(keyType0) {
+			g.f("func %s(%s ent.Storage) ([]string, error)\t{\n", fname, svar)
+			g.f("  return ent.ListIndexKeyStrings(%s, %#v, &%s)\n",
+				svar, e.name, xref)
+		} else {
+			g.f("func %s(%s ent.Storage) ([][]byte, error)\t{\n", fname, svar)
+			g.f("  return %s.ListIndexKeys(%#v, &%s)\n",
+				svar, e.name, xref)
 		}
 		g.s("}\n\n")
 	}
@@ -1233,6 +2130,99 @@ func (g *Codegen) genFindTYPEByINDEX(e *EntInfo, fx *EntFieldIndex) error {
 	return nil
 }
 
+// genFindTYPEWhere generates a TYPEQuery struct with a field for each single-field index of e
+// and a FindTYPEWhere function which intersects the results of looking up each non-nil field
+// of a query with the FindTYPEByINDEX functions generated by genFindTYPEByINDEX.
+// Returns the name of the function, or "" if e has no such indexes.
+func (g *Codegen) genFindTYPEWhere(e *EntInfo, fieldIndexes []*EntFieldIndex) string {
+	// partial indexes are left out since they only have entries for some ents
+	var indexes []*EntFieldIndex
+	for _, fx := range fieldIndexes {
+		if len(fx.fields) == 1 && len(fx.where) == 0 {
+			indexes = append(indexes, fx)
+		}
+	}
+	if len(indexes) == 0 {
+		return ""
+	}
+	qname := e.sname + "Query"
+	fname := "Find" + e.sname + "Where"
+	g.generatedFunctions[fname] = true
+	g.generatedFunctions[fname+"Context"] = true
+
+	// TYPEQuery
+	g.f("// %s is a query for %s. Each non-nil field constrains the result to ents\n"+
+		"// with that value in the index of the same name.\n", qname, fname)
+	g.f("type %s struct {\n", qname)
+	for _, fx := range indexes {
+		f := fx.fields[0]
+		goType := g.goTypeName(indexKeyType(fx, f))
+		if _, ok := indexKeyType(fx, f).(*types.Pointer); !ok {
+			goType = "*" + goType
+		}
+		if fx.IsMulti() {
+			g.f("  %s %s // an element of %s\n", capitalize(fx.name), goType, f.sname)
+		} else {
+			g.f("  %s %s\n", capitalize(fx.name), goType)
+		}
+	}
+	g.s("}\n\n")
+
+	// FindTYPEWhere
+	g.f("// %s looks up ids of %s ents matching all non-nil fields of q, by intersecting\n"+
+		"// the results of looking up each field in its index. The returned ids are sorted in\n"+
+		"// ascending order. A query without any non-nil fields matches no ents.\n", fname, e.sname)
+	g.f("func %s(s ent.Storage, q %s, fl ...ent.LookupFlags) ([]uint64, error)\t{\n",
+		fname, qname)
+	g.s("  var ids ent.IdSet\n")
+	g.s("  n := 0 // number of constraints applied to ids\n")
+	g.s("  intersect := func(v []uint64) bool {\n" +
+		"    r := ent.IdSet(v)\n" +
+		"    r.Sort()\n" +
+		"    if n > 0 {\n" +
+		"      r = ids.Intersect(r)\n" +
+		"    }\n" +
+		"    ids = r\n" +
+		"    n++\n" +
+		"    return len(ids) > 0\n" +
+		"  }\n")
+	for _, fx := range indexes {
+		field := capitalize(fx.name)
+		arg := "*q." + field
+		if _, ok := indexKeyType(fx, fx.fields[0]).(*types.Pointer); ok {
+			arg = "q." + field
+		}
+		g.f("  if q.%s != nil {\n", field)
+		if fx.IsUnique() {
+			g.f("    id, err := Find%sBy%s(s, %s, fl...)\n", e.sname, field, arg)
+		} else {
+			g.f("    v, err := Find%sBy%s(s, %s, 0, fl...)\n", e.sname, field, arg)
+		}
+		g.s("    if err == ent.ErrNotFound {\n" +
+			"      return nil, nil\n" +
+			"    } else if err != nil {\n" +
+			"      return nil, err\n" +
+			"    }\n")
+		if fx.IsUnique() {
+			g.s("    if !intersect([]uint64{id}) {\n")
+		} else {
+			g.s("    if !intersect(v) {\n")
+		}
+		g.s("      return nil, nil\n" +
+			"    }\n" +
+			"  }\n")
+	}
+	g.s("  return ids, nil\n")
+	g.s("}\n\n")
+
+	g.f("// %sContext is like %s but with ctx (see ent.WithContext)\n", fname, fname)
+	g.f("func %sContext(ctx context.Context, s ent.Storage, q %s, fl ...ent.LookupFlags) "+
+		"([]uint64, error)\t{\n", fname, qname)
+	g.f("  return %s(ent.WithContext(ctx, s), q, fl...)\n", fname)
+	g.s("}\n\n")
+	return fname
+}
+
 func (g *Codegen) getEntSliceCastHelper(e *EntInfo) (string, error) {
 	fname := fmt.Sprintf("ent_%s_slice_cast", e.sname)
 	err := g.getOrBuildHelper(fname, "c", nil,
@@ -1255,11 +2245,20 @@ func (g *Codegen) getEntSliceCastHelper(e *EntInfo) (string, error) {
 func (g *Codegen) genEntDecode(e *EntInfo, mname string) error {
 	g.f("\n// %s populates fields from a decoder\n", mname)
 	g.f("func (e *%s) %s(c ent.Decoder) (id, version uint64) {\n", e.sname, mname)
-	g.s("  for {\n")
-	g.s("    switch string(c.Key()) {\n")
+	if e.keepUnknownFields {
+		g.s("  e.EntBase.ClearEntUnknownFields()\n")
+		g.s("  for {\n")
+		g.s("    switch k := string(c.Key()); k {\n")
+	} else {
+		g.s("  for {\n")
+		g.s("    switch string(c.Key()) {\n")
+	}
 	g.s("    case \"\": return\n")
 	g.s("    case ent.FieldNameId:  id = c.Uint(64)\n")
 	g.s("    case ent.FieldNameVersion:  version = c.Uint(64)\n")
+	if e.trackFieldVersions {
+		g.s("    case ent.FieldNameFieldVersions:  e.EntBase.DecodeEntFieldVersions(c)\n")
+	}
 	for _, field := range e.fields {
 		g.pushPos(field.pos)
 		g.f("    case %#v:\n", field.name)
@@ -1269,7 +2268,11 @@ func (g *Codegen) genEntDecode(e *EntInfo, mname string) error {
 			return err
 		}
 	}
-	g.s("    default:  c.Discard()\n")
+	if e.keepUnknownFields {
+		g.s("    default:  e.EntBase.DecodeEntUnknownField(c, k)\n")
+	} else {
+		g.s("    default:  c.Discard()\n")
+	}
 	g.s("    }\n")
 	g.s("  }\n")
 	g.s("  return\n")
@@ -1278,18 +2281,21 @@ func (g *Codegen) genEntDecode(e *EntInfo, mname string) error {
 }
 
 func (g *Codegen) genEntDecodePartial(e *EntInfo, mname string) error {
+	// indexed fields, fields of partial index predicates and the soft-delete marker, which
+	// index updates depend on
 	var indexedFields []*EntField
 	for _, field := range e.fields {
-		if field.storageIndex != nil {
+		if field.storageIndex != nil || field.isIndexWhere || field == e.softDeleteField {
 			indexedFields = append(indexedFields, field)
 		}
 	}
 	g.f("\n// %s is used internally by ent.Storage during updates.\n", mname)
 	g.f("func (e *%s) %s(c ent.Decoder, fields ent.FieldSet) (version uint64) {\n", e.sname, mname)
-	g.f("  for n := %d; n > 0; {\n", len(indexedFields))
+	// n counts the version field too, so that ents without indexed fields still decode version
+	g.f("  for n := %d; n > 0; {\n", len(indexedFields)+1)
 	g.s("    switch string(c.Key()) {\n")
 	g.s("    case \"\": return\n")
-	g.s("    case ent.FieldNameVersion: version = c.Uint(64); continue\n")
+	g.s("    case ent.FieldNameVersion: n--; version = c.Uint(64); continue\n")
 	for _, field := range indexedFields {
 		g.pushPos(field.pos)
 		g.f("    case %#v:\n", field.name)
@@ -1313,6 +2319,71 @@ func (g *Codegen) genEntDecodePartial(e *EntInfo, mname string) error {
 
 // —————————————————————————————————————————————————————————————————————————————————————————
 
+// genRefMethods generates methods for a field with the tag "ref=Type", which holds the id of
+// an ent of Type: LoadREF loads the ent and SetREF sets the field to its id, where REF is the
+// name of the field without an "Id" suffix, e.g. LoadOwner and SetOwner for a field "ownerId".
+func (g *Codegen) genRefMethods(
+	e *EntInfo, field *EntField, setterPrefix string,
+	methodIsUndefined func(string) bool, generatedMethods map[string]bool,
+) {
+	var ref *EntInfo
+	for _, e2 := range g.ents {
+		if e2.sname == field.ref {
+			ref = e2
+			break
+		}
+	}
+	if ref == nil {
+		g.logSrcErrAt(field.pos,
+			"ref=%s of field %s is not an ent type of this package", field.ref, field.sname)
+		return
+	}
+	if t, ok := field.t.Type.Underlying().(*types.Basic); !ok || t.Kind() != types.Uint64 {
+		g.logSrcErrAt(field.pos,
+			"field %s with ref=%s must be of type uint64, the type of ent ids",
+			field.sname, ref.sname)
+		return
+	}
+
+	name := field.uname
+	if n := len(name) - 2; n > 0 && (name[n:] == "Id" || name[n:] == "ID") {
+		name = name[:n]
+	} else {
+		name += "Ent" // e.g. "SetOwnerEnt" since "SetOwner" is the setter of the field
+	}
+
+	mname := "Load" + name
+	if methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s loads the %s which id is %s\n"+
+			"func (e *%s) %s(storage ent.Storage, fl ...ent.LookupFlags) (*%s, error)\t{\n"+
+			"  return Load%sById(storage, e.%s, fl...)\n"+
+			"}\n\n",
+			mname, ref.sname, field.sname,
+			e.sname, mname, ref.sname,
+			ref.sname, field.sname)
+	}
+	mname = setterPrefix + name
+	if !field.noSetter && methodIsUndefined(mname) {
+		generatedMethods[mname] = true
+		g.f("// %s sets %s to the id of v, or to 0 if v is nil\n"+
+			"func (e *%s) %s(v *%s)\t{\n"+
+			"  if v == nil {\n"+
+			"    e.%s = 0\n"+
+			"  } else {\n"+
+			"    e.%s = v.Id()\n"+
+			"  }\n"+
+			"  e.EntBase.SetEntFieldChanged(%d)\n"+
+			"}\n\n",
+			mname, field.sname,
+			e.sname, mname, ref.sname,
+			field.sname,
+			field.sname,
+			field.index,
+		)
+	}
+}
+
 // collectFieldIndexes builds EntFieldIndex for all indexes defined by field tags.
 // The returned list is sorted on name
 func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
@@ -1325,8 +2396,31 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 			m[index.name] = index
 			x = index
 		} else {
+			// fields sharing an index name form one multi-field index. These fields must agree
+			// on uniqueness and are usually declared next to each other; otherwise the name may
+			// have been reused by mistake.
+			field, prev := index.fields[0], x.fields[len(x.fields)-1]
+			if (x.flags^index.flags)&fieldIndexUnique != 0 {
+				g.logSrcErrAt(field.pos,
+					"index %s of field %s is declared both unique and non-unique", x.name, field.sname)
+				g.logSrcErrAt(prev.pos, "index %s of field %s declared here", x.name, prev.sname)
+			} else if field.index != prev.index+1 {
+				logSrcWarn(g.srcdir, g.pkg, field.pos,
+					"index %s of field %s is also used by non-adjacent field %s",
+					x.name, field.sname, prev.sname)
+				logSrcWarn(g.srcdir, g.pkg, prev.pos,
+					"index %s of field %s declared here", x.name, prev.sname)
+			}
 			x.flags |= index.flags
 			x.fields = append(x.fields, index.fields[0])
+			x.whereNames = append(x.whereNames, index.whereNames...)
+			if x.scoreName == "" {
+				x.scoreName = index.scoreName
+			} else if index.scoreName != "" && index.scoreName != x.scoreName {
+				g.logSrcErrAt(field.pos,
+					"index %s of field %s has score field %s; %s declared at another field",
+					x.name, field.sname, index.scoreName, x.scoreName)
+			}
 		}
 		return x
 	}
@@ -1338,10 +2432,14 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 
 		g.pushPos(field.pos)
 
+		revlookup, fold, multi := false, false, false
 		for _, tag := range field.tags {
 			// tag="key=foo=bar"  =>  key="key", val="foo=bar"
 			// tag="key"          =>  key="key", val="fieldname"
-			key, val := tag, field.name
+			// tag="key=foo;where=bar"  =>  key="key", val="foo", options=["where=bar"]
+			options := strings.Split(tag, ";")
+			key, val := options[0], field.name
+			options = options[1:]
 			if i := strings.IndexByte(key, '='); i != -1 {
 				val = key[i+1:]
 				key = key[:i]
@@ -1354,10 +2452,45 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 				index = &EntFieldIndex{name: val}
 			case "unique":
 				index = &EntFieldIndex{name: val, flags: fieldIndexUnique}
+			case "softdelete":
+				g.setSoftDeleteField(field)
+			case "revlookup":
+				revlookup = true
+			case "fold":
+				fold = true
+			case "multi":
+				multi = true
+			case "nogetter":
+				field.noGetter = true
+			case "nosetter":
+				field.noSetter = true
+			case "ref":
+				if !strings.HasPrefix(strings.ToLower(tag), "ref=") {
+					g.logSrcErr("missing ent type in ref tag of field %s (e.g. ref=Account)",
+						field.sname)
+				} else {
+					field.ref = val
+				}
+			case "codec":
+				if field.codec != nil {
+					g.logSrcErr("multiple codecs defined for field %s", field.sname)
+				} else {
+					field.codec = g.parseFieldCodec(field, val)
+				}
 			case "":
 				// silently ignore
 			default:
-				g.logSrcWarn("unknown field tag %q on field %s; ignoring", tag, field.sname)
+				g.logUnknownTag("unknown field tag %q on field %s", tag, field.sname)
+			}
+			for _, opt := range options {
+				if index != nil && strings.HasPrefix(opt, "where=") {
+					index.whereNames = append(index.whereNames, opt[len("where="):])
+				} else if index != nil && strings.HasPrefix(opt, "score=") {
+					index.scoreName = opt[len("score="):]
+				} else {
+					g.logUnknownTag("unknown option %q of field tag %q on field %s",
+						opt, key, field.sname)
+				}
 			}
 			if index != nil {
 				if field.storageIndex != nil {
@@ -1368,6 +2501,35 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 				}
 			}
 		}
+		if revlookup {
+			// "revlookup" applies to the index of the field, regardless of tag order
+			if field.storageIndex == nil {
+				g.logSrcWarn("revlookup tag on field %s without index; ignoring", field.sname)
+			} else {
+				field.storageIndex.flags |= fieldIndexReverseLookup
+			}
+		}
+		if fold {
+			if field.storageIndex == nil {
+				g.logSrcWarn("fold tag on field %s without index; ignoring", field.sname)
+			} else if field.codec != nil || !isStringType(field.t.Type.Underlying()) {
+				g.logSrcErr("fold tag on field %s of type %s; expected string",
+					field.sname, g.goTypeName(field.t.Type))
+			} else {
+				field.foldIndexKey = true
+			}
+		}
+		if multi {
+			// "multi" makes the index of a list field have an entry per element
+			if field.storageIndex == nil {
+				g.logSrcWarn("multi tag on field %s without index; ignoring", field.sname)
+			} else if field.codec != nil || listElemType(field.t.Type) == nil {
+				g.logSrcErr("multi tag on field %s of type %s; expected a slice or array",
+					field.sname, g.goTypeName(field.t.Type))
+			} else {
+				field.storageIndex.flags |= fieldIndexMulti
+			}
+		}
 		g.popPos()
 	}
 
@@ -1383,6 +2545,105 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 
 	sort.Sort(EntFieldIndexes(indexes))
 
+	// resolve fields of partial index predicates
+	for _, x := range indexes {
+		for _, name := range x.whereNames {
+			var wf *EntField
+			for _, field := range fields {
+				if field.sname == name || field.name == name {
+					wf = field
+					break
+				}
+			}
+			g.pushPos(x.fields[0].pos)
+			if wf == nil {
+				g.logSrcErr("unknown field %q in where= of index %s", name, x.name)
+			} else if !isBoolType(wf.t.Type) {
+				g.logSrcErr("field %s in where= of index %s has type %s; expected bool",
+					wf.sname, x.name, g.goTypeName(wf.t.Type))
+			} else {
+				wf.isIndexWhere = true
+				x.where = append(x.where, wf)
+			}
+			g.popPos()
+		}
+	}
+
+	// resolve score fields
+	for _, x := range indexes {
+		if x.scoreName == "" {
+			continue
+		}
+		var sf *EntField
+		for _, field := range fields {
+			if field.sname == x.scoreName || field.name == x.scoreName {
+				sf = field
+				break
+			}
+		}
+		g.pushPos(x.fields[0].pos)
+		if sf == nil {
+			g.logSrcErr("unknown field %q in score= of index %s", x.scoreName, x.name)
+		} else if sf.codec != nil || !isNumericType(sf.t.Type) {
+			g.logSrcErr("field %s in score= of index %s has type %s; expected a number",
+				sf.sname, x.name, g.goTypeName(sf.t.Type))
+		} else if x.IsUnique() {
+			g.logSrcErr("unique index %s can't have a score field", x.name)
+		} else {
+			if (x.flags & fieldIndexReverseLookup) != 0 {
+				g.logSrcWarn("revlookup is not supported for index %s with a score field; ignoring",
+					x.name)
+				x.flags &^= fieldIndexReverseLookup
+			}
+			x.score = sf
+		}
+		g.popPos()
+	}
+
+	for _, x := range indexes {
+		if !x.IsMulti() {
+			continue
+		}
+		g.pushPos(x.fields[0].pos)
+		if len(x.fields) > 1 {
+			g.logSrcErr("multi-entry index %s has %d fields; expected one", x.name, len(x.fields))
+		}
+		if (x.flags & fieldIndexReverseLookup) != 0 {
+			g.logSrcWarn("revlookup is not supported for multi-entry index %s; ignoring", x.name)
+			x.flags &^= fieldIndexReverseLookup
+		}
+		g.popPos()
+	}
+
+	// Values of some types can't be encoded as index keys (see ent.IndexKeyEncoder.)
+	// Lookup functions are still generated for such indexes but saving ents fails.
+	for _, x := range indexes {
+		for _, f := range x.fields {
+			keyType := indexKeyType(x, f)
+			if keyType == nil || f.codec != nil {
+				continue
+			}
+			var problem string
+			switch keyType.Underlying().(type) {
+			case *types.Map:
+				problem = "dicts can't be indexed"
+			case *types.Slice, *types.Array:
+				if listElemType(keyType) != nil {
+					problem = "lists can't be indexed"
+				} else if len(x.fields) > 1 {
+					problem = "blobs can only be indexed alone"
+				}
+			}
+			if problem != "" {
+				g.pushPos(f.pos)
+				g.logSrcWarn("field %s of type %s can't be part of index %s (%s); "+
+					"saving %s ents will fail", f.sname, g.goTypeName(keyType), x.name, problem,
+					f.ent.sname)
+				g.popPos()
+			}
+		}
+	}
+
 	// assign table indices
 	for i, x := range indexes {
 		x.index = i
@@ -1391,6 +2652,94 @@ func (g *Codegen) collectFieldIndexes(fields []*EntField) []*EntFieldIndex {
 	return indexes
 }
 
+// setSoftDeleteField makes field the soft-delete marker of its ent (tag "softdelete").
+// The field must be a bool or a time.Time.
+func (g *Codegen) setSoftDeleteField(field *EntField) {
+	e := field.ent
+	if e.softDeleteField != nil {
+		g.logSrcErr("multiple softdelete fields defined for %s (%s and %s)",
+			e.sname, e.softDeleteField.sname, field.sname)
+		return
+	}
+	if !isBoolType(field.t.Type) && !isTimeType(field.t.Type) {
+		g.logSrcErr("softdelete field %s has type %s; expected bool or time.Time",
+			field.sname, g.goTypeName(field.t.Type))
+		return
+	}
+	e.softDeleteField = field
+}
+
+// parseFieldCodec parses the value of a "codec=encodeFunc/decodeFunc" field tag and verifies
+// that the named functions are defined in the package with signatures compatible with the field:
+//   func encodeFunc(c ent.Encoder, v T)
+//   func decodeFunc(c ent.Decoder) T
+// Returns nil if the tag is invalid, after logging an error.
+func (g *Codegen) parseFieldCodec(field *EntField, val string) *EntFieldCodec {
+	i := strings.IndexByte(val, '/')
+	if i == -1 || i == 0 || i == len(val)-1 {
+		g.logSrcErr("invalid codec tag %q on field %s; expected codec=encodeFunc/decodeFunc",
+			val, field.sname)
+		return nil
+	}
+	codec := &EntFieldCodec{encode: val[:i], decode: val[i+1:]}
+	ok := true
+
+	lookupFunc := func(name string) *types.Signature {
+		obj := g.pkg.Types.Scope().Lookup(name)
+		if obj == nil {
+			g.logSrcErr("codec function %s (field %s) not found in package %s",
+				name, field.sname, g.pkg.Name)
+			ok = false
+			return nil
+		}
+		fn, isfn := obj.(*types.Func)
+		if !isfn {
+			g.logSrcErr("codec %s (field %s) is not a function", name, field.sname)
+			ok = false
+			return nil
+		}
+		return fn.Type().(*types.Signature)
+	}
+
+	goType := g.goTypeName(field.t.Type)
+
+	if sig := lookupFunc(codec.encode); sig != nil {
+		params := sig.Params()
+		if params.Len() != 2 || sig.Results().Len() != 0 || sig.Variadic() ||
+			!g.isEntPkgType(params.At(0).Type(), "Encoder") ||
+			!types.Identical(params.At(1).Type(), field.t.Type) {
+			g.logSrcErr("codec function %s (field %s) has signature %s; expected func(ent.Encoder, %s)",
+				codec.encode, field.sname, sig, goType)
+			ok = false
+		}
+	}
+
+	if sig := lookupFunc(codec.decode); sig != nil {
+		results := sig.Results()
+		if sig.Params().Len() != 1 || results.Len() != 1 ||
+			!g.isEntPkgType(sig.Params().At(0).Type(), "Decoder") ||
+			!types.Identical(results.At(0).Type(), field.t.Type) {
+			g.logSrcErr("codec function %s (field %s) has signature %s; expected func(ent.Decoder) %s",
+				codec.decode, field.sname, sig, goType)
+			ok = false
+		}
+	}
+
+	if !ok {
+		return nil
+	}
+	return codec
+}
+
+// isEntPkgType returns true if t is the named type name of the ent package
+func (g *Codegen) isEntPkgType(t types.Type, name string) bool {
+	if t, ok := t.(*types.Named); ok {
+		o := t.Obj()
+		return o != nil && o.Name() == name && o.Pkg() != nil && o.Pkg().Path() == g.entpkgPath
+	}
+	return false
+}
+
 type EntFieldIndexes []*EntFieldIndex
 
 func (a EntFieldIndexes) Len() int           { return len(a) }
@@ -1424,6 +2773,9 @@ func fmtMappedNames(m map[string]bool) []byte {
 	return buf.Bytes()
 }
 
+// goTypeName returns the Go syntax for type t as seen from package inpkg.
+// Alias names of basic types, like "rune" and "byte", are preserved so that generated method
+// signatures read like the source struct definition.
 func goTypeName(t types.Type, inpkg *types.Package) string {
 	return types.TypeString(t, func(pkg *types.Package) string {
 		if inpkg == pkg || inpkg.Path() == pkg.Path() {
@@ -1483,6 +2835,72 @@ func isStringType(typ types.Type) bool {
 	return ok && t.Kind() == types.String
 }
 
+func isBoolType(typ types.Type) bool {
+	t, ok := typ.Underlying().(*types.Basic)
+	return ok && t.Kind() == types.Bool
+}
+
+// isTimeType returns true if typ is time.Time
+func isTimeType(typ types.Type) bool {
+	t, ok := typ.(*types.Named)
+	return ok && t.Obj().Pkg() != nil && t.Obj().Pkg().Path() == "time" && t.Obj().Name() == "Time"
+}
+
+// bigNumTypeName returns "Int" or "Rat" if typ is big.Int or big.Rat of package math/big
+func bigNumTypeName(typ types.Type) string {
+	t, ok := typ.(*types.Named)
+	if ok && t.Obj().Pkg() != nil && t.Obj().Pkg().Path() == "math/big" {
+		if name := t.Obj().Name(); name == "Int" || name == "Rat" {
+			return name
+		}
+	}
+	return ""
+}
+
+// listElemType returns the element type of a slice or array type, or nil if typ is another
+// type or a byte slice or array (which is encoded as a blob)
+func listElemType(typ types.Type) types.Type {
+	var elemt types.Type
+	switch t := typ.Underlying().(type) {
+	case *types.Slice:
+		elemt = t.Elem()
+	case *types.Array:
+		elemt = t.Elem()
+	default:
+		return nil
+	}
+	if bt, ok := elemt.(*types.Basic); ok && bt.Kind() == types.Uint8 {
+		return nil
+	}
+	return elemt
+}
+
+// indexKeyType returns the type of values of field f in lookups of index fx, which for a
+// multi-entry index is the element type of f
+func indexKeyType(fx *EntFieldIndex, f *EntField) types.Type {
+	if fx.IsMulti() {
+		return listElemType(f.t.Type)
+	}
+	return f.t.Type
+}
+
+// isBigIntType returns true if typ is *big.Int
+func isBigIntType(typ types.Type) bool {
+	t, ok := typ.(*types.Pointer)
+	return ok && bigNumTypeName(t.Elem()) == "Int"
+}
+
+// isNumericType returns true if typ is an integer or floating-point number type
+func isNumericType(typ types.Type) bool {
+	t, ok := typ.Underlying().(*types.Basic)
+	return ok && t.Info()&(types.IsInteger|types.IsFloat) != 0
+}
+
+func isUnsignedIntType(typ types.Type) bool {
+	t, ok := typ.Underlying().(*types.Basic)
+	return ok && t.Info()&types.IsUnsigned != 0
+}
+
 func isByteSliceType(typ types.Type) bool {
 	if t, ok := typ.(*types.Slice); ok {
 		et, ok := t.Elem().(*types.Basic)
@@ -1490,3 +2908,12 @@ func isByteSliceType(typ types.Type) bool {
 	}
 	return false
 }
+
+// isByteArrayType returns true for [N]byte and named types of it, like uuid.UUID
+func isByteArrayType(typ types.Type) bool {
+	if t, ok := typ.Underlying().(*types.Array); ok {
+		et, ok := t.Elem().(*types.Basic)
+		return ok && et.Kind() == types.Uint8
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestGoTypeNameAliases(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	pkg, typelist, _ := testParseTypes(`
+var _ rune
+var _ byte
+var _ int32
+var _ uint8
+var _ []rune
+var _ [4]byte
+`)
+	typeByName := map[string]types.Type{}
+	for _, v := range typelist {
+		typeByName[v.s] = v.t
+	}
+
+	// alias names are preserved in generated signatures
+	for _, name := range []string{"rune", "byte", "int32", "uint8", "[]rune", "[4]byte"} {
+		typ := typeByName[name]
+		assert.Ok(name+" parsed", typ != nil)
+		assert.Eq(name, goTypeName(typ, pkg), name)
+	}
+
+	// aliases share storage encoding with the types they alias, so helpers are shared too
+	mangle := func(name string) string {
+		s, err := Typemangle(pkg, typeByName[name])
+		assert.NoErr("Typemangle "+name, err)
+		return s
+	}
+	assert.Eq("rune mangles as int32", mangle("rune"), mangle("int32"))
+	assert.Eq("byte mangles as uint8", mangle("byte"), mangle("uint8"))
+
+	// codec calls cast to the alias name when decoding and encode with the aliased bitsize
+	g := &Codegen{pkg: &Package{Types: pkg}}
+	m, cast, advice := g.basicCodecCall(typeByName["rune"].(*types.Basic), codecDecode, false)
+	assert.Eq("rune decode method", m, "Int")
+	assert.Eq("rune decode cast", cast, "rune")
+	assert.Eq("rune decode bitsize", advice, "32")
+	m, cast, advice = g.basicCodecCall(typeByName["byte"].(*types.Basic), codecEncode, false)
+	assert.Eq("byte encode method", m, "Uint")
+	assert.Eq("byte encode cast", cast, "uint64")
+	assert.Eq("byte encode bitsize", advice, "8")
+}
+
+// testEntPkgSrc is a stub of the ent package with just what ent declarations refer to
+const testEntPkgSrc = `package ent
+type EntBase struct{ id, version uint64 }
+type Encoder interface{}
+type Decoder interface{}
+`
+
+// testCodegen generates code for the ents declared in src, which is a file of package foo
+// that can import the ent package (a stub; see testEntPkgSrc.) configure, if not nil, is called
+// with the Codegen before generating code.
+func testCodegen(t *testing.T, src string, configure func(g *Codegen)) (string, error) {
+	t.Helper()
+	fset := token.NewFileSet()
+	check := func(path, src string, imp types.Importer) (*types.Package, *ast.File, *types.Info) {
+		f, err := parser.ParseFile(fset, path+".go", src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &types.Info{
+			Types: make(map[ast.Expr]types.TypeAndValue),
+			Defs:  make(map[*ast.Ident]types.Object),
+			Uses:  make(map[*ast.Ident]types.Object),
+		}
+		conf := types.Config{Importer: imp}
+		pkg, err := conf.Check(path, fset, []*ast.File{f}, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkg, f, info
+	}
+	entpkg, _, _ := check("github.com/rsms/ent", testEntPkgSrc, nil)
+	imp := importerFunc(func(path string) (*types.Package, error) {
+		if path == entpkg.Path() {
+			return entpkg, nil
+		}
+		return importer.Default().Import(path)
+	})
+	tpkg, f, info := check("foo", "package foo\nimport \"github.com/rsms/ent\"\n"+src, imp)
+	pkg := &Package{
+		Name:      tpkg.Name(),
+		PkgPath:   tpkg.Path(),
+		Fset:      fset,
+		Syntax:    []*ast.File{f},
+		Types:     tpkg,
+		TypesInfo: info,
+	}
+	ents, err := scanFile("", pkg, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewCodegen(pkg, "", entpkg.Path())
+	g.ents = ents
+	if configure != nil {
+		configure(g)
+	}
+	for _, e := range ents {
+		if err := g.codegenEnt(e); err != nil {
+			return "", err
+		}
+	}
+	gosrc, err := format.Source(g.Finalize())
+	return string(gosrc), err
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+func TestFoldIndex(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	src, err := testCodegen(t, `
+type Email string
+type Account struct {
+	ent.EntBase `+"`account`"+`
+	email Email  `+"`ent:\",unique,fold\"`"+`
+	name  string `+"`ent:\",index,fold\"`"+`
+	code  string `+"`ent:\",unique\"`"+`
+}
+`, nil)
+	assert.NoErr("codegen", err)
+	// index keys are case-folded when saving and when looking up ents.
+	// Values of named string types are converted to string for case folding.
+	for _, s := range []string{
+		"ent.EncodeStrFolded(c, string(e.email))",
+		"ent.EncodeStrFolded(c, e.name)",
+		"ent.EncodeStrFolded(c, string(email))",
+		"[]byte(ent.FoldIndexKey(name))",
+		"[]byte(ent.FoldIndexKey(prefix))",
+	} {
+		assert.Ok(s, strings.Contains(src, s))
+	}
+
+	// prefix lookups of unique indexes are documented as scanning with redis
+	note := "// Note: the redis storage scans all keys of a unique index for this lookup.\n"
+	assert.Ok("unique prefix note", strings.Contains(src,
+		"ordered by code\n"+note+"func FindAccountByCodePrefix("))
+	assert.Ok("non-unique prefix", !strings.Contains(src,
+		"ordered by name\n"+note+"func FindAccountByNamePrefix("))
+	if t.Failed() {
+		t.Log(src)
+	}
+}
+
+func TestIndexNameReuse(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	codegen := func(fields string, configure func(g *Codegen)) error {
+		_, err := testCodegen(t, "type Part struct {\n\tent.EntBase `part`\n"+fields+"}\n", configure)
+		return err
+	}
+	tag := func(s string) string { return "`ent:\"" + s + "\"`" }
+
+	assert.NoErr("composite", codegen(
+		"\tw int "+tag(",unique=size")+"\n"+
+			"\th int "+tag(",unique=size")+"\n", nil))
+	assert.Err("unique and non-unique", "invalid field tags in Part", codegen(
+		"\tw int "+tag(",unique=size")+"\n"+
+			"\th int "+tag(",index=size")+"\n", nil))
+	assert.Err("different score fields", "invalid field tags in Part", codegen(
+		"\tw int "+tag(",index=size;score=a")+"\n"+
+			"\th int "+tag(",index=size;score=b")+"\n"+
+			"\ta int\n\tb int\n", nil))
+
+	// fields of an index which are not declared next to each other are only warned about,
+	// since such schemas used to be accepted
+	assert.NoErr("non-adjacent", codegen(
+		"\tw    int "+tag(",index=size")+"\n"+
+			"\tname string\n"+
+			"\th    int "+tag(",index=size")+"\n", nil))
+
+	// unknown tags are errors with Strict
+	badtag := "\tw int " + tag(",idnex") + "\n"
+	assert.NoErr("unknown tag", codegen(badtag, nil))
+	assert.Err("unknown tag with Strict", "invalid field tags in Part", codegen(badtag,
+		func(g *Codegen) { g.Strict = true }))
+}
+
+func TestRefField(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	codegen := func(ownerField string) (string, error) {
+		return testCodegen(t, `
+type Account struct {
+	ent.EntBase `+"`account`"+`
+}
+type Doc struct {
+	ent.EntBase `+"`doc`"+`
+	`+ownerField+`
+}
+`, nil)
+	}
+	src, err := codegen("ownerId uint64 `ent:\",ref=Account\"`")
+	assert.NoErr("codegen", err)
+	for _, s := range []string{
+		"func (e *Doc) LoadOwner(storage ent.Storage, fl ...ent.LookupFlags) (*Account, error) {\n" +
+			"\treturn LoadAccountById(storage, e.ownerId, fl...)\n",
+		// a nil ent clears the reference
+		"func (e *Doc) SetOwner(v *Account) {\n" +
+			"\tif v == nil {\n" +
+			"\t\te.ownerId = 0\n" +
+			"\t} else {\n" +
+			"\t\te.ownerId = v.Id()\n" +
+			"\t}\n",
+	} {
+		assert.Ok(s, strings.Contains(src, s))
+	}
+	if t.Failed() {
+		t.Log(src)
+	}
+
+	_, err = codegen("ownerId uint64 `ent:\",ref=Acount\"`")
+	assert.Err("unknown type", "invalid field tags in Doc", err)
+	_, err = codegen("ownerId int64 `ent:\",ref=Account\"`")
+	assert.Err("not uint64", "invalid field tags in Doc", err)
+}
+
+func TestFieldCodec(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	codegen := func(codec, funcs string) (string, error) {
+		return testCodegen(t, `
+type Point struct{ X, Y int }
+type Shape struct {
+	ent.EntBase `+"`shape`"+`
+	origin Point `+"`ent:\",codec="+codec+"\"`"+`
+}
+`+funcs, nil)
+	}
+	const funcs = `
+func encodePoint(c ent.Encoder, p Point) {}
+func decodePoint(c ent.Decoder) Point { return Point{} }
+`
+	src, err := codegen("encodePoint/decodePoint", funcs)
+	assert.NoErr("codegen", err)
+	assert.Ok("encode", strings.Contains(src, "encodePoint(c, e.origin)"))
+	assert.Ok("decode", strings.Contains(src, "e.origin = decodePoint(c)"))
+	if t.Failed() {
+		t.Log(src)
+	}
+
+	for _, test := range []struct{ name, codec, funcs string }{
+		{"missing slash", "encodePoint", funcs},
+		{"missing func", "encodePoint/decodePointt", funcs},
+		{"not a func", "encodePoint/decodePoint", `
+var encodePoint = 1
+func decodePoint(c ent.Decoder) Point { return Point{} }
+`},
+		{"wrong encode signature", "encodePoint/decodePoint", `
+func encodePoint(c ent.Encoder, p *Point) {}
+func decodePoint(c ent.Decoder) Point { return Point{} }
+`},
+		{"wrong decode signature", "encodePoint/decodePoint", `
+func encodePoint(c ent.Encoder, p Point) {}
+func decodePoint(c ent.Decoder) (Point, error) { return Point{}, nil }
+`},
+		{"not ent.Decoder", "encodePoint/decodePoint", `
+type Decoder interface{}
+func encodePoint(c ent.Encoder, p Point) {}
+func decodePoint(c Decoder) Point { return Point{} }
+`},
+	} {
+		_, err := codegen(test.codec, test.funcs)
+		assert.Err(test.name, "invalid field tags in Shape", err)
+	}
+}
+
+func TestFieldEqualExpr(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	src, err := testCodegen(t, `
+type Attrs struct{ v interface{} }
+type Thing struct {
+	ent.EntBase `+"`thing`"+`
+	name  string
+	data  []byte
+	tags  []string
+	sizes map[string]int
+	value interface{} `+"`ent:\",codec=encodeAny/decodeAny\"`"+`
+	attrs Attrs       `+"`ent:\",codec=encodeAttrs/decodeAttrs\"`"+`
+}
+func encodeAny(c ent.Encoder, v interface{}) {}
+func decodeAny(c ent.Decoder) interface{} { return nil }
+func encodeAttrs(c ent.Encoder, v Attrs) {}
+func decodeAttrs(c ent.Decoder) Attrs { return Attrs{} }
+`, nil)
+	assert.NoErr("codegen", err)
+	cond := func(field string) string {
+		i := strings.Index(src, "func (e *Thing) Set"+field+"IfDifferent(")
+		if i == -1 {
+			return "(not generated)"
+		}
+		line := src[i:]
+		line = line[strings.Index(line, "\tif ")+4:]
+		return line[:strings.Index(line, " {\n")]
+	}
+	assert.Eq("string", cond("Name"), "e.name == v")
+	assert.Eq("[]byte", cond("Data"), "bytes.Equal(e.data, v)")
+	// nil and empty are equal, since they encode the same way
+	assert.Eq("slice", cond("Tags"),
+		"len(e.tags) == len(v) && (len(v) == 0 || reflect.DeepEqual(e.tags, v))")
+	assert.Eq("map", cond("Sizes"),
+		"len(e.sizes) == len(v) && (len(v) == 0 || reflect.DeepEqual(e.sizes, v))")
+	// == panics when the dynamic values are e.g. slices
+	assert.Eq("interface", cond("Value"), "reflect.DeepEqual(e.value, v)")
+	assert.Eq("struct with interface", cond("Attrs"), "reflect.DeepEqual(e.attrs, v)")
+	if t.Failed() {
+		t.Log(src)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"go/format"
 	"go/scanner"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -19,7 +22,11 @@ import (
 // cli options
 var (
 	opt_outfile   string
+	opt_split     bool
 	opt_nofmt     bool
+	opt_strict    bool
+	opt_proto     bool
+	opt_query     bool
 	opt_filter    string
 	opt_filter_re *regexp.Regexp
 	opt_verbose   bool
@@ -44,6 +51,9 @@ var (
 	entFieldNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
 )
 
+// maxEntFields is the max number of fields of an ent (see ent.MaxFields)
+const maxEntFields = 64
+
 func parseopts() []string {
 	versionstring := fmt.Sprintf("entgen %s", VERSION)
 
@@ -58,7 +68,16 @@ func parseopts() []string {
 	flag.BoolVar(&opt_vverbose, "debug", false, "Debug logging (implies -v)")
 	flag.StringVar(&opt_outfile, "o", "ents.gen.go",
 		`Filename of generated go code, relative to <srcdir>. Use "-" for stdout.`)
+	flag.BoolVar(&opt_split, "split", false,
+		`Write the code of each ent to <enttype>.gen.go and shared helpers to `+
+			splitHelpersFile+` in <srcdir>, instead of to -o`)
 	flag.BoolVar(&opt_nofmt, "nofmt", false, `Disable "gofmt" formatting of generated code`)
+	flag.BoolVar(&opt_strict, "strict", false,
+		`Treat unknown field tags as errors rather than ignoring them with a warning`)
+	flag.BoolVar(&opt_proto, "proto", false,
+		`Generate protobuf methods and write a <enttype>.proto file for each ent to <srcdir>`)
+	flag.BoolVar(&opt_query, "query", false,
+		`Generate a <enttype>Query struct and a Find<enttype>Where function for each ent`)
 	flag.StringVar(&opt_filter, "filter", "",
 		`Only process go struct types which name matches the provided regular expression`)
 	flag.StringVar(&opt_entpkg, "entpkg", opt_entpkg, `Import path of ent package`)
@@ -82,11 +101,15 @@ func parseopts() []string {
 	log.RootLogger.SetWriter(os.Stderr)
 	log.RootLogger.EnableFeatures(log.FSync)
 	log.RootLogger.DisableFeatures(log.FTime | log.FPrefixInfo)
-	log.Debug("%s (filter=%#v nofmt=%#v o=%#v v=%#v vv=%#v)",
+	log.Debug("%s (filter=%#v nofmt=%#v strict=%#v proto=%#v query=%#v o=%#v split=%#v v=%#v vv=%#v)",
 		versionstring,
 		opt_filter,
 		opt_nofmt,
+		opt_strict,
+		opt_proto,
+		opt_query,
 		opt_outfile,
+		opt_split,
 		opt_verbose,
 		opt_vverbose,
 	)
@@ -114,6 +137,10 @@ func parseopts() []string {
 			os.Args[0])
 		showUsageAndExit(1)
 	}
+	if opt_split && opt_outfile == "-" {
+		fmt.Fprintf(os.Stderr, "%s: -split can't be used with -o -\n", os.Args[0])
+		showUsageAndExit(1)
+	}
 
 	// compile filter regexp
 	if opt_filter != "" && opt_filter != "*" && opt_filter != ".*" {
@@ -189,6 +216,9 @@ func (a EntInfoList) Len() int           { return len(a) }
 func (a EntInfoList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a EntInfoList) Less(i, j int) bool { return a[i].name < a[j].name }
 
+// splitHelpersFile is the file in <srcdir> which helpers are written to with -split
+const splitHelpersFile = "ents_helpers.gen.go"
+
 // main entry point for a single srcdir
 func handleSrcDir(srcdir string) error {
 	log.Debug("processing directory %q", srcdir)
@@ -198,7 +228,7 @@ func handleSrcDir(srcdir string) error {
 
 	// parse
 	var dstfile1 string
-	if opt_outfile != "-" {
+	if opt_outfile != "-" && !opt_split {
 		dstfile1 = dstfile
 	}
 	entsByName, pkg, err := scanDir(srcdir, dstfile1)
@@ -212,27 +242,10 @@ func handleSrcDir(srcdir string) error {
 			return nil
 		}
 		// do we need to remove a previously-generated file?
-		fd, err := os.Open(dstfile)
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				log.Warn("open %q: %v; you man need to manually remove or edit this file", dstfile, err)
-			}
-			return nil
-		}
-		buf := make([]byte, len(generatedByHeaderPrefix))
-		_, err = fd.Read(buf)
-		fd.Close()
-		if err != nil || string(buf) != generatedByHeaderPrefix {
-			// leave the file be
-			log.Debug("leaving %q as it does not appears to be generated by me")
-			return nil
-		}
-		// we can safely remove the file
-		if err := os.Remove(dstfile); err != nil {
-			return fmt.Errorf("failed to remove %q: %v", dstfile, err)
+		if opt_split {
+			return removeGeneratedFile(filepath.Join(srcdir, splitHelpersFile))
 		}
-		log.Info("removed %s", dstfile)
-		return nil
+		return removeGeneratedFile(dstfile)
 	}
 
 	// build an ordered list of ents from the unordered map
@@ -245,46 +258,128 @@ func handleSrcDir(srcdir string) error {
 	sort.Sort(ents)
 
 	// codegen
+	type genFile struct {
+		filename string
+		desc     string // e.g. "code for 2 ents"
+		gosrc    []byte
+	}
+	var files []genFile
 	g := NewCodegen(pkg, srcdir, opt_entpkg)
+	g.Proto = opt_proto
+	g.Query = opt_query
+	g.Strict = opt_strict
+	g.ents = ents
 	for _, ei := range ents {
 		g.w.Write([]byte{'\n'})
 		if err := g.codegenEnt(ei); err != nil {
 			return err
 		}
+		if opt_split {
+			filename := filepath.Join(srcdir, ei.name+".gen.go")
+			files = append(files, genFile{filename, "code for " + ei.sname, g.FinalizeEnt()})
+		}
 	}
 	if log.RootLogger.Level <= log.LevelDebug {
 		log.Debug("functions generated:%s", fmtMappedNames(g.generatedFunctions))
 	}
+	if !opt_split {
+		desc := fmt.Sprintf("code for %d ents", len(ents))
+		files = append(files, genFile{dstfile, desc, g.Finalize()})
+	} else if helpers := g.FinalizeHelpers(); helpers != nil {
+		filename := filepath.Join(srcdir, splitHelpersFile)
+		files = append(files, genFile{filename, "helpers", helpers})
+	}
 
-	// gofmt output
-	gosrc := g.Finalize()
-	if !opt_nofmt {
-		gosrcin := gosrc
-		gosrc, err = format.Source(gosrc)
-		if err != nil {
-			if log.RootLogger.Level <= log.LevelDebug {
-				// log generated code with numbered lines
-				log.Debug("gofmt error:\n------------------------\n%s", fmtSourceCode(gosrcin, err))
+	for _, f := range files {
+		// gofmt output
+		gosrc := f.gosrc
+		if !opt_nofmt {
+			gosrc, err = format.Source(gosrc)
+			if err != nil {
+				if log.RootLogger.Level <= log.LevelDebug {
+					// log generated code with numbered lines
+					log.Debug("gofmt error:\n------------------------\n%s", fmtSourceCode(f.gosrc, err))
+				}
+				return fmt.Errorf("gofmt: %v\n", err)
 			}
-			return fmt.Errorf("gofmt: %v\n", err)
 		}
-	}
 
-	// write output
-	if opt_outfile == "-" {
-		os.Stdout.Write(gosrc)
-	} else {
+		// write output
+		if opt_outfile == "-" {
+			os.Stdout.Write(gosrc)
+			continue
+		}
 		// log.Debug("—————————————————————— output ————————————————————\n%s\n", gosrc)
-		fd, err := os.Create(dstfile)
-		if err != nil {
+		if err := ioutil.WriteFile(f.filename, gosrc, 0666); err != nil {
+			return err
+		}
+		log.Info("wrote %s to %s", f.desc, f.filename)
+	}
+
+	// remove files previously generated with (or without) -split, which would otherwise
+	// contain duplicate declarations
+	if opt_outfile != "-" {
+		staleFiles := []string{dstfile}
+		if !opt_split {
+			staleFiles = []string{filepath.Join(srcdir, splitHelpersFile)}
+			for _, ei := range ents {
+				staleFiles = append(staleFiles, filepath.Join(srcdir, ei.name+".gen.go"))
+			}
+		}
+		written := make(map[string]bool, len(files))
+		for _, f := range files {
+			written[f.filename] = true
+		}
+		for _, filename := range staleFiles {
+			if written[filename] {
+				continue
+			}
+			if err := removeGeneratedFile(filename); err != nil {
+				return err
+			}
+		}
+	}
+	if !opt_proto {
+		return nil
+	}
+
+	// write protobuf definitions
+	for _, ei := range ents {
+		filename := filepath.Join(srcdir, ei.name+".proto")
+		if err := ioutil.WriteFile(filename, g.ProtoFile(ei), 0666); err != nil {
 			return err
 		}
-		fd.Write(gosrc)
-		err = fd.Close()
-		log.Info("wrote code for %d ents to %s", len(ents), dstfile)
+		log.Info("wrote protobuf definition of %s to %s", ei.sname, filename)
 	}
+	return nil
+}
 
-	return err
+// removeGeneratedFile removes filename if it exists and was generated by entgen
+func removeGeneratedFile(filename string) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("open %q: %v; you man need to manually remove or edit this file", filename, err)
+		}
+		return nil
+	}
+	// note: gofmt of go >=1.17 adds a "//go:build" line before the "// +build" line
+	buf := make([]byte, len(generatedByHeaderPrefix)+len("//go:build !entgen\n"))
+	n, err := io.ReadFull(fd, buf)
+	fd.Close()
+	buf = bytes.TrimPrefix(buf[:n], []byte("//go:build !entgen\n"))
+	if (err != nil && err != io.ErrUnexpectedEOF) ||
+		!bytes.HasPrefix(buf, []byte(generatedByHeaderPrefix)) {
+		// leave the file be
+		log.Debug("leaving %q as it does not appears to be generated by me", filename)
+		return nil
+	}
+	// we can safely remove the file
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("failed to remove %q: %v", filename, err)
+	}
+	log.Info("removed %s", filename)
+	return nil
 }
 
 func fmtSourceCode(src []byte, err error) string {
@@ -28,6 +28,12 @@ type EntInfo struct {
 	fields       []*EntField
 	fieldsByName map[string]*EntField
 	userMethods  map[string]*EntMethod // cached value for getUserMethods()
+
+	// options from tags of the EntBase field
+	trackFieldVersions bool // "fieldversions"
+	keepUnknownFields  bool // "keepunknown"
+
+	softDeleteField *EntField // field with the "softdelete" tag, or nil
 }
 
 func (e *EntInfo) logSrcErr(pos token.Pos, format string, args ...interface{}) {
@@ -50,6 +56,19 @@ type EntField struct {
 	pos   token.Pos
 
 	storageIndex *EntFieldIndex
+	codec        *EntFieldCodec // custom codec functions (tag "codec=enc/dec")
+	foldIndexKey bool           // case-fold index keys of the field (tag "fold")
+	isIndexWhere bool           // field is part of the predicate of a partial index
+	noGetter     bool           // don't generate a getter (tag "nogetter")
+	noSetter     bool           // don't generate setters (tag "nosetter")
+	ref          string         // Go type name of the ent referenced by id (tag "ref=Type")
+	jsonName     string         // name used in JSON, when a json tag differs from the ent tag
+}
+
+// EntFieldCodec names user-provided functions used to encode & decode a field
+type EntFieldCodec struct {
+	encode string // func(ent.Encoder, T)
+	decode string // func(ent.Decoder) T
 }
 
 type EntFieldType struct {
@@ -67,6 +86,8 @@ type fieldIndexFlags int
 
 const (
 	fieldIndexUnique = 1 << iota
+	fieldIndexReverseLookup
+	fieldIndexMulti
 )
 
 type EntFieldIndex struct {
@@ -74,6 +95,14 @@ type EntFieldIndex struct {
 	name   string
 	fields []*EntField
 	flags  fieldIndexFlags
+
+	// bool fields which must all be true for an ent to have an entry (tag "index=name;where=f")
+	where      []*EntField
+	whereNames []string // names of where fields, resolved into where by collectFieldIndexes
+
+	// numeric field which value is the score of entries (tag "index=name;score=f")
+	score     *EntField
+	scoreName string // name of the score field, resolved into score by collectFieldIndexes
 }
 
 type EntFieldTags []string
@@ -88,6 +117,7 @@ func (tags EntFieldTags) Has(tag string) bool {
 }
 
 func (fx *EntFieldIndex) IsUnique() bool { return (fx.flags & fieldIndexUnique) != 0 }
+func (fx *EntFieldIndex) IsMulti() bool  { return (fx.flags & fieldIndexMulti) != 0 }
 
 // getUserMethods returns a map of user-defined methods on the type
 func (e *EntInfo) getUserMethods() map[string]*EntMethod {
@@ -200,6 +230,23 @@ func buildEntInfo(
 			"invalid ent type name %q; does not match regexp %v", e.name, entTypeNameRegexp)
 		return nil, fmt.Errorf("invalid ent type name")
 	}
+	for _, tag := range tags[1:] {
+		switch strings.ToLower(tag) {
+		case "fieldversions":
+			e.trackFieldVersions = true
+		case "keepunknown":
+			e.keepUnknownFields = true
+		case "":
+			// silently ignore
+		default:
+			if opt_strict {
+				logSrcErr(srcdir, pkg, field.Tag.ValuePos, "unknown EntBase tag %q in %s", tag, e.sname)
+				return nil, fmt.Errorf("unknown EntBase tag")
+			}
+			logSrcWarn(srcdir, pkg, field.Tag.ValuePos,
+				"unknown EntBase tag %q in %s; ignoring", tag, e.sname)
+		}
+	}
 
 	log.Info("parsing ent %q (%s.%s) in %s", e.name, pkg.Name, e.sname, relfilename)
 
@@ -282,6 +329,12 @@ func buildEntInfo(
 				// not documentation (trailing comment e.g. "foo int // magnitude")
 			}
 
+			if len(fieldNames) == 1 {
+				if jsonName := parseJsonName(field.Tag); jsonName != name {
+					f.jsonName = jsonName
+				}
+			}
+
 			fieldIndex++
 
 			// best source pos for ent field name
@@ -290,6 +343,13 @@ func buildEntInfo(
 				pos = field.Tag.ValuePos
 			}
 
+			// field sets (ent.FieldSet) are 64-bit bitmaps with one bit per field
+			if f.index >= maxEntFields {
+				logSrcErr(srcdir, pkg, pos, "%s.%s: too many fields; an ent can have at most %d fields",
+					e.sname, f.sname, maxEntFields)
+				return nil, fmt.Errorf("too many fields")
+			}
+
 			// check for duplicate field names
 			if f2 := e.fieldsByName[name]; f2 != nil {
 				logSrcErr(srcdir, pkg, pos, "%s.%s: Duplicate field name %q", e.sname, f.sname, name)
@@ -299,8 +359,12 @@ func buildEntInfo(
 
 			// verify field name
 			if !entFieldNameRegexp.MatchString(name) {
+				alias := ""
+				if f.isAliased() {
+					alias = fmt.Sprintf(" (from tag of %s.%s)", e.sname, f.sname)
+				}
 				logSrcErr(srcdir, pkg, pos,
-					"invalid ent field name %q; does not match regexp %v", name, entFieldNameRegexp)
+					"invalid ent field name %q%s; does not match regexp %v", name, alias, entFieldNameRegexp)
 				return nil, fmt.Errorf("invalid ent field name")
 			}
 
@@ -317,9 +381,44 @@ func buildEntInfo(
 		//  }
 		// }
 	}
+
+	// warn about aliases which are the Go name of another field, e.g. "b" in
+	//   a int `ent:"b"`
+	//   b int `ent:"c"`
+	// which is valid but easily confused
+	for _, f := range e.fields {
+		if !f.isAliased() {
+			continue
+		}
+		for _, f2 := range e.fields {
+			if f2 != f && f2.name != f.name && f2.defaultName() == f.name {
+				logSrcWarn(srcdir, pkg, f.pos,
+					"%s.%s: field name %q shadows the name of field %s, which is stored as %q",
+					e.sname, f.sname, f.name, f2.sname, f2.name)
+			}
+		}
+	}
+
 	return e, nil
 }
 
+// defaultName returns the name which f would have without an explicit name in its tag
+func (f *EntField) defaultName() string {
+	name, _ := selectEntFieldName(f.sname, nil)
+	return name
+}
+
+// isAliased returns true if f is stored with a name given by its tag, e.g. `ent:"alias"`
+func (f *EntField) isAliased() bool { return f.name != f.defaultName() }
+
+// selectEntFieldName returns the storage name of the Go field name, dequeuing it from tags.
+// The first tag, when not empty, is the storage name ("alias") and takes precedence over the Go
+// name. "-" means the field is ignored, for which "" is returned. Otherwise the Go name is used
+// with its first letter in lower case. For example:
+//   displayName string `ent:"alias"`   => "alias"
+//   displayName string `ent:",unique"` => "displayName"
+//   DisplayName string                 => "displayName"
+//   cache       []byte `ent:"-"`       => ""
 func selectEntFieldName(name string, tags []string) (string, []string) {
 	if len(tags) > 0 {
 		tag0 := tags[0]
@@ -341,6 +440,8 @@ func selectEntFieldName(name string, tags []string) (string, []string) {
 }
 
 // Examples:
+//   `bob` => ["bob"]
+//   `bob,foo` => ["bob", "foo"]
 //   `ent:"bob"` => ["bob"]
 //   `ent:",foo, bar baz,lolcat " x:"y"` => ["", "foo", "bar baz", "lolcat"]
 //   `ent:"foo" json:"bar"` => ["foo"]
@@ -356,8 +457,8 @@ func parseFieldTags(tag *ast.BasicLit) []string {
 		return nil
 	}
 	if strings.IndexByte(s, ':') == -1 {
-		// no keys; single tag
-		return []string{s}
+		// no keys; bare tag
+		return splitCommaSeparated(s)
 	}
 	st := reflect.StructTag(s)
 	tags := splitCommaSeparated(st.Get("ent"))
@@ -370,6 +471,27 @@ func parseFieldTags(tag *ast.BasicLit) []string {
 	return tags
 }
 
+// parseJsonName returns the name of a json tag when there's also an ent tag, otherwise "".
+// (parseFieldTags uses the json tag as the storage name when there's no ent tag.) Examples:
+//   `ent:"w" json:"width"` => "width"
+//   `ent:",unique" json:"width,omitempty"` => "width"
+//   `ent:"w" json:"-"` => ""
+//   `json:"width"` => ""
+func parseJsonName(tag *ast.BasicLit) string {
+	if tag == nil || len(tag.Value) == 0 {
+		return ""
+	}
+	st := reflect.StructTag(strings.TrimSpace(trimSyntaxString(tag.Value)))
+	if _, ok := st.Lookup("ent"); !ok {
+		return ""
+	}
+	jsontags := splitCommaSeparated(st.Get("json"))
+	if len(jsontags) == 0 || jsontags[0] == "-" {
+		return ""
+	}
+	return jsontags[0]
+}
+
 // e.g. ` some\`thing` => some`thing
 // e.g. "lol\"cat\""   => lol"cat"
 func trimSyntaxString(s string) string {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// protobuf names & numbers of the implicit id and version fields.
+// Must match ent.FieldNameId, ent.ProtoFieldNumberId, etc.
+const (
+	protoFieldNameId        = "_id"
+	protoFieldNumberId      = 100
+	protoFieldNameVersion   = "_ver"
+	protoFieldNumberVersion = 101
+)
+
+// protoScalarType returns the protobuf scalar type for values of typ, or "" if typ is not
+// a scalar type (or can't be represented in protobuf.)
+func (g *Codegen) protoScalarType(typ types.Type) string {
+	typ, _ = g.unwrapNamedType(typ)
+	switch t := typ.(type) {
+	case *types.Basic:
+		switch t.Kind() {
+		case types.Bool:
+			return "bool"
+		case types.Int8, types.Int16, types.Int32:
+			return "int32"
+		case types.Int, types.Int64:
+			return "int64"
+		case types.Uint8, types.Uint16, types.Uint32:
+			return "uint32"
+		case types.Uint, types.Uint64, types.Uintptr:
+			return "uint64"
+		case types.Float32:
+			return "float"
+		case types.Float64:
+			return "double"
+		case types.String:
+			return "string"
+		}
+	case *types.Slice:
+		if isByteType(t.Elem()) {
+			return "bytes"
+		}
+	case *types.Array:
+		if isByteType(t.Elem()) {
+			return "bytes"
+		}
+	}
+	return ""
+}
+
+// protoFieldType returns the protobuf type of field f, for example "repeated string", or ""
+// if the field can't be represented in protobuf.
+func (g *Codegen) protoFieldType(f *EntField) string {
+	if f.codec != nil {
+		return ""
+	}
+	if s := g.protoScalarType(f.t.Type); s != "" {
+		return s
+	}
+	typ, _ := g.unwrapNamedType(f.t.Type)
+	switch t := typ.(type) {
+	case *types.Slice:
+		return protoRepeated(g.protoScalarType(t.Elem()))
+	case *types.Array:
+		return protoRepeated(g.protoScalarType(t.Elem()))
+	case *types.Map:
+		kt, ok := t.Key().(*types.Basic)
+		vt := g.protoScalarType(t.Elem())
+		if ok && kt.Kind() == types.String && vt != "" {
+			return "map<string, " + vt + ">"
+		}
+	}
+	return ""
+}
+
+func protoRepeated(elemType string) string {
+	if elemType == "" {
+		return ""
+	}
+	return "repeated " + elemType
+}
+
+func isByteType(t types.Type) bool {
+	bt, ok := t.Underlying().(*types.Basic)
+	return ok && bt.Kind() == types.Uint8
+}
+
+// protoFieldSet returns a bitmap of the fields of e which can be represented in protobuf
+func (g *Codegen) protoFieldSet(e *EntInfo) (fieldmap uint64) {
+	for _, field := range e.fields {
+		if g.protoFieldType(field) != "" {
+			fieldmap |= (1 << field.index)
+		}
+	}
+	return
+}
+
+// ProtoFile generates a protobuf definition (a .proto file) for e.
+// Fields are numbered by their field index + 1. Fields which can't be represented in
+// protobuf are left out and their field numbers reserved.
+func (g *Codegen) ProtoFile(e *EntInfo) []byte {
+	var buf bytes.Buffer
+	wf := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format, args...)
+	}
+	wf("// Code generated by entgen. DO NOT EDIT.\n")
+	wf("syntax = \"proto3\";\n\n")
+	wf("package %s;\n\n", g.pkg.Name)
+	wf("option go_package = %q;\n\n", g.pkg.PkgPath)
+	for _, line := range e.doc {
+		wf("// %s\n", line)
+	}
+	wf("message %s {\n", e.sname)
+	wf("  uint64 %s = %d;\n", protoFieldNameId, protoFieldNumberId)
+	wf("  uint64 %s = %d;\n", protoFieldNameVersion, protoFieldNumberVersion)
+	for _, field := range e.fields {
+		number := field.index + 1
+		typ := g.protoFieldType(field)
+		if typ == "" {
+			wf("  reserved %d; // %s %s\n", number, field.name, g.goTypeName(field.t.Type))
+			continue
+		}
+		for _, line := range field.doc {
+			wf("  // %s\n", line)
+		}
+		var opt string
+		if strings.HasPrefix(typ, "repeated ") && typ != "repeated string" &&
+			typ != "repeated bytes" {
+			// ProtoEncoder does not produce packed values
+			opt = " [packed = false]"
+		}
+		wf("  %s %s = %d%s;\n", typ, protoIdent(field.name), number, opt)
+	}
+	wf("}\n")
+	return buf.Bytes()
+}
+
+// protoIdent returns name with characters which are not valid in protobuf identifiers
+// replaced by "_"
+func protoIdent(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
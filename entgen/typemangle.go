@@ -70,6 +70,7 @@ import (
 	"bytes"
 	"fmt"
 	"go/types"
+	"unicode"
 )
 
 func Typemangle(pkg *types.Package, typ types.Type) (string, error) {
@@ -350,6 +351,13 @@ func (m *Mangler) wpkg(pkg *types.Package) bool {
 		// pkg == m.Pkg
 		return false
 	}
-	m.wstr(pkg.Path())
+	// replace characters which are not valid in identifiers, e.g. "math/big" => "math_big"
+	for _, r := range pkg.Path() {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			m.buf.WriteRune(r)
+		} else {
+			m.wbyte('_')
+		}
+	}
 	return true
 }
@@ -4,79 +4,365 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"github.com/rsms/ent"
 	"github.com/rsms/go-uuid"
+	"reflect"
 )
 
 // ----------------------------------------------------------------------------
 // Account
 
-// LoadAccountById loads Account with id from storage
-func LoadAccountById(storage ent.Storage, id uint64) (*Account, error) {
+// LoadAccountById loads Account with id from storage.
+// Pass ent.Consistent to read from the primary of a storage with replicas.
+func LoadAccountById(storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Account, error) {
 	e := &Account{}
-	return e, ent.LoadEntById(e, storage, id)
+	return e, ent.LoadEntById(e, storage, id, fl...)
+}
+
+// LoadAccountByIdContext is like LoadAccountById but loads with ctx (see ent.WithContext)
+func LoadAccountByIdContext(ctx context.Context, storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Account, error) {
+	return LoadAccountById(ent.WithContext(ctx, storage), id, fl...)
+}
+
+// AccountExists returns true if storage has Account with id, without loading it
+func AccountExists(storage ent.Storage, id uint64) (bool, error) {
+	return ent.EntExists(&Account{}, storage, id)
+}
+
+// AccountExistsContext is like AccountExists but with ctx (see ent.WithContext)
+func AccountExistsContext(ctx context.Context, storage ent.Storage, id uint64) (bool, error) {
+	return AccountExists(ent.WithContext(ctx, storage), id)
+}
+
+// FindAccountByExample looks up ids of Account ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func FindAccountByExample(s ent.Storage, example *Account, limit int) ([]uint64, error) {
+	return ent.FindIdsByExample(s, example, limit)
+}
+
+// LoadAccountByExample loads Account ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func LoadAccountByExample(s ent.Storage, example *Account, limit int) ([]*Account, error) {
+	r, err := ent.LoadEntsByExample(s, example, limit)
+	return ent_Account_slice_cast(r), err
 }
 
 // LoadAccountByEmail loads Account with email
 func LoadAccountByEmail(s ent.Storage, email string, fl ...ent.LookupFlags) (*Account, error) {
 	e := &Account{}
-	err := ent.LoadEntByIndexKey(s, e, &ent_Account_idx[0], []byte(email), fl)
+	err := ent.LoadEntByIndexKey(s, e, &ent_Account_idx[ent_Account_idx_email], []byte(email), fl)
 	return e, err
 }
 
+// LoadAccountByEmailContext is like LoadAccountByEmail but with ctx (see ent.WithContext)
+func LoadAccountByEmailContext(ctx context.Context, s ent.Storage, email string, fl ...ent.LookupFlags) (*Account, error) {
+	return LoadAccountByEmail(ent.WithContext(ctx, s), email, fl...)
+}
+
+// LoadOrCreateAccountByEmail loads Account with email or, if there is no such ent, creates it.
+// init is called with the new ent, which has email set, before it is created and
+// may be nil. Returns true if the ent was created.
+func LoadOrCreateAccountByEmail(s ent.Storage, email string, init func(e *Account)) (*Account, bool, error) {
+	e := &Account{}
+	created, err := ent.LoadOrCreate(e, s, &ent_Account_idx[ent_Account_idx_email], []byte(email), func() {
+		e.email = email
+		if init != nil {
+			init(e)
+		}
+	})
+	return e, created, err
+}
+
+// LoadOrCreateAccountByEmailContext is like LoadOrCreateAccountByEmail but with ctx (see ent.WithContext)
+func LoadOrCreateAccountByEmailContext(ctx context.Context, s ent.Storage, email string, init func(e *Account)) (*Account, bool, error) {
+	return LoadOrCreateAccountByEmail(ent.WithContext(ctx, s), email, init)
+}
+
 // FindAccountByEmail looks up Account id with email
 func FindAccountByEmail(s ent.Storage, email string, fl ...ent.LookupFlags) (uint64, error) {
-	return ent.FindIdByIndexKey(s, "account", &ent_Account_idx[0], []byte(email), fl)
+	return ent.FindIdByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(email), fl)
+}
+
+// FindAccountByEmailContext is like FindAccountByEmail but with ctx (see ent.WithContext)
+func FindAccountByEmailContext(ctx context.Context, s ent.Storage, email string, fl ...ent.LookupFlags) (uint64, error) {
+	return FindAccountByEmail(ent.WithContext(ctx, s), email, fl...)
+}
+
+// CountAccountByEmail returns the number of Account ents with email
+func CountAccountByEmail(s ent.Storage, email string) (int, error) {
+	return ent.CountByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(email))
+}
+
+// CountAccountByEmailContext is like CountAccountByEmail but with ctx (see ent.WithContext)
+func CountAccountByEmailContext(ctx context.Context, s ent.Storage, email string) (int, error) {
+	return CountAccountByEmail(ent.WithContext(ctx, s), email)
+}
+
+// DeleteAccountByEmail permanently deletes all Account ents with email.
+// Returns the number of ents deleted.
+func DeleteAccountByEmail(s ent.Storage, email string) (int, error) {
+	return ent.DeleteEntsByIndexKey(s, &Account{}, &ent_Account_idx[ent_Account_idx_email], []byte(email))
+}
+
+// DeleteAccountByEmailContext is like DeleteAccountByEmail but with ctx (see ent.WithContext)
+func DeleteAccountByEmailContext(ctx context.Context, s ent.Storage, email string) (int, error) {
+	return DeleteAccountByEmail(ent.WithContext(ctx, s), email)
+}
+
+// FindAccountByEmailPrefix looks up Account ids with email starting with prefix, ordered by email
+// Note: the redis storage scans all keys of a unique index for this lookup.
+func FindAccountByEmailPrefix(s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return ent.FindIdsByIndexKeyPrefix(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(prefix), limit, fl)
+}
+
+// FindAccountByEmailPrefixContext is like FindAccountByEmailPrefix but with ctx (see ent.WithContext)
+func FindAccountByEmailPrefixContext(ctx context.Context, s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByEmailPrefix(ent.WithContext(ctx, s), prefix, limit, fl...)
+}
+
+// LoadAccountByEmailPrefix loads Account ents with email starting with prefix, ordered by email
+// Note: the redis storage scans all keys of a unique index for this lookup.
+func LoadAccountByEmailPrefix(s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	e := &Account{}
+	r, err := ent.LoadEntsByIndexKeyPrefix(s, e, &ent_Account_idx[ent_Account_idx_email], []byte(prefix), limit, fl)
+	return ent_Account_slice_cast(r), err
+}
+
+// LoadAccountByEmailPrefixContext is like LoadAccountByEmailPrefix but with ctx (see ent.WithContext)
+func LoadAccountByEmailPrefixContext(ctx context.Context, s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByEmailPrefix(ent.WithContext(ctx, s), prefix, limit, fl...)
+}
+
+// ListAccountEmailKeys returns all email values of Account ents, in sorted order
+func ListAccountEmailKeys(s ent.Storage) ([]string, error) {
+	return ent.ListIndexKeyStrings(s, "account", &ent_Account_idx[ent_Account_idx_email])
 }
 
 // LoadAccountByFlag loads all Account ents with flag
 func LoadAccountByFlag(s ent.Storage, flag uint16, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
 	e := &Account{}
-	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[1], limit, fl, 1, func(c ent.Encoder) {
+	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[ent_Account_idx_flag], limit, fl, 1, func(c ent.Encoder) {
 		c.Uint(uint64(flag), 16)
 	})
 	return ent_Account_slice_cast(r), err
 }
 
+// LoadAccountByFlagContext is like LoadAccountByFlag but with ctx (see ent.WithContext)
+func LoadAccountByFlagContext(ctx context.Context, s ent.Storage, flag uint16, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByFlag(ent.WithContext(ctx, s), flag, limit, fl...)
+}
+
+// LoadAccountByFlagPaged loads a page of at most limit Account ents with flag, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadAccountByFlagPaged(s ent.Storage, flag uint16, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	e := &Account{}
+	r, next, err := ent.LoadEntsByIndexPaged(s, e, &ent_Account_idx[ent_Account_idx_flag], cursor, limit, fl, 1, func(c ent.Encoder) {
+		c.Uint(uint64(flag), 16)
+	})
+	return ent_Account_slice_cast(r), next, err
+}
+
+// LoadAccountByFlagPagedContext is like LoadAccountByFlagPaged but with ctx (see ent.WithContext)
+func LoadAccountByFlagPagedContext(ctx context.Context, s ent.Storage, flag uint16, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	return LoadAccountByFlagPaged(ent.WithContext(ctx, s), flag, cursor, limit, fl...)
+}
+
 // FindAccountByFlag looks up Account ids with flag
 func FindAccountByFlag(s ent.Storage, flag uint16, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[1], limit, fl, 1, func(c ent.Encoder) {
+	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[ent_Account_idx_flag], limit, fl, 1, func(c ent.Encoder) {
+		c.Uint(uint64(flag), 16)
+	})
+}
+
+// FindAccountByFlagContext is like FindAccountByFlag but with ctx (see ent.WithContext)
+func FindAccountByFlagContext(ctx context.Context, s ent.Storage, flag uint16, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByFlag(ent.WithContext(ctx, s), flag, limit, fl...)
+}
+
+// CountAccountByFlag returns the number of Account ents with flag
+func CountAccountByFlag(s ent.Storage, flag uint16) (int, error) {
+	return ent.CountByIndex(s, "account", &ent_Account_idx[ent_Account_idx_flag], 1, func(c ent.Encoder) {
 		c.Uint(uint64(flag), 16)
 	})
 }
 
+// CountAccountByFlagContext is like CountAccountByFlag but with ctx (see ent.WithContext)
+func CountAccountByFlagContext(ctx context.Context, s ent.Storage, flag uint16) (int, error) {
+	return CountAccountByFlag(ent.WithContext(ctx, s), flag)
+}
+
+// DeleteAccountByFlag permanently deletes all Account ents with flag.
+// Returns the number of ents deleted.
+func DeleteAccountByFlag(s ent.Storage, flag uint16) (int, error) {
+	return ent.DeleteEntsByIndex(s, &Account{}, &ent_Account_idx[ent_Account_idx_flag], 1, func(c ent.Encoder) {
+		c.Uint(uint64(flag), 16)
+	})
+}
+
+// DeleteAccountByFlagContext is like DeleteAccountByFlag but with ctx (see ent.WithContext)
+func DeleteAccountByFlagContext(ctx context.Context, s ent.Storage, flag uint16) (int, error) {
+	return DeleteAccountByFlag(ent.WithContext(ctx, s), flag)
+}
+
+// FindAccountByFlagRange looks up Account ids with flag in the range [min, max]
+func FindAccountByFlagRange(s ent.Storage, min, max uint16, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return ent.FindIdsByIndexRange(s, "account", &ent_Account_idx[ent_Account_idx_flag], limit, fl, 1,
+		func(c ent.Encoder) { c.Uint(uint64(min), 16) },
+		func(c ent.Encoder) { c.Uint(uint64(max), 16) })
+}
+
+// FindAccountByFlagRangeContext is like FindAccountByFlagRange but with ctx (see ent.WithContext)
+func FindAccountByFlagRangeContext(ctx context.Context, s ent.Storage, min, max uint16, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByFlagRange(ent.WithContext(ctx, s), min, max, limit, fl...)
+}
+
+// LoadAccountByFlagRange loads Account ents with flag in the range [min, max]
+func LoadAccountByFlagRange(s ent.Storage, min, max uint16, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	e := &Account{}
+	r, err := ent.LoadEntsByIndexRange(s, e, &ent_Account_idx[ent_Account_idx_flag], limit, fl, 1,
+		func(c ent.Encoder) { c.Uint(uint64(min), 16) },
+		func(c ent.Encoder) { c.Uint(uint64(max), 16) })
+	return ent_Account_slice_cast(r), err
+}
+
+// LoadAccountByFlagRangeContext is like LoadAccountByFlagRange but with ctx (see ent.WithContext)
+func LoadAccountByFlagRangeContext(ctx context.Context, s ent.Storage, min, max uint16, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByFlagRange(ent.WithContext(ctx, s), min, max, limit, fl...)
+}
+
 // LoadAccountByPicture loads all Account ents with picture
 func LoadAccountByPicture(s ent.Storage, picture []byte, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
 	e := &Account{}
-	r, err := ent.LoadEntsByIndexKey(s, e, &ent_Account_idx[2], picture, limit, fl)
+	r, err := ent.LoadEntsByIndexKey(s, e, &ent_Account_idx[ent_Account_idx_picture], picture, limit, fl)
 	return ent_Account_slice_cast(r), err
 }
 
+// LoadAccountByPictureContext is like LoadAccountByPicture but with ctx (see ent.WithContext)
+func LoadAccountByPictureContext(ctx context.Context, s ent.Storage, picture []byte, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByPicture(ent.WithContext(ctx, s), picture, limit, fl...)
+}
+
+// LoadAccountByPicturePaged loads a page of at most limit Account ents with picture, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadAccountByPicturePaged(s ent.Storage, picture []byte, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	e := &Account{}
+	r, next, err := ent.LoadEntsByIndexKeyPaged(s, e, &ent_Account_idx[ent_Account_idx_picture], picture, cursor, limit, fl)
+	return ent_Account_slice_cast(r), next, err
+}
+
+// LoadAccountByPicturePagedContext is like LoadAccountByPicturePaged but with ctx (see ent.WithContext)
+func LoadAccountByPicturePagedContext(ctx context.Context, s ent.Storage, picture []byte, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	return LoadAccountByPicturePaged(ent.WithContext(ctx, s), picture, cursor, limit, fl...)
+}
+
 // FindAccountByPicture looks up Account ids with picture
 func FindAccountByPicture(s ent.Storage, picture []byte, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndexKey(s, "account", &ent_Account_idx[2], picture, limit, fl)
+	return ent.FindIdsByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_picture], picture, limit, fl)
+}
+
+// FindAccountByPictureContext is like FindAccountByPicture but with ctx (see ent.WithContext)
+func FindAccountByPictureContext(ctx context.Context, s ent.Storage, picture []byte, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByPicture(ent.WithContext(ctx, s), picture, limit, fl...)
+}
+
+// CountAccountByPicture returns the number of Account ents with picture
+func CountAccountByPicture(s ent.Storage, picture []byte) (int, error) {
+	return ent.CountByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_picture], picture)
+}
+
+// CountAccountByPictureContext is like CountAccountByPicture but with ctx (see ent.WithContext)
+func CountAccountByPictureContext(ctx context.Context, s ent.Storage, picture []byte) (int, error) {
+	return CountAccountByPicture(ent.WithContext(ctx, s), picture)
+}
+
+// DeleteAccountByPicture permanently deletes all Account ents with picture.
+// Returns the number of ents deleted.
+func DeleteAccountByPicture(s ent.Storage, picture []byte) (int, error) {
+	return ent.DeleteEntsByIndexKey(s, &Account{}, &ent_Account_idx[ent_Account_idx_picture], picture)
+}
+
+// DeleteAccountByPictureContext is like DeleteAccountByPicture but with ctx (see ent.WithContext)
+func DeleteAccountByPictureContext(ctx context.Context, s ent.Storage, picture []byte) (int, error) {
+	return DeleteAccountByPicture(ent.WithContext(ctx, s), picture)
+}
+
+// ListAccountPictureKeys returns all picture values of Account ents, in sorted order
+func ListAccountPictureKeys(s ent.Storage) ([][]byte, error) {
+	return s.ListIndexKeys("account", &ent_Account_idx[ent_Account_idx_picture])
 }
 
 // LoadAccountByScore loads all Account ents with score
 func LoadAccountByScore(s ent.Storage, score float32, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
 	e := &Account{}
-	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[3], limit, fl, 1, func(c ent.Encoder) {
+	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[ent_Account_idx_score], limit, fl, 1, func(c ent.Encoder) {
 		c.Float(float64(score), 32)
 	})
 	return ent_Account_slice_cast(r), err
 }
 
+// LoadAccountByScoreContext is like LoadAccountByScore but with ctx (see ent.WithContext)
+func LoadAccountByScoreContext(ctx context.Context, s ent.Storage, score float32, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByScore(ent.WithContext(ctx, s), score, limit, fl...)
+}
+
+// LoadAccountByScorePaged loads a page of at most limit Account ents with score, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadAccountByScorePaged(s ent.Storage, score float32, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	e := &Account{}
+	r, next, err := ent.LoadEntsByIndexPaged(s, e, &ent_Account_idx[ent_Account_idx_score], cursor, limit, fl, 1, func(c ent.Encoder) {
+		c.Float(float64(score), 32)
+	})
+	return ent_Account_slice_cast(r), next, err
+}
+
+// LoadAccountByScorePagedContext is like LoadAccountByScorePaged but with ctx (see ent.WithContext)
+func LoadAccountByScorePagedContext(ctx context.Context, s ent.Storage, score float32, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	return LoadAccountByScorePaged(ent.WithContext(ctx, s), score, cursor, limit, fl...)
+}
+
 // FindAccountByScore looks up Account ids with score
 func FindAccountByScore(s ent.Storage, score float32, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[3], limit, fl, 1, func(c ent.Encoder) {
+	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[ent_Account_idx_score], limit, fl, 1, func(c ent.Encoder) {
+		c.Float(float64(score), 32)
+	})
+}
+
+// FindAccountByScoreContext is like FindAccountByScore but with ctx (see ent.WithContext)
+func FindAccountByScoreContext(ctx context.Context, s ent.Storage, score float32, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByScore(ent.WithContext(ctx, s), score, limit, fl...)
+}
+
+// CountAccountByScore returns the number of Account ents with score
+func CountAccountByScore(s ent.Storage, score float32) (int, error) {
+	return ent.CountByIndex(s, "account", &ent_Account_idx[ent_Account_idx_score], 1, func(c ent.Encoder) {
 		c.Float(float64(score), 32)
 	})
 }
 
+// CountAccountByScoreContext is like CountAccountByScore but with ctx (see ent.WithContext)
+func CountAccountByScoreContext(ctx context.Context, s ent.Storage, score float32) (int, error) {
+	return CountAccountByScore(ent.WithContext(ctx, s), score)
+}
+
+// DeleteAccountByScore permanently deletes all Account ents with score.
+// Returns the number of ents deleted.
+func DeleteAccountByScore(s ent.Storage, score float32) (int, error) {
+	return ent.DeleteEntsByIndex(s, &Account{}, &ent_Account_idx[ent_Account_idx_score], 1, func(c ent.Encoder) {
+		c.Float(float64(score), 32)
+	})
+}
+
+// DeleteAccountByScoreContext is like DeleteAccountByScore but with ctx (see ent.WithContext)
+func DeleteAccountByScoreContext(ctx context.Context, s ent.Storage, score float32) (int, error) {
+	return DeleteAccountByScore(ent.WithContext(ctx, s), score)
+}
+
 // LoadAccountBySize loads all Account ents matching width AND height
 func LoadAccountBySize(s ent.Storage, width, height int, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
 	e := &Account{}
-	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[4], limit, fl, 2, func(c ent.Encoder) {
+	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[ent_Account_idx_size], limit, fl, 2, func(c ent.Encoder) {
 		c.Key("w")
 		c.Int(int64(width), 64)
 		c.Key("h")
@@ -85,9 +371,47 @@ func LoadAccountBySize(s ent.Storage, width, height int, limit int, fl ...ent.Lo
 	return ent_Account_slice_cast(r), err
 }
 
+// LoadAccountBySizeContext is like LoadAccountBySize but with ctx (see ent.WithContext)
+func LoadAccountBySizeContext(ctx context.Context, s ent.Storage, width, height int, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountBySize(ent.WithContext(ctx, s), width, height, limit, fl...)
+}
+
+// LoadAccountBySizePaged loads a page of at most limit Account ents matching width AND height, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadAccountBySizePaged(s ent.Storage, width, height int, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	e := &Account{}
+	r, next, err := ent.LoadEntsByIndexPaged(s, e, &ent_Account_idx[ent_Account_idx_size], cursor, limit, fl, 2, func(c ent.Encoder) {
+		c.Key("w")
+		c.Int(int64(width), 64)
+		c.Key("h")
+		c.Int(int64(height), 64)
+	})
+	return ent_Account_slice_cast(r), next, err
+}
+
+// LoadAccountBySizePagedContext is like LoadAccountBySizePaged but with ctx (see ent.WithContext)
+func LoadAccountBySizePagedContext(ctx context.Context, s ent.Storage, width, height int, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	return LoadAccountBySizePaged(ent.WithContext(ctx, s), width, height, cursor, limit, fl...)
+}
+
 // FindAccountBySize looks up Account ids matching width AND height
 func FindAccountBySize(s ent.Storage, width, height int, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[4], limit, fl, 2, func(c ent.Encoder) {
+	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[ent_Account_idx_size], limit, fl, 2, func(c ent.Encoder) {
+		c.Key("w")
+		c.Int(int64(width), 64)
+		c.Key("h")
+		c.Int(int64(height), 64)
+	})
+}
+
+// FindAccountBySizeContext is like FindAccountBySize but with ctx (see ent.WithContext)
+func FindAccountBySizeContext(ctx context.Context, s ent.Storage, width, height int, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountBySize(ent.WithContext(ctx, s), width, height, limit, fl...)
+}
+
+// CountAccountBySize returns the number of Account ents matching width AND height
+func CountAccountBySize(s ent.Storage, width, height int) (int, error) {
+	return ent.CountByIndex(s, "account", &ent_Account_idx[ent_Account_idx_size], 2, func(c ent.Encoder) {
 		c.Key("w")
 		c.Int(int64(width), 64)
 		c.Key("h")
@@ -95,20 +419,92 @@ func FindAccountBySize(s ent.Storage, width, height int, limit int, fl ...ent.Lo
 	})
 }
 
+// CountAccountBySizeContext is like CountAccountBySize but with ctx (see ent.WithContext)
+func CountAccountBySizeContext(ctx context.Context, s ent.Storage, width, height int) (int, error) {
+	return CountAccountBySize(ent.WithContext(ctx, s), width, height)
+}
+
+// DeleteAccountBySize permanently deletes all Account ents matching width AND height.
+// Returns the number of ents deleted.
+func DeleteAccountBySize(s ent.Storage, width, height int) (int, error) {
+	return ent.DeleteEntsByIndex(s, &Account{}, &ent_Account_idx[ent_Account_idx_size], 2, func(c ent.Encoder) {
+		c.Key("w")
+		c.Int(int64(width), 64)
+		c.Key("h")
+		c.Int(int64(height), 64)
+	})
+}
+
+// DeleteAccountBySizeContext is like DeleteAccountBySize but with ctx (see ent.WithContext)
+func DeleteAccountBySizeContext(ctx context.Context, s ent.Storage, width, height int) (int, error) {
+	return DeleteAccountBySize(ent.WithContext(ctx, s), width, height)
+}
+
 // LoadAccountByUuid loads Account with uuid_
 func LoadAccountByUuid(s ent.Storage, uuid_ uuid.UUID, fl ...ent.LookupFlags) (*Account, error) {
 	e := &Account{}
-	err := ent.LoadEntByIndex(s, e, &ent_Account_idx[5], fl, 1, func(c ent.Encoder) {
-		c.Blob(uuid_[:])
-	})
+	err := ent.LoadEntByIndexKey(s, e, &ent_Account_idx[ent_Account_idx_uuid], uuid_[:], fl)
 	return e, err
 }
 
+// LoadAccountByUuidContext is like LoadAccountByUuid but with ctx (see ent.WithContext)
+func LoadAccountByUuidContext(ctx context.Context, s ent.Storage, uuid_ uuid.UUID, fl ...ent.LookupFlags) (*Account, error) {
+	return LoadAccountByUuid(ent.WithContext(ctx, s), uuid_, fl...)
+}
+
+// LoadOrCreateAccountByUuid loads Account with uuid_ or, if there is no such ent, creates it.
+// init is called with the new ent, which has uuid_ set, before it is created and
+// may be nil. Returns true if the ent was created.
+func LoadOrCreateAccountByUuid(s ent.Storage, uuid_ uuid.UUID, init func(e *Account)) (*Account, bool, error) {
+	e := &Account{}
+	created, err := ent.LoadOrCreate(e, s, &ent_Account_idx[ent_Account_idx_uuid], uuid_[:], func() {
+		e.uuid = uuid_
+		if init != nil {
+			init(e)
+		}
+	})
+	return e, created, err
+}
+
+// LoadOrCreateAccountByUuidContext is like LoadOrCreateAccountByUuid but with ctx (see ent.WithContext)
+func LoadOrCreateAccountByUuidContext(ctx context.Context, s ent.Storage, uuid_ uuid.UUID, init func(e *Account)) (*Account, bool, error) {
+	return LoadOrCreateAccountByUuid(ent.WithContext(ctx, s), uuid_, init)
+}
+
 // FindAccountByUuid looks up Account id with uuid_
 func FindAccountByUuid(s ent.Storage, uuid_ uuid.UUID, fl ...ent.LookupFlags) (uint64, error) {
-	return ent.FindIdByIndex(s, "account", &ent_Account_idx[5], fl, 1, func(c ent.Encoder) {
-		c.Blob(uuid_[:])
-	})
+	return ent.FindIdByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_uuid], uuid_[:], fl)
+}
+
+// FindAccountByUuidContext is like FindAccountByUuid but with ctx (see ent.WithContext)
+func FindAccountByUuidContext(ctx context.Context, s ent.Storage, uuid_ uuid.UUID, fl ...ent.LookupFlags) (uint64, error) {
+	return FindAccountByUuid(ent.WithContext(ctx, s), uuid_, fl...)
+}
+
+// CountAccountByUuid returns the number of Account ents with uuid_
+func CountAccountByUuid(s ent.Storage, uuid_ uuid.UUID) (int, error) {
+	return ent.CountByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_uuid], uuid_[:])
+}
+
+// CountAccountByUuidContext is like CountAccountByUuid but with ctx (see ent.WithContext)
+func CountAccountByUuidContext(ctx context.Context, s ent.Storage, uuid_ uuid.UUID) (int, error) {
+	return CountAccountByUuid(ent.WithContext(ctx, s), uuid_)
+}
+
+// DeleteAccountByUuid permanently deletes all Account ents with uuid_.
+// Returns the number of ents deleted.
+func DeleteAccountByUuid(s ent.Storage, uuid_ uuid.UUID) (int, error) {
+	return ent.DeleteEntsByIndexKey(s, &Account{}, &ent_Account_idx[ent_Account_idx_uuid], uuid_[:])
+}
+
+// DeleteAccountByUuidContext is like DeleteAccountByUuid but with ctx (see ent.WithContext)
+func DeleteAccountByUuidContext(ctx context.Context, s ent.Storage, uuid_ uuid.UUID) (int, error) {
+	return DeleteAccountByUuid(ent.WithContext(ctx, s), uuid_)
+}
+
+// ListAccountUuidKeys returns all uuid_ values of Account ents, in sorted order
+func ListAccountUuidKeys(s ent.Storage) ([][]byte, error) {
+	return s.ListIndexKeys("account", &ent_Account_idx[ent_Account_idx_uuid])
 }
 
 // EntTypeName returns the ent's storage name ("account")
@@ -117,30 +513,148 @@ func (e Account) EntTypeName() string { return "account" }
 // EntStorage returns the storage this ent belongs to or nil if it doesn't belong anywhere.
 func (e *Account) EntStorage() ent.Storage { return ent.GetStorage(e) }
 
+// BindStorage binds the ent to storage as version of the ent with id (see ent.BindStorage)
+func (e *Account) BindStorage(storage ent.Storage, id, version uint64) {
+	ent.BindStorage(e, storage, id, version)
+}
+
 // EntNew returns a new empty Account. Used by the ent package for loading ents.
 func (e Account) EntNew() ent.Ent { return &Account{} }
 
-// UnmarshalJSON populates the ent from JSON data. Conforms to json.Unmarshaler.
+// UnmarshalJSON populates the ent from JSON data, including its id and version.
+// Conforms to json.Unmarshaler. Use ent.JsonDecodeFields for untrusted data.
 func (e *Account) UnmarshalJSON(b []byte) error { return ent.JsonDecode(e, b) }
 
 // String returns a JSON representation of e.
 func (e Account) String() string { return ent.EntString(&e) }
 
+// Clone returns a copy of e. Slice and map fields are copied while other fields,
+// like pointers, are copied shallowly. Useful with ent.Atomic for copy-on-write.
+func (e *Account) Clone() *Account {
+	c := *e
+	if e.picture != nil {
+		c.picture = make([]byte, len(e.picture))
+		copy(c.picture, e.picture)
+	}
+	if e.foo != nil {
+		c.foo = make([]int, len(e.foo))
+		copy(c.foo, e.foo)
+	}
+	if e.foofoo != nil {
+		c.foofoo = make([][]int16, len(e.foofoo))
+		copy(c.foofoo, e.foofoo)
+	}
+	if e.data != nil {
+		c.data = make(Data, len(e.data))
+		copy(c.data, e.data)
+	}
+	if e.things != nil {
+		c.things = make(map[string]int, len(e.things))
+		for k, v := range e.things {
+			c.things[k] = v
+		}
+	}
+	return &c
+}
+
+// EntMergeFrom copies the fields in fields from other, which must be a *Account.
+// Values are copied shallowly. Used by ent.MergeEnt.
+func (e *Account) EntMergeFrom(other ent.Ent, fields ent.FieldSet) {
+	o := other.(*Account)
+	if fields.Has(0) {
+		e.name = o.name
+	}
+	if fields.Has(1) {
+		e.width = o.width
+	}
+	if fields.Has(2) {
+		e.height = o.height
+	}
+	if fields.Has(3) {
+		e.uuid = o.uuid
+	}
+	if fields.Has(4) {
+		e.flag = o.flag
+	}
+	if fields.Has(5) {
+		e.score = o.score
+	}
+	if fields.Has(6) {
+		e.picture = o.picture
+	}
+	if fields.Has(7) {
+		e.email = o.email
+	}
+	if fields.Has(8) {
+		e.emailVerified = o.emailVerified
+	}
+	if fields.Has(9) {
+		e.Deleted = o.Deleted
+	}
+	if fields.Has(10) {
+		e.passwordHash = o.passwordHash
+	}
+	if fields.Has(11) {
+		e.thing = o.thing
+	}
+	if fields.Has(12) {
+		e.foo = o.foo
+	}
+	if fields.Has(13) {
+		e.foofoo = o.foofoo
+	}
+	if fields.Has(14) {
+		e.data = o.data
+	}
+	if fields.Has(15) {
+		e.rgb = o.rgb
+	}
+	if fields.Has(16) {
+		e.threebytes = o.threebytes
+	}
+	if fields.Has(17) {
+		e.things = o.things
+	}
+}
+
 // Create a new account ent in storage
 func (e *Account) Create(storage ent.Storage) error { return ent.CreateEnt(e, storage) }
 
+// CreateContext is like Create but with ctx (see ent.WithContext)
+func (e *Account) CreateContext(ctx context.Context, storage ent.Storage) error {
+	return ent.CreateEnt(e, ent.WithContext(ctx, storage))
+}
+
 // Save pending changes to whatever storage this ent was created or loaded from
 func (e *Account) Save() error { return ent.SaveEnt(e) }
 
+// SaveContext is like Save but with ctx (see ent.WithContext)
+func (e *Account) SaveContext(ctx context.Context) error { return ent.SaveEntContext(ctx, e) }
+
 // Reload fields to latest values from storage, discarding any unsaved changes
 func (e *Account) Reload() error { return ent.ReloadEnt(e) }
 
+// ReloadContext is like Reload but with ctx (see ent.WithContext)
+func (e *Account) ReloadContext(ctx context.Context) error { return ent.ReloadEntContext(ctx, e) }
+
 // PermanentlyDelete deletes this ent from storage. This can usually not be undone.
 func (e *Account) PermanentlyDelete() error { return ent.DeleteEnt(e) }
 
+// PermanentlyDeleteContext is like PermanentlyDelete but with ctx (see ent.WithContext)
+func (e *Account) PermanentlyDeleteContext(ctx context.Context) error {
+	return ent.DeleteEntContext(ctx, e)
+}
+
 // Iterator returns an iterator over all Account ents. Order is undefined.
 func (e Account) Iterator(s ent.Storage) ent.EntIterator { return s.IterateEnts(&e) }
 
+// IteratorFiltered returns an iterator over the Account ents for which keep returns true.
+// The ents are loaded and then filtered in memory. Order is undefined.
+func (e Account) IteratorFiltered(s ent.Storage, keep func(*Account) bool) ent.EntIterator {
+	it := s.IterateEnts(&e)
+	return ent.FilterEnts(it, func(e ent.Ent) bool { return keep(e.(*Account)) })
+}
+
 // ---- field accessor methods ----
 
 func (e *Account) Name() string { return e.name }
@@ -238,6 +752,15 @@ func (e *Account) SetScoreIfDifferent(v float32) bool {
 	return true
 }
 
+// SetPictureIfDifferent sets picture only if v is different from the current value.
+func (e *Account) SetPictureIfDifferent(v []byte) bool {
+	if bytes.Equal(e.picture, v) {
+		return false
+	}
+	e.SetPicture(v)
+	return true
+}
+
 // SetEmailIfDifferent sets email only if v is different from the current value.
 func (e *Account) SetEmailIfDifferent(v string) bool {
 	if e.email == v {
@@ -283,6 +806,33 @@ func (e *Account) SetThingIfDifferent(v Thing3) bool {
 	return true
 }
 
+// SetFooIfDifferent sets foo only if v is different from the current value.
+func (e *Account) SetFooIfDifferent(v []int) bool {
+	if len(e.foo) == len(v) && (len(v) == 0 || reflect.DeepEqual(e.foo, v)) {
+		return false
+	}
+	e.SetFoo(v)
+	return true
+}
+
+// SetFoofooIfDifferent sets foofoo only if v is different from the current value.
+func (e *Account) SetFoofooIfDifferent(v [][]int16) bool {
+	if len(e.foofoo) == len(v) && (len(v) == 0 || reflect.DeepEqual(e.foofoo, v)) {
+		return false
+	}
+	e.SetFoofoo(v)
+	return true
+}
+
+// SetDataIfDifferent sets data only if v is different from the current value.
+func (e *Account) SetDataIfDifferent(v Data) bool {
+	if bytes.Equal(e.data, v) {
+		return false
+	}
+	e.SetData(v)
+	return true
+}
+
 // SetRgbIfDifferent sets rgb only if v is different from the current value.
 func (e *Account) SetRgbIfDifferent(v [3]int) bool {
 	if e.rgb == v {
@@ -301,6 +851,15 @@ func (e *Account) SetThreebytesIfDifferent(v [3]byte) bool {
 	return true
 }
 
+// SetThingsIfDifferent sets things only if v is different from the current value.
+func (e *Account) SetThingsIfDifferent(v map[string]int) bool {
+	if len(e.things) == len(v) && (len(v) == 0 || reflect.DeepEqual(e.things, v)) {
+		return false
+	}
+	e.SetThings(v)
+	return true
+}
+
 func (e *Account) SetUuidChanged()       { e.EntBase.SetEntFieldChanged(3) }
 func (e *Account) SetPictureChanged()    { e.EntBase.SetEntFieldChanged(6) }
 func (e *Account) SetFooChanged()        { e.EntBase.SetEntFieldChanged(12) }
@@ -442,11 +1001,12 @@ func (e *Account) EntDecode(c ent.Decoder) (id, version uint64) {
 
 // EntDecodePartial is used internally by ent.Storage during updates.
 func (e *Account) EntDecodePartial(c ent.Decoder, fields ent.FieldSet) (version uint64) {
-	for n := 7; n > 0; {
+	for n := 8; n > 0; {
 		switch string(c.Key()) {
 		case "":
 			return
 		case ent.FieldNameVersion:
+			n--
 			version = c.Uint(64)
 			continue
 		case "w":
@@ -547,77 +1107,214 @@ var ent_Account_fields = ent.Fields{
 // EntFields returns information about Account fields
 func (e Account) EntFields() ent.Fields { return ent_Account_fields }
 
-// Indexes (Name, Fields, Flags)
+// Indexes (Name, Fields, Flags, Where, Score)
 var ent_Account_idx = []ent.EntIndex{
-	{"email", 1 << ent_Account_f_email, ent.EntIndexUnique},
-	{"flag", 1 << ent_Account_f_flag, 0},
-	{"picture", 1 << ent_Account_f_picture, 0},
-	{"score", 1 << ent_Account_f_score, 0},
-	{"size", (1 << ent_Account_f_width) | (1 << ent_Account_f_height), 0},
-	{"uuid", 1 << ent_Account_f_uuid, ent.EntIndexUnique},
+	{"email", 1 << ent_Account_f_email, ent.EntIndexUnique, 0, 0},
+	{"flag", 1 << ent_Account_f_flag, 0, 0, 0},
+	{"picture", 1 << ent_Account_f_picture, 0, 0, 0},
+	{"score", 1 << ent_Account_f_score, 0, 0, 0},
+	{"size", (1 << ent_Account_f_width) | (1 << ent_Account_f_height), 0, 0, 0},
+	{"uuid", 1 << ent_Account_f_uuid, ent.EntIndexUnique, 0, 0},
 }
 
+// Symbolic index positions in ent_Account_idx
+const (
+	ent_Account_idx_email   = 0
+	ent_Account_idx_flag    = 1
+	ent_Account_idx_picture = 2
+	ent_Account_idx_score   = 3
+	ent_Account_idx_size    = 4
+	ent_Account_idx_uuid    = 5
+)
+
 // EntIndexes returns information about secondary indexes
 func (e *Account) EntIndexes() []ent.EntIndex { return ent_Account_idx }
 
 // ----------------------------------------------------------------------------
 // Department
 
-// LoadDepartmentById loads Department with id from storage
-func LoadDepartmentById(storage ent.Storage, id uint64) (*Department, error) {
+// LoadDepartmentById loads Department with id from storage.
+// Pass ent.Consistent to read from the primary of a storage with replicas.
+func LoadDepartmentById(storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Department, error) {
 	e := &Department{}
-	return e, ent.LoadEntById(e, storage, id)
+	return e, ent.LoadEntById(e, storage, id, fl...)
+}
+
+// LoadDepartmentByIdContext is like LoadDepartmentById but loads with ctx (see ent.WithContext)
+func LoadDepartmentByIdContext(ctx context.Context, storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Department, error) {
+	return LoadDepartmentById(ent.WithContext(ctx, storage), id, fl...)
+}
+
+// DepartmentExists returns true if storage has Department with id, without loading it
+func DepartmentExists(storage ent.Storage, id uint64) (bool, error) {
+	return ent.EntExists(&Department{}, storage, id)
+}
+
+// DepartmentExistsContext is like DepartmentExists but with ctx (see ent.WithContext)
+func DepartmentExistsContext(ctx context.Context, storage ent.Storage, id uint64) (bool, error) {
+	return DepartmentExists(ent.WithContext(ctx, storage), id)
+}
+
+// FindDepartmentByExample looks up ids of Department ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func FindDepartmentByExample(s ent.Storage, example *Department, limit int) ([]uint64, error) {
+	return ent.FindIdsByExample(s, example, limit)
+}
+
+// LoadDepartmentByExample loads Department ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func LoadDepartmentByExample(s ent.Storage, example *Department, limit int) ([]*Department, error) {
+	r, err := ent.LoadEntsByExample(s, example, limit)
+	return ent_Department_slice_cast(r), err
 }
 
 // LoadDepartmentByBuilding loads all Department ents with building
 func LoadDepartmentByBuilding(s ent.Storage, building Building, limit int, fl ...ent.LookupFlags) ([]*Department, error) {
 	e := &Department{}
-	r, err := ent.LoadEntsByIndex(s, e, &ent_Department_idx[0], limit, fl, 1, func(c ent.Encoder) {
+	r, err := ent.LoadEntsByIndex(s, e, &ent_Department_idx[ent_Department_idx_building], limit, fl, 1, func(c ent.Encoder) {
 		c.Int(int64(building), 32)
 	})
 	return ent_Department_slice_cast(r), err
 }
 
+// LoadDepartmentByBuildingContext is like LoadDepartmentByBuilding but with ctx (see ent.WithContext)
+func LoadDepartmentByBuildingContext(ctx context.Context, s ent.Storage, building Building, limit int, fl ...ent.LookupFlags) ([]*Department, error) {
+	return LoadDepartmentByBuilding(ent.WithContext(ctx, s), building, limit, fl...)
+}
+
+// LoadDepartmentByBuildingPaged loads a page of at most limit Department ents with building, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadDepartmentByBuildingPaged(s ent.Storage, building Building, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Department, []byte, error) {
+	e := &Department{}
+	r, next, err := ent.LoadEntsByIndexPaged(s, e, &ent_Department_idx[ent_Department_idx_building], cursor, limit, fl, 1, func(c ent.Encoder) {
+		c.Int(int64(building), 32)
+	})
+	return ent_Department_slice_cast(r), next, err
+}
+
+// LoadDepartmentByBuildingPagedContext is like LoadDepartmentByBuildingPaged but with ctx (see ent.WithContext)
+func LoadDepartmentByBuildingPagedContext(ctx context.Context, s ent.Storage, building Building, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Department, []byte, error) {
+	return LoadDepartmentByBuildingPaged(ent.WithContext(ctx, s), building, cursor, limit, fl...)
+}
+
 // FindDepartmentByBuilding looks up Department ids with building
 func FindDepartmentByBuilding(s ent.Storage, building Building, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndex(s, "dept", &ent_Department_idx[0], limit, fl, 1, func(c ent.Encoder) {
+	return ent.FindIdsByIndex(s, "dept", &ent_Department_idx[ent_Department_idx_building], limit, fl, 1, func(c ent.Encoder) {
+		c.Int(int64(building), 32)
+	})
+}
+
+// FindDepartmentByBuildingContext is like FindDepartmentByBuilding but with ctx (see ent.WithContext)
+func FindDepartmentByBuildingContext(ctx context.Context, s ent.Storage, building Building, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindDepartmentByBuilding(ent.WithContext(ctx, s), building, limit, fl...)
+}
+
+// CountDepartmentByBuilding returns the number of Department ents with building
+func CountDepartmentByBuilding(s ent.Storage, building Building) (int, error) {
+	return ent.CountByIndex(s, "dept", &ent_Department_idx[ent_Department_idx_building], 1, func(c ent.Encoder) {
+		c.Int(int64(building), 32)
+	})
+}
+
+// CountDepartmentByBuildingContext is like CountDepartmentByBuilding but with ctx (see ent.WithContext)
+func CountDepartmentByBuildingContext(ctx context.Context, s ent.Storage, building Building) (int, error) {
+	return CountDepartmentByBuilding(ent.WithContext(ctx, s), building)
+}
+
+// DeleteDepartmentByBuilding permanently deletes all Department ents with building.
+// Returns the number of ents deleted.
+func DeleteDepartmentByBuilding(s ent.Storage, building Building) (int, error) {
+	return ent.DeleteEntsByIndex(s, &Department{}, &ent_Department_idx[ent_Department_idx_building], 1, func(c ent.Encoder) {
 		c.Int(int64(building), 32)
 	})
 }
 
+// DeleteDepartmentByBuildingContext is like DeleteDepartmentByBuilding but with ctx (see ent.WithContext)
+func DeleteDepartmentByBuildingContext(ctx context.Context, s ent.Storage, building Building) (int, error) {
+	return DeleteDepartmentByBuilding(ent.WithContext(ctx, s), building)
+}
+
 // EntTypeName returns the ent's storage name ("dept")
 func (e Department) EntTypeName() string { return "dept" }
 
 // EntStorage returns the storage this ent belongs to or nil if it doesn't belong anywhere.
 func (e *Department) EntStorage() ent.Storage { return ent.GetStorage(e) }
 
+// BindStorage binds the ent to storage as version of the ent with id (see ent.BindStorage)
+func (e *Department) BindStorage(storage ent.Storage, id, version uint64) {
+	ent.BindStorage(e, storage, id, version)
+}
+
 // EntNew returns a new empty Department. Used by the ent package for loading ents.
 func (e Department) EntNew() ent.Ent { return &Department{} }
 
 // MarshalJSON returns a JSON representation of e. Conforms to json.Marshaler.
 func (e *Department) MarshalJSON() ([]byte, error) { return ent.JsonEncode(e, "") }
 
-// UnmarshalJSON populates the ent from JSON data. Conforms to json.Unmarshaler.
+// UnmarshalJSON populates the ent from JSON data, including its id and version.
+// Conforms to json.Unmarshaler. Use ent.JsonDecodeFields for untrusted data.
 func (e *Department) UnmarshalJSON(b []byte) error { return ent.JsonDecode(e, b) }
 
 // String returns a JSON representation of e.
 func (e Department) String() string { return ent.EntString(&e) }
 
+// Clone returns a copy of e. Slice and map fields are copied while other fields,
+// like pointers, are copied shallowly. Useful with ent.Atomic for copy-on-write.
+func (e *Department) Clone() *Department {
+	c := *e
+	return &c
+}
+
+// EntMergeFrom copies the fields in fields from other, which must be a *Department.
+// Values are copied shallowly. Used by ent.MergeEnt.
+func (e *Department) EntMergeFrom(other ent.Ent, fields ent.FieldSet) {
+	o := other.(*Department)
+	if fields.Has(0) {
+		e.name = o.name
+	}
+	if fields.Has(1) {
+		e.building = o.building
+	}
+}
+
 // Create a new dept ent in storage
 func (e *Department) Create(storage ent.Storage) error { return ent.CreateEnt(e, storage) }
 
+// CreateContext is like Create but with ctx (see ent.WithContext)
+func (e *Department) CreateContext(ctx context.Context, storage ent.Storage) error {
+	return ent.CreateEnt(e, ent.WithContext(ctx, storage))
+}
+
 // Save pending changes to whatever storage this ent was created or loaded from
 func (e *Department) Save() error { return ent.SaveEnt(e) }
 
+// SaveContext is like Save but with ctx (see ent.WithContext)
+func (e *Department) SaveContext(ctx context.Context) error { return ent.SaveEntContext(ctx, e) }
+
 // Reload fields to latest values from storage, discarding any unsaved changes
 func (e *Department) Reload() error { return ent.ReloadEnt(e) }
 
+// ReloadContext is like Reload but with ctx (see ent.WithContext)
+func (e *Department) ReloadContext(ctx context.Context) error { return ent.ReloadEntContext(ctx, e) }
+
 // PermanentlyDelete deletes this ent from storage. This can usually not be undone.
 func (e *Department) PermanentlyDelete() error { return ent.DeleteEnt(e) }
 
+// PermanentlyDeleteContext is like PermanentlyDelete but with ctx (see ent.WithContext)
+func (e *Department) PermanentlyDeleteContext(ctx context.Context) error {
+	return ent.DeleteEntContext(ctx, e)
+}
+
 // Iterator returns an iterator over all Department ents. Order is undefined.
 func (e Department) Iterator(s ent.Storage) ent.EntIterator { return s.IterateEnts(&e) }
 
+// IteratorFiltered returns an iterator over the Department ents for which keep returns true.
+// The ents are loaded and then filtered in memory. Order is undefined.
+func (e Department) IteratorFiltered(s ent.Storage, keep func(*Department) bool) ent.EntIterator {
+	it := s.IterateEnts(&e)
+	return ent.FilterEnts(it, func(e ent.Ent) bool { return keep(e.(*Department)) })
+}
+
 // ---- field accessor methods ----
 
 func (e *Department) Name() string       { return e.name }
@@ -680,11 +1377,12 @@ func (e *Department) EntDecode(c ent.Decoder) (id, version uint64) {
 
 // EntDecodePartial is used internally by ent.Storage during updates.
 func (e *Department) EntDecodePartial(c ent.Decoder, fields ent.FieldSet) (version uint64) {
-	for n := 1; n > 0; {
+	for n := 2; n > 0; {
 		switch string(c.Key()) {
 		case "":
 			return
 		case ent.FieldNameVersion:
+			n--
 			version = c.Uint(64)
 			continue
 		case "building":
@@ -717,11 +1415,16 @@ var ent_Department_fields = ent.Fields{
 // EntFields returns information about Department fields
 func (e Department) EntFields() ent.Fields { return ent_Department_fields }
 
-// Indexes (Name, Fields, Flags)
+// Indexes (Name, Fields, Flags, Where, Score)
 var ent_Department_idx = []ent.EntIndex{
-	{"building", 1 << ent_Department_f_building, 0},
+	{"building", 1 << ent_Department_f_building, 0, 0, 0},
 }
 
+// Symbolic index positions in ent_Department_idx
+const (
+	ent_Department_idx_building = 0
+)
+
 // EntIndexes returns information about secondary indexes
 func (e *Department) EntIndexes() []ent.EntIndex { return ent_Department_idx }
 
@@ -102,15 +102,17 @@ func main() {
 	// remove any and all preexisting departments from a previous run
 	panicOnError(ent.DeleteAllEntsOfType(estore, &Department{}))
 
-	// create some departments
-	panicOnError((&Department{name: "Astronomy", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Computer Science", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Mathematical Sciences", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Art History", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Physics", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Psychology", building: BuildingF2}).Create(estore))
-	panicOnError((&Department{name: "Religious Mythology", building: BuildingF3}).Create(estore))
-	panicOnError((&Department{name: "Bookstore", building: BuildingF3}).Create(estore))
+	// create some departments, all in one go
+	panicOnError(estore.CreateBatch([]ent.Ent{
+		&Department{name: "Astronomy", building: BuildingF2},
+		&Department{name: "Computer Science", building: BuildingF2},
+		&Department{name: "Mathematical Sciences", building: BuildingF2},
+		&Department{name: "Art History", building: BuildingF2},
+		&Department{name: "Physics", building: BuildingF2},
+		&Department{name: "Psychology", building: BuildingF2},
+		&Department{name: "Religious Mythology", building: BuildingF3},
+		&Department{name: "Bookstore", building: BuildingF3},
+	}))
 
 	// list all departments using an iterator. Iteration order is undefined; varies by storage.
 	fmt.Printf("\n-- list all departments --\n")
@@ -3,78 +3,293 @@
 // Code generated by entgen. DO NOT EDIT.
 package main
 
-import "github.com/rsms/ent"
+import (
+	"context"
+	"github.com/rsms/ent"
+)
 
 // ----------------------------------------------------------------------------
 // Account
 
-// LoadAccountById loads Account with id from storage
-func LoadAccountById(storage ent.Storage, id uint64) (*Account, error) {
+// LoadAccountById loads Account with id from storage.
+// Pass ent.Consistent to read from the primary of a storage with replicas.
+func LoadAccountById(storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Account, error) {
 	e := &Account{}
-	return e, ent.LoadEntById(e, storage, id)
+	return e, ent.LoadEntById(e, storage, id, fl...)
+}
+
+// LoadAccountByIdContext is like LoadAccountById but loads with ctx (see ent.WithContext)
+func LoadAccountByIdContext(ctx context.Context, storage ent.Storage, id uint64, fl ...ent.LookupFlags) (*Account, error) {
+	return LoadAccountById(ent.WithContext(ctx, storage), id, fl...)
+}
+
+// AccountExists returns true if storage has Account with id, without loading it
+func AccountExists(storage ent.Storage, id uint64) (bool, error) {
+	return ent.EntExists(&Account{}, storage, id)
+}
+
+// AccountExistsContext is like AccountExists but with ctx (see ent.WithContext)
+func AccountExistsContext(ctx context.Context, storage ent.Storage, id uint64) (bool, error) {
+	return AccountExists(ent.WithContext(ctx, storage), id)
+}
+
+// FindAccountByExample looks up ids of Account ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func FindAccountByExample(s ent.Storage, example *Account, limit int) ([]uint64, error) {
+	return ent.FindIdsByExample(s, example, limit)
+}
+
+// LoadAccountByExample loads Account ents with field values matching those set in example.
+// See ent.FindIdsByExample for details.
+func LoadAccountByExample(s ent.Storage, example *Account, limit int) ([]*Account, error) {
+	r, err := ent.LoadEntsByExample(s, example, limit)
+	return ent_Account_slice_cast(r), err
 }
 
 // LoadAccountByEmail loads Account with email
 func LoadAccountByEmail(s ent.Storage, email string, fl ...ent.LookupFlags) (*Account, error) {
 	e := &Account{}
-	err := ent.LoadEntByIndexKey(s, e, &ent_Account_idx[0], []byte(email), fl)
+	err := ent.LoadEntByIndexKey(s, e, &ent_Account_idx[ent_Account_idx_email], []byte(email), fl)
 	return e, err
 }
 
+// LoadAccountByEmailContext is like LoadAccountByEmail but with ctx (see ent.WithContext)
+func LoadAccountByEmailContext(ctx context.Context, s ent.Storage, email string, fl ...ent.LookupFlags) (*Account, error) {
+	return LoadAccountByEmail(ent.WithContext(ctx, s), email, fl...)
+}
+
+// LoadOrCreateAccountByEmail loads Account with email or, if there is no such ent, creates it.
+// init is called with the new ent, which has email set, before it is created and
+// may be nil. Returns true if the ent was created.
+func LoadOrCreateAccountByEmail(s ent.Storage, email string, init func(e *Account)) (*Account, bool, error) {
+	e := &Account{}
+	created, err := ent.LoadOrCreate(e, s, &ent_Account_idx[ent_Account_idx_email], []byte(email), func() {
+		e.email = email
+		if init != nil {
+			init(e)
+		}
+	})
+	return e, created, err
+}
+
+// LoadOrCreateAccountByEmailContext is like LoadOrCreateAccountByEmail but with ctx (see ent.WithContext)
+func LoadOrCreateAccountByEmailContext(ctx context.Context, s ent.Storage, email string, init func(e *Account)) (*Account, bool, error) {
+	return LoadOrCreateAccountByEmail(ent.WithContext(ctx, s), email, init)
+}
+
 // FindAccountByEmail looks up Account id with email
 func FindAccountByEmail(s ent.Storage, email string, fl ...ent.LookupFlags) (uint64, error) {
-	return ent.FindIdByIndexKey(s, "account", &ent_Account_idx[0], []byte(email), fl)
+	return ent.FindIdByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(email), fl)
+}
+
+// FindAccountByEmailContext is like FindAccountByEmail but with ctx (see ent.WithContext)
+func FindAccountByEmailContext(ctx context.Context, s ent.Storage, email string, fl ...ent.LookupFlags) (uint64, error) {
+	return FindAccountByEmail(ent.WithContext(ctx, s), email, fl...)
+}
+
+// CountAccountByEmail returns the number of Account ents with email
+func CountAccountByEmail(s ent.Storage, email string) (int, error) {
+	return ent.CountByIndexKey(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(email))
+}
+
+// CountAccountByEmailContext is like CountAccountByEmail but with ctx (see ent.WithContext)
+func CountAccountByEmailContext(ctx context.Context, s ent.Storage, email string) (int, error) {
+	return CountAccountByEmail(ent.WithContext(ctx, s), email)
+}
+
+// DeleteAccountByEmail permanently deletes all Account ents with email.
+// Returns the number of ents deleted.
+func DeleteAccountByEmail(s ent.Storage, email string) (int, error) {
+	return ent.DeleteEntsByIndexKey(s, &Account{}, &ent_Account_idx[ent_Account_idx_email], []byte(email))
+}
+
+// DeleteAccountByEmailContext is like DeleteAccountByEmail but with ctx (see ent.WithContext)
+func DeleteAccountByEmailContext(ctx context.Context, s ent.Storage, email string) (int, error) {
+	return DeleteAccountByEmail(ent.WithContext(ctx, s), email)
+}
+
+// FindAccountByEmailPrefix looks up Account ids with email starting with prefix, ordered by email
+// Note: the redis storage scans all keys of a unique index for this lookup.
+func FindAccountByEmailPrefix(s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return ent.FindIdsByIndexKeyPrefix(s, "account", &ent_Account_idx[ent_Account_idx_email], []byte(prefix), limit, fl)
+}
+
+// FindAccountByEmailPrefixContext is like FindAccountByEmailPrefix but with ctx (see ent.WithContext)
+func FindAccountByEmailPrefixContext(ctx context.Context, s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByEmailPrefix(ent.WithContext(ctx, s), prefix, limit, fl...)
+}
+
+// LoadAccountByEmailPrefix loads Account ents with email starting with prefix, ordered by email
+// Note: the redis storage scans all keys of a unique index for this lookup.
+func LoadAccountByEmailPrefix(s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	e := &Account{}
+	r, err := ent.LoadEntsByIndexKeyPrefix(s, e, &ent_Account_idx[ent_Account_idx_email], []byte(prefix), limit, fl)
+	return ent_Account_slice_cast(r), err
+}
+
+// LoadAccountByEmailPrefixContext is like LoadAccountByEmailPrefix but with ctx (see ent.WithContext)
+func LoadAccountByEmailPrefixContext(ctx context.Context, s ent.Storage, prefix string, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByEmailPrefix(ent.WithContext(ctx, s), prefix, limit, fl...)
+}
+
+// ListAccountEmailKeys returns all email values of Account ents, in sorted order
+func ListAccountEmailKeys(s ent.Storage) ([]string, error) {
+	return ent.ListIndexKeyStrings(s, "account", &ent_Account_idx[ent_Account_idx_email])
 }
 
 // LoadAccountByKind loads all Account ents with kind
 func LoadAccountByKind(s ent.Storage, kind AccountKind, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
 	e := &Account{}
-	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[1], limit, fl, 1, func(c ent.Encoder) {
+	r, err := ent.LoadEntsByIndex(s, e, &ent_Account_idx[ent_Account_idx_kind], limit, fl, 1, func(c ent.Encoder) {
 		c.Int(int64(kind), 32)
 	})
 	return ent_Account_slice_cast(r), err
 }
 
+// LoadAccountByKindContext is like LoadAccountByKind but with ctx (see ent.WithContext)
+func LoadAccountByKindContext(ctx context.Context, s ent.Storage, kind AccountKind, limit int, fl ...ent.LookupFlags) ([]*Account, error) {
+	return LoadAccountByKind(ent.WithContext(ctx, s), kind, limit, fl...)
+}
+
+// LoadAccountByKindPaged loads a page of at most limit Account ents with kind, starting after cursor.
+// Pass a nil cursor for the first page. The returned cursor is nil after the last page.
+func LoadAccountByKindPaged(s ent.Storage, kind AccountKind, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	e := &Account{}
+	r, next, err := ent.LoadEntsByIndexPaged(s, e, &ent_Account_idx[ent_Account_idx_kind], cursor, limit, fl, 1, func(c ent.Encoder) {
+		c.Int(int64(kind), 32)
+	})
+	return ent_Account_slice_cast(r), next, err
+}
+
+// LoadAccountByKindPagedContext is like LoadAccountByKindPaged but with ctx (see ent.WithContext)
+func LoadAccountByKindPagedContext(ctx context.Context, s ent.Storage, kind AccountKind, cursor []byte, limit int, fl ...ent.LookupFlags) ([]*Account, []byte, error) {
+	return LoadAccountByKindPaged(ent.WithContext(ctx, s), kind, cursor, limit, fl...)
+}
+
 // FindAccountByKind looks up Account ids with kind
 func FindAccountByKind(s ent.Storage, kind AccountKind, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
-	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[1], limit, fl, 1, func(c ent.Encoder) {
+	return ent.FindIdsByIndex(s, "account", &ent_Account_idx[ent_Account_idx_kind], limit, fl, 1, func(c ent.Encoder) {
+		c.Int(int64(kind), 32)
+	})
+}
+
+// FindAccountByKindContext is like FindAccountByKind but with ctx (see ent.WithContext)
+func FindAccountByKindContext(ctx context.Context, s ent.Storage, kind AccountKind, limit int, fl ...ent.LookupFlags) ([]uint64, error) {
+	return FindAccountByKind(ent.WithContext(ctx, s), kind, limit, fl...)
+}
+
+// CountAccountByKind returns the number of Account ents with kind
+func CountAccountByKind(s ent.Storage, kind AccountKind) (int, error) {
+	return ent.CountByIndex(s, "account", &ent_Account_idx[ent_Account_idx_kind], 1, func(c ent.Encoder) {
 		c.Int(int64(kind), 32)
 	})
 }
 
+// CountAccountByKindContext is like CountAccountByKind but with ctx (see ent.WithContext)
+func CountAccountByKindContext(ctx context.Context, s ent.Storage, kind AccountKind) (int, error) {
+	return CountAccountByKind(ent.WithContext(ctx, s), kind)
+}
+
+// DeleteAccountByKind permanently deletes all Account ents with kind.
+// Returns the number of ents deleted.
+func DeleteAccountByKind(s ent.Storage, kind AccountKind) (int, error) {
+	return ent.DeleteEntsByIndex(s, &Account{}, &ent_Account_idx[ent_Account_idx_kind], 1, func(c ent.Encoder) {
+		c.Int(int64(kind), 32)
+	})
+}
+
+// DeleteAccountByKindContext is like DeleteAccountByKind but with ctx (see ent.WithContext)
+func DeleteAccountByKindContext(ctx context.Context, s ent.Storage, kind AccountKind) (int, error) {
+	return DeleteAccountByKind(ent.WithContext(ctx, s), kind)
+}
+
 // EntTypeName returns the ent's storage name ("account")
 func (e Account) EntTypeName() string { return "account" }
 
 // EntStorage returns the storage this ent belongs to or nil if it doesn't belong anywhere.
 func (e *Account) EntStorage() ent.Storage { return ent.GetStorage(e) }
 
+// BindStorage binds the ent to storage as version of the ent with id (see ent.BindStorage)
+func (e *Account) BindStorage(storage ent.Storage, id, version uint64) {
+	ent.BindStorage(e, storage, id, version)
+}
+
 // EntNew returns a new empty Account. Used by the ent package for loading ents.
 func (e Account) EntNew() ent.Ent { return &Account{} }
 
 // MarshalJSON returns a JSON representation of e. Conforms to json.Marshaler.
 func (e *Account) MarshalJSON() ([]byte, error) { return ent.JsonEncode(e, "") }
 
-// UnmarshalJSON populates the ent from JSON data. Conforms to json.Unmarshaler.
+// UnmarshalJSON populates the ent from JSON data, including its id and version.
+// Conforms to json.Unmarshaler. Use ent.JsonDecodeFields for untrusted data.
 func (e *Account) UnmarshalJSON(b []byte) error { return ent.JsonDecode(e, b) }
 
 // String returns a JSON representation of e.
 func (e Account) String() string { return ent.EntString(&e) }
 
+// Clone returns a copy of e. Slice and map fields are copied while other fields,
+// like pointers, are copied shallowly. Useful with ent.Atomic for copy-on-write.
+func (e *Account) Clone() *Account {
+	c := *e
+	return &c
+}
+
+// EntMergeFrom copies the fields in fields from other, which must be a *Account.
+// Values are copied shallowly. Used by ent.MergeEnt.
+func (e *Account) EntMergeFrom(other ent.Ent, fields ent.FieldSet) {
+	o := other.(*Account)
+	if fields.Has(0) {
+		e.name = o.name
+	}
+	if fields.Has(1) {
+		e.displayName = o.displayName
+	}
+	if fields.Has(2) {
+		e.email = o.email
+	}
+	if fields.Has(3) {
+		e.kind = o.kind
+	}
+}
+
 // Create a new account ent in storage
 func (e *Account) Create(storage ent.Storage) error { return ent.CreateEnt(e, storage) }
 
+// CreateContext is like Create but with ctx (see ent.WithContext)
+func (e *Account) CreateContext(ctx context.Context, storage ent.Storage) error {
+	return ent.CreateEnt(e, ent.WithContext(ctx, storage))
+}
+
 // Save pending changes to whatever storage this ent was created or loaded from
 func (e *Account) Save() error { return ent.SaveEnt(e) }
 
+// SaveContext is like Save but with ctx (see ent.WithContext)
+func (e *Account) SaveContext(ctx context.Context) error { return ent.SaveEntContext(ctx, e) }
+
 // Reload fields to latest values from storage, discarding any unsaved changes
 func (e *Account) Reload() error { return ent.ReloadEnt(e) }
 
+// ReloadContext is like Reload but with ctx (see ent.WithContext)
+func (e *Account) ReloadContext(ctx context.Context) error { return ent.ReloadEntContext(ctx, e) }
+
 // PermanentlyDelete deletes this ent from storage. This can usually not be undone.
 func (e *Account) PermanentlyDelete() error { return ent.DeleteEnt(e) }
 
+// PermanentlyDeleteContext is like PermanentlyDelete but with ctx (see ent.WithContext)
+func (e *Account) PermanentlyDeleteContext(ctx context.Context) error {
+	return ent.DeleteEntContext(ctx, e)
+}
+
 // Iterator returns an iterator over all Account ents. Order is undefined.
 func (e Account) Iterator(s ent.Storage) ent.EntIterator { return s.IterateEnts(&e) }
 
+// IteratorFiltered returns an iterator over the Account ents for which keep returns true.
+// The ents are loaded and then filtered in memory. Order is undefined.
+func (e Account) IteratorFiltered(s ent.Storage, keep func(*Account) bool) ent.EntIterator {
+	it := s.IterateEnts(&e)
+	return ent.FilterEnts(it, func(e ent.Ent) bool { return keep(e.(*Account)) })
+}
+
 // ---- field accessor methods ----
 
 func (e *Account) Name() string        { return e.name }
@@ -171,11 +386,12 @@ func (e *Account) EntDecode(c ent.Decoder) (id, version uint64) {
 
 // EntDecodePartial is used internally by ent.Storage during updates.
 func (e *Account) EntDecodePartial(c ent.Decoder, fields ent.FieldSet) (version uint64) {
-	for n := 2; n > 0; {
+	for n := 3; n > 0; {
 		switch string(c.Key()) {
 		case "":
 			return
 		case ent.FieldNameVersion:
+			n--
 			version = c.Uint(64)
 			continue
 		case "email":
@@ -218,12 +434,18 @@ var ent_Account_fields = ent.Fields{
 // EntFields returns information about Account fields
 func (e Account) EntFields() ent.Fields { return ent_Account_fields }
 
-// Indexes (Name, Fields, Flags)
+// Indexes (Name, Fields, Flags, Where, Score)
 var ent_Account_idx = []ent.EntIndex{
-	{"email", 1 << ent_Account_f_email, ent.EntIndexUnique},
-	{"kind", 1 << ent_Account_f_kind, 0},
+	{"email", 1 << ent_Account_f_email, ent.EntIndexUnique, 0, 0},
+	{"kind", 1 << ent_Account_f_kind, 0, 0, 0},
 }
 
+// Symbolic index positions in ent_Account_idx
+const (
+	ent_Account_idx_email = 0
+	ent_Account_idx_kind  = 1
+)
+
 // EntIndexes returns information about secondary indexes
 func (e *Account) EntIndexes() []ent.EntIndex { return ent_Account_idx }
 
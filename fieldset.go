@@ -1,13 +1,19 @@
 package ent
 
 import (
+	mathbits "math/bits"
 	"reflect"
 
 	"github.com/rsms/go-bits"
 )
 
+// FieldSet is a set of fields of an ent, as a bitmap with one bit per field index.
+// Hence an ent can have at most MaxFields fields; entgen rejects ents with more fields.
 type FieldSet uint64
 
+// MaxFields is the max number of fields of an ent
+const MaxFields = 64
+
 func (f FieldSet) Len() int { return bits.PopcountUint64(uint64(f)) }
 
 func (f FieldSet) With(fieldIndex int) FieldSet {
@@ -22,7 +28,13 @@ func (f FieldSet) Has(fieldIndex int) bool {
 	return (f & (1 << fieldIndex)) != 0
 }
 
+// Contains returns true if all fields of other are in f
 func (f FieldSet) Contains(other FieldSet) bool {
+	return (f & other) == other
+}
+
+// Intersects returns true if any field of other is in f
+func (f FieldSet) Intersects(other FieldSet) bool {
 	return (f & other) != 0
 }
 
@@ -30,6 +42,28 @@ func (f FieldSet) Union(other FieldSet) FieldSet {
 	return f | other
 }
 
+// Each calls fn with the index of each field in f, in field order
+func (f FieldSet) Each(fn func(fieldIndex int)) {
+	for f != 0 {
+		fn(mathbits.TrailingZeros64(uint64(f)))
+		f &= f - 1 // clear lowest bit
+	}
+}
+
+// NamesOf returns the storage names of the fields in f, in field order, or nil if f is empty
+func (fs Fields) NamesOf(f FieldSet) []string {
+	if f == 0 {
+		return nil
+	}
+	names := make([]string, 0, f.Len())
+	f.Each(func(i int) {
+		if i < len(fs.Names) {
+			names = append(names, fs.Names[i])
+		}
+	})
+	return names
+}
+
 // FieldsWithEmptyValue returns a FieldSet of all non-numeric non-bool fields
 // which has a zero value for its type.
 func FieldsWithEmptyValue(e Ent) FieldSet {
@@ -53,15 +87,16 @@ func FieldsWithEmptyValue(e Ent) FieldSet {
 	return fields
 }
 
-// // FieldsWithZeroValue returns a fieldmap of all fields which has a zero value for its type.
-// func FieldsWithZeroValue(e Ent) uint64 {
-// 	v := reflect.ValueOf(e).Elem()
-// 	n := v.NumField()
-// 	var fieldmap uint64
-// 	for i := 1; i < n; i++ {
-// 		if v.Field(i).IsZero() {
-// 			fieldmap |= (1 << (i - 1))
-// 		}
-// 	}
-// 	return fieldmap
-// }
+// FieldsWithZeroValue returns a FieldSet of all fields which has a zero value for its type.
+// Unlike FieldsWithEmptyValue, this includes numeric and bool fields.
+func FieldsWithZeroValue(e Ent) FieldSet {
+	v := reflect.ValueOf(e).Elem()
+	n := v.NumField()
+	var fields FieldSet
+	for i := 1; i < n; i++ {
+		if v.Field(i).IsZero() {
+			fields |= (1 << (i - 1))
+		}
+	}
+	return fields
+}
@@ -0,0 +1,36 @@
+package ent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestFieldSetContainsIntersects(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	f := FieldSet(0).With(0).With(2) // fields 0 and 2
+	assert.Eq("Contains single", f.Contains(FieldSet(1<<0)), true)
+	assert.Eq("Contains all", f.Contains(FieldSet(1<<0|1<<2)), true)
+	assert.Eq("Contains some", f.Contains(FieldSet(1<<0|1<<1)), false)
+	assert.Eq("Contains none", f.Contains(FieldSet(1<<1)), false)
+	assert.Eq("Contains empty", f.Contains(0), true)
+	assert.Eq("Intersects single", f.Intersects(FieldSet(1<<2)), true)
+	assert.Eq("Intersects some", f.Intersects(FieldSet(1<<0|1<<1)), true)
+	assert.Eq("Intersects none", f.Intersects(FieldSet(1<<1|1<<3)), false)
+	assert.Eq("Intersects empty", f.Intersects(0), false)
+}
+
+func TestFieldSetEach(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var indexes []int
+	FieldSet(0).With(1).With(3).With(63).Each(func(i int) { indexes = append(indexes, i) })
+	assert.Eq("Each", fmt.Sprint(indexes), "[1 3 63]")
+	FieldSet(0).Each(func(i int) { t.Errorf("Each called for empty set") })
+
+	fields := Fields{Names: []string{"a", "b", "c"}, FieldSet: 7}
+	assert.Eq("NamesOf", fmt.Sprint(fields.NamesOf(FieldSet(0).With(0).With(2))), "[a c]")
+	assert.Eq("NamesOf empty", fields.NamesOf(0) == nil, true)
+	allocs := testing.AllocsPerRun(10, func() { fields.FieldSet.Each(func(int) {}) })
+	assert.Eq("Each allocs", allocs, 0.0)
+}
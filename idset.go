@@ -10,17 +10,26 @@ import (
 type IdSet []uint64
 
 func ParseIdSet(data []byte) IdSet {
+	ids, err := parseIdSet(data)
+	if err != nil {
+		panic("failed to parse IdSet " + err.Error())
+	}
+	return ids
+}
+
+// parseIdSet is like ParseIdSet but returns an error instead of panicking on malformed data
+func parseIdSet(data []byte) (IdSet, error) {
 	var ids IdSet
 	if len(data) > 0 {
 		for _, chunk := range bytes.Split(data, []byte{' '}) {
 			u, err := strconv.ParseUint(string(chunk), 10, 64)
 			if err != nil {
-				panic("failed to parse IdSet " + err.Error())
+				return nil, err
 			}
 			ids = append(ids, u)
 		}
 	}
-	return ids
+	return ids, nil
 }
 
 func (s IdSet) Encode() []byte {
@@ -66,3 +75,106 @@ func (s *IdSet) Del(id uint64) {
 func (s IdSet) Sort() {
 	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
 }
+
+// Intersect returns the ids which are in both s and other.
+// The result is ordered like s. When both s and other are sorted, the sets are merged in one pass.
+func (s IdSet) Intersect(other IdSet) IdSet {
+	var result IdSet
+	if s.isSorted() && other.isSorted() {
+		for i, j := 0, 0; i < len(s) && j < len(other); {
+			if s[i] < other[j] {
+				i++
+			} else if s[i] > other[j] {
+				j++
+			} else {
+				result = append(result, s[i])
+				i++
+				j++
+			}
+		}
+		return result
+	}
+	m := other.makeMap()
+	for _, id := range s {
+		if _, ok := m[id]; ok {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// Union returns the ids which are in s, other or both.
+// The result holds the ids of s followed by the ids of other which are not in s, or, when both
+// s and other are sorted, all ids in sorted order.
+func (s IdSet) Union(other IdSet) IdSet {
+	result := make(IdSet, 0, len(s)+len(other))
+	if s.isSorted() && other.isSorted() {
+		i, j := 0, 0
+		for i < len(s) && j < len(other) {
+			if s[i] < other[j] {
+				result = append(result, s[i])
+				i++
+			} else if s[i] > other[j] {
+				result = append(result, other[j])
+				j++
+			} else {
+				result = append(result, s[i])
+				i++
+				j++
+			}
+		}
+		result = append(result, s[i:]...)
+		return append(result, other[j:]...)
+	}
+	m := s.makeMap()
+	result = append(result, s...)
+	for _, id := range other {
+		if _, ok := m[id]; !ok {
+			m[id] = struct{}{}
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// Subtract returns the ids of s which are not in other.
+// The result is ordered like s. When both s and other are sorted, the sets are merged in one pass.
+func (s IdSet) Subtract(other IdSet) IdSet {
+	var result IdSet
+	if s.isSorted() && other.isSorted() {
+		j := 0
+		for _, id := range s {
+			for j < len(other) && other[j] < id {
+				j++
+			}
+			if j == len(other) || other[j] != id {
+				result = append(result, id)
+			}
+		}
+		return result
+	}
+	m := other.makeMap()
+	for _, id := range s {
+		if _, ok := m[id]; !ok {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func (s IdSet) isSorted() bool {
+	for i := 1; i < len(s); i++ {
+		if s[i-1] > s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s IdSet) makeMap() map[uint64]struct{} {
+	m := make(map[uint64]struct{}, len(s))
+	for _, id := range s {
+		m[id] = struct{}{}
+	}
+	return m
+}
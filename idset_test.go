@@ -0,0 +1,31 @@
+package ent
+
+import (
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestIdSetAlgebra(t *testing.T) {
+	assert := testutil.NewAssert(t)
+
+	// sorted sets are merged
+	a := IdSet{1, 2, 4, 6}
+	b := IdSet{2, 3, 4, 7}
+	assert.Eq("Intersect sorted", string(a.Intersect(b).Encode()), "2 4")
+	assert.Eq("Union sorted", string(a.Union(b).Encode()), "1 2 3 4 6 7")
+	assert.Eq("Subtract sorted", string(a.Subtract(b).Encode()), "1 6")
+	assert.Eq("Subtract sorted reverse", string(b.Subtract(a).Encode()), "3 7")
+
+	// unsorted sets keep the order of the receiver
+	c := IdSet{6, 1, 4, 2}
+	assert.Eq("Intersect unsorted", string(c.Intersect(b).Encode()), "4 2")
+	assert.Eq("Union unsorted", string(c.Union(b).Encode()), "6 1 4 2 3 7")
+	assert.Eq("Subtract unsorted", string(c.Subtract(b).Encode()), "6 1")
+
+	// empty sets
+	assert.Eq("Intersect empty", len(a.Intersect(nil)), 0)
+	assert.Eq("Union empty", string(a.Union(nil).Encode()), "1 2 4 6")
+	assert.Eq("Subtract empty", string(a.Subtract(nil).Encode()), "1 2 4 6")
+	assert.Eq("Subtract from empty", len(IdSet(nil).Subtract(a)), 0)
+}
@@ -1,11 +1,15 @@
 package ent
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 // IndexGetter is used to look up an entry in an index
@@ -21,6 +25,9 @@ type StorageIndexEdit struct {
 	// A Storage implementation can choose to perform these edits independently from or outside of
 	// the logical transaction of modifying an ent.
 	IsCleanup bool
+
+	// Score is the score of an entry added to an index with a score field (see EntIndex.Score)
+	Score float64
 }
 
 // ComputeIndexEdits calculates changes to secondary indexes.
@@ -55,6 +62,19 @@ type StorageIndexEdit struct {
 //     }
 //   }
 //
+// A partial index (see EntIndex.Where) only has entries for ents which match its predicate.
+// When an ent no longer matches, its entries are removed.
+//
+// A multi-entry index (see EntIndexMulti) has one entry per element of its list field. Edits
+// are only produced for elements which were added or removed.
+//
+// When the score field of an index (see EntIndex.Score) has changed, all entries of the ent
+// in the index are removed and added again with the new score.
+//
+// Entries of soft-deleted ents (see SoftDeleter) are edited in DeletedIndex(x) rather than in x.
+// For this to work, changedFields must include both the soft-delete marker and the indexed
+// fields when either of them changed, which SaveEnt makes sure of.
+//
 // indexGet may be nil in which case it is assumed that calling storage handles sets of ids.
 // For example, ent/redis.EntStorage handles ids of non-unique indexes manually and thus
 // provides nil for indexGet, while ent/mem.EntStorage does not handle id sets itself and instead
@@ -111,6 +131,10 @@ func ComputeIndexEdits(
 		return nil, fmt.Errorf("different ent types (%s, %s)", prevEnt.EntTypeName(), entTypeName)
 	}
 
+	// soft-deleted ents (see SoftDeleter)
+	prevDeleted := prevEnt != nil && IsDeleted(prevEnt)
+	nextDeleted := nextEnt != nil && IsDeleted(nextEnt)
+
 	// allocate the max number of edits we may need up front
 	edits := make([]StorageIndexEdit, 0, changedFields.Len()*2)
 
@@ -122,7 +146,7 @@ func ComputeIndexEdits(
 	for i := range indexes {
 		x := &indexes[i] // *EntIndex
 
-		if !changedFields.Contains(x.Fields) {
+		if !changedFields.Intersects(x.Fields | x.Where | x.Score) {
 			// none of the fields that this index depends on has changed
 			// fmt.Printf("[ComputeIndexEdits] index %s unaffected (not in changedFields)\n", x.Name)
 			continue
@@ -130,51 +154,58 @@ func ComputeIndexEdits(
 		// fmt.Printf("[ComputeIndexEdits] index %s is affected\n", x.Name)
 
 		// build index entry keys
-		var prevValueKey, nextValueKey string
-		if prevEnt != nil {
-			data, err := indexKeyEncoder.EncodeKey(prevEnt, x.Fields)
+		var prevKeys, nextKeys []string
+		if prevEnt != nil && indexKeyEncoder.matchesWhere(prevEnt, x) {
+			keys, err := indexKeyEncoder.encodeIndexKeys(prevEnt, x)
 			if err != nil {
 				return nil, err
 			}
-			prevValueKey = string(data)
-			// fmt.Printf("[ComputeIndexEdits] prevValueKey %q\n", prevValueKey)
+			prevKeys = keys
+			// fmt.Printf("[ComputeIndexEdits] prevKeys %q\n", prevKeys)
 		}
-		if nextEnt != nil {
-			data, err := indexKeyEncoder.EncodeKey(nextEnt, x.Fields)
+		if nextEnt != nil && indexKeyEncoder.matchesWhere(nextEnt, x) {
+			keys, err := indexKeyEncoder.encodeIndexKeys(nextEnt, x)
 			if err != nil {
 				return nil, err
 			}
-			nextValueKey = string(data)
-			// fmt.Printf("[ComputeIndexEdits] nextValueKey %q\n", nextValueKey)
+			nextKeys = keys
+			// fmt.Printf("[ComputeIndexEdits] nextKeys %q\n", nextKeys)
+		}
+
+		// entries of soft-deleted ents are kept in a separate index
+		prevX, nextX := x, x
+		if prevDeleted {
+			prevX = DeletedIndex(x)
+		}
+		if nextDeleted {
+			nextX = DeletedIndex(x)
 		}
 
-		isUnique := x.IsUnique()
+		// identical keys? skip index changes.
+		// This happens if the same value is written to the field, which isn't uncommon.
+		// For a multi-entry index, only the entries of elements added or removed change.
+		if prevDeleted == nextDeleted && !changedFields.Intersects(x.Score) {
+			prevKeys, nextKeys = diffIndexKeys(prevKeys, nextKeys)
+		}
 
-		// remove old entry
-		if prevValueKey != "" {
-			// identical keys? skip index changes.
-			// This happens if the same value is written to the field, which isn't uncommon.
-			if prevValueKey == nextValueKey {
-				// fmt.Printf("[ComputeIndexEdits] identical; index keys skip\n")
-				continue
-			}
+		// remove old entries
+		for _, prevValueKey := range prevKeys {
 			var ids IdSet
 			var err error
 			if indexGet != nil {
-				ids, err = indexGet(entTypeName, x.Name, prevValueKey)
+				ids, err = indexGet(entTypeName, prevX.Name, prevValueKey)
 				if err != nil {
 					return nil, err
 				}
 			}
 			if len(ids) > 0 || indexGet == nil {
-				if isUnique || len(ids) == 1 {
+				if prevX.IsUnique() || len(ids) == 1 {
 					ids = nil
 				} else {
 					ids.Del(id)
 				}
-				// prevValueKey is borrowed from indexKeyEncoder
 				edits = append(edits, StorageIndexEdit{
-					Index:     x,
+					Index:     prevX,
 					Key:       prevValueKey,
 					Value:     ids,
 					IsCleanup: true,
@@ -183,15 +214,22 @@ func ComputeIndexEdits(
 			}
 		}
 
-		// add new entry
-		if nextValueKey != "" {
+		// add new entries
+		var score float64
+		if x.Score != 0 && len(nextKeys) > 0 {
+			var err error
+			if score, err = IndexScore(nextEnt, x); err != nil {
+				return nil, err
+			}
+		}
+		for _, nextValueKey := range nextKeys {
 			var ids IdSet
-			if isUnique {
+			if nextX.IsUnique() {
 				ids = IdSet{id}
 			} else {
 				var err error
 				if indexGet != nil {
-					ids, err = indexGet(entTypeName, x.Name, nextValueKey)
+					ids, err = indexGet(entTypeName, nextX.Name, nextValueKey)
 					if err != nil {
 						return nil, err
 					}
@@ -199,10 +237,11 @@ func ComputeIndexEdits(
 				ids.Add(id)
 			}
 			edits = append(edits, StorageIndexEdit{
-				Index:     x,
+				Index:     nextX,
 				Key:       nextValueKey,
 				Value:     ids,
 				IsCleanup: false,
+				Score:     score,
 			})
 		}
 	} // for each index
@@ -210,6 +249,67 @@ func ComputeIndexEdits(
 	return edits, nil
 }
 
+// encodeIndexKeys returns the keys of the entries of e in index x (see EncodeKeys.)
+// An index which is not multi-entry has at most one entry per ent; none if its key is empty.
+func (c *IndexKeyEncoder) encodeIndexKeys(e Ent, x *EntIndex) ([]string, error) {
+	if x.IsMulti() {
+		return c.EncodeKeys(e, x.Fields)
+	}
+	data, err := c.EncodeKey(e, x.Fields)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return []string{string(data)}, nil
+}
+
+// matchesWhere returns true if e has entries in x, which is the case when x is not a partial
+// index or when all bool fields of x.Where are true for e
+func (c *IndexKeyEncoder) matchesWhere(e Ent, x *EntIndex) bool {
+	for i := 0; x.Where>>uint(i) != 0; i++ {
+		if x.Where.Has(i) {
+			// a single bool field is encoded as 0 or 1
+			if key, err := c.EncodeKey(e, FieldSet(0).With(i)); err != nil || string(key) != "\x01" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indexFields returns the fields to save for e, given changed fields.
+// A change to a field of an index includes all other fields of the index, as well as the
+// fields of its Where predicate and its score field, and vice versa. Storage which loads only
+// the saved fields of the previous version of an ent can then tell which entries it had (see ComputeIndexEdits), which
+// for a multi-field index depends on the values of all of its fields.
+func indexFields(e Ent, fields FieldSet) FieldSet {
+	for _, x := range e.EntIndexes() {
+		if fields.Intersects(x.Fields | x.Where | x.Score) {
+			fields |= x.Fields | x.Where | x.Score
+		}
+	}
+	return fields
+}
+
+// diffIndexKeys removes keys which are in both a and b from a and b.
+// a and b must be sorted, which is the case for keys of encodeIndexKeys.
+func diffIndexKeys(a, b []string) ([]string, []string) {
+	var a2, b2 []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			i++
+			j++
+		} else if a[i] < b[j] {
+			a2 = append(a2, a[i])
+			i++
+		} else {
+			b2 = append(b2, b[j])
+			j++
+		}
+	}
+	return append(a2, a[i:]...), append(b2, b[j:]...)
+}
+
 func mergeLookupFlags(v []LookupFlags) (flags LookupFlags) {
 	for _, fl := range v {
 		flags |= fl
@@ -237,9 +337,9 @@ func FindIdsByIndex(
 	s Storage, entTypeName string, x *EntIndex, limit int, flags []LookupFlags,
 	nfields int, keyEncoder func(Encoder),
 ) ([]uint64, error) {
-	var c IndexKeyEncoder
-	c.Reset(nfields)
-	keyEncoder(&c)
+	c := getIndexKeyEncoder(nfields)
+	defer indexKeyEncoderPool.Put(c)
+	keyEncoder(c)
 	if c.err != nil {
 		return nil, c.err
 	}
@@ -274,10 +374,314 @@ func FindIdByIndexKey(
 	return 0, err
 }
 
-func LoadEntsByIndex(
+func CountByIndexKey(s Storage, entTypeName string, x *EntIndex, key []byte) (int, error) {
+	return s.Count(entTypeName, x, key)
+}
+
+func CountByIndex(
+	s Storage, entTypeName string, x *EntIndex, nfields int, keyEncoder func(Encoder),
+) (int, error) {
+	c := getIndexKeyEncoder(nfields)
+	defer indexKeyEncoderPool.Put(c)
+	keyEncoder(c)
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.EndEnt()
+	return CountByIndexKey(s, entTypeName, x, c.b.Bytes())
+}
+
+// FindIdsByIndexKeyRange returns ids of ents which key in index x is in the range [lo, hi],
+// ordered by key.
+//
+// Keys are compared as byte strings, which matches the order of values only for some types.
+// Unsigned integers are encoded in big-endian byte order and so are ordered correctly, while
+// signed integers need to be offset encoded to be ordered correctly, e.g. by storing an int32
+// as uint32(int64(v) + 1<<31). Floats are encoded as text and are not ordered.
+// Storages may also order keys of different lengths inconsistently (for example redis orders
+// the key "a" after the key "ab" of a non-unique index), so range lookups are only reliable for
+// indexes with keys of the same length, like those of unsigned integer fields.
+func FindIdsByIndexKeyRange(
+	s Storage, entTypeName string, x *EntIndex, lo, hi []byte, limit int, flags []LookupFlags,
+) ([]uint64, error) {
+	if !s.Capabilities().Has(CapRange) {
+		return nil, ErrUnsupported
+	}
+	return s.FindByIndexRange(entTypeName, x, lo, hi, limit, mergeLookupFlags(flags))
+}
+
+// FindIdsByIndexRange is like FindIdsByIndexKeyRange but with the range defined by key encoders
+func FindIdsByIndexRange(
+	s Storage, entTypeName string, x *EntIndex, limit int, flags []LookupFlags,
+	nfields int, loEncoder, hiEncoder func(Encoder),
+) ([]uint64, error) {
+	lo, err := encodeIndexKey(nfields, loEncoder)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := encodeIndexKey(nfields, hiEncoder)
+	if err != nil {
+		return nil, err
+	}
+	return FindIdsByIndexKeyRange(s, entTypeName, x, lo, hi, limit, flags)
+}
+
+// LoadEntsByIndexKeyRange loads the ents found by FindIdsByIndexKeyRange.
+// The first ent returned is e. Ents which are deleted while loading are left out.
+func LoadEntsByIndexKeyRange(
+	s Storage, e Ent, x *EntIndex, lo, hi []byte, limit int, flags []LookupFlags,
+) ([]Ent, error) {
+	ids, err := FindIdsByIndexKeyRange(s, e.EntTypeName(), x, lo, hi, limit, flags)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return loadEntsById(s, e, ids)
+}
+
+// loadEntsById loads the ents with ids into e and new ents of the type of e, leaving out ents
+// which are not found
+func loadEntsById(s Storage, e Ent, ids []uint64) ([]Ent, error) {
+	ents := make([]Ent, 0, len(ids))
+	for _, id := range ids {
+		e2 := e
+		if len(ents) > 0 {
+			e2 = e.EntNew()
+		}
+		if err := LoadEntById(e2, s, id); err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		ents = append(ents, e2)
+	}
+	return ents, nil
+}
+
+// LoadEntsByIndexRange is like LoadEntsByIndexKeyRange but with the range defined by key encoders
+func LoadEntsByIndexRange(
 	s Storage, e Ent, x *EntIndex, limit int, flags []LookupFlags,
+	nfields int, loEncoder, hiEncoder func(Encoder),
+) ([]Ent, error) {
+	lo, err := encodeIndexKey(nfields, loEncoder)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := encodeIndexKey(nfields, hiEncoder)
+	if err != nil {
+		return nil, err
+	}
+	return LoadEntsByIndexKeyRange(s, e, x, lo, hi, limit, flags)
+}
+
+// FindIdsByIndexKeyPrefix returns ids of ents which key in index x starts with prefix, ordered
+// by key, e.g. for type-ahead search. Meant for indexes of a single string field.
+//
+// This is a range lookup (see FindIdsByIndexKeyRange) from prefix to prefix+"\xff", which
+// matches all keys with the prefix since valid UTF-8 never contains the byte 0xFF. Note that
+// the redis storage scans all keys of a unique index for a range lookup, while non-unique
+// indexes are kept in a sorted set which is looked up directly.
+func FindIdsByIndexKeyPrefix(
+	s Storage, entTypeName string, x *EntIndex, prefix []byte, limit int, flags []LookupFlags,
+) ([]uint64, error) {
+	hi := append(append(make([]byte, 0, len(prefix)+1), prefix...), 0xff)
+	return FindIdsByIndexKeyRange(s, entTypeName, x, prefix, hi, limit, flags)
+}
+
+// LoadEntsByIndexKeyPrefix loads the ents found by FindIdsByIndexKeyPrefix.
+// The first ent returned is e. Ents which are deleted while loading are left out.
+func LoadEntsByIndexKeyPrefix(
+	s Storage, e Ent, x *EntIndex, prefix []byte, limit int, flags []LookupFlags,
+) ([]Ent, error) {
+	ids, err := FindIdsByIndexKeyPrefix(s, e.EntTypeName(), x, prefix, limit, flags)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return loadEntsById(s, e, ids)
+}
+
+// FindIdsByIndexKeyScoreRange returns ids of ents with key in index x which score is in the
+// range [min, max], ordered by score and then by id. x must have a score field
+// (see EntIndex.Score). Use math.Inf(-1) and math.Inf(1) for an unbounded range, e.g. to find
+// the N ents with the highest scores with Reverse and a limit of N.
+func FindIdsByIndexKeyScoreRange(
+	s Storage, entTypeName string, x *EntIndex, key []byte, min, max float64, limit int,
+	flags []LookupFlags,
+) ([]uint64, error) {
+	if x.Score == 0 {
+		return nil, fmt.Errorf("index %s has no score field", x.Name)
+	}
+	if !s.Capabilities().Has(CapScoreRange) {
+		return nil, ErrUnsupported
+	}
+	return s.FindByIndexScoreRange(entTypeName, x, key, min, max, limit, mergeLookupFlags(flags))
+}
+
+// FindIdsByIndexScoreRange is like FindIdsByIndexKeyScoreRange but with the key defined by an
+// encoder
+func FindIdsByIndexScoreRange(
+	s Storage, entTypeName string, x *EntIndex, min, max float64, limit int, flags []LookupFlags,
+	nfields int, keyEncoder func(Encoder),
+) ([]uint64, error) {
+	key, err := encodeIndexKey(nfields, keyEncoder)
+	if err != nil {
+		return nil, err
+	}
+	return FindIdsByIndexKeyScoreRange(s, entTypeName, x, key, min, max, limit, flags)
+}
+
+// LoadEntsByIndexKeyScoreRange loads the ents found by FindIdsByIndexKeyScoreRange.
+// The first ent returned is e. Ents which are deleted while loading are left out.
+func LoadEntsByIndexKeyScoreRange(
+	s Storage, e Ent, x *EntIndex, key []byte, min, max float64, limit int, flags []LookupFlags,
+) ([]Ent, error) {
+	ids, err := FindIdsByIndexKeyScoreRange(s, e.EntTypeName(), x, key, min, max, limit, flags)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return loadEntsById(s, e, ids)
+}
+
+// LoadEntsByIndexScoreRange is like LoadEntsByIndexKeyScoreRange but with the key defined by an
+// encoder
+func LoadEntsByIndexScoreRange(
+	s Storage, e Ent, x *EntIndex, min, max float64, limit int, flags []LookupFlags,
 	nfields int, keyEncoder func(Encoder),
 ) ([]Ent, error) {
+	key, err := encodeIndexKey(nfields, keyEncoder)
+	if err != nil {
+		return nil, err
+	}
+	return LoadEntsByIndexKeyScoreRange(s, e, x, key, min, max, limit, flags)
+}
+
+// LoadEntsByIndexKeyPaged loads a page of at most limit ents with key in index x, ordered by id.
+// The first ent returned is e.
+//
+// The page starts after cursor, which is either nil for the first page or a cursor returned
+// for a previous page. The cursor returned is nil when there are no more ents. Since a cursor
+// identifies the last ent of a page, rather than an offset, ents added or removed while paging
+// do not cause ents to be skipped or returned twice.
+func LoadEntsByIndexKeyPaged(
+	s Storage, e Ent, x *EntIndex, key, cursor []byte, limit int, flags []LookupFlags,
+) ([]Ent, []byte, error) {
+	return s.LoadByIndexPaged(e, x, key, cursor, limit, mergeLookupFlags(flags))
+}
+
+// LoadEntsByIndexPaged is like LoadEntsByIndexKeyPaged but with the key defined by an encoder
+func LoadEntsByIndexPaged(
+	s Storage, e Ent, x *EntIndex, cursor []byte, limit int, flags []LookupFlags,
+	nfields int, keyEncoder func(Encoder),
+) ([]Ent, []byte, error) {
+	key, err := encodeIndexKey(nfields, keyEncoder)
+	if err != nil {
+		return nil, nil, err
+	}
+	return LoadEntsByIndexKeyPaged(s, e, x, key, cursor, limit, flags)
+}
+
+// IndexCursor returns a cursor for a page starting after the ent with id.
+// Meant to be used by Storage implementations of LoadByIndexPaged.
+func IndexCursor(id uint64) []byte {
+	cursor := make([]byte, 8)
+	binary.BigEndian.PutUint64(cursor, id)
+	return cursor
+}
+
+// ParseIndexCursor returns the id of a cursor created by IndexCursor.
+// Returns 0 for a nil cursor.
+func ParseIndexCursor(cursor []byte) (uint64, error) {
+	if cursor == nil {
+		return 0, nil
+	}
+	if len(cursor) != 8 {
+		return 0, ErrInvalidCursor
+	}
+	return binary.BigEndian.Uint64(cursor), nil
+}
+
+// PageIds returns the page of ids which starts after cursor along with the cursor of the next
+// page (see LoadEntsByIndexKeyPaged.) ids must be sorted in ascending order.
+// Meant to be used by Storage implementations of LoadByIndexPaged.
+func PageIds(ids []uint64, cursor []byte, limit int, flags LookupFlags) ([]uint64, []byte, error) {
+	after, err := ParseIndexCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	var page []uint64
+	if (flags & Reverse) != 0 {
+		i := len(ids)
+		if cursor != nil {
+			i = sort.Search(len(ids), func(i int) bool { return ids[i] >= after })
+		}
+		for i--; i >= 0 && (limit <= 0 || len(page) < limit); i-- {
+			page = append(page, ids[i])
+		}
+		if i < 0 {
+			return page, nil, nil
+		}
+	} else {
+		i := 0
+		if cursor != nil {
+			i = sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+		}
+		page = ids[i:]
+		if limit <= 0 || len(page) <= limit {
+			return page, nil, nil
+		}
+		page = page[:limit]
+	}
+	return page, IndexCursor(page[len(page)-1]), nil
+}
+
+// LimitIds returns at most limit ids of ids, which must be in ascending order, the way a lookup
+// with flags returns them: when flags contains Reverse, the order of ids is reversed before the
+// limit is applied, so that the last (e.g. newest) ids are returned. ids is modified in place.
+// Meant to be used by Storage implementations of FindByIndex and FindByIndexRange.
+func LimitIds(ids []uint64, limit int, flags LookupFlags) []uint64 {
+	if (flags & Reverse) != 0 {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+// DeleteEntsByIndexKey permanently deletes all ents of the type of e with key in index x,
+// including their index entries. e is only used as a prototype and is not modified.
+// Returns the number of ents deleted.
+func DeleteEntsByIndexKey(s Storage, e Ent, x *EntIndex, key []byte) (int, error) {
+	return s.DeleteByIndex(e, x, key)
+}
+
+// DeleteEntsByIndex is like DeleteEntsByIndexKey but with the key defined by an encoder
+func DeleteEntsByIndex(
+	s Storage, e Ent, x *EntIndex, nfields int, keyEncoder func(Encoder),
+) (int, error) {
+	key, err := encodeIndexKey(nfields, keyEncoder)
+	if err != nil {
+		return 0, err
+	}
+	return DeleteEntsByIndexKey(s, e, x, key)
+}
+
+// indexKeyEncoderPool holds IndexKeyEncoders for encoding the keys of lookups, which are only
+// used for the duration of a call to the storage (see getIndexKeyEncoder)
+var indexKeyEncoderPool = sync.Pool{New: func() interface{} { return new(IndexKeyEncoder) }}
+
+// getIndexKeyEncoder returns a reset IndexKeyEncoder from indexKeyEncoderPool.
+// Put it back when done with both the encoder and the key it encoded.
+func getIndexKeyEncoder(nfields int) *IndexKeyEncoder {
+	c := indexKeyEncoderPool.Get().(*IndexKeyEncoder)
+	c.Reset(nfields)
+	c.err = nil
+	return c
+}
+
+func encodeIndexKey(nfields int, keyEncoder func(Encoder)) ([]byte, error) {
 	var c IndexKeyEncoder
 	c.Reset(nfields)
 	keyEncoder(&c)
@@ -285,6 +689,130 @@ func LoadEntsByIndex(
 		return nil, c.err
 	}
 	c.EndEnt()
+	return c.b.Bytes(), nil
+}
+
+// EncodeScalarIndexKey writes the key of integer v of bitsize (8, 16, 32 or 64) in a
+// single-field index to buf and returns that part of buf. The key is the same as the one
+// IndexKeyEncoder produces; pass signed integers as uint64(v).
+//
+// A key passed to a Storage escapes to the heap, so declaring buf for each lookup allocates,
+// while lookups with a key encoder (like FindIdsByIndex) use pooled encoders and don't.
+// EncodeScalarIndexKey is meant for code doing many lookups, which can reuse buf.
+func EncodeScalarIndexKey(buf *[8]byte, v uint64, bitsize int) []byte {
+	switch bitsize {
+	case 8:
+		buf[0] = uint8(v)
+		return buf[:1]
+	case 16:
+		writeUint16BE(buf[:2], uint16(v))
+		return buf[:2]
+	case 32:
+		writeUint32BE(buf[:4], uint32(v))
+		return buf[:4]
+	default:
+		writeUint64BE(buf[:], v)
+		return buf[:]
+	}
+}
+
+// EncodeIndexKey returns the key of e in index x, encoded like when ent maintains the index
+// (see IndexKeyEncoder for the format.) An empty key means that e has no entry in x.
+// Note that the key is returned even if e has no entry in a partial index (see EntIndex.Where).
+// Returns an error for a multi-entry index, which has one key per element of its field;
+// use IndexKeyEncoder.EncodeKeys for that kind of index.
+func EncodeIndexKey(e Ent, x *EntIndex) ([]byte, error) {
+	if x.IsMulti() {
+		return nil, fmt.Errorf("multi-entry index %s has more than one key per ent", x.Name)
+	}
+	var c IndexKeyEncoder
+	return c.EncodeKey(e, x.Fields)
+}
+
+// IndexRebuilder is implemented by storages which can rebuild the indexes of a type of ent.
+// Used by RebuildIndexes.
+type IndexRebuilder interface {
+	// RebuildIndexes removes all index entries of the type of prototype and adds the entries of
+	// each ent of the type again
+	RebuildIndexes(prototype Ent) error
+}
+
+// RebuildIndexes rebuilds the indexes of all ents of the type of prototype from the ents
+// themselves. This is needed when the keys of an index are encoded differently than when the
+// ents were stored, e.g. after upgrading from a version of ent which ordered the fields of
+// multi-field keys by name (see IndexKeyEncoder), since lookups don't find entries with keys in
+// the old format. Ents should not be written while their indexes are being rebuilt.
+// Returns ErrUnsupported if s does not implement IndexRebuilder.
+func RebuildIndexes(s Storage, prototype Ent) error {
+	if r, ok := s.(IndexRebuilder); ok {
+		return r.RebuildIndexes(prototype)
+	}
+	return ErrUnsupported
+}
+
+// IndexScore returns the score of the entries of e in index x, which is the value of the score
+// field of x (see EntIndex.Score), or 0 if x has no score field.
+// Meant to be used by Storage implementations.
+func IndexScore(e Ent, x *EntIndex) (float64, error) {
+	if x.Score == 0 {
+		return 0, nil
+	}
+	var c indexScoreEncoder
+	e.EntEncode(&c, x.Score)
+	return c.score, c.err
+}
+
+// indexScoreEncoder is an Encoder which reads the value of a numeric field (see IndexScore)
+type indexScoreEncoder struct {
+	score float64
+	err   error
+}
+
+func (c *indexScoreEncoder) Err() error                   { return c.err }
+func (c *indexScoreEncoder) BeginEnt(version uint64)      {}
+func (c *indexScoreEncoder) EndEnt()                      {}
+func (c *indexScoreEncoder) BeginList(length int)         { c.setNotNumeric() }
+func (c *indexScoreEncoder) EndList()                     {}
+func (c *indexScoreEncoder) BeginDict(length int)         { c.setNotNumeric() }
+func (c *indexScoreEncoder) EndDict()                     {}
+func (c *indexScoreEncoder) Key(k string)                 {}
+func (c *indexScoreEncoder) Str(v string)                 { c.setNotNumeric() }
+func (c *indexScoreEncoder) Blob(v []byte)                { c.setNotNumeric() }
+func (c *indexScoreEncoder) Int(v int64, bitsize int)     { c.score = float64(v) }
+func (c *indexScoreEncoder) Uint(v uint64, bitsize int)   { c.score = float64(v) }
+func (c *indexScoreEncoder) Float(v float64, bitsize int) { c.score = v }
+func (c *indexScoreEncoder) Bool(v bool)                  { c.setNotNumeric() }
+
+func (c *indexScoreEncoder) setNotNumeric() {
+	if c.err == nil {
+		c.err = fmt.Errorf("index score field is not numeric")
+	}
+}
+
+// ListIndexKeyStrings returns the keys of index x as strings, in sorted order
+func ListIndexKeyStrings(s Storage, entTypeName string, x *EntIndex) ([]string, error) {
+	keys, err := s.ListIndexKeys(entTypeName, x)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]string, len(keys))
+	for i, k := range keys {
+		v[i] = string(k)
+	}
+	return v, nil
+}
+
+func LoadEntsByIndex(
+	s Storage, e Ent, x *EntIndex, limit int, flags []LookupFlags,
+	nfields int, keyEncoder func(Encoder),
+) ([]Ent, error) {
+	c := getIndexKeyEncoder(nfields)
+	defer indexKeyEncoderPool.Put(c)
+	keyEncoder(c)
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.EndEnt()
 	return LoadEntsByIndexKey(s, e, x, c.b.Bytes(), limit, flags)
 }
 
@@ -317,9 +845,91 @@ func LoadEntByIndexKey(s Storage, e Ent, x *EntIndex, key []byte, flags []Lookup
 	return err
 }
 
+// LoadOrCreate loads the ent with key in the unique index x into e or, if there is no such ent,
+// calls init to populate e and then creates it in s. init must set the fields of x to key.
+// If the ent is created by someone else between the lookup and the creation, i.e. creation
+// fails with ErrUniqueConflict, the lookup is retried once. Returns true if e was created.
+// entgen generates LoadOrCreateTYPEByINDEX functions for unique indexes.
+func LoadOrCreate(
+	e Ent, s Storage, x *EntIndex, key []byte, init func(),
+) (created bool, err error) {
+	for retry := false; ; retry = true {
+		err = LoadEntByIndexKey(s, e, x, key, nil)
+		if err != ErrNotFound {
+			return false, err
+		}
+		init()
+		err = CreateEnt(e, s)
+		if err == nil {
+			return true, nil
+		}
+		if retry || !errors.Is(err, ErrUniqueConflict) {
+			return false, err
+		}
+	}
+}
+
+// LoadOrCreateByIndex is like LoadOrCreate but with the key defined by an encoder
+func LoadOrCreateByIndex(
+	e Ent, s Storage, x *EntIndex, init func(), nfields int, keyEncoder func(Encoder),
+) (bool, error) {
+	key, err := encodeIndexKey(nfields, keyEncoder)
+	if err != nil {
+		return false, err
+	}
+	return LoadOrCreate(e, s, x, key, init)
+}
+
+// FoldIndexKey returns s with all letters case-folded to lower case, so that e.g. "Bob@Bob.com"
+// and "bob@bob.com" map to the same index key.
+func FoldIndexKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		// upper then lower maps letters like 'ſ' (long s) and 'K' (kelvin) to 's' and 'k'
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, s)
+}
+
+// EncodeStrFolded encodes v as a string, case-folded with FoldIndexKey when c is an
+// IndexKeyEncoder. The value stored with the ent keeps its original case.
+// entgen uses this function for string fields with the "fold" tag.
+func EncodeStrFolded(c Encoder, v string) {
+	if _, ok := c.(*IndexKeyEncoder); ok {
+		v = FoldIndexKey(v)
+	}
+	c.Str(v)
+}
+
 // ———————————————————————————————————————————————————————————————————————————————————
 
-// IndexKeyEncoder is an implementation of the Encoder interface, used to encode index keys
+// IndexKeyEncoder is an implementation of the Encoder interface, used to encode index keys.
+// EncodeIndexKey is a convenient way of computing the key of an ent in an index.
+//
+// The key of a single-field index is the value of the field:
+//
+//	string, []byte  the bytes of the value as-is
+//	int, uint       big-endian, 1, 2, 4 or 8 bytes depending on bit size;
+//	                signed ints in two's complement
+//	float           decimal string, formatted like JavaScript does (e.g. "1.5", "1e+21")
+//	bool            a single byte 0x00 or 0x01
+//
+// The key of a multi-field index is a sequence of field names and values, each followed by the
+// separator "\xff\x01" except for the last value, in the order the fields are encoded (i.e.
+// declaration order), e.g. "w\xff\x011\xff\x01h\xff\x012". In a multi-field key, values are
+// encoded so that they can't contain the separator:
+//
+//	string          the value with each "\xff" byte replaced by "\xff\x00"
+//	int, uint       base-36 digits of the value (signed ints as uint64, i.e. two's complement)
+//	float           like for a single-field key
+//	bool            "0" or "1"
+//
+// Field names are escaped like string values. []byte, list and dict values can not be part of a
+// multi-field key. An empty key means "no entry". The key of each element of a multi-entry index
+// (see EncodeKeys) is encoded like the key of a single-field index.
+//
+// Index keys are stored by storage implementations, so when this format changes, indexes stored
+// in the old format must be rebuilt with RebuildIndexes. Earlier versions of ent encoded
+// multi-field keys differently: the pairs were sorted by name and separated by a single "\xff"
+// byte, string values were not escaped and float values were preceded by 32 zero bytes.
 type IndexKeyEncoder struct {
 	b    Buffer
 	err  error
@@ -328,8 +938,19 @@ type IndexKeyEncoder struct {
 	nfields int
 	keys    []string
 	values  []string
+
+	multi     int      // state of EncodeKeys (0 when not encoding a multi-entry index)
+	multiKeys []string // keys produced by EncodeKeys
 }
 
+// states of IndexKeyEncoder.multi
+const (
+	multiNone   = iota
+	multiField  // expecting the list of the field
+	multiInList // each value is a separate key
+	multiDone   // the list has been encoded
+)
+
 func (c *IndexKeyEncoder) EncodeKey(e Ent, fields FieldSet) ([]byte, error) {
 	c.Reset(fields.Len())
 	e.EntEncode(c, fields)
@@ -337,6 +958,41 @@ func (c *IndexKeyEncoder) EncodeKey(e Ent, fields FieldSet) ([]byte, error) {
 	return c.b.Bytes(), c.err
 }
 
+// EncodeKeys encodes the keys of a multi-entry index (see EntIndexMulti) of e, with one key
+// for each element of the list field of the index. The returned keys are sorted and contain
+// neither duplicates nor empty keys.
+func (c *IndexKeyEncoder) EncodeKeys(e Ent, fields FieldSet) ([]string, error) {
+	c.Reset(1)
+	c.multi = multiField
+	c.multiKeys = nil
+	e.EntEncode(c, fields)
+	if c.multi == multiField && c.err == nil {
+		c.setErr(fmt.Errorf("multi-entry index field is not a list"))
+	}
+	keys := c.multiKeys
+	c.multi = multiNone
+	c.multiKeys = nil
+	sort.Strings(keys)
+	n := 0
+	for i, k := range keys {
+		if i == 0 || k != keys[n-1] {
+			keys[n] = k
+			n++
+		}
+	}
+	return keys[:n], c.err
+}
+
+// endMultiValue ends a key of EncodeKeys after a list element has been encoded
+func (c *IndexKeyEncoder) endMultiValue() {
+	if c.multi == multiInList && c.nest == 0 {
+		if len(c.b) > 0 {
+			c.multiKeys = append(c.multiKeys, string(c.b))
+		}
+		c.b.Reset()
+	}
+}
+
 func (c *IndexKeyEncoder) Reset(nfields int) {
 	c.nfields = nfields
 	c.b.Reset()
@@ -345,6 +1001,7 @@ func (c *IndexKeyEncoder) Reset(nfields int) {
 		c.keys = c.keys[:0]
 	}
 	c.nest = 0
+	c.multi = multiNone
 }
 
 func (c *IndexKeyEncoder) Err() error { return c.err }
@@ -362,42 +1019,46 @@ func (c *IndexKeyEncoder) EndEnt() {
 	}
 }
 
-type keysValuesSort IndexKeyEncoder
-
-func (a *keysValuesSort) Len() int { return len(a.keys) }
-func (a *keysValuesSort) Swap(i, j int) {
-	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
-	a.values[i], a.values[j] = a.values[j], a.values[i]
-}
-func (a *keysValuesSort) Less(i, j int) bool { return a.keys[i] < a.keys[j] }
-
+// flush writes the key-value pairs of a multi-field index key. The pairs are written in the
+// order they were encoded, which for ents and generated lookup functions is the order in which
+// the fields are declared in the struct. I.e. the key of an index of (w, h) is
+// "w\xff\x01W\xff\x01h\xff\x01H" where W and H are the values. Before, the pairs were sorted
+// by name; indexes of ents stored with keys in that order must be rebuilt (see RebuildIndexes.)
 func (c *IndexKeyEncoder) flush() {
 	if len(c.values) > 0 {
 		if len(c.values) == 1 {
 			c.b.WriteString(c.values[0])
 		} else {
-			// sorted key-value pairs
 			if len(c.keys) != len(c.values) {
 				c.setErr(fmt.Errorf("unbalanced key-value: %d keys, %d values",
 					len(c.keys), len(c.values)))
 				return
 			}
-			sort.Sort((*keysValuesSort)(c))
 			for i, k := range c.keys {
 				if i > 0 {
-					c.b.WriteByte('\xff')
+					c.b.WriteString(indexKeySep)
 				}
-				c.b.WriteString(k)
-				c.b.WriteByte('\xff')
+				c.b.WriteString(escapeIndexKeyStr(k))
+				c.b.WriteString(indexKeySep)
 				c.b.WriteString(c.values[i])
 			}
-			// // sorted values
-			// sort.Strings(c.values)
-			// c.b.WriteString(strings.Join(c.values, "\xff"))
 		}
 	}
 }
 
+// indexKeySep separates the names and values of a multi-field index key
+const indexKeySep = "\xff\x01"
+
+// escapeIndexKeyStr escapes s for a multi-field index key so that it can't contain indexKeySep.
+// Since "\xff" is replaced by "\xff\x00", different strings have different escaped forms.
+// Note: check bytes, not runes, since "\xff" is not valid UTF-8.
+func escapeIndexKeyStr(s string) string {
+	if strings.IndexByte(s, '\xff') == -1 {
+		return s
+	}
+	return strings.ReplaceAll(s, "\xff", "\xff\x00")
+}
+
 func (c *IndexKeyEncoder) Key(k string) {
 	if c.nest == 0 {
 		if c.nfields > 1 {
@@ -411,11 +1072,19 @@ func (c *IndexKeyEncoder) Key(k string) {
 }
 
 func (c *IndexKeyEncoder) BeginList(length int) {
+	if c.multi == multiField && c.nest == 0 {
+		c.multi = multiInList
+		return
+	}
 	// TODO: append "[" + varint(length) to c.values
 	c.setErr(fmt.Errorf("can't index lists"))
 	c.nest++
 }
 func (c *IndexKeyEncoder) EndList() {
+	if c.multi == multiInList && c.nest == 0 {
+		c.multi = multiDone
+		return
+	}
 	c.nest--
 }
 func (c *IndexKeyEncoder) BeginDict(length int) {
@@ -434,14 +1103,9 @@ func (c *IndexKeyEncoder) Str(v string) {
 		// if c.nest > 0 {
 		//   // TODO: append "s" + varint(length) & v to c.values
 		// }
-		for _, c := range v {
-			if c == '\xff' {
-				v = strings.ReplaceAll(v, "\xff", "\\xff")
-				break
-			}
-		}
-		c.values = append(c.values, v)
+		c.values = append(c.values, escapeIndexKeyStr(v))
 	}
+	c.endMultiValue()
 }
 
 func (c *IndexKeyEncoder) Blob(v []byte) {
@@ -450,6 +1114,7 @@ func (c *IndexKeyEncoder) Blob(v []byte) {
 	} else {
 		c.setErr(fmt.Errorf("can't index nested blobs"))
 	}
+	c.endMultiValue()
 }
 
 func (c *IndexKeyEncoder) Int(v int64, bitsize int) {
@@ -474,6 +1139,7 @@ func (c *IndexKeyEncoder) Uint(v uint64, bitsize int) {
 	} else {
 		c.values = append(c.values, strconv.FormatUint(v, 36))
 	}
+	c.endMultiValue()
 }
 
 func (c *IndexKeyEncoder) Float(v float64, bitsize int) {
@@ -481,9 +1147,10 @@ func (c *IndexKeyEncoder) Float(v float64, bitsize int) {
 		c.b = c.appendFloatValue(c.b, v, bitsize)
 	} else {
 		var buf [32]byte
-		b := c.appendFloatValue(buf[:], v, bitsize)
+		b := c.appendFloatValue(buf[:0], v, bitsize)
 		c.values = append(c.values, string(b))
 	}
+	c.endMultiValue()
 }
 
 func (c *IndexKeyEncoder) Bool(v bool) {
@@ -496,6 +1163,7 @@ func (c *IndexKeyEncoder) Bool(v bool) {
 	} else {
 		c.values = append(c.values, string([]byte{0x30 + b})) // "0" or "1"
 	}
+	c.endMultiValue()
 }
 
 // appendFloatValue appends a JavaScript-style float64 number of bits size to b
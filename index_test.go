@@ -0,0 +1,377 @@
+package ent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+type multiIndexTestEnt struct {
+	EntBase
+	tags []string
+}
+
+var multiIndexTestIdx = []EntIndex{{Name: "tag", Fields: 1, Flags: EntIndexMulti}}
+
+func (e *multiIndexTestEnt) EntTypeName() string { return "multitest" }
+func (e *multiIndexTestEnt) EntNew() Ent         { return &multiIndexTestEnt{} }
+func (e *multiIndexTestEnt) EntEncode(c Encoder, fields FieldSet) {
+	c.Key("tags")
+	c.BeginList(len(e.tags))
+	for _, v := range e.tags {
+		c.Str(v)
+	}
+	c.EndList()
+}
+func (e *multiIndexTestEnt) EntDecode(c Decoder) (id, version uint64)           { return }
+func (e *multiIndexTestEnt) EntDecodePartial(c Decoder, fields FieldSet) uint64 { return 0 }
+func (e *multiIndexTestEnt) EntIndexes() []EntIndex                             { return multiIndexTestIdx }
+func (e *multiIndexTestEnt) EntFields() Fields {
+	return Fields{Names: []string{"tags"}, FieldSet: 1}
+}
+
+func TestMultiIndexEdits(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	fmtEdits := func(edits []StorageIndexEdit) string {
+		s := ""
+		for _, ed := range edits {
+			op := "+"
+			if ed.IsCleanup {
+				op = "-"
+			}
+			s += fmt.Sprintf("%s%s ", op, ed.Key)
+		}
+		return s
+	}
+
+	var c IndexKeyEncoder
+	keys, err := c.EncodeKeys(&multiIndexTestEnt{tags: []string{"b", "a", "", "b"}}, 1)
+	assert.NoErr("EncodeKeys", err)
+	assert.Eq("keys", fmt.Sprint(keys), "[a b]")
+
+	prev := &multiIndexTestEnt{tags: []string{"a", "b", "c"}}
+	next := &multiIndexTestEnt{tags: []string{"c", "d", "a"}}
+	edits, err := ComputeIndexEdits(nil, nil, prev, 1, 1)
+	assert.NoErr("create", err)
+	assert.Eq("create", fmtEdits(edits), "+a +b +c ")
+
+	edits, err = ComputeIndexEdits(nil, prev, next, 1, 1)
+	assert.NoErr("update", err)
+	assert.Eq("update", fmtEdits(edits), "-b +d ")
+
+	edits, err = ComputeIndexEdits(nil, next, nil, 1, 1)
+	assert.NoErr("delete", err)
+	assert.Eq("delete", fmtEdits(edits), "-a -c -d ")
+}
+
+func TestLimitIds(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	ids := func() []uint64 { return []uint64{1, 2, 3, 4, 5} }
+	assert.Eq("no limit", fmt.Sprint(LimitIds(ids(), 0, 0)), "[1 2 3 4 5]")
+	assert.Eq("limit", fmt.Sprint(LimitIds(ids(), 2, 0)), "[1 2]")
+	assert.Eq("reverse", fmt.Sprint(LimitIds(ids(), 0, Reverse)), "[5 4 3 2 1]")
+	assert.Eq("reverse limit", fmt.Sprint(LimitIds(ids(), 2, Reverse)), "[5 4]")
+	assert.Eq("limit > len", fmt.Sprint(LimitIds(ids(), 9, Reverse)), "[5 4 3 2 1]")
+}
+
+type sizeIndexTestEnt struct {
+	EntBase
+	w, h int
+	name string
+}
+
+// "w" is indexed alone, "size" is a composite index of (w,h)
+var sizeIndexTestIdx = []EntIndex{{Name: "w", Fields: 1}, {Name: "size", Fields: 1 | 2}}
+
+func (e *sizeIndexTestEnt) EntTypeName() string { return "sizetest" }
+func (e *sizeIndexTestEnt) EntNew() Ent         { return &sizeIndexTestEnt{} }
+func (e *sizeIndexTestEnt) EntEncode(c Encoder, fields FieldSet) {
+	if fields.Has(0) {
+		c.Key("w")
+		c.Int(int64(e.w), 64)
+	}
+	if fields.Has(1) {
+		c.Key("h")
+		c.Int(int64(e.h), 64)
+	}
+	if fields.Has(2) {
+		c.Key("name")
+		c.Str(e.name)
+	}
+}
+func (e *sizeIndexTestEnt) EntDecode(c Decoder) (id, version uint64) {
+	for {
+		switch c.Key() {
+		case "":
+			return
+		case FieldNameId:
+			id = c.Uint(64)
+		case FieldNameVersion:
+			version = c.Uint(64)
+		case "w":
+			e.w = int(c.Int(64))
+		case "h":
+			e.h = int(c.Int(64))
+		case "name":
+			e.name = c.Str()
+		default:
+			c.Discard()
+		}
+	}
+}
+func (e *sizeIndexTestEnt) EntDecodePartial(c Decoder, fields FieldSet) uint64 { return 0 }
+func (e *sizeIndexTestEnt) EntIndexes() []EntIndex                             { return sizeIndexTestIdx }
+func (e *sizeIndexTestEnt) EntFields() Fields {
+	return Fields{Names: []string{"w", "h", "name"}, FieldSet: 1 | 2 | 4}
+}
+
+func TestCompositeIndexEdits(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	indexNames := func(edits []StorageIndexEdit) string {
+		s := ""
+		for _, ed := range edits {
+			if !ed.IsCleanup {
+				s += ed.Index.Name + " "
+			}
+		}
+		return s
+	}
+	prev := &sizeIndexTestEnt{w: 1, h: 2, name: "a"}
+
+	next := &sizeIndexTestEnt{w: 1, h: 3, name: "a"}
+	edits, err := ComputeIndexEdits(nil, prev, next, 1, 2)
+	assert.NoErr("change h", err)
+	assert.Eq("change h", indexNames(edits), "size ")
+
+	next = &sizeIndexTestEnt{w: 4, h: 2, name: "a"}
+	edits, err = ComputeIndexEdits(nil, prev, next, 1, 1)
+	assert.NoErr("change w", err)
+	assert.Eq("change w", indexNames(edits), "w size ")
+
+	next = &sizeIndexTestEnt{w: 4, h: 3, name: "a"}
+	edits, err = ComputeIndexEdits(nil, prev, next, 1, 1|2)
+	assert.NoErr("change w and h", err)
+	assert.Eq("change w and h", indexNames(edits), "w size ")
+
+	next = &sizeIndexTestEnt{w: 1, h: 2, name: "b"}
+	edits, err = ComputeIndexEdits(nil, prev, next, 1, 4)
+	assert.NoErr("change name", err)
+	assert.Eq("change name", indexNames(edits), "")
+}
+
+func TestCompositeIndexKeyOrder(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var c IndexKeyEncoder
+	key, err := c.EncodeKey(&sizeIndexTestEnt{w: 1, h: 2}, 1|2)
+	assert.NoErr("EncodeKey", err)
+	assert.Eq("key follows declaration order", string(key), "w\xff\x011\xff\x01h\xff\x012")
+
+	// a lookup encoding the fields in the same order yields the same key
+	lookupKey, err := encodeIndexKey(2, func(c Encoder) {
+		c.Key("w")
+		c.Int(1, 64)
+		c.Key("h")
+		c.Int(2, 64)
+	})
+	assert.NoErr("encodeIndexKey", err)
+	assert.Eq("lookup key", string(lookupKey), string(key))
+}
+
+type keyFormatTestEnt struct {
+	EntBase
+	s  string
+	b  []byte
+	i8 int8
+	i  int
+	u  uint32
+	f  float64
+	ok bool
+}
+
+var keyFormatTestFields = []string{"s", "b", "i8", "i", "u", "f", "ok"}
+
+func (e *keyFormatTestEnt) EntTypeName() string { return "keyformat" }
+func (e *keyFormatTestEnt) EntNew() Ent         { return &keyFormatTestEnt{} }
+func (e *keyFormatTestEnt) EntEncode(c Encoder, fields FieldSet) {
+	for i, name := range keyFormatTestFields {
+		if !fields.Has(i) {
+			continue
+		}
+		c.Key(name)
+		switch i {
+		case 0:
+			c.Str(e.s)
+		case 1:
+			c.Blob(e.b)
+		case 2:
+			c.Int(int64(e.i8), 8)
+		case 3:
+			c.Int(int64(e.i), 64)
+		case 4:
+			c.Uint(uint64(e.u), 32)
+		case 5:
+			c.Float(e.f, 64)
+		case 6:
+			c.Bool(e.ok)
+		}
+	}
+}
+func (e *keyFormatTestEnt) EntDecode(c Decoder) (id, version uint64)           { return }
+func (e *keyFormatTestEnt) EntDecodePartial(c Decoder, fields FieldSet) uint64 { return 0 }
+func (e *keyFormatTestEnt) EntIndexes() []EntIndex                             { return nil }
+func (e *keyFormatTestEnt) EntFields() Fields {
+	return Fields{Names: keyFormatTestFields, FieldSet: 1<<7 - 1}
+}
+
+// TestIndexKeyFormat pins the format of index keys, which are stored (see IndexKeyEncoder)
+func TestIndexKeyFormat(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &keyFormatTestEnt{
+		s: "a\xffb", b: []byte{0, 0xff}, i8: -2, i: 1000, u: 0x01020304, f: 1.5, ok: true,
+	}
+	key := func(fields FieldSet) string {
+		k, err := EncodeIndexKey(e, &EntIndex{Name: "x", Fields: fields})
+		assert.NoErr("EncodeIndexKey", err)
+		return string(k)
+	}
+
+	// single-field keys
+	assert.Eq("str", key(1<<0), "a\xffb")
+	assert.Eq("blob", key(1<<1), "\x00\xff")
+	assert.Eq("int8", key(1<<2), "\xfe")
+	assert.Eq("int", key(1<<3), "\x00\x00\x00\x00\x00\x00\x03\xe8")
+	assert.Eq("uint32", key(1<<4), "\x01\x02\x03\x04")
+	assert.Eq("float", key(1<<5), "1.5")
+	assert.Eq("bool", key(1<<6), "\x01")
+	emptyKey, err := EncodeIndexKey(&keyFormatTestEnt{}, &EntIndex{Name: "x", Fields: 1})
+	assert.NoErr("EncodeIndexKey", err)
+	assert.Eq("empty str", string(emptyKey), "")
+
+	// multi-field keys
+	assert.Eq("str+int", key(1<<0|1<<3), "s\xff\x01a\xff\x00b\xff\x01i\xff\x01rs")
+	assert.Eq("int8+uint32+float+bool", key(1<<2|1<<4|1<<5|1<<6),
+		"i8\xff\x013w5e11264sgse\xff\x01u\xff\x01a2f44\xff\x01f\xff\x011.5\xff\x01ok\xff\x011")
+
+	// "\xff" in strings is escaped so that different values have different keys, which wasn't
+	// the case when "\xff" was replaced by "\\xff"
+	for _, v := range [][2]string{
+		{"a\xffb", "a\\xffb"},
+		{"a\xff", "a\xff\x00"},
+		{"a\xff\x01", "a\xff"},
+	} {
+		e1, e2 := &keyFormatTestEnt{s: v[0], i: 1000}, &keyFormatTestEnt{s: v[1], i: 1000}
+		k1, err := EncodeIndexKey(e1, &EntIndex{Name: "x", Fields: 1<<0 | 1<<3})
+		assert.NoErr("EncodeIndexKey", err)
+		k2, err := EncodeIndexKey(e2, &EntIndex{Name: "x", Fields: 1<<0 | 1<<3})
+		assert.NoErr("EncodeIndexKey", err)
+		assert.Ok(fmt.Sprintf("%q and %q have different keys", v[0], v[1]),
+			string(k1) != string(k2))
+	}
+
+	_, err = EncodeIndexKey(e, &EntIndex{Name: "x", Fields: 1<<0 | 1<<1})
+	assert.Err("blob in multi-field key", "can't index nested blobs", err)
+
+	// keys encoded by lookup functions are identical to keys encoded from ents
+	for _, fields := range []FieldSet{1 << 0, 1 << 3, 1<<0 | 1<<3, 1<<2 | 1<<4 | 1<<5 | 1<<6} {
+		lookupKey, err := encodeIndexKey(fields.Len(), func(c Encoder) {
+			e.EntEncode(c, fields)
+		})
+		assert.NoErr("encodeIndexKey", err)
+		assert.Eq(fmt.Sprintf("lookup key %b", fields), string(lookupKey), key(fields))
+	}
+
+	_, err = EncodeIndexKey(&multiIndexTestEnt{}, &multiIndexTestIdx[0])
+	assert.Err("multi-entry index", "more than one key", err)
+}
+
+// findTestStorage finds no ents, without recording calls (see BenchmarkFindIdsByIndex)
+type findTestStorage struct {
+	testStorage
+}
+
+func (s *findTestStorage) FindByIndex(
+	entType string, x *EntIndex, key []byte, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	return nil, nil
+}
+
+func TestStorageCapsUnsupported(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &testStorage{caps: CapTx}
+	_, err := FindIdsByIndexKeyPrefix(s, "sizetest", &sizeIndexTestIdx[0], []byte("a"), 0, nil)
+	assert.Eq("prefix lookup", err, ErrUnsupported)
+	assert.Eq("Has", s.Capabilities().Has(CapTx|CapRange), false)
+}
+
+func BenchmarkFindIdsByIndex(b *testing.B) {
+	s := &findTestStorage{}
+	x := &sizeIndexTestIdx[1]
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := FindIdsByIndex(s, "sizetest", x, 0, nil, 2, func(c Encoder) {
+				c.Key("w")
+				c.Int(640, 64)
+				c.Key("h")
+				c.Int(480, 64)
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestEncodeScalarIndexKey(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var buf [8]byte
+	v := int64(-2)
+	for _, bitsize := range []int{8, 16, 32, 64} {
+		var c IndexKeyEncoder
+		c.Reset(1)
+		c.Int(v, bitsize)
+		c.EndEnt()
+		assert.Eq(fmt.Sprintf("int%d", bitsize),
+			EncodeScalarIndexKey(&buf, uint64(v), bitsize), c.b.Bytes())
+	}
+}
+
+// BenchmarkFindIdsByScalarIndex compares lookups by a single int field with IndexKeyEncoder
+// and with EncodeScalarIndexKey, with a buffer declared for each lookup (which allocates since
+// the key escapes to the storage) and with a reused one
+func BenchmarkFindIdsByScalarIndex(b *testing.B) {
+	s := &findTestStorage{}
+	x := &sizeIndexTestIdx[0]
+	b.Run("IndexKeyEncoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := FindIdsByIndex(s, "sizetest", x, 0, nil, 1, func(c Encoder) {
+				c.Int(640, 64)
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("EncodeScalarIndexKey", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var keybuf [8]byte
+			key := EncodeScalarIndexKey(&keybuf, uint64(640), 64)
+			if _, err := FindIdsByIndexKey(s, "sizetest", x, key, 0, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("EncodeScalarIndexKey/reused", func(b *testing.B) {
+		b.ReportAllocs()
+		var keybuf [8]byte
+		for i := 0; i < b.N; i++ {
+			key := EncodeScalarIndexKey(&keybuf, uint64(640), 64)
+			if _, err := FindIdsByIndexKey(s, "sizetest", x, key, 0, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -1,11 +1,22 @@
 package ent
 
-import "github.com/rsms/go-json"
+import (
+	"bytes"
+	"sync"
+
+	"github.com/rsms/go-json"
+)
 
 // JsonEncoder is an implementation of the Encoder interface
 type JsonEncoder struct {
 	json.Builder      // Note: set Builder.Indent to enable pretty-printing
 	BareKeys     bool // when true, don't wrap keys in "..."
+
+	// Names, when not nil, maps the keys of the ent's fields to the keys written.
+	// Keys of lists and dicts within fields are not renamed. See JsonNamer.
+	Names map[string]string
+
+	depth int // list and dict nesting
 }
 
 func (c *JsonEncoder) Err() error { return c.Builder.Err }
@@ -20,12 +31,17 @@ func (c *JsonEncoder) EndEnt() {
 	c.EndObject()
 }
 
-func (c *JsonEncoder) BeginList(length int) { c.StartArray() }
-func (c *JsonEncoder) EndList()             { c.EndArray() }
-func (c *JsonEncoder) BeginDict(length int) { c.StartObject() }
-func (c *JsonEncoder) EndDict()             { c.EndObject() }
+func (c *JsonEncoder) BeginList(length int) { c.depth++; c.StartArray() }
+func (c *JsonEncoder) EndList()             { c.depth--; c.EndArray() }
+func (c *JsonEncoder) BeginDict(length int) { c.depth++; c.StartObject() }
+func (c *JsonEncoder) EndDict()             { c.depth--; c.EndObject() }
 
 func (e *JsonEncoder) Key(k string) {
+	if e.Names != nil && e.depth == 0 {
+		if name, ok := e.Names[k]; ok {
+			k = name
+		}
+	}
 	if e.BareKeys {
 		e.RawKey([]byte(k))
 	} else {
@@ -35,7 +51,11 @@ func (e *JsonEncoder) Key(k string) {
 
 // JsonDecoder is an implementation of the Decoder interface
 type JsonDecoder struct {
-	json.Reader
+	jsonReader
+
+	// Names, when not nil, maps keys of the ent's fields read to the keys returned by Key.
+	// Keys of lists and dicts within fields are not renamed. See JsonNamer.
+	Names map[string]string
 }
 
 func NewJsonDecoder(data []byte) *JsonDecoder {
@@ -44,15 +64,25 @@ func NewJsonDecoder(data []byte) *JsonDecoder {
 	return c
 }
 
+func (c *JsonDecoder) Key() string {
+	k := c.jsonReader.Key()
+	if c.Names != nil && len(c.delimstack) == 1 {
+		if name, ok := c.Names[k]; ok {
+			return name
+		}
+	}
+	return k
+}
+
 func (c *JsonDecoder) DictHeader() int {
-	if c.Reader.ObjectStart() {
+	if c.ObjectStart() {
 		return -1
 	}
 	return 0
 }
 
 func (c *JsonDecoder) ListHeader() int {
-	if c.Reader.ArrayStart() {
+	if c.ArrayStart() {
 		return -1
 	}
 	return 0
@@ -76,8 +106,21 @@ func JsonDecodeEntPartial(e Ent, data []byte, fields FieldSet) (version uint64,
 // The two following functions are used by ent.JsonEncode and ent.JsonDecode to expose a general
 // JSON codec as well as to implement MarshalJSON and UnmarshalJSON for Ent types.
 
+// jsonBufPool holds the buffers of JsonEncodeEnt, which copies the JSON out when done.
+// Buffers are pooled by pointer since putting a slice in a sync.Pool allocates.
+var jsonBufPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
 func JsonEncodeEnt(e Ent, id, version uint64, fields FieldSet, indent string) ([]byte, error) {
-	c := JsonEncoder{}
+	return jsonEncodeEnt(e, id, version, fields, indent, nil)
+}
+
+func jsonEncodeEnt(
+	e Ent, id, version uint64, fields FieldSet, indent string, names map[string]string,
+) ([]byte, error) {
+	buf := jsonBufPool.Get().(*[]byte)
+	defer jsonBufPool.Put(buf)
+	c := JsonEncoder{Names: names}
+	c.Builder.Buffer = *bytes.NewBuffer((*buf)[:0])
 	c.Builder.Indent = indent
 	c.BeginEnt(version)
 
@@ -85,13 +128,24 @@ func JsonEncodeEnt(e Ent, id, version uint64, fields FieldSet, indent string) ([
 	c.Key(FieldNameId)
 	c.Uint(id, 64)
 
+	EncodeFieldVersions(e, &c)
+
 	e.EntEncode(&c, fields)
+	if fields == e.EntFields().FieldSet {
+		encodeUnknownFields(e, &c)
+	}
 	c.EndEnt()
-	return c.Bytes(), c.Err()
+	*buf = c.Bytes()
+	return append([]byte(nil), *buf...), c.Err()
 }
 
 func JsonDecodeEnt(e Ent, data []byte) (id, version uint64, err error) {
+	return jsonDecodeEnt(e, data, nil)
+}
+
+func jsonDecodeEnt(e Ent, data []byte, names map[string]string) (id, version uint64, err error) {
 	c := NewJsonDecoder(data)
+	c.Names = names
 	if c.DictHeader() != 0 {
 		id, version = e.EntDecode(c)
 	}
@@ -101,6 +155,28 @@ func JsonDecodeEnt(e Ent, data []byte) (id, version uint64, err error) {
 	return
 }
 
+// jsonNames returns the JSON names of the fields of e which differ from their storage names
+// (see JsonNamer), or nil
+func jsonNames(e Ent) map[string]string {
+	if n, ok := e.(JsonNamer); ok {
+		return n.EntJsonNames()
+	}
+	return nil
+}
+
+// jsonStorageNames returns the inverse of jsonNames(e)
+func jsonStorageNames(e Ent) map[string]string {
+	names := jsonNames(e)
+	if names == nil {
+		return nil
+	}
+	m := make(map[string]string, len(names))
+	for name, jsonName := range names {
+		m[jsonName] = name
+	}
+	return m
+}
+
 type JsonError struct {
 	Underlying error
 }
@@ -0,0 +1,217 @@
+package ent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// jsonReader reads JSON values token by token.
+// It is based on json.Reader of github.com/rsms/go-json, which can't discard lists and dicts.
+type jsonReader struct {
+	d          *json.Decoder
+	err        error
+	tok        json.Token // most recently parsed token
+	delimstack []json.Delim
+	delim      json.Delim // top of logical delimstack
+}
+
+func (c *jsonReader) Reset(r io.Reader) {
+	c.d = json.NewDecoder(r)
+	c.err = nil
+	c.delim = 0
+	if c.delimstack != nil {
+		c.delimstack = c.delimstack[:0]
+	}
+}
+
+func (c *jsonReader) ResetBytes(data []byte) {
+	c.Reset(bytes.NewReader(data))
+}
+
+func (c *jsonReader) Err() error { return c.err }
+
+func (c *jsonReader) setError(err error) {
+	if c.err == nil {
+		if numerr, ok := err.(*strconv.NumError); ok && numerr.Err == strconv.ErrSyntax {
+			err = c.errExpected("number")
+		}
+		c.err = err
+	}
+}
+
+func (c *jsonReader) errExpected(expected string) error {
+	var actual string
+	if d, ok := c.tok.(json.Delim); ok {
+		actual = fmt.Sprint(d)
+	} else {
+		actual = fmt.Sprintf("%T", c.tok)
+	}
+	return fmt.Errorf("expected %s but got %s at offset %d", expected, actual, c.d.InputOffset())
+}
+
+func (c *jsonReader) setErrorExpected(expected string) {
+	c.setError(c.errExpected(expected))
+}
+
+func (c *jsonReader) next() json.Token {
+	t, err := c.d.Token()
+	c.tok = t
+	if err != nil {
+		c.setError(err)
+	}
+	return t
+}
+
+func (c *jsonReader) Key() string {
+	if c.d.More() {
+		t := c.next()
+		if s, ok := t.(string); ok {
+			return s
+		}
+		c.setErrorExpected("key")
+	}
+	return ""
+}
+
+// rawValue reads the next value, which may be a list or dict, and returns its JSON encoding
+func (c *jsonReader) rawValue() json.RawMessage {
+	var v json.RawMessage
+	if c.err == nil {
+		if err := c.d.Decode(&v); err != nil {
+			c.setError(err)
+		}
+	}
+	return v
+}
+
+func (c *jsonReader) pushDelim(d json.Delim) bool {
+	if c.next() != d {
+		c.setErrorExpected(fmt.Sprint(d))
+		return false
+	}
+	c.delimstack = append(c.delimstack, c.delim)
+	c.delim = d
+	return true
+}
+
+func (c *jsonReader) popDelim() {
+	t := c.next()
+	if d, ok := t.(json.Delim); ok {
+		expect := json.Delim(rune(c.delim) + 2) // i.e. '['+2 = ']', '{'+2 = '}'
+		if d != expect {
+			// delimiter mismatch, e.g. "[1,2,}"
+			c.setErrorExpected(fmt.Sprint(expect))
+		}
+		if len(c.delimstack) > 0 {
+			c.delim = c.delimstack[len(c.delimstack)-1]
+			c.delimstack = c.delimstack[:len(c.delimstack)-1]
+		}
+	}
+}
+
+func (c *jsonReader) ObjectStart() bool { return c.pushDelim(json.Delim('{')) }
+func (c *jsonReader) ArrayStart() bool  { return c.pushDelim(json.Delim('[')) }
+
+func (c *jsonReader) More() bool {
+	if c.err == nil && c.d.More() {
+		return true
+	}
+	// consume ending delimiter
+	c.popDelim()
+	return false
+}
+
+func (c *jsonReader) Int(bitsize int) int64 {
+	switch v := c.next().(type) {
+	case float64:
+		return int64(v)
+	case string:
+		i, err := strconv.ParseInt(v, 10, bitsize)
+		if err != nil {
+			c.setError(err)
+		}
+		return i
+	default:
+		c.setErrorExpected("number")
+	}
+	return 0
+}
+
+func (c *jsonReader) Uint(bitsize int) uint64 {
+	switch v := c.next().(type) {
+	case float64:
+		return uint64(v)
+	case string:
+		i, err := strconv.ParseUint(v, 10, bitsize)
+		if err != nil {
+			c.setError(err)
+		}
+		return i
+	default:
+		c.setErrorExpected("number")
+	}
+	return 0
+}
+
+func (c *jsonReader) Float(bitsize int) float64 {
+	if v, ok := c.next().(float64); ok {
+		return v
+	}
+	c.setErrorExpected("number")
+	return 0.0
+}
+
+func (c *jsonReader) Bool() bool {
+	if v, ok := c.next().(bool); ok {
+		return v
+	}
+	c.setErrorExpected("boolean")
+	return false
+}
+
+func (c *jsonReader) Str() string {
+	if s, ok := c.next().(string); ok {
+		return s
+	}
+	c.setErrorExpected("string")
+	return ""
+}
+
+func (c *jsonReader) Blob() []byte {
+	s := c.Str()
+	if len(s) == 0 {
+		return nil
+	}
+	buf, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		c.setError(fmt.Errorf("failed to decode blob: %v", err))
+	}
+	return buf
+}
+
+// Discard reads and discards the next value, including entire lists and dicts
+func (c *jsonReader) Discard() {
+	d, ok := c.next().(json.Delim)
+	if !ok {
+		return
+	}
+	if d != '[' && d != '{' {
+		c.setErrorExpected("value")
+		return
+	}
+	// skip tokens until the matching end delimiter.
+	// Note that json.Decoder validates delimiter pairing for us.
+	for depth := 1; depth > 0 && c.err == nil; {
+		if d, ok := c.next().(json.Delim); ok {
+			if d == '[' || d == '{' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+	}
+}
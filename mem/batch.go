@@ -0,0 +1,117 @@
+package mem
+
+import (
+	"errors"
+
+	"github.com/rsms/ent"
+)
+
+// ErrBatchAborted is the error of ents passed to SaveBatch which were not saved because
+// another ent of the batch could not be saved
+var ErrBatchAborted = errors.New("batch aborted")
+
+// LoadByIds loads ents with ids. e is used for the first ent loaded and new ents of the same
+// type (see ent.Ent.EntNew) for the rest.
+// Ids which are not found are skipped; the result is in the order of ids.
+func (s *EntStorage) LoadByIds(e Ent, ids []uint64) ([]Ent, error) {
+	ents := make([]Ent, 0, len(ids))
+	for _, id := range ids {
+		e2 := e
+		if len(ents) > 0 {
+			e2 = e.EntNew()
+		}
+		version, err := s.loadById(&s.m, e2, id)
+		if err == ent.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ent.SetEntBaseFieldsAfterLoad(e2, s, id, version)
+		ents = append(ents, e2)
+	}
+	return ents, nil
+}
+
+// SaveBatch is part of the ent.BatchSaver interface, used by ent.SaveAll.
+// Either all ents are saved or none are: when an ent can't be saved, its error is returned
+// along with ErrBatchAborted for the other ents.
+func (s *EntStorage) SaveBatch(ents []Ent, fields []ent.FieldSet) ([]uint64, []error) {
+	versions := make([]uint64, len(ents))
+	failed := -1 // index of the ent which could not be saved
+	err := s.batch(func(m *ScopedMap) (err error) {
+		for i, e := range ents {
+			if versions[i], err = s.save(m, e, fields[i]); err != nil {
+				failed = i
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		errs := make([]error, len(ents))
+		for i := range errs {
+			if failed == -1 || i == failed {
+				errs[i] = err
+			} else {
+				errs[i] = ErrBatchAborted
+			}
+		}
+		return nil, errs
+	}
+	events := make([]ent.ChangeEvent, len(ents))
+	for i, e := range ents {
+		events[i] = ent.ChangeEvent{
+			Op: ent.OpSave, EntTypeName: e.EntTypeName(), Id: e.Id(), Version: versions[i]}
+	}
+	s.notify(events...)
+	return versions, nil
+}
+
+// CreateBatch creates all ents. Either all ents are created or none are. An ent which conflicts
+// on a unique index, either with an existing ent or with another ent in ents, causes the entire
+// batch to fail with an ent.IndexConflictErr.
+//
+// On success, each ent is assigned an id and version 1 and is bound to s, just like after
+// a successful call to TYPE.Create. Note that lifecycle hooks (e.g. ent.BeforeCreate) are not
+// called.
+func (s *EntStorage) CreateBatch(ents []Ent) error {
+	ids := make([]uint64, len(ents))
+	err := s.batch(func(m *ScopedMap) (err error) {
+		for i, e := range ents {
+			if ids[i], err = s.create(m, e, e.EntFields().FieldSet); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	events := make([]ent.ChangeEvent, len(ents))
+	for i, e := range ents {
+		ent.SetEntBaseFieldsAfterLoad(e, s, ids[i], 1)
+		events[i] = ent.ChangeEvent{
+			Op: ent.OpCreate, EntTypeName: e.EntTypeName(), Id: ids[i], Version: 1}
+	}
+	s.notify(events...)
+	return nil
+}
+
+// batch calls f with an isolated scope of s.m and, if f succeeds, applies the changes f made
+// to s.m. Fails with ent.ErrVersionConflict if any data f has read was changed in the meantime,
+// in which case no changes are made (like Tx.Commit.)
+func (s *EntStorage) batch(f func(m *ScopedMap) error) error {
+	s.mu.RLock()
+	m := s.m.NewIsolatedScope()
+	s.mu.RUnlock()
+	if err := f(m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.OuterChanged() {
+		return ent.ErrVersionConflict
+	}
+	m.ApplyToOuter()
+	return nil
+}
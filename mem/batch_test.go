@@ -0,0 +1,68 @@
+package mem
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+func TestSaveBatchAtomic(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	a, b := &testEnt{name: "a"}, &testEnt{name: "b"}
+	createTestEnts(t, s, a, b)
+
+	// b is saved by someone else, so b conflicts and a must not be saved either
+	b2 := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(b2, s, b.Id()))
+	b2.n = 9
+	b2.setChanged(testEnt_f_n)
+	assert.NoErr("save b2", ent.SaveEnt(b2))
+
+	a.n, b.n = 1, 1
+	a.setChanged(testEnt_f_n)
+	b.setChanged(testEnt_f_n)
+	err := ent.SaveAll(a, b)
+	var saveErr *ent.SaveAllErr
+	assert.Eq("SaveAllErr", errors.As(err, &saveErr), true)
+	assert.Eq("failed ents", len(saveErr.Ents), 2)
+	assert.Eq("a aborted", errors.Is(saveErr.Errs[0], ErrBatchAborted), true)
+	assert.Eq("b conflict", errors.Is(saveErr.Errs[1], ent.ErrVersionConflict), true)
+	assert.Eq("a version", a.Version(), uint64(1))
+	assert.Eq("a changes kept", a.ChangedFields(), fieldSet(testEnt_f_n))
+
+	a2 := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(a2, s, a.Id()))
+	assert.Eq("a not saved", a2.n, 0)
+	assert.Eq("a version stored", a2.Version(), uint64(1))
+
+	assert.NoErr("retry a", ent.SaveAll(a))
+	assert.Eq("a saved", a.Version(), uint64(2))
+}
+
+func TestCreateBatch(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s, &testEnt{name: "taken"})
+
+	a, b, c := &testEnt{name: "a"}, &testEnt{name: "b"}, &testEnt{name: "Taken"}
+	assert.Err("conflict", "unique index conflict", s.CreateBatch([]ent.Ent{a, b, c}))
+	for _, e := range []*testEnt{a, b, c} {
+		assert.Eq("unbound", ent.GetStorage(e), nil)
+		assert.Eq("no id", e.Id(), uint64(0))
+	}
+	ids, err := s.FindByIndex("memtest", &testEntIdx[testEnt_idx_name], []byte("a"), 0, 0)
+	assert.NoErr("find", err)
+	assert.Eq("a not created", len(ids), 0)
+
+	// duplicates within the batch conflict too
+	a2 := &testEnt{name: "A"}
+	assert.Err("dup", "unique index conflict", s.CreateBatch([]ent.Ent{a, a2}))
+
+	assert.NoErr("create", s.CreateBatch([]ent.Ent{a, b}))
+	assert.Eq("a bound", ent.GetStorage(a), ent.Storage(s))
+	assert.Eq("a version", a.Version(), uint64(1))
+	assert.Eq("b id", b.Id() > a.Id(), true)
+}
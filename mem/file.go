@@ -0,0 +1,159 @@
+package mem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// fileMagic identifies files written by SaveToFile. The last byte is the format version.
+const fileMagic = "entmem\x00\x01"
+
+var errBadFile = errors.New("mem: not a storage file (bad header)")
+
+// SaveToFile writes all data in the storage to a file at path, replacing any existing file.
+// The file is first written to a temporary file which is then renamed to path, so that a
+// crash never leaves a partially written file behind.
+//
+// File format:
+//
+//	file  = magic idgen count entry*
+//	entry = uvarint(len(key)) key uvarint(len(value)) value
+//
+// where magic is 8 bytes, idgen and count are uvarints and entries are sorted by key.
+func (s *EntStorage) SaveToFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	err = s.writeTo(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// LoadFromFile replaces all data in the storage with the data of a file written by SaveToFile
+func (s *EntStorage) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.readFrom(f)
+}
+
+func (s *EntStorage) writeTo(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.m.m))
+	for key := range s.m.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf, v)])
+	}
+	bw.WriteString(fileMagic)
+	writeUvarint(atomic.LoadUint64(&s.idgen))
+	writeUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		value := s.m.m[key]
+		writeUvarint(uint64(len(key)))
+		bw.WriteString(key)
+		writeUvarint(uint64(len(value)))
+		bw.Write(value)
+	}
+	return bw.Flush()
+}
+
+func (s *EntStorage) readFrom(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != fileMagic {
+		return errBadFile
+	}
+	idgen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	// count comes from the file, so don't trust it for more than a size hint
+	sizeHint := count
+	if sizeHint > maxSizeHint {
+		sizeHint = maxSizeHint
+	}
+	m := make(map[string][]byte, sizeHint)
+	for i := uint64(0); i < count; i++ {
+		key, err := readSizedBytes(br)
+		if err != nil {
+			return err
+		}
+		value, err := readSizedBytes(br)
+		if err != nil {
+			return err
+		}
+		m[string(key)] = value
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Reset(m)
+	atomic.StoreUint64(&s.idgen, idgen)
+	return nil
+}
+
+// maxSizeHint limits the sizes preallocated for lengths read from files and logs, which may be
+// corrupt. Larger data is read in chunks instead.
+const maxSizeHint = 1 << 16
+
+// readSizedBytes reads uvarint(len(b)) b, as written by writeTo and logWrite. A length larger
+// than the remaining input fails with io.ErrUnexpectedEOF without allocating that much memory.
+func readSizedBytes(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size <= maxSizeHint {
+		b := make([]byte, size)
+		_, err = io.ReadFull(br, b)
+		return b, unexpectedEOF(err)
+	}
+	if size > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, br, int64(size)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF, otherwise err
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
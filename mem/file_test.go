@@ -0,0 +1,96 @@
+package mem
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestSaveToFile(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	dir, err := ioutil.TempDir("", "ent-mem-test")
+	assert.NoErr("TempDir", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	s := NewEntStorage()
+	s.m.Put("a:1", []byte(`{"_ver":"1"}`))
+	s.m.Put("a#x:k", []byte("1"))
+	s.m.Put("empty", []byte{})
+	s.idgen = 7
+	assert.NoErr("SaveToFile", s.SaveToFile(path))
+
+	s2 := NewEntStorage()
+	s2.m.Put("stale", []byte("x"))
+	assert.NoErr("LoadFromFile", s2.LoadFromFile(path))
+	assert.Eq("idgen", s2.idgen, uint64(7))
+	assert.Eq("len", len(s2.m.m), 3)
+	assert.Eq("get", s2.m.Get("a:1"), []byte(`{"_ver":"1"}`))
+	assert.Eq("get", s2.m.Get("a#x:k"), []byte("1"))
+	assert.Eq("get", s2.m.Get("stale"), []byte(nil))
+
+	// truncated file
+	data, err := ioutil.ReadFile(path)
+	assert.NoErr("ReadFile", err)
+	assert.NoErr("WriteFile", ioutil.WriteFile(path, data[:len(data)-2], 0644))
+	assert.Err("truncated", "unexpected EOF", s2.LoadFromFile(path))
+	assert.Eq("unchanged", s2.m.Get("a:1"), []byte(`{"_ver":"1"}`))
+
+	assert.NoErr("WriteFile", ioutil.WriteFile(path, []byte("hello"), 0644))
+	assert.Err("bad header", "bad header", s2.LoadFromFile(path))
+
+	// corrupt counts and lengths larger than the file fail without allocating that much
+	var corrupt []byte
+	corrupt = append(corrupt, fileMagic...)
+	corrupt = appendUvarint(corrupt, 7)
+	corrupt = appendUvarint(corrupt, 1<<62)
+	corrupt = appendUvarint(corrupt, 1<<62)
+	corrupt = append(corrupt, "a:1"...)
+	assert.NoErr("WriteFile", ioutil.WriteFile(path, corrupt, 0644))
+	assert.Err("corrupt length", "unexpected EOF", s2.LoadFromFile(path))
+	corrupt = append(corrupt[:len(fileMagic)], 7, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0x01)
+	assert.NoErr("WriteFile", ioutil.WriteFile(path, corrupt, 0644))
+	assert.Err("length > MaxInt64", "unexpected EOF", s2.LoadFromFile(path))
+}
+
+func TestReplayLog(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var log bytes.Buffer
+	s := NewEntStorage()
+	s.Log = &log
+	s.idgen = 3
+	s.m.Put("a:1", []byte(`{"_ver":"1"}`))
+	s.m.Put("a:2", []byte(`{"_ver":"1"}`))
+	s.m.Put("empty", []byte{})
+	s.m.Put("big", bytes.Repeat([]byte("x"), maxSizeHint*3)) // read in chunks
+	m := s.m.NewScope()
+	m.Put("a:1", []byte(`{"_ver":"2"}`))
+	m.Del("a:2")
+	m.ApplyToOuter()
+	s.idgen = 5
+	s.m.Put("a#x:k", []byte("1"))
+	assert.NoErr("LogErr", s.LogErr())
+
+	s2 := NewEntStorage()
+	assert.NoErr("ReplayLog", s2.ReplayLog(bytes.NewReader(log.Bytes())))
+	assert.Eq("idgen", s2.idgen, uint64(5))
+	assert.Eq("state", fmt.Sprint(s2.m.m), fmt.Sprint(s.m.m))
+
+	// log cut off in the middle of the last entry
+	s3 := NewEntStorage()
+	err := s3.ReplayLog(bytes.NewReader(log.Bytes()[:log.Len()-2]))
+	assert.Err("truncated", "unexpected EOF", err)
+	assert.Eq("applied", s3.m.Get("a:1"), []byte(`{"_ver":"2"}`))
+	assert.Eq("idgen", s3.idgen, uint64(5))
+
+	assert.Err("bad entry", "bad log entry", s3.ReplayLog(bytes.NewReader([]byte("x"))))
+	corrupt := appendUvarint([]byte{logOpPut}, 1<<62)
+	err = s3.ReplayLog(bytes.NewReader(append(corrupt, "a:1"...)))
+	assert.Err("corrupt length", "unexpected EOF", err)
+}
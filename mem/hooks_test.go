@@ -0,0 +1,100 @@
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+// hookTestEnt is a testEnt which records calls to its lifecycle hooks
+type hookTestEnt struct {
+	testEnt
+	calls []string
+	fail  string // name of a before-hook which fails
+}
+
+var errHook = errors.New("hook failed")
+
+func (e *hookTestEnt) EntNew() ent.Ent { return &hookTestEnt{} }
+
+func (e *hookTestEnt) before(name string) error {
+	e.calls = append(e.calls, name)
+	if e.fail == name {
+		return errHook
+	}
+	return nil
+}
+
+func (e *hookTestEnt) BeforeSave() error {
+	e.group = "set by BeforeSave"
+	e.setChanged(testEnt_f_group)
+	return e.before("BeforeSave")
+}
+func (e *hookTestEnt) BeforeCreate() error { return e.before("BeforeCreate") }
+func (e *hookTestEnt) BeforeDelete() error { return e.before("BeforeDelete") }
+func (e *hookTestEnt) AfterCreate()        { e.calls = append(e.calls, "AfterCreate") }
+func (e *hookTestEnt) AfterSave()          { e.calls = append(e.calls, "AfterSave") }
+func (e *hookTestEnt) AfterDelete()        { e.calls = append(e.calls, "AfterDelete") }
+
+func (e *hookTestEnt) takeCalls() string {
+	s := strings.Join(e.calls, " ")
+	e.calls = nil
+	return s
+}
+
+func TestHooks(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+
+	// a failing before-hook aborts creation
+	e := &hookTestEnt{testEnt: testEnt{name: "a"}, fail: "BeforeCreate"}
+	assert.Err("create", "hook failed", ent.CreateEnt(e, s))
+	assert.Eq("calls", e.takeCalls(), "BeforeSave BeforeCreate")
+	assert.Eq("no id", e.Id(), uint64(0))
+	ids, err := s.FindByIndex("memtest", &testEntIdx[testEnt_idx_name], []byte("a"), 0, 0)
+	assert.Eq("not stored", fmt.Sprint(ids, err), "[] <nil>")
+
+	e.fail = ""
+	assert.NoErr("create", ent.CreateEnt(e, s))
+	assert.Eq("calls", e.takeCalls(), "BeforeSave BeforeCreate AfterCreate AfterSave")
+	loaded := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(loaded, s, e.Id()))
+	assert.Eq("field set by BeforeSave is stored", loaded.group, "set by BeforeSave")
+
+	// a failing before-hook aborts saving and leaves the ent unchanged
+	e.n = 2
+	e.setChanged(testEnt_f_n)
+	e.fail = "BeforeSave"
+	assert.Err("save", "hook failed", ent.SaveEnt(e))
+	assert.Eq("calls", e.takeCalls(), "BeforeSave")
+	assert.Eq("version", e.Version(), uint64(1))
+	assert.Eq("changes kept", e.ChangedFields().Has(testEnt_f_n), true)
+	assert.NoErr("load", ent.LoadEntById(loaded, s, e.Id()))
+	assert.Eq("not saved", loaded.n, 0)
+
+	// after-hooks are skipped when the storage fails
+	createTestEnts(t, s, &testEnt{name: "b"})
+	e.fail = ""
+	e.name = "b"
+	e.setChanged(testEnt_f_name)
+	assert.Err("save conflict", "unique index conflict", ent.SaveEnt(e))
+	assert.Eq("calls", e.takeCalls(), "BeforeSave")
+	e.name = "a"
+	assert.NoErr("save", ent.SaveEnt(e))
+	assert.Eq("calls", e.takeCalls(), "BeforeSave AfterSave")
+
+	// delete
+	e.fail = "BeforeDelete"
+	assert.Err("delete", "hook failed", ent.DeleteEnt(e))
+	assert.Eq("calls", e.takeCalls(), "BeforeDelete")
+	assert.Eq("id kept", e.Id(), uint64(1))
+	assert.Eq("not deleted", s.exists(&s.m, "memtest", 1), true)
+	e.fail = ""
+	assert.NoErr("delete", ent.DeleteEnt(e))
+	assert.Eq("calls", e.takeCalls(), "BeforeDelete AfterDelete")
+	assert.Eq("deleted", s.exists(&s.m, "memtest", 1), false)
+}
@@ -0,0 +1,125 @@
+package mem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Log entry ops
+const (
+	logOpPut   = 'p'
+	logOpDel   = 'd'
+	logOpIdgen = 'i'
+)
+
+var errBadLog = errors.New("mem: bad log entry")
+
+// logWrite is called for every change made to s.m, with s.mu locked, and appends it to s.Log.
+// Each entry is written with a single call to Log.Write.
+//
+// Log format:
+//
+//	log   = entry*
+//	entry = 'p' uvarint(len(key)) key uvarint(len(value)) value  ; put
+//	      | 'd' uvarint(len(key)) key                            ; delete
+//	      | 'i' uvarint(idgen)                                   ; id generator
+//
+// An 'i' entry is written before a change whenever the id generator has changed since the
+// previous entry.
+func (s *EntStorage) logWrite(key string, value []byte) {
+	if s.Log == nil || s.logErr != nil {
+		return
+	}
+	b := s.logBuf[:0]
+	if idgen := atomic.LoadUint64(&s.idgen); idgen != s.logIdgen {
+		b = append(b, logOpIdgen)
+		b = appendUvarint(b, idgen)
+		s.logIdgen = idgen
+	}
+	if value == nil {
+		b = append(b, logOpDel)
+	} else {
+		b = append(b, logOpPut)
+	}
+	b = appendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	if value != nil {
+		b = appendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	s.logBuf = b
+	_, s.logErr = s.Log.Write(b)
+}
+
+// LogErr returns the first error which occurred while writing to Log, or nil.
+// No more entries are written to Log after an error.
+func (s *EntStorage) LogErr() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logErr
+}
+
+// ReplayLog applies the changes of a log written to Log, reconstructing the state the storage
+// had when the log was written. This can be used in tests to verify recovery after a crash:
+//
+//	var log bytes.Buffer
+//	s := mem.NewEntStorage()
+//	s.Log = &log
+//	... write ents to s, then "crash" ...
+//	s2 := mem.NewEntStorage()
+//	err := s2.ReplayLog(&log)
+//
+// Changes are applied on top of the current data of the storage, which is usually empty, or
+// e.g. the data of a file loaded with LoadFromFile before the log was started. Note that
+// LoadFromFile and Restore are not written to Log.
+//
+// A log which ends with a partially written entry, as after a crash, has all complete entries
+// applied and io.ErrUnexpectedEOF is returned. Changes made by ReplayLog are not written to
+// Log.
+func (s *EntStorage) ReplayLog(r io.Reader) error {
+	br := bufio.NewReader(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.onWrite = nil
+	defer func() { s.m.onWrite = s.logWrite }()
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch op {
+		case logOpIdgen:
+			idgen, err := binary.ReadUvarint(br)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			atomic.StoreUint64(&s.idgen, idgen)
+		case logOpPut, logOpDel:
+			key, err := readSizedBytes(br)
+			if err != nil {
+				return err
+			}
+			if op == logOpDel {
+				s.m.Del(string(key))
+				break
+			}
+			value, err := readSizedBytes(br)
+			if err != nil {
+				return err
+			}
+			s.m.Put(string(key), value)
+		default:
+			return errBadLog
+		}
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -1,10 +1,24 @@
 package mem
 
+import (
+	"bytes"
+	"sort"
+)
+
 // ScopedMap is like a map[string][]byte but prototypal in behaviour; local read misses causes
 // a parent ScopedMap to be tried, while writes are always local. Sort of like a hacky HAMT map.
 type ScopedMap struct {
 	outer *ScopedMap
 	m     map[string][]byte
+	reads map[string][]byte // values read from outer; only used by isolated scopes
+
+	// sorted holds the keys of m (including deleted ones) which belong to a key group
+	// (see keyGroupLen), in sorted order per group. Used by RangeSorted.
+	sorted map[string][]string
+
+	// onWrite, when not nil, is called for every change made to s; nil value means deleted.
+	// Only used by the root scope of EntStorage (see EntStorage.Log.)
+	onWrite func(key string, value []byte)
 }
 
 func (s ScopedMap) Get(key string) []byte {
@@ -15,7 +29,13 @@ func (s ScopedMap) Get(key string) []byte {
 		}
 	}
 	if s.outer != nil {
-		return s.outer.Get(key)
+		v := s.outer.Get(key)
+		if s.reads != nil {
+			if _, ok := s.reads[key]; !ok {
+				s.reads[key] = v
+			}
+		}
+		return v
 	}
 	return nil
 }
@@ -27,25 +47,165 @@ func (s *ScopedMap) Put(key string, value []byte) {
 		if s.m == nil {
 			s.m = make(map[string][]byte)
 		}
+		if _, ok := s.m[key]; !ok {
+			s.addSorted(key)
+		}
 		s.m[key] = value
+		if s.onWrite != nil {
+			s.onWrite(key, value)
+		}
 	}
 }
 
 func (s *ScopedMap) Del(key string) {
 	if s.outer == nil {
-		delete(s.m, key)
+		if _, ok := s.m[key]; ok {
+			delete(s.m, key)
+			s.removeSorted(key)
+			if s.onWrite != nil {
+				s.onWrite(key, nil)
+			}
+		}
 	} else {
 		if s.m == nil {
 			s.m = make(map[string][]byte)
 		}
+		if _, ok := s.m[key]; !ok {
+			s.addSorted(key)
+		}
 		s.m[key] = nil
 	}
 }
 
+// Reset replaces all entries of s with m. s must not have an outer scope.
+func (s *ScopedMap) Reset(m map[string][]byte) {
+	s.m = m
+	s.sorted = nil
+	for k := range m {
+		if n := keyGroupLen(k); n >= 0 {
+			if s.sorted == nil {
+				s.sorted = make(map[string][]string)
+			}
+			s.sorted[k[:n]] = append(s.sorted[k[:n]], k)
+		}
+	}
+	for _, keys := range s.sorted {
+		sort.Strings(keys)
+	}
+}
+
+func (s *ScopedMap) addSorted(key string) {
+	n := keyGroupLen(key)
+	if n < 0 {
+		return
+	}
+	if s.sorted == nil {
+		s.sorted = make(map[string][]string)
+	}
+	group := key[:n]
+	keys := s.sorted[group]
+	i := sort.SearchStrings(keys, key)
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	s.sorted[group] = keys
+}
+
+func (s *ScopedMap) removeSorted(key string) {
+	n := keyGroupLen(key)
+	if n < 0 {
+		return
+	}
+	group := key[:n]
+	keys := s.sorted[group]
+	i := sort.SearchStrings(keys, key)
+	if i < len(keys) && keys[i] == key {
+		if len(keys) == 1 {
+			delete(s.sorted, group)
+		} else {
+			s.sorted[group] = append(keys[:i], keys[i+1:]...)
+		}
+	}
+}
+
 func (s *ScopedMap) NewScope() *ScopedMap {
 	return &ScopedMap{outer: s}
 }
 
+// NewIsolatedScope returns a new scope which remembers values it reads from its outer scope,
+// making it possible to check if those values have changed with OuterChanged.
+func (s *ScopedMap) NewIsolatedScope() *ScopedMap {
+	return &ScopedMap{outer: s, reads: make(map[string][]byte)}
+}
+
+// OuterChanged returns true if any value read from the outer scope of an isolated scope has
+// changed since it was read.
+func (s *ScopedMap) OuterChanged() bool {
+	for k, v := range s.reads {
+		if !bytes.Equal(s.outer.Get(k), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Range calls f for every key with a value (i.e. not deleted) in s and its outer scopes.
+// Keys in inner scopes shadow the same keys in outer scopes.
+// Iteration stops if f returns false.
+func (s *ScopedMap) Range(f func(key string, value []byte) bool) {
+	for scope := s; scope != nil; scope = scope.outer {
+	keys:
+		for k, v := range scope.m {
+			for inner := s; inner != scope; inner = inner.outer {
+				if _, ok := inner.m[k]; ok {
+					continue keys // shadowed
+				}
+			}
+			if v != nil && !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// RangeSorted calls f, in key order, for every key with a value in s and its outer scopes
+// which has the key group prefix group (see keyGroupLen) and where the rest of the key is
+// within the inclusive range [lo, hi]. Iteration stops if f returns false.
+func (s *ScopedMap) RangeSorted(group, lo, hi string, f func(key string, value []byte) bool) {
+	var keys []string
+	for scope := s; scope != nil; scope = scope.outer {
+		v := scope.sorted[group]
+		for i := sort.SearchStrings(v, group+lo); i < len(v) && v[i][len(group):] <= hi; i++ {
+			keys = append(keys, v[i])
+		}
+	}
+	if s.outer != nil {
+		// merge keys of all scopes
+		sort.Strings(keys)
+		n := 0
+		for i, k := range keys {
+			if i == 0 || k != keys[n-1] {
+				keys[n] = k
+				n++
+			}
+		}
+		keys = keys[:n]
+	}
+	for _, k := range keys {
+		// find value in the innermost scope which has the key
+		var v []byte
+		for scope := s; scope != nil; scope = scope.outer {
+			var ok bool
+			if v, ok = scope.m[k]; ok {
+				break
+			}
+		}
+		if v != nil && !f(k, v) {
+			return
+		}
+	}
+}
+
 // ApplyToOuter applies all entries (including deletes) of this scope to its outer scope.
 // This effectively moves changes from this scope to the outer scope, clearing this scope.
 func (s *ScopedMap) ApplyToOuter() {
@@ -53,4 +213,8 @@ func (s *ScopedMap) ApplyToOuter() {
 		s.outer.Put(k, v)
 	}
 	s.m = nil
+	s.sorted = nil
+	if s.reads != nil {
+		s.reads = make(map[string][]byte)
+	}
 }
@@ -1,6 +1,8 @@
 package mem
 
 import (
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/rsms/go-testutil"
@@ -36,3 +38,67 @@ func TestScopedMap(t *testing.T) {
 	assert.Eq("get", m1.Get("b"), empty)
 	assert.Eq("get", m1.Get("c"), []byte("c"))
 }
+
+func TestScopedMapIsolated(t *testing.T) {
+	assert := testutil.NewAssert(t)
+
+	var m1 ScopedMap
+	m1.Put("a", []byte{'a'})
+	m1.Put("b", []byte{'b'})
+
+	m2 := m1.NewIsolatedScope()
+	m2.Put("c", []byte{'c'})
+	m2.Del("b")
+	assert.Eq("get", m2.Get("a"), []byte("a"))
+	assert.Eq("unchanged", m2.OuterChanged(), false)
+
+	// Range visits keys in all scopes, except deleted ones
+	var keys []string
+	m2.Range(func(k string, v []byte) bool {
+		keys = append(keys, k+"="+string(v))
+		return true
+	})
+	sort.Strings(keys)
+	assert.Eq("range", strings.Join(keys, " "), "a=a c=c")
+
+	// changing a value in the outer scope which m2 has not read is not a conflict
+	m1.Put("b", []byte{'B'})
+	assert.Eq("unchanged", m2.OuterChanged(), false)
+
+	// changing a value in the outer scope which m2 has read is a conflict
+	m1.Put("a", []byte{'A'})
+	assert.Eq("changed", m2.OuterChanged(), true)
+}
+
+func TestScopedMapRangeSorted(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	rangeSorted := func(m *ScopedMap, lo, hi string) string {
+		var keys []string
+		m.RangeSorted("t#x:", lo, hi, func(k string, v []byte) bool {
+			keys = append(keys, k[len("t#x:"):]+"="+string(v))
+			return true
+		})
+		return strings.Join(keys, " ")
+	}
+
+	var m1 ScopedMap
+	for _, k := range []string{"d", "b", "e", "a", "c"} {
+		m1.Put("t#x:"+k, []byte(k))
+	}
+	m1.Put("t#y:c", []byte("y"))
+	m1.Put("t:1", []byte("1"))
+	m1.Del("t#x:e")
+	assert.Eq("range", rangeSorted(&m1, "b", "d"), "b=b c=c d=d")
+	assert.Eq("range", rangeSorted(&m1, "", "z"), "a=a b=b c=c d=d")
+
+	// inner scopes shadow and delete keys of outer scopes
+	m2 := m1.NewScope()
+	m2.Put("t#x:bb", []byte("bb"))
+	m2.Put("t#x:c", []byte("C"))
+	m2.Del("t#x:d")
+	assert.Eq("range", rangeSorted(m2, "b", "d"), "b=b bb=bb c=C")
+	assert.Eq("outer", rangeSorted(&m1, "b", "d"), "b=b c=c d=d")
+
+	m2.ApplyToOuter()
+	assert.Eq("applied", rangeSorted(&m1, "b", "d"), "b=b bb=bb c=C")
+}
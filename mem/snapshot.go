@@ -0,0 +1,48 @@
+package mem
+
+import "sync/atomic"
+
+// Snapshot holds the state of an EntStorage at some point in time. See EntStorage.Snapshot.
+type Snapshot struct {
+	idgen uint64
+	m     map[string][]byte
+}
+
+// Snapshot captures the current state of the storage, including its id generator, so that it
+// can later be restored with Restore. This is useful in tests to share a fixture between
+// subtests:
+//
+//	s := mem.NewEntStorage()
+//	createFixture(s)
+//	fixture := s.Snapshot()
+//	for _, test := range tests {
+//	  s.Restore(fixture)
+//	  ...
+//	}
+//
+// Changes made in transactions which have not yet been committed are not included.
+func (s *EntStorage) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &Snapshot{idgen: atomic.LoadUint64(&s.idgen), m: copyMap(s.m.m)}
+}
+
+// Restore resets the storage to the state captured by snap.
+// A snapshot can be restored any number of times.
+// Restore must not be called while transactions of the storage are in progress.
+func (s *EntStorage) Restore(snap *Snapshot) {
+	m := copyMap(snap.m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Reset(m)
+	atomic.StoreUint64(&s.idgen, snap.idgen)
+}
+
+// copyMap returns a shallow copy of m. Values are shared since they are never modified.
+func copyMap(m map[string][]byte) map[string][]byte {
+	m2 := make(map[string][]byte, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
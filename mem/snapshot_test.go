@@ -0,0 +1,31 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s, &testEnt{name: "a"}, &testEnt{name: "b"})
+	snap := s.Snapshot()
+
+	for i := 0; i < 2; i++ {
+		e := &testEnt{name: "c"}
+		createTestEnts(t, s, e)
+		assert.Eq("id after snapshot", e.Id(), uint64(3))
+		a := &testEnt{}
+		assert.NoErr("load", ent.LoadEntById(a, s, 1))
+		assert.NoErr("delete", ent.DeleteEnt(a))
+
+		s.Restore(snap) // restores the id generator too, so that ids are the same every time
+		assert.Eq("a restored", s.exists(&s.m, "memtest", 1), true)
+		assert.Eq("c gone", s.exists(&s.m, "memtest", 3), false)
+		ids, err := s.FindByIndex("memtest", &testEntIdx[testEnt_idx_name], []byte("c"), 0, 0)
+		assert.NoErr("find", err)
+		assert.Eq("index restored", len(ids), 0)
+	}
+}
@@ -1,8 +1,13 @@
 package mem
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,13 +23,36 @@ type Ent = ent.Ent
 type EntStorage struct {
 	idgen uint64 // id generator for creating new ents
 
-	mu sync.RWMutex // protects the following fields
-	m  ScopedMap    // entkey => json
+	// Compression, when not ent.NoCompression, causes ents to be stored compressed.
+	// Ents stored with a different setting (or none) are still readable.
+	Compression ent.Compression
+
+	// MaxEntBytes, when larger than zero, limits the size of encoded ents.
+	// Creating or saving an ent which encodes to more bytes fails with ent.ErrEntTooLarge.
+	MaxEntBytes int
+
+	// Msgpack, when true, causes ents to be stored as MessagePack (see ent.MsgpackEncodeEnt)
+	// rather than as JSON, which takes up less memory. Ents stored with a different setting
+	// are still readable.
+	Msgpack bool
+
+	// Log, when not nil, receives every change made to the storage as a log which can be
+	// replayed with ReplayLog, e.g. to test recovery after a crash.
+	Log io.Writer
+
+	mu   sync.RWMutex  // protects the following fields
+	m    ScopedMap     // entkey => json or msgpack
+	subs []*subscriber // see Subscribe
+
+	logIdgen uint64 // idgen as of the latest log entry
+	logErr   error  // first error writing to Log
+	logBuf   []byte
 }
 
 func NewEntStorage() *EntStorage {
 	s := &EntStorage{}
 	s.m.m = make(map[string][]byte)
+	s.m.onWrite = s.logWrite
 	return s
 }
 
@@ -34,36 +62,206 @@ func debugTrace(format string, args ...interface{}) {
 	//fmt.Printf("TRACE "+format+"\n", args...)
 }
 
-func (s *EntStorage) Create(e Ent, fields ent.FieldSet) (id uint64, err error) {
+// Note: Storage methods are implemented by functions which accept the map to operate on, so
+// that they can be used both with s.m and with the isolated map scope of a transaction (Tx).
+
+func (s *EntStorage) Create(e Ent, fields ent.FieldSet) (uint64, error) {
+	id, err := s.create(&s.m, e, fields)
+	if err == nil {
+		s.notify(ent.ChangeEvent{Op: ent.OpCreate, EntTypeName: e.EntTypeName(), Id: id, Version: 1})
+	}
+	return id, err
+}
+
+func (s *EntStorage) Save(e Ent, fields ent.FieldSet) (nextVersion uint64, err error) {
+	nextVersion, err = s.save(&s.m, e, fields)
+	if err == nil {
+		s.notify(ent.ChangeEvent{
+			Op: ent.OpSave, EntTypeName: e.EntTypeName(), Id: e.Id(), Version: nextVersion})
+	}
+	return
+}
+
+// Put is part of the ent.Storage interface, used by ent.PutEnt
+func (s *EntStorage) Put(e Ent, id uint64) (version uint64, err error) {
+	version, err = s.put(&s.m, e, id)
+	if err == nil {
+		s.notify(putEvent(e, id, version))
+	}
+	return
+}
+
+func (s *EntStorage) LoadById(e Ent, id uint64) (version uint64, err error) {
+	return s.loadById(&s.m, e, id)
+}
+
+func (s *EntStorage) Exists(entType string, id uint64) (bool, error) {
+	return s.exists(&s.m, entType, id), nil
+}
+
+func (s *EntStorage) Delete(e Ent, id uint64) error {
+	err := s.delete(&s.m, e, id)
+	if err == nil {
+		s.notify(ent.ChangeEvent{Op: ent.OpDelete, EntTypeName: e.EntTypeName(), Id: id})
+	}
+	return err
+}
+
+func (s *EntStorage) DeleteByIndex(e Ent, x *ent.EntIndex, key []byte) (int, error) {
+	ids, err := s.deleteByIndex(&s.m, e, x, key)
+	s.notify(deleteEvents(e.EntTypeName(), ids)...)
+	return len(ids), err
+}
+
+// DeleteAllOfType is part of the ent.BulkDeleter interface, used by ent.DeleteAllEntsOfType.
+// All keys of ents of the type of prototype and of their indexes are removed at once.
+func (s *EntStorage) DeleteAllOfType(prototype Ent) error {
+	entType := prototype.EntTypeName()
+	entPrefix, indexPrefix := entType+":", entType+"#"
+	var ids []uint64
+	s.mu.Lock()
+	var keys []string
+	s.m.Range(func(key string, _ []byte) bool {
+		if strings.HasPrefix(key, entPrefix) {
+			if id, err := strconv.ParseUint(key[len(entPrefix):], 36, 64); err == nil {
+				ids = append(ids, id)
+			}
+			keys = append(keys, key)
+		} else if strings.HasPrefix(key, indexPrefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		s.m.Del(key)
+	}
+	s.mu.Unlock()
+	s.notify(deleteEvents(entType, ids)...)
+	return nil
+}
+
+// RebuildIndexes is part of the ent.IndexRebuilder interface, used by ent.RebuildIndexes.
+// The keys of all indexes of the type of prototype are removed and the index entries of each
+// ent are added again, all at once.
+func (s *EntStorage) RebuildIndexes(prototype Ent) error {
+	entType := prototype.EntTypeName()
+	entPrefix, indexPrefix := entType+":", entType+"#"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.m.NewScope()
+	var ids []uint64
+	s.m.Range(func(key string, _ []byte) bool {
+		if strings.HasPrefix(key, entPrefix) {
+			if id, err := strconv.ParseUint(key[len(entPrefix):], 36, 64); err == nil {
+				ids = append(ids, id)
+			}
+		} else if strings.HasPrefix(key, indexPrefix) {
+			m.Del(key)
+		}
+		return true
+	})
+	ent.IdSet(ids).Sort()
+	for _, id := range ids {
+		e := prototype.EntNew()
+		if _, err := s.loadEnt(e, s.m.Get(s.entKey(entType, id))); err != nil {
+			return err
+		}
+		if err := s.updateIndexes(m, nil, e, id, e.EntFields().FieldSet, m); err != nil {
+			return err
+		}
+	}
+	m.ApplyToOuter()
+	return nil
+}
+
+func (s *EntStorage) create(m *ScopedMap, e Ent, fields ent.FieldSet) (id uint64, err error) {
 	id = atomic.AddUint64(&s.idgen, 1)
-	err = s.putEnt(e, id, 1, fields)
+	err = s.putEnt(m, e, id, 0, 1, fields)
 	return
 }
 
-func (s *EntStorage) Save(e Ent, fields ent.FieldSet) (nextVersion uint64, err error) {
+func (s *EntStorage) save(m *ScopedMap, e Ent, fields ent.FieldSet) (nextVersion uint64, err error) {
 	nextVersion = e.Version() + 1
-	err = s.putEnt(e, e.Id(), nextVersion, fields)
+	err = s.putEnt(m, e, e.Id(), e.Version(), nextVersion, fields)
 	return
 }
 
-func (s *EntStorage) LoadById(e Ent, id uint64) (version uint64, err error) {
+// put writes e as the ent with id regardless of its current version (see ent.PutEnt)
+func (s *EntStorage) put(m *ScopedMap, e Ent, id uint64) (version uint64, err error) {
+	key := s.entKey(e.EntTypeName(), id)
+	for {
+		var prevVersion uint64
+		s.mu.RLock()
+		prevData := m.Get(key)
+		s.mu.RUnlock()
+		if prevData != nil {
+			if prevVersion, err = s.loadEntPartial(e.EntNew(), prevData, 0); err != nil {
+				return
+			}
+		}
+		version = prevVersion + 1
+		err = s.putEnt(m, e, id, prevVersion, version, e.EntFields().FieldSet)
+		if err != ent.ErrVersionConflict {
+			break
+		}
+		// changed by someone else in the meantime; try again with the latest version
+	}
+	if err == nil {
+		// make sure ids created later do not collide with id
+		for {
+			idgen := atomic.LoadUint64(&s.idgen)
+			if id <= idgen || atomic.CompareAndSwapUint64(&s.idgen, idgen, id) {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (s *EntStorage) loadById(m *ScopedMap, e Ent, id uint64) (version uint64, err error) {
 	key := s.entKey(e.EntTypeName(), id)
 	s.mu.RLock()
-	data := s.m.Get(key)
+	data := m.Get(key)
 	s.mu.RUnlock()
 	return s.loadEnt(e, data)
 }
 
+func (s *EntStorage) exists(m *ScopedMap, entType string, id uint64) bool {
+	key := s.entKey(entType, id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return m.Get(key) != nil
+}
+
 func (s *EntStorage) loadEnt(e Ent, data []byte) (version uint64, err error) {
 	if data == nil {
 		err = ent.ErrNotFound
 		return
 	}
-	_, version, err = ent.JsonDecodeEnt(e, data) // note: ignore "id" return value
+	if data, err = ent.DecompressData(data); err != nil {
+		return
+	}
+	// note: ignore "id" return value
+	if ent.IsMsgpackData(data) {
+		_, version, err = ent.MsgpackDecodeEnt(e, data)
+	} else {
+		_, version, err = ent.JsonDecodeEnt(e, data)
+	}
 	return
 }
 
-func (s *EntStorage) Delete(e Ent, id uint64) error {
+func (s *EntStorage) loadEntPartial(e Ent, data []byte, fields ent.FieldSet) (uint64, error) {
+	data, err := ent.DecompressData(data)
+	if err != nil {
+		return 0, err
+	}
+	if ent.IsMsgpackData(data) {
+		return ent.MsgpackDecodeEntPartial(e, data, fields)
+	}
+	return ent.JsonDecodeEntPartial(e, data, fields)
+}
+
+func (s *EntStorage) delete(root *ScopedMap, e Ent, id uint64) error {
 	allfields := e.EntFields().FieldSet
 	key := s.entKey(e.EntTypeName(), id)
 
@@ -71,20 +269,20 @@ func (s *EntStorage) Delete(e Ent, id uint64) error {
 	defer s.mu.Unlock()
 
 	if len(e.EntIndexes()) == 0 {
-		if s.m.Get(key) == nil {
+		if root.Get(key) == nil {
 			return ent.ErrNotFound
 		}
 	} else {
 		// load latest data that indexes depends on
-		if _, err := ent.JsonDecodeEntPartial(e, s.m.Get(key), allfields); err != nil {
+		if _, err := s.loadEntPartial(e, root.Get(key), allfields); err != nil {
 			return err
 		}
 
 		// fork storage
-		m := s.m.NewScope()
+		m := root.NewScope()
 
 		// update indexes
-		if err := s.updateIndexes(e, nil, id, allfields, m); err != nil {
+		if err := s.updateIndexes(root, e, nil, id, allfields, m); err != nil {
 			return err
 		}
 
@@ -93,26 +291,64 @@ func (s *EntStorage) Delete(e Ent, id uint64) error {
 	}
 
 	// remove ent
-	s.m.Del(key)
+	root.Del(key)
 
 	return nil
 }
 
-func (s *EntStorage) putEnt(e Ent, id, version uint64, changedFields ent.FieldSet) error {
+// deleteByIndex returns the ids of the ents deleted
+func (s *EntStorage) deleteByIndex(
+	m *ScopedMap, e Ent, x *ent.EntIndex, key []byte,
+) ([]uint64, error) {
+	ids, err := s.findByIndex(m, e.EntTypeName(), x, key, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	deleted := ids[:0]
+	for _, id := range ids {
+		if err := s.delete(m, e.EntNew(), id); err != nil {
+			if err == ent.ErrNotFound {
+				continue // deleted by someone else in the meantime
+			}
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
+}
+
+// putEnt writes e as version of the ent with id.
+// Fails with ent.ErrVersionConflict if prevVersion is not zero and the ent exists with another
+// version.
+func (s *EntStorage) putEnt(
+	root *ScopedMap, e Ent, id, prevVersion, version uint64, changedFields ent.FieldSet,
+) error {
 	debugTrace("putEnt ent %q id=%d version=%d fieldmap=%b",
 		e.EntTypeName(), id, version, changedFields)
 
 	// encode
-	// Note: EntFields().Fieldmap is used here instead of changedFields, since the JSON encoding
-	// we use doesn't support patching. Storage that writes fields to individual cells,
+	// Note: EntFields().Fieldmap is used here instead of changedFields, since the encodings
+	// we use don't support patching. Storage that writes fields to individual cells,
 	// like an SQL table or key-value store entry may make use of fieldmap to store/update
 	// only modified fields.
-	json, err := ent.JsonEncodeEnt(e, id, version, e.EntFields().FieldSet, "")
+	var data []byte
+	var err error
+	if s.Msgpack {
+		data, err = ent.MsgpackEncodeEnt(e, id, version, e.EntFields().FieldSet)
+	} else {
+		data, err = ent.JsonEncodeEnt(e, id, version, e.EntFields().FieldSet, "")
+	}
 	if err != nil {
 		return err
 	}
+	if s.MaxEntBytes > 0 && len(data) > s.MaxEntBytes {
+		return ent.ErrEntTooLarge
+	}
+	if data, err = ent.CompressData(data, s.Compression); err != nil {
+		return err
+	}
 
-	// lock read & write access to s.m, which we will read from (and edit at the end)
+	// lock read & write access to root, which we will read from (and edit at the end)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -120,15 +356,15 @@ func (s *EntStorage) putEnt(e Ent, id, version uint64, changedFields ent.FieldSe
 	key := s.entKey(e.EntTypeName(), id)
 
 	// load & verify that the current version is what we are expecting
-	expectVersion := e.Version()
+	expectVersion := prevVersion
 	var prevEnt Ent
 	if expectVersion != 0 {
-		prevData := s.m.Get(key)
+		prevData := root.Get(key)
 		if prevData != nil {
 			// Make a new ent instance of the same type as e, then load it.
 			// Effectively the same as calling LoadTYPE(id) but
 			prevEnt = e.EntNew()
-			currentVersion, err := ent.JsonDecodeEntPartial(prevEnt, prevData, changedFields)
+			currentVersion, err := s.loadEntPartial(prevEnt, prevData, changedFields)
 			if err != nil {
 				return err
 			}
@@ -139,10 +375,10 @@ func (s *EntStorage) putEnt(e Ent, id, version uint64, changedFields ent.FieldSe
 	}
 
 	// fork storage, creating a new map scope to hold changes queued up in this transaction
-	m := s.m.NewScope()
+	m := root.NewScope()
 
 	// update indexes
-	if err := s.updateIndexes(prevEnt, e, id, changedFields, m); err != nil {
+	if err := s.updateIndexes(root, prevEnt, e, id, changedFields, m); err != nil {
 		return err
 	}
 
@@ -151,17 +387,21 @@ func (s *EntStorage) putEnt(e Ent, id, version uint64, changedFields ent.FieldSe
 	m.ApplyToOuter()
 
 	// write value
-	debugTrace("storage put %q => %s", key, json)
-	s.m.Put(key, json)
+	debugTrace("storage put %q => %q", key, data)
+	root.Put(key, data)
 	// note that s.mu is locked with deferred unlock
 	return nil
 }
 
 func (s *EntStorage) updateIndexes(
-	prevEnt, nextEnt Ent, id uint64, fields ent.FieldSet, m *ScopedMap,
+	root *ScopedMap, prevEnt, nextEnt Ent, id uint64, fields ent.FieldSet, m *ScopedMap,
 ) error {
+	indexGet := func(entTypeName, indexName, key string) ([]uint64, error) {
+		return s.indexGet(root, entTypeName, indexName, key)
+	}
+
 	// update indexes
-	indexEdits, err := ent.ComputeIndexEdits(s.indexGet, prevEnt, nextEnt, id, fields)
+	indexEdits, err := ent.ComputeIndexEdits(indexGet, prevEnt, nextEnt, id, fields)
 	if err != nil {
 		return err
 	}
@@ -175,6 +415,16 @@ func (s *EntStorage) updateIndexes(
 	}
 
 	for _, ed := range indexEdits {
+		if ed.Index.Score != 0 {
+			scoreKey := s.indexScoreKey(entType, ed.Index.Name, ed.Key, id)
+			if ed.IsCleanup {
+				m.Del(scoreKey)
+			} else {
+				var b [8]byte
+				binary.BigEndian.PutUint64(b[:], math.Float64bits(ed.Score))
+				m.Put(scoreKey, b[:])
+			}
+		}
 		key := s.indexKey(entType, ed.Index.Name, ed.Key)
 		if len(ed.Value) == 0 {
 			debugTrace("index del %q", key)
@@ -182,7 +432,7 @@ func (s *EntStorage) updateIndexes(
 		} else {
 			if !ed.IsCleanup && ed.Index.IsUnique() {
 				// check for collision
-				ids, err := s.indexGet(entType, ed.Index.Name, string(ed.Key))
+				ids, err := indexGet(entType, ed.Index.Name, string(ed.Key))
 				if err != nil {
 					return err
 				}
@@ -194,6 +444,8 @@ func (s *EntStorage) updateIndexes(
 						Underlying:  ent.ErrUniqueConflict,
 						EntTypeName: entType,
 						IndexName:   ed.Index.Name,
+						Key:         ed.Key,
+						ExistingId:  ids[0],
 					}
 				}
 			}
@@ -207,15 +459,134 @@ func (s *EntStorage) updateIndexes(
 
 func (s *EntStorage) FindByIndex(
 	entTypeName string, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	return s.findByIndex(&s.m, entTypeName, x, key, limit, flags)
+}
+
+func (s *EntStorage) FindByIndexRange(
+	entTypeName string, x *ent.EntIndex, lo, hi []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	return s.findByIndexRange(&s.m, entTypeName, x, lo, hi, limit, flags)
+}
+
+func (s *EntStorage) FindByIndexScoreRange(
+	entTypeName string, x *ent.EntIndex, key []byte, min, max float64, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	return s.findByIndexScoreRange(&s.m, entTypeName, x, key, min, max, limit, flags)
+}
+
+func (s *EntStorage) Count(entTypeName string, x *ent.EntIndex, key []byte) (int, error) {
+	return s.count(&s.m, entTypeName, x, key)
+}
+
+func (s *EntStorage) ListIndexKeys(entTypeName string, x *ent.EntIndex) ([][]byte, error) {
+	return s.listIndexKeys(&s.m, entTypeName, x)
+}
+
+func (s *EntStorage) LoadByIndex(
+	e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, error) {
+	return s.loadByIndex(&s.m, s, e, x, key, limit, flags)
+}
+
+func (s *EntStorage) LoadByIndexPaged(
+	e Ent, x *ent.EntIndex, key, cursor []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	return s.loadByIndexPaged(&s.m, s, e, x, key, cursor, limit, flags)
+}
+
+func (s *EntStorage) findByIndex(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex, key []byte, limit int,
+	flags ent.LookupFlags,
 ) ([]uint64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	ids, err := s.indexGet(entTypeName, x.Name, string(key))
-	limitIds(&ids, limit, (flags&ent.Reverse) != 0)
-	return ids, err
+	return s.indexFind(m, entTypeName, x, string(key), limit, flags)
 }
 
-func (s *EntStorage) LoadByIndex(
+func (s *EntStorage) findByIndexRange(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex, lo, hi []byte, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	keyPrefix := s.indexKey(entTypeName, x.Name, "")
+	reverse := (flags & ent.Reverse) != 0
+	var ids []uint64 // sorted by key, then id
+	s.mu.RLock()
+	m.RangeSorted(keyPrefix, string(lo), string(hi), func(_ string, v []byte) bool {
+		if len(v) > 0 {
+			set := ent.ParseIdSet(v)
+			set.Sort()
+			ids = append(ids, set...)
+		}
+		return reverse || limit <= 0 || len(ids) < limit
+	})
+	s.mu.RUnlock()
+	return ent.LimitIds(ids, limit, flags), nil
+}
+
+// findByIndexScoreRange looks up the score of each ent with key in index x (see indexScoreKey)
+func (s *EntStorage) findByIndexScoreRange(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex, key []byte, min, max float64, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids, err := s.indexGet(m, entTypeName, x.Name, string(key))
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[uint64]float64, len(ids))
+	n := 0
+	for _, id := range ids {
+		b := m.Get(s.indexScoreKey(entTypeName, x.Name, string(key), id))
+		if len(b) != 8 {
+			continue
+		}
+		score := math.Float64frombits(binary.BigEndian.Uint64(b))
+		if score >= min && score <= max {
+			scores[id] = score
+			ids[n] = id
+			n++
+		}
+	}
+	ids = ids[:n]
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := scores[ids[i]], scores[ids[j]]
+		return a < b || (a == b && ids[i] < ids[j])
+	})
+	return ent.LimitIds(ids, limit, flags), nil
+}
+
+func (s *EntStorage) count(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex, key []byte,
+) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids, err := s.indexGet(m, entTypeName, x.Name, string(key))
+	return len(ids), err
+}
+
+func (s *EntStorage) listIndexKeys(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex,
+) ([][]byte, error) {
+	keyPrefix := s.indexKey(entTypeName, x.Name, "")
+	var keys [][]byte
+	s.mu.RLock()
+	m.Range(func(k string, v []byte) bool {
+		if len(v) > 0 && strings.HasPrefix(k, keyPrefix) {
+			keys = append(keys, []byte(k[len(keyPrefix):]))
+		}
+		return true
+	})
+	s.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys, nil
+}
+
+// loadByIndex loads ents from m, binding them to storage
+func (s *EntStorage) loadByIndex(
+	m *ScopedMap, storage ent.Storage,
 	e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
 ) ([]Ent, error) {
 	//
@@ -226,8 +597,7 @@ func (s *EntStorage) LoadByIndex(
 	//
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	entTypeName := e.EntTypeName()
-	ids, err := s.indexGet(entTypeName, x.Name, string(key))
+	ids, err := s.indexFind(m, e.EntTypeName(), x, string(key), limit, flags)
 	if err != nil {
 		return nil, err
 	}
@@ -237,32 +607,62 @@ func (s *EntStorage) LoadByIndex(
 		}
 		return nil, nil
 	}
-	limitIds(&ids, limit, (flags&ent.Reverse) != 0)
+	return s.loadEnts(m, storage, e, ids)
+}
+
+// loadByIndexPaged loads a page of ents from m, binding them to storage
+func (s *EntStorage) loadByIndexPaged(
+	m *ScopedMap, storage ent.Storage,
+	e Ent, x *ent.EntIndex, key, cursor []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids, err := s.indexFind(m, e.EntTypeName(), x, string(key), 0, flags&^ent.Reverse)
+	if err != nil || len(ids) == 0 {
+		return nil, nil, err
+	}
+	ent.IdSet(ids).Sort()
+	ids, nextCursor, err := ent.PageIds(ids, cursor, limit, flags)
+	if err != nil || len(ids) == 0 {
+		return nil, nil, err
+	}
+	ents, err := s.loadEnts(m, storage, e, ids)
+	return ents, nextCursor, err
+}
+
+// loadEnts loads ents with ids from m into e and new ents of the same type as e.
+// s.mu must be locked by the caller.
+func (s *EntStorage) loadEnts(m *ScopedMap, storage ent.Storage, e Ent, ids []uint64) ([]Ent, error) {
+	entTypeName := e.EntTypeName()
 	ents := make([]Ent, len(ids))
 	for i, id := range ids {
 		e2 := e
 		if i > 0 {
 			e2 = e.EntNew()
 		}
-		version, err := s.loadEnt(e2, s.m.Get(s.entKey(entTypeName, id)))
+		version, err := s.loadEnt(e2, m.Get(s.entKey(entTypeName, id)))
 		if err != nil {
 			return nil, err
 		}
-		ent.SetEntBaseFieldsAfterLoad(e2, s, id, version)
+		ent.SetEntBaseFieldsAfterLoad(e2, storage, id, version)
 		ents[i] = e2
 	}
 	return ents, nil
 }
 
+// IterateIds returns an iterator over the ids of all ents of type entType, in ascending order.
+// The iterator operates on a snapshot of the ids taken when IterateIds is called.
 func (s *EntStorage) IterateIds(entType string) ent.IdIterator {
 	it := &IdIterator{}
-	it.init(s, entType)
+	it.init(s, &s.m, entType)
 	return it
 }
 
+// IterateEnts returns an iterator over all ents of the type of proto, in ascending id order.
+// Ents deleted after IterateEnts is called are skipped.
 func (s *EntStorage) IterateEnts(proto Ent) ent.EntIterator {
 	it := &EntIterator{s: s, etype: reflect.TypeOf(proto).Elem()}
-	it.init(s, proto.EntTypeName())
+	it.init(s, &s.m, proto.EntTypeName())
 	return it
 }
 
@@ -272,23 +672,26 @@ type IdIterator struct {
 type EntIterator struct {
 	IdIterator
 	err   error
-	s     *EntStorage
+	s     ent.Storage
 	etype reflect.Type
 }
 
-func (it *IdIterator) init(s *EntStorage, entType string) {
+func (it *IdIterator) init(s *EntStorage, m *ScopedMap, entType string) {
 	keyPrefix := entType + ":"
 	// this could be fancier... for now, KISS -- full scan of all ids into memory
 	ids := make([]uint64, 0, 32)
 	s.mu.RLock()
-	for k, _ := range s.m.m {
+	m.Range(func(k string, _ []byte) bool {
 		if strings.HasPrefix(k, keyPrefix) {
-			id, _ := strconv.ParseUint(k[len(keyPrefix):], 10, 64)
+			id, _ := strconv.ParseUint(k[len(keyPrefix):], 36, 64) // see entKey
 			ids = append(ids, id)
 		}
-	}
-	it.ids = ids
+		return true
+	})
 	s.mu.RUnlock()
+	// sort so that iteration order does not depend on the order of map iteration
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	it.ids = ids
 }
 
 func (it *IdIterator) Err() error { return nil }
@@ -297,8 +700,8 @@ func (it *IdIterator) Next(id *uint64) bool {
 	if len(it.ids) == 0 {
 		return false
 	}
-	*id = it.ids[len(it.ids)-1]
-	it.ids = it.ids[:len(it.ids)-1]
+	*id = it.ids[0]
+	it.ids = it.ids[1:]
 	return true
 }
 
@@ -333,21 +736,11 @@ func (it *EntIterator) Next(e Ent) bool {
 
 // -------
 
-func limitIds(ids *[]uint64, limit int, reverse bool) {
-	if reverse {
-		v := *ids
-		for i, j := 0, len(v)-1; i < j; i, j = i+1, j-1 {
-			v[i], v[j] = v[j], v[i]
-		}
-	}
-	if limit > 0 && limit < len(*ids) {
-		*ids = (*ids)[:limit]
-	}
-}
-
-func (s *EntStorage) indexGet(entTypeName, indexName, key string) ([]uint64, error) {
+func (s *EntStorage) indexGet(
+	m *ScopedMap, entTypeName, indexName, key string,
+) ([]uint64, error) {
 	indexKey := s.indexKey(entTypeName, indexName, key)
-	value := s.m.Get(indexKey)
+	value := m.Get(indexKey)
 	debugTrace("index get %q => %q", indexKey, value)
 	if len(value) == 0 {
 		return nil, nil
@@ -355,10 +748,49 @@ func (s *EntStorage) indexGet(entTypeName, indexName, key string) ([]uint64, err
 	return ent.ParseIdSet(value), nil
 }
 
+// indexFind returns at most limit ids of ents with key in index x. Ids of soft-deleted ents
+// are included when flags contains ent.IncludeDeleted. s.mu must be locked by the caller.
+func (s *EntStorage) indexFind(
+	m *ScopedMap, entTypeName string, x *ent.EntIndex, key string, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	find := func(x *ent.EntIndex, flags ent.LookupFlags) ([]uint64, error) {
+		// the ids of an index entry are in the order they were added, not in id order
+		ids, err := s.indexGet(m, entTypeName, x.Name, key)
+		ent.IdSet(ids).Sort()
+		return ent.LimitIds(ids, limit, flags), err
+	}
+	if (flags & ent.IncludeDeleted) == 0 {
+		return find(x, flags)
+	}
+	return ent.FindIdsIncludingDeleted(x, limit, flags, find)
+}
+
 func (s *EntStorage) indexKey(entTypeName, indexName, key string) string {
 	return entTypeName + "#" + indexName + ":" + key
 }
 
+// indexScoreKey returns the key of the score of the entry of the ent with id in an index with a
+// score field (see ent.EntIndex.Score), which holds the score as a big-endian float64
+func (s *EntStorage) indexScoreKey(entTypeName, indexName, key string, id uint64) string {
+	return entTypeName + "#" + indexName + "#score:" + key + "\xfe" + strconv.FormatUint(id, 36)
+}
+
+// keyGroupLen returns the length of the "type#index:" prefix of an index key (see indexKey),
+// or -1 if key is not an index key. ScopedMap keeps index keys sorted per such prefix, which
+// allows FindByIndexRange to find keys without scanning all data.
+func keyGroupLen(key string) int {
+	i := strings.IndexByte(key, '#')
+	if i < 0 {
+		return -1
+	}
+	j := strings.IndexByte(key[i:], ':')
+	if j < 0 {
+		return -1
+	}
+	return i + j + 1
+}
+
 func (s *EntStorage) entKey(entTypeName string, id uint64) string {
 	if id == 0 {
 		panic("zero id")
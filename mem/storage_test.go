@@ -0,0 +1,569 @@
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+// testEnt is a hand-written ent, like one generated by entgen, used to test the storage
+type testEnt struct {
+	ent.EntBase
+	name    string   // unique case-folded index "name"
+	n       int      // index "n"
+	tags    []string // multi-entry index "tag", and "scoredtag" scored by score
+	group   string   // index "group", scored by score
+	score   int      //
+	deleted bool     // soft-delete marker
+}
+
+const (
+	testEnt_f_name = iota
+	testEnt_f_n
+	testEnt_f_tags
+	testEnt_f_group
+	testEnt_f_score
+	testEnt_f_deleted
+)
+
+var testEntFields = ent.Fields{
+	Names:    []string{"name", "n", "tags", "group", "score", "deleted"},
+	FieldSet: 0b111111,
+}
+
+var testEntIdx = []ent.EntIndex{
+	{Name: "name", Fields: 1 << testEnt_f_name, Flags: ent.EntIndexUnique},
+	{Name: "n", Fields: 1 << testEnt_f_n},
+	{Name: "tag", Fields: 1 << testEnt_f_tags, Flags: ent.EntIndexMulti},
+	{Name: "group", Fields: 1 << testEnt_f_group, Score: 1 << testEnt_f_score},
+	{Name: "scoredtag", Fields: 1 << testEnt_f_tags, Flags: ent.EntIndexMulti,
+		Score: 1 << testEnt_f_score},
+}
+
+const (
+	testEnt_idx_name = iota
+	testEnt_idx_n
+	testEnt_idx_tag
+	testEnt_idx_group
+	testEnt_idx_scoredtag
+)
+
+func (e *testEnt) EntTypeName() string        { return "memtest" }
+func (e *testEnt) EntNew() ent.Ent            { return &testEnt{} }
+func (e *testEnt) EntIndexes() []ent.EntIndex { return testEntIdx }
+func (e *testEnt) EntFields() ent.Fields      { return testEntFields }
+func (e *testEnt) EntIsDeleted() bool         { return e.deleted }
+func (e *testEnt) EntDeletedField() int       { return testEnt_f_deleted }
+func (e *testEnt) setChanged(fields ...int)   { e.SetEntFieldsChanged(fieldSet(fields...)) }
+
+func (e *testEnt) EntEncode(c ent.Encoder, fields ent.FieldSet) {
+	if fields.Has(testEnt_f_name) {
+		c.Key("name")
+		ent.EncodeStrFolded(c, e.name)
+	}
+	if fields.Has(testEnt_f_n) {
+		c.Key("n")
+		c.Int(int64(e.n), 64)
+	}
+	if fields.Has(testEnt_f_tags) {
+		c.Key("tags")
+		c.BeginList(len(e.tags))
+		for _, v := range e.tags {
+			c.Str(v)
+		}
+		c.EndList()
+	}
+	if fields.Has(testEnt_f_group) {
+		c.Key("group")
+		c.Str(e.group)
+	}
+	if fields.Has(testEnt_f_score) {
+		c.Key("score")
+		c.Int(int64(e.score), 64)
+	}
+	if fields.Has(testEnt_f_deleted) {
+		c.Key("deleted")
+		c.Bool(e.deleted)
+	}
+}
+
+func (e *testEnt) EntDecode(c ent.Decoder) (id, version uint64) {
+	for {
+		switch c.Key() {
+		case "":
+			return
+		case ent.FieldNameId:
+			id = c.Uint(64)
+		case ent.FieldNameVersion:
+			version = c.Uint(64)
+		case ent.FieldNameFieldVersions:
+			e.DecodeEntFieldVersions(c)
+		case "name":
+			e.name = c.Str()
+		case "n":
+			e.n = int(c.Int(64))
+		case "tags":
+			e.tags = nil
+			if n := c.ListHeader(); n != 0 {
+				for i := 0; (n < 0 && c.More()) || i < n; i++ {
+					e.tags = append(e.tags, c.Str())
+				}
+			}
+		case "group":
+			e.group = c.Str()
+		case "score":
+			e.score = int(c.Int(64))
+		case "deleted":
+			e.deleted = c.Bool()
+		default:
+			c.Discard()
+		}
+	}
+}
+
+// EntDecodePartial decodes all fields, which is a superset of the fields asked for
+func (e *testEnt) EntDecodePartial(c ent.Decoder, fields ent.FieldSet) (version uint64) {
+	_, version = e.EntDecode(c)
+	return
+}
+
+func fieldSet(fields ...int) (fs ent.FieldSet) {
+	for _, i := range fields {
+		fs = fs.With(i)
+	}
+	return
+}
+
+// fvTestEnt is a testEnt which tracks field versions
+type fvTestEnt struct{ testEnt }
+
+func (e *fvTestEnt) EntNew() ent.Ent         { return &fvTestEnt{} }
+func (e *fvTestEnt) EntTracksFieldVersions() {}
+
+func TestFieldVersions(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	e := &fvTestEnt{testEnt{name: "a", n: 1}}
+	assert.NoErr("create", ent.CreateEnt(e, s))
+	assert.Eq("name version", e.FieldVersion(testEnt_f_name), uint64(1))
+
+	e.n = 2
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save", ent.SaveEnt(e))
+
+	e2 := &fvTestEnt{}
+	assert.NoErr("load", ent.LoadEntById(e2, s, e.Id()))
+	assert.Eq("n", e2.n, 2)
+	assert.Eq("name version", e2.FieldVersion(testEnt_f_name), uint64(1))
+	assert.Eq("n version", e2.FieldVersion(testEnt_f_n), uint64(2))
+
+	e2.name = "b"
+	e2.setChanged(testEnt_f_name)
+	assert.NoErr("save loaded", ent.SaveEnt(e2))
+	e3 := &fvTestEnt{}
+	assert.NoErr("load", ent.LoadEntById(e3, s, e.Id()))
+	assert.Eq("name version", e3.FieldVersion(testEnt_f_name), uint64(3))
+	assert.Eq("n version", e3.FieldVersion(testEnt_f_n), uint64(2))
+
+	// malformed field versions fail to load rather than panic
+	s.m.Put(s.entKey("memtest", e.Id()), []byte(`{"_ver":"3","_id":"1","_fver":"1 x"}`))
+	assert.Err("malformed", "invalid field versions", ent.LoadEntById(&fvTestEnt{}, s, e.Id()))
+}
+
+// createTestEnts creates ents in s
+func createTestEnts(t *testing.T, s ent.Storage, ents ...*testEnt) {
+	t.Helper()
+	for _, e := range ents {
+		if err := ent.CreateEnt(e, s); err != nil {
+			t.Fatalf("CreateEnt %q: %v", e.name, err)
+		}
+	}
+}
+
+func TestFindByExample(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s,
+		&testEnt{name: "a", n: 1, group: "x"},
+		&testEnt{name: "b", n: 2, group: "x"},
+		&testEnt{name: "c", n: 2, group: "y"},
+		&testEnt{name: "d", n: 2, group: "x"},
+		&testEnt{name: "e", n: 2, group: "x", deleted: true})
+
+	// n is indexed, group is compared by value. Soft-deleted ents are left out, whether an
+	// index is used or all ents are scanned.
+	ids, err := ent.FindIdsByExample(s, &testEnt{n: 2, group: "x"}, 0)
+	assert.NoErr("FindIdsByExample", err)
+	assert.Eq("ids", fmt.Sprint(ids), "[2 4]")
+
+	ids, err = ent.FindIdsByExample(s, &testEnt{n: 2, group: "x"}, 1)
+	assert.NoErr("limit", err)
+	assert.Eq("limit", fmt.Sprint(ids), "[2]")
+
+	// zero value matched with an explicit change; no index applies so all ents are scanned
+	e := &testEnt{}
+	e.setChanged(testEnt_f_score)
+	ents, err := ent.LoadEntsByExample(s, e, 0)
+	assert.NoErr("LoadEntsByExample", err)
+	assert.Eq("all but the soft-deleted", len(ents), 4)
+	assert.Eq("loaded", ents[0].(*testEnt).name, "a")
+	ids, err = ent.FindIdsByExample(s, &testEnt{name: "e"}, 0)
+	assert.NoErr("soft-deleted", err)
+	assert.Eq("soft-deleted", len(ids), 0)
+
+	ids, err = ent.FindIdsByExample(s, &testEnt{n: 3}, 0)
+	assert.NoErr("no match", err)
+	assert.Eq("no match", len(ids), 0)
+}
+
+func TestCompression(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	plain := &testEnt{name: "plain", group: strings.Repeat("x", 200)}
+	createTestEnts(t, s, plain)
+	s.Compression = ent.GzipCompression
+	e := &testEnt{name: "zipped", group: strings.Repeat("x", 200)}
+	createTestEnts(t, s, e)
+
+	data := s.m.Get(s.entKey("memtest", e.Id()))
+	assert.Eq("compressed", ent.IsCompressedData(data), true)
+	assert.Eq("smaller", len(data) < 200, true)
+	assert.Eq("plain", ent.IsCompressedData(s.m.Get(s.entKey("memtest", plain.Id()))), false)
+
+	// both are readable, regardless of the current setting
+	for _, c := range []ent.Compression{ent.NoCompression, ent.GzipCompression} {
+		s.Compression = c
+		for _, want := range []*testEnt{plain, e} {
+			e2 := &testEnt{}
+			assert.NoErr("load", ent.LoadEntById(e2, s, want.Id()))
+			assert.Eq("name", e2.name, want.name)
+			assert.Eq("group", e2.group, want.group)
+		}
+	}
+
+	// indexes work with compressed ents
+	e2 := &testEnt{}
+	assert.NoErr("load by index", ent.LoadEntByIndexKey(s, e2, &testEntIdx[testEnt_idx_name],
+		[]byte("zipped"), nil))
+	assert.Eq("by index", e2.Id(), e.Id())
+}
+
+func TestFoldIndex(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	e := &testEnt{name: "Ann Ström"}
+	createTestEnts(t, s, e)
+	x := &testEntIdx[testEnt_idx_name]
+
+	// looked up like by the functions generated for a "fold" index
+	for _, name := range []string{"Ann Ström", "ann ström", "ANN STRÖM"} {
+		id, err := ent.FindIdByIndexKey(s, "memtest", x, []byte(ent.FoldIndexKey(name)), nil)
+		assert.NoErr("find "+name, err)
+		assert.Eq("find "+name, id, e.Id())
+		e2 := &testEnt{}
+		assert.NoErr("load "+name, ent.LoadEntByIndex(s, e2, x, nil, 1, func(c ent.Encoder) {
+			ent.EncodeStrFolded(c, name)
+		}))
+		assert.Eq("stored value keeps its case", e2.name, "Ann Ström")
+	}
+	ids, err := ent.FindIdsByIndexKeyPrefix(s, "memtest", x, []byte(ent.FoldIndexKey("ANN")), 0, nil)
+	assert.NoErr("prefix", err)
+	assert.Eq("prefix", fmt.Sprint(ids), fmt.Sprint([]uint64{e.Id()}))
+
+	// unique regardless of case
+	err = ent.CreateEnt(&testEnt{name: "ANN STRÖM"}, s)
+	_, isConflict := err.(*ent.IndexConflictErr)
+	assert.Ok("conflict", isConflict)
+}
+
+func TestIndexKeyPrefix(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s,
+		&testEnt{name: "jo", tags: []string{"jo"}},
+		&testEnt{name: "Joe", tags: []string{"joe"}},
+		&testEnt{name: "jn\U0010FFFF", tags: []string{"jn\U0010FFFF"}},
+		&testEnt{name: "jo\U0010FFFF", tags: []string{"jo\U0010FFFF"}},
+		&testEnt{name: "jp", tags: []string{"jp"}},
+		&testEnt{name: "j", tags: []string{"j"}})
+
+	// The range is [prefix, prefix+"\xff"]: a key equal to prefix is included and so is the
+	// largest valid UTF-8 continuation, while keys on either side of the range are not.
+	find := func(x *ent.EntIndex, prefix string, limit int, fl ...ent.LookupFlags) string {
+		ids, err := ent.FindIdsByIndexKeyPrefix(s, "memtest", x, []byte(prefix), limit, fl)
+		assert.NoErr("prefix "+prefix, err)
+		return fmt.Sprint(ids)
+	}
+	name := &testEntIdx[testEnt_idx_name] // unique, fold
+	tag := &testEntIdx[testEnt_idx_tag]   // non-unique
+	assert.Eq("unique", find(name, "jo", 0), "[1 2 4]")
+	assert.Eq("non-unique", find(tag, "jo", 0), "[1 2 4]")
+	assert.Eq("fold", find(name, ent.FoldIndexKey("JO"), 0), "[1 2 4]")
+	assert.Eq("case-sensitive", find(tag, "JO", 0), "[]")
+	assert.Eq("unique reverse", find(name, "jo", 2, ent.Reverse), "[4 2]")
+	assert.Eq("non-unique reverse", find(tag, "jo", 2, ent.Reverse), "[4 2]")
+	assert.Eq("empty prefix", find(tag, "", 0), "[6 3 1 2 4 5]")
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s,
+		&testEnt{name: "a", n: 1, tags: []string{"x", "y"}, group: "g", score: 2},
+		&testEnt{name: "b", n: 1, tags: []string{"y"}, group: "g", score: 1},
+		&testEnt{name: "c", n: 2, deleted: true})
+
+	// replace the index keys of memtest with keys in a format which lookups don't find
+	var keys []string
+	s.m.Range(func(key string, _ []byte) bool {
+		if strings.HasPrefix(key, "memtest#") {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		s.m.Put("memtest#"+key[len("memtest#"):]+"\x00old", s.m.Get(key))
+		s.m.Del(key)
+	}
+	x := &testEntIdx[testEnt_idx_name]
+	_, err := ent.FindIdByIndexKey(s, "memtest", x, []byte("a"), nil)
+	assert.Eq("not found before rebuild", err, ent.ErrNotFound)
+
+	assert.NoErr("RebuildIndexes", ent.RebuildIndexes(s, &testEnt{}))
+	find := func(x int, key string, flags ...ent.LookupFlags) string {
+		ids, err := ent.FindIdsByIndexKey(s, "memtest", &testEntIdx[x], []byte(key), 0, flags)
+		assert.NoErr("find "+key, err)
+		return fmt.Sprint(ids)
+	}
+	assert.Eq("unique", find(testEnt_idx_name, "b"), "[2]")
+	assert.Eq("non-unique", find(testEnt_idx_n, "\x00\x00\x00\x00\x00\x00\x00\x01"), "[1 2]")
+	assert.Eq("multi", find(testEnt_idx_tag, "y"), "[1 2]")
+	assert.Eq("soft-deleted", find(testEnt_idx_name, "c"), "[]")
+	assert.Eq("soft-deleted", find(testEnt_idx_name, "c", ent.IncludeDeleted), "[3]")
+	ids, err := ent.FindIdsByIndexKeyScoreRange(
+		s, "memtest", &testEntIdx[testEnt_idx_group], []byte("g"), 0, 10, 0, nil)
+	assert.NoErr("score range", err)
+	assert.Eq("ordered by score", fmt.Sprint(ids), "[2 1]")
+
+	// old keys are gone
+	nameKeys, err := s.ListIndexKeys("memtest", x)
+	assert.NoErr("ListIndexKeys", err)
+	assert.Eq("keys", fmt.Sprintf("%q", nameKeys), `["a" "b"]`)
+}
+
+func TestScoreIndex(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	a := &testEnt{name: "a", group: "g", score: 3, tags: []string{"x", "y"}}
+	b := &testEnt{name: "b", group: "g", score: 1, tags: []string{"x"}}
+	c := &testEnt{name: "c", group: "g", score: 2}
+	createTestEnts(t, s, a, b, c)
+	scoreRange := func(x int, key string, min, max float64, limit int, flags ...ent.LookupFlags) string {
+		ids, err := ent.FindIdsByIndexKeyScoreRange(
+			s, "memtest", &testEntIdx[x], []byte(key), min, max, limit, flags)
+		assert.NoErr("FindIdsByIndexKeyScoreRange", err)
+		return fmt.Sprint(ids)
+	}
+	scoreKeys := func() (n int) {
+		s.m.Range(func(key string, _ []byte) bool {
+			if strings.HasPrefix(key, "memtest#group#score:") {
+				n++
+			}
+			return true
+		})
+		return
+	}
+	assert.Eq("ordered by score", scoreRange(testEnt_idx_group, "g", 0, 10, 0), "[2 3 1]")
+	assert.Eq("min and max", scoreRange(testEnt_idx_group, "g", 2, 3, 0), "[3 1]")
+
+	// top N: a limit is applied after reversing
+	inf := math.Inf(1)
+	assert.Eq("reverse", scoreRange(testEnt_idx_group, "g", -inf, inf, 0, ent.Reverse), "[1 3 2]")
+	assert.Eq("reverse limit", scoreRange(testEnt_idx_group, "g", -inf, inf, 2, ent.Reverse),
+		"[1 3]")
+	assert.Eq("limit", scoreRange(testEnt_idx_group, "g", -inf, inf, 2), "[2 3]")
+
+	// a changed score replaces the previous score of the entry
+	b.score = 5
+	b.setChanged(testEnt_f_score)
+	assert.NoErr("save score", ent.SaveEnt(b))
+	assert.Eq("score changed", scoreRange(testEnt_idx_group, "g", 0, 10, 0), "[3 1 2]")
+	assert.Eq("old score gone", scoreRange(testEnt_idx_group, "g", 0, 1, 0), "[]")
+	assert.Eq("score keys", scoreKeys(), 3)
+
+	// a changed key moves the entry and its score
+	c.group = "h"
+	c.setChanged(testEnt_f_group)
+	assert.NoErr("save group", ent.SaveEnt(c))
+	assert.Eq("moved from", scoreRange(testEnt_idx_group, "g", 0, 10, 0), "[1 2]")
+	assert.Eq("moved to", scoreRange(testEnt_idx_group, "h", 0, 10, 0), "[3]")
+	assert.Eq("score keys", scoreKeys(), 3)
+
+	// soft-deleted ents are not in score ranges
+	a.deleted = true
+	a.setChanged(testEnt_f_deleted)
+	assert.NoErr("soft-delete", ent.SaveEnt(a))
+	assert.Eq("soft-deleted", scoreRange(testEnt_idx_group, "g", 0, 10, 0), "[2]")
+
+	// each entry of a multi-entry index has the score of its ent
+	assert.Eq("multi x", scoreRange(testEnt_idx_scoredtag, "x", 0, 10, 0), "[2]")
+	a.deleted = false
+	a.setChanged(testEnt_f_deleted)
+	assert.NoErr("undelete", ent.SaveEnt(a))
+	assert.Eq("multi x", scoreRange(testEnt_idx_scoredtag, "x", 0, 10, 0), "[1 2]")
+	assert.Eq("multi y", scoreRange(testEnt_idx_scoredtag, "y", 0, 10, 0), "[1]")
+	a.score = 9
+	a.tags = []string{"x"}
+	a.setChanged(testEnt_f_score, testEnt_f_tags)
+	assert.NoErr("save tags and score", ent.SaveEnt(a))
+	assert.Eq("multi x reordered", scoreRange(testEnt_idx_scoredtag, "x", 0, 10, 0), "[2 1]")
+	assert.Eq("multi y removed", scoreRange(testEnt_idx_scoredtag, "y", 0, 10, 0), "[]")
+	assert.NoErr("delete", ent.DeleteEnt(a))
+	assert.Eq("multi x deleted", scoreRange(testEnt_idx_scoredtag, "x", 0, 10, 0), "[2]")
+}
+
+// conflictStorage is an EntStorage which fails the first conflicts saves with a version
+// conflict, like when other writers save the same ent
+type conflictStorage struct {
+	*EntStorage
+	conflicts int
+	saves     int
+}
+
+func (s *conflictStorage) Save(e ent.Ent, fields ent.FieldSet) (uint64, error) {
+	s.saves++
+	if s.saves <= s.conflicts {
+		return 0, ent.ErrVersionConflict
+	}
+	return s.EntStorage.Save(e, fields)
+}
+
+func TestWithEntRetries(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := &conflictStorage{EntStorage: NewEntStorage()}
+	createTestEnts(t, s.EntStorage, &testEnt{name: "a"})
+	calls := 0
+	inc := func(e ent.Ent) (bool, error) {
+		calls++
+		e.(*testEnt).n++
+		e.(*testEnt).setChanged(testEnt_f_n)
+		return true, nil
+	}
+
+	s.conflicts = ent.WithEntMaxAttempts - 1
+	assert.NoErr("WithEnt", ent.WithEnt(s, &testEnt{}, 1, inc))
+	assert.Eq("calls", calls, ent.WithEntMaxAttempts)
+	e := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e, s, 1))
+	assert.Eq("saved once", e.n, 1)
+
+	calls, s.saves, s.conflicts = 0, 0, ent.WithEntMaxAttempts
+	assert.Err("gives up", "version conflict", ent.WithEnt(s, &testEnt{}, 1, inc))
+	assert.Eq("calls", calls, ent.WithEntMaxAttempts)
+	assert.NoErr("load", ent.LoadEntById(e, s, 1))
+	assert.Eq("not saved", e.n, 1)
+}
+
+func TestIterateIdsOrder(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	// ids beyond 36 have two base-36 digits in their keys, e.g. 37 => "11", which sorts before
+	// "2" as a string
+	for i := 0; i < 40; i++ {
+		createTestEnts(t, s, &testEnt{name: fmt.Sprint(i)})
+	}
+	it := s.IterateIds("memtest")
+	var ids []uint64
+	var id uint64
+	for it.Next(&id) {
+		ids = append(ids, id)
+	}
+	assert.NoErr("Err", it.Err())
+	assert.Eq("count", len(ids), 40)
+	for i, id := range ids {
+		if id != uint64(i+1) {
+			t.Fatalf("ids not in ascending order: %v", ids)
+		}
+	}
+}
+
+func TestMaxEntBytes(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	s.MaxEntBytes = 100
+	e := &testEnt{name: "a", group: strings.Repeat("x", 100)}
+	assert.Err("create", ent.ErrEntTooLarge.Error(), ent.CreateEnt(e, s))
+	assert.Eq("not created", e.Id(), uint64(0))
+
+	e.group = "small"
+	assert.NoErr("create", ent.CreateEnt(e, s))
+	e.group = strings.Repeat("x", 100)
+	e.setChanged(testEnt_f_group)
+	err := ent.SaveEnt(e)
+	assert.Eq("save", errors.Is(err, ent.ErrEntTooLarge), true)
+	assert.Eq("version", e.Version(), uint64(1))
+	e2 := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e2, s, e.Id()))
+	assert.Eq("not saved", e2.group, "small")
+
+	// the limit applies to the encoded size, before compression
+	s.Compression = ent.GzipCompression
+	assert.Err("save compressed", ent.ErrEntTooLarge.Error(), ent.SaveEnt(e))
+}
+
+// raceStorage is an EntStorage where someone else creates an ent named "a" just before the
+// first Create
+type raceStorage struct {
+	*EntStorage
+	raced bool
+}
+
+func (s *raceStorage) Create(e ent.Ent, fields ent.FieldSet) (uint64, error) {
+	if !s.raced {
+		s.raced = true
+		if err := ent.CreateEnt(&testEnt{name: "a", n: 7}, s.EntStorage); err != nil {
+			return 0, err
+		}
+	}
+	return s.EntStorage.Create(e, fields)
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	x := &testEntIdx[testEnt_idx_name]
+	inits := 0
+	loadOrCreate := func(s ent.Storage, name string) (*testEnt, bool, error) {
+		e := &testEnt{}
+		created, err := ent.LoadOrCreate(e, s, x, []byte(name), func() {
+			inits++
+			e.name = name
+			e.n = inits
+		})
+		return e, created, err
+	}
+
+	e, created, err := loadOrCreate(s, "a")
+	assert.NoErr("create", err)
+	assert.Eq("created", created, true)
+	assert.Eq("id", e.Id(), uint64(1))
+
+	e, created, err = loadOrCreate(s, "a")
+	assert.NoErr("load", err)
+	assert.Eq("loaded", created, false)
+	assert.Eq("id", e.Id(), uint64(1))
+	assert.Eq("n", e.n, 1)
+	assert.Eq("inits", inits, 1)
+
+	// created by someone else between lookup and creation
+	rs := &raceStorage{EntStorage: NewEntStorage()}
+	e, created, err = loadOrCreate(rs, "a")
+	assert.NoErr("race", err)
+	assert.Eq("race: loaded", created, false)
+	assert.Eq("race: n of other", e.n, 7)
+}
@@ -0,0 +1,85 @@
+package mem
+
+import (
+	"github.com/rsms/ent"
+)
+
+// subscriberBufferSize is the number of events buffered for each subscriber
+const subscriberBufferSize = 64
+
+type subscriber struct {
+	entType string // "" for all types
+	c       chan ent.ChangeEvent
+}
+
+// Subscribe returns a channel which receives a ChangeEvent after every successful create,
+// save and delete of an ent of type entType, or of any type if entType is "".
+// Changes made in a transaction are delivered when the transaction is committed.
+//
+// Events are buffered. When a subscriber does not keep up and its buffer is full, events are
+// silently dropped for that subscriber rather than blocking the storage.
+//
+// Events are sent after the change has been made, outside of the storage's lock. Events of
+// changes made one after the other (e.g. by one goroutine) arrive in order, but events of
+// changes made concurrently by several goroutines may arrive in a different order than the
+// changes were made. Use the Version of an event to tell which save of an ent is the latest.
+//
+// Call the returned function to unsubscribe, which closes the channel.
+func (s *EntStorage) Subscribe(entType string) (<-chan ent.ChangeEvent, func()) {
+	sub := &subscriber{entType: entType, c: make(chan ent.ChangeEvent, subscriberBufferSize)}
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, sub2 := range s.subs {
+			if sub2 == sub {
+				s.subs = append(s.subs[:i], s.subs[i+1:]...)
+				close(sub.c)
+				break
+			}
+		}
+	}
+	return sub.c, unsubscribe
+}
+
+// notify delivers events to subscribers. Called after s.mu has been released, so events of
+// concurrent writers may be delivered out of order (see Subscribe.)
+func (s *EntStorage) notify(events ...ent.ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sub := range s.subs {
+		for _, ev := range events {
+			if sub.entType != "" && sub.entType != ev.EntTypeName {
+				continue
+			}
+			select {
+			case sub.c <- ev:
+			default: // subscriber is not keeping up
+			}
+		}
+	}
+}
+
+// deleteEvents returns OpDelete events for ids of ents of type entType
+func deleteEvents(entType string, ids []uint64) []ent.ChangeEvent {
+	events := make([]ent.ChangeEvent, len(ids))
+	for i, id := range ids {
+		events[i] = ent.ChangeEvent{Op: ent.OpDelete, EntTypeName: entType, Id: id}
+	}
+	return events
+}
+
+// putEvent returns the event of a put of version of the ent with id: OpCreate for version 1,
+// otherwise OpSave
+func putEvent(e Ent, id, version uint64) ent.ChangeEvent {
+	op := ent.OpSave
+	if version == 1 {
+		op = ent.OpCreate
+	}
+	return ent.ChangeEvent{Op: op, EntTypeName: e.EntTypeName(), Id: id, Version: version}
+}
@@ -0,0 +1,90 @@
+package mem
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+// takeEvents returns the events buffered in c, formatted as "op:id:version"
+func takeEvents(c <-chan ent.ChangeEvent) string {
+	var s []string
+	for {
+		select {
+		case ev, ok := <-c:
+			if !ok {
+				return fmt.Sprint(append(s, "closed"))
+			}
+			s = append(s, fmt.Sprintf("%s:%d:%d", ev.Op, ev.Id, ev.Version))
+		default:
+			return fmt.Sprint(s)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	events, unsubscribe := s.Subscribe("memtest")
+	other, unsubscribeOther := s.Subscribe("other")
+	defer unsubscribeOther()
+
+	e := &testEnt{name: "a"}
+	createTestEnts(t, s, e)
+	e.n = 1
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save", ent.SaveEnt(e))
+	assert.NoErr("delete", ent.DeleteEnt(e))
+	assert.Eq("events", takeEvents(events), fmt.Sprint([]string{
+		ent.OpCreate.String() + ":1:1", ent.OpSave.String() + ":1:2", ent.OpDelete.String() + ":1:0",
+	}))
+	assert.Eq("other type", takeEvents(other), "[]")
+
+	// failed writes have no events
+	assert.Err("save deleted", "", ent.SaveEnt(e))
+	assert.Eq("no events", takeEvents(events), "[]")
+
+	unsubscribe()
+	createTestEnts(t, s, &testEnt{name: "b"})
+	assert.Eq("unsubscribed", takeEvents(events), "[closed]")
+	unsubscribe() // no-op
+}
+
+func TestSubscribeTx(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	events, unsubscribe := s.Subscribe("")
+	defer unsubscribe()
+
+	tx, err := s.Begin()
+	assert.NoErr("Begin", err)
+	createTestEnts(t, tx, &testEnt{name: "a"}, &testEnt{name: "b"})
+	assert.Eq("not yet committed", takeEvents(events), "[]")
+	assert.NoErr("Commit", tx.Commit())
+	c := ent.OpCreate.String()
+	assert.Eq("committed", takeEvents(events), fmt.Sprintf("[%s:1:1 %s:2:1]", c, c))
+
+	tx, err = s.Begin()
+	assert.NoErr("Begin", err)
+	createTestEnts(t, tx, &testEnt{name: "c"})
+	assert.NoErr("Rollback", tx.Rollback())
+	assert.Eq("rolled back", takeEvents(events), "[]")
+}
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	events, unsubscribe := s.Subscribe("")
+	defer unsubscribe()
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		createTestEnts(t, s, &testEnt{name: fmt.Sprint(i)})
+	}
+	n := 0
+	for len(events) > 0 {
+		<-events
+		n++
+	}
+	assert.Eq("dropped events beyond the buffer", n, subscriberBufferSize)
+}
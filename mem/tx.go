@@ -0,0 +1,268 @@
+package mem
+
+import (
+	"reflect"
+
+	"github.com/rsms/ent"
+)
+
+// Tx is a transaction of EntStorage, implementing ent.Tx.
+//
+// Changes made in a transaction are kept in an isolated map scope which is applied to the
+// storage when the transaction is committed. Reads in a transaction observe its own changes.
+// Commit fails with ent.ErrVersionConflict if any data the transaction has read was changed
+// by someone else in the meantime, in which case no changes are made.
+//
+// Transactions can be nested by calling Begin on a Tx.
+// A Tx must not be used by multiple goroutines at once.
+type Tx struct {
+	s      *EntStorage
+	parent ent.Storage // storage which began the transaction; *EntStorage or *Tx
+	outer  *ScopedMap  // map scope of parent
+	m      *ScopedMap  // nil when the transaction is done
+	ents   ent.TxEnts
+	events []ent.ChangeEvent // delivered to subscribers by Commit (see EntStorage.Subscribe)
+}
+
+// Capabilities is part of the ent.Storage interface
+func (s *EntStorage) Capabilities() ent.StorageCaps {
+	return ent.CapTx | ent.CapRange | ent.CapScoreRange | ent.CapSubscribe
+}
+
+// Capabilities is part of the ent.Storage interface
+func (tx *Tx) Capabilities() ent.StorageCaps {
+	return ent.CapTx | ent.CapRange | ent.CapScoreRange
+}
+
+// Begin starts a new transaction
+func (s *EntStorage) Begin() (ent.Tx, error) {
+	return s.begin(s, &s.m), nil
+}
+
+func (s *EntStorage) begin(parent ent.Storage, outer *ScopedMap) *Tx {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &Tx{s: s, parent: parent, outer: outer, m: outer.NewIsolatedScope()}
+}
+
+// Begin starts a nested transaction which, when committed, applies its changes to tx
+func (tx *Tx) Begin() (ent.Tx, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.begin(tx, tx.m), nil
+}
+
+// Commit applies all changes made in the transaction
+func (tx *Tx) Commit() error {
+	if tx.m == nil {
+		return ent.ErrTxDone
+	}
+	tx.s.mu.Lock()
+	if tx.m.OuterChanged() {
+		tx.s.mu.Unlock()
+		tx.end(false)
+		return ent.ErrVersionConflict
+	}
+	tx.m.ApplyToOuter()
+	tx.s.mu.Unlock()
+	tx.end(true)
+	if outer, nested := tx.parent.(*Tx); nested {
+		outer.events = append(outer.events, tx.events...)
+	} else {
+		tx.s.notify(tx.events...)
+	}
+	tx.events = nil
+	return nil
+}
+
+// Rollback discards all changes made in the transaction
+func (tx *Tx) Rollback() error {
+	if tx.m == nil {
+		return ent.ErrTxDone
+	}
+	tx.end(false)
+	return nil
+}
+
+func (tx *Tx) end(commit bool) {
+	tx.m = nil
+	if !commit {
+		tx.events = nil
+	}
+	outer, nested := tx.parent.(*Tx)
+	if commit {
+		if nested {
+			tx.ents.CommitNested(tx, outer, &outer.ents)
+		} else {
+			tx.ents.Commit(tx, tx.parent)
+		}
+	} else {
+		if nested {
+			tx.ents.RollbackNested(tx, outer, &outer.ents)
+		} else {
+			tx.ents.Rollback(tx, tx.parent)
+		}
+	}
+}
+
+func (tx *Tx) Create(e Ent, fields ent.FieldSet) (uint64, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	tx.ents.Add(e, true)
+	id, err := tx.s.create(tx.m, e, fields)
+	if err == nil {
+		tx.events = append(tx.events,
+			ent.ChangeEvent{Op: ent.OpCreate, EntTypeName: e.EntTypeName(), Id: id, Version: 1})
+	}
+	return id, err
+}
+
+func (tx *Tx) Save(e Ent, fields ent.FieldSet) (uint64, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	tx.ents.Add(e, true)
+	version, err := tx.s.save(tx.m, e, fields)
+	if err == nil {
+		tx.events = append(tx.events, ent.ChangeEvent{
+			Op: ent.OpSave, EntTypeName: e.EntTypeName(), Id: e.Id(), Version: version})
+	}
+	return version, err
+}
+
+func (tx *Tx) Put(e Ent, id uint64) (uint64, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	tx.ents.Add(e, true)
+	version, err := tx.s.put(tx.m, e, id)
+	if err == nil {
+		tx.events = append(tx.events, putEvent(e, id, version))
+	}
+	return version, err
+}
+
+func (tx *Tx) Delete(e Ent, id uint64) error {
+	if tx.m == nil {
+		return ent.ErrTxDone
+	}
+	tx.ents.Add(e, true)
+	err := tx.s.delete(tx.m, e, id)
+	if err == nil {
+		tx.events = append(tx.events,
+			ent.ChangeEvent{Op: ent.OpDelete, EntTypeName: e.EntTypeName(), Id: id})
+	}
+	return err
+}
+
+func (tx *Tx) DeleteByIndex(e Ent, x *ent.EntIndex, key []byte) (int, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	ids, err := tx.s.deleteByIndex(tx.m, e, x, key)
+	tx.events = append(tx.events, deleteEvents(e.EntTypeName(), ids)...)
+	return len(ids), err
+}
+
+func (tx *Tx) LoadById(e Ent, id uint64) (uint64, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	tx.ents.Add(e, false)
+	return tx.s.loadById(tx.m, e, id)
+}
+
+func (tx *Tx) Exists(entType string, id uint64) (bool, error) {
+	if tx.m == nil {
+		return false, ent.ErrTxDone
+	}
+	return tx.s.exists(tx.m, entType, id), nil
+}
+
+func (tx *Tx) LoadByIndex(
+	e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	ents, err := tx.s.loadByIndex(tx.m, tx, e, x, key, limit, flags)
+	for _, e := range ents {
+		tx.ents.Add(e, false)
+	}
+	return ents, err
+}
+
+func (tx *Tx) LoadByIndexPaged(
+	e Ent, x *ent.EntIndex, key, cursor []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	if tx.m == nil {
+		return nil, nil, ent.ErrTxDone
+	}
+	ents, nextCursor, err := tx.s.loadByIndexPaged(tx.m, tx, e, x, key, cursor, limit, flags)
+	for _, e := range ents {
+		tx.ents.Add(e, false)
+	}
+	return ents, nextCursor, err
+}
+
+func (tx *Tx) FindByIndex(
+	entTypeName string, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.findByIndex(tx.m, entTypeName, x, key, limit, flags)
+}
+
+func (tx *Tx) FindByIndexRange(
+	entTypeName string, x *ent.EntIndex, lo, hi []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.findByIndexRange(tx.m, entTypeName, x, lo, hi, limit, flags)
+}
+
+func (tx *Tx) FindByIndexScoreRange(
+	entTypeName string, x *ent.EntIndex, key []byte, min, max float64, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.findByIndexScoreRange(tx.m, entTypeName, x, key, min, max, limit, flags)
+}
+
+func (tx *Tx) Count(entTypeName string, x *ent.EntIndex, key []byte) (int, error) {
+	if tx.m == nil {
+		return 0, ent.ErrTxDone
+	}
+	return tx.s.count(tx.m, entTypeName, x, key)
+}
+
+func (tx *Tx) ListIndexKeys(entTypeName string, x *ent.EntIndex) ([][]byte, error) {
+	if tx.m == nil {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.listIndexKeys(tx.m, entTypeName, x)
+}
+
+func (tx *Tx) IterateIds(entType string) ent.IdIterator {
+	it := &IdIterator{}
+	if tx.m != nil {
+		it.init(tx.s, tx.m, entType)
+	}
+	return it
+}
+
+func (tx *Tx) IterateEnts(proto Ent) ent.EntIterator {
+	it := &EntIterator{s: tx, etype: reflect.TypeOf(proto).Elem()}
+	if tx.m == nil {
+		it.err = ent.ErrTxDone
+	} else {
+		it.init(tx.s, tx.m, proto.EntTypeName())
+	}
+	return it
+}
@@ -0,0 +1,106 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+func TestTxRollbackAfterLoadAndSave(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s, &testEnt{name: "a", n: 1})
+
+	tx, err := s.Begin()
+	assert.NoErr("Begin", err)
+	e := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e, tx, 1))
+	e.n = 2
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save", ent.SaveEnt(e))
+	assert.Eq("version in tx", e.Version(), uint64(2))
+	assert.NoErr("Rollback", tx.Rollback())
+
+	assert.Eq("version restored", e.Version(), uint64(1))
+	assert.Eq("changes restored", e.ChangedFields(), fieldSet(testEnt_f_n))
+	assert.Eq("storage", ent.GetStorage(e), ent.Storage(s))
+	assert.NoErr("save after rollback", ent.SaveEnt(e))
+	e2 := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e2, s, 1))
+	assert.Eq("saved", e2.n, 2)
+}
+
+func TestTxFailedCommit(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s, &testEnt{name: "a", n: 1})
+
+	tx, err := s.Begin()
+	assert.NoErr("Begin", err)
+	e := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e, tx, 1))
+	e.n = 2
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save", ent.SaveEnt(e))
+
+	// someone else saves the ent before the commit
+	other := &testEnt{}
+	assert.NoErr("load other", ent.LoadEntById(other, s, 1))
+	other.n = 3
+	other.setChanged(testEnt_f_n)
+	assert.NoErr("save other", ent.SaveEnt(other))
+
+	assert.Err("Commit", "version conflict", tx.Commit())
+	assert.Eq("version restored", e.Version(), uint64(1))
+	assert.Eq("storage", ent.GetStorage(e), ent.Storage(s))
+	assert.Err("stale save", "version conflict", ent.SaveEnt(e))
+	assert.NoErr("reload", ent.ReloadEnt(e))
+	assert.Eq("reloaded", e.n, 3)
+}
+
+func TestTxNested(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	s := NewEntStorage()
+	createTestEnts(t, s, &testEnt{name: "a", n: 1})
+
+	tx, err := s.Begin()
+	assert.NoErr("Begin", err)
+	e := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e, tx, 1))
+
+	// modified and committed in a nested tx, then the outer tx is rolled back
+	tx2, err := tx.(*Tx).Begin()
+	assert.NoErr("Begin nested", err)
+	assert.NoErr("load nested", ent.LoadEntById(e, tx2, 1))
+	e.n = 2
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save nested", ent.SaveEnt(e))
+	assert.NoErr("Commit nested", tx2.Commit())
+	assert.Eq("storage after nested commit", ent.GetStorage(e), ent.Storage(tx))
+	assert.Eq("version after nested commit", e.Version(), uint64(2))
+	assert.NoErr("Rollback", tx.Rollback())
+	assert.Eq("version restored", e.Version(), uint64(1))
+	assert.Eq("storage", ent.GetStorage(e), ent.Storage(s))
+	assert.NoErr("save after rollback", ent.SaveEnt(e))
+
+	// a nested tx which is rolled back leaves the ent as it was in the outer tx
+	tx, err = s.Begin()
+	assert.NoErr("Begin", err)
+	assert.NoErr("load", ent.LoadEntById(e, tx, 1))
+	tx2, err = tx.(*Tx).Begin()
+	assert.NoErr("Begin nested", err)
+	assert.NoErr("load nested", ent.LoadEntById(e, tx2, 1))
+	e.n = 4
+	e.setChanged(testEnt_f_n)
+	assert.NoErr("save nested", ent.SaveEnt(e))
+	assert.NoErr("Rollback nested", tx2.Rollback())
+	assert.Eq("version restored", e.Version(), uint64(2))
+	assert.Eq("storage", ent.GetStorage(e), ent.Storage(tx))
+	assert.NoErr("save in outer", ent.SaveEnt(e))
+	assert.NoErr("Commit", tx.Commit())
+	e2 := &testEnt{}
+	assert.NoErr("load", ent.LoadEntById(e2, s, 1))
+	assert.Eq("committed", e2.n, 4)
+	assert.Eq("version", e2.Version(), uint64(3))
+}
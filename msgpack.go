@@ -0,0 +1,526 @@
+package ent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	errMsgpackType  = errors.New("unexpected type")
+	errMsgpackTrunc = errors.New("truncated data")
+	errMsgpackEnd   = errors.New("unbalanced end of list or dict")
+)
+
+// MsgpackEncoder is an implementation of the Encoder interface which produces MessagePack
+// data (https://msgpack.org), a compact binary alternative to JSON.
+//
+// An ent is encoded as a map. Integers are encoded in the smallest representation which
+// can hold their value.
+type MsgpackEncoder struct {
+	buf   []byte
+	err   error
+	depth int // nesting level of lists and dicts of the current ent
+
+	entStart int // offset in buf of the map header of the current ent
+	entKeys  int // number of keys of the current ent
+}
+
+func (c *MsgpackEncoder) Err() error    { return c.err }
+func (c *MsgpackEncoder) Bytes() []byte { return c.buf }
+
+// BeginEnt starts the map of an ent. Since the number of fields is not known up front, the map
+// always has a 32-bit length, which EndEnt fills in.
+func (c *MsgpackEncoder) BeginEnt(version uint64) {
+	c.entStart = len(c.buf)
+	c.entKeys = 0
+	c.depth = 0
+	c.buf = append(c.buf, 0xdf, 0, 0, 0, 0)
+	c.Key(FieldNameVersion)
+	c.Uint(version, 64)
+}
+
+func (c *MsgpackEncoder) EndEnt() {
+	if c.depth != 0 {
+		c.setErr(errMsgpackEnd)
+		return
+	}
+	binary.BigEndian.PutUint32(c.buf[c.entStart+1:], uint32(c.entKeys))
+}
+
+func (c *MsgpackEncoder) BeginList(length int) {
+	c.depth++
+	c.header(0x90, 0xdc, length)
+}
+
+func (c *MsgpackEncoder) BeginDict(length int) {
+	c.depth++
+	c.header(0x80, 0xde, length)
+}
+
+func (c *MsgpackEncoder) EndList() { c.end() }
+func (c *MsgpackEncoder) EndDict() { c.end() }
+
+func (c *MsgpackEncoder) end() {
+	if c.depth == 0 {
+		c.setErr(errMsgpackEnd)
+		return
+	}
+	c.depth--
+}
+
+func (c *MsgpackEncoder) Key(k string) {
+	if c.depth == 0 {
+		c.entKeys++
+	}
+	c.Str(k)
+}
+
+func (c *MsgpackEncoder) Str(v string) {
+	if len(v) < 32 {
+		c.buf = append(c.buf, 0xa0|byte(len(v)))
+	} else {
+		c.size(0xd9, len(v))
+	}
+	c.buf = append(c.buf, v...)
+}
+
+func (c *MsgpackEncoder) Blob(v []byte) {
+	c.size(0xc4, len(v))
+	c.buf = append(c.buf, v...)
+}
+
+func (c *MsgpackEncoder) Int(v int64, bitsize int) {
+	switch {
+	case v >= 0:
+		c.Uint(uint64(v), bitsize)
+	case v >= -32:
+		c.buf = append(c.buf, byte(v)) // negative fixint
+	case v >= math.MinInt8:
+		c.buf = append(c.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		c.buf = append(c.buf, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32:
+		c.buf = append(c.buf, 0xd2)
+		c.buf = appendUint32BE(c.buf, uint32(v))
+	default:
+		c.buf = append(c.buf, 0xd3)
+		c.buf = appendUint64BE(c.buf, uint64(v))
+	}
+}
+
+func (c *MsgpackEncoder) Uint(v uint64, bitsize int) {
+	switch {
+	case v < 0x80:
+		c.buf = append(c.buf, byte(v)) // positive fixint
+	case v <= math.MaxUint8:
+		c.buf = append(c.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		c.buf = append(c.buf, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		c.buf = append(c.buf, 0xce)
+		c.buf = appendUint32BE(c.buf, uint32(v))
+	default:
+		c.buf = append(c.buf, 0xcf)
+		c.buf = appendUint64BE(c.buf, v)
+	}
+}
+
+func (c *MsgpackEncoder) Float(v float64, bitsize int) {
+	if bitsize == 32 {
+		c.buf = append(c.buf, 0xca)
+		c.buf = appendUint32BE(c.buf, math.Float32bits(float32(v)))
+	} else {
+		c.buf = append(c.buf, 0xcb)
+		c.buf = appendUint64BE(c.buf, math.Float64bits(v))
+	}
+}
+
+func (c *MsgpackEncoder) Bool(v bool) {
+	if v {
+		c.buf = append(c.buf, 0xc3)
+	} else {
+		c.buf = append(c.buf, 0xc2)
+	}
+}
+
+// header writes the header of a list or dict. fix is the type byte of the "fix" format which
+// holds lengths up to 15 and typ the type byte of the 16-bit length format, which is followed
+// by the type byte of the 32-bit length format.
+func (c *MsgpackEncoder) header(fix, typ byte, length int) {
+	switch {
+	case length < 16:
+		c.buf = append(c.buf, fix|byte(length))
+	case length <= math.MaxUint16:
+		c.buf = append(c.buf, typ, byte(length>>8), byte(length))
+	default:
+		c.buf = append(c.buf, typ+1)
+		c.buf = appendUint32BE(c.buf, uint32(length))
+	}
+}
+
+// size writes a type byte and length for the 8-bit length format typ, which is followed by the
+// type bytes of the 16-bit and the 32-bit length formats
+func (c *MsgpackEncoder) size(typ byte, n int) {
+	switch {
+	case n <= math.MaxUint8:
+		c.buf = append(c.buf, typ, byte(n))
+	case n <= math.MaxUint16:
+		c.buf = append(c.buf, typ+1, byte(n>>8), byte(n))
+	default:
+		c.buf = append(c.buf, typ+2)
+		c.buf = appendUint32BE(c.buf, uint32(n))
+	}
+}
+
+func (c *MsgpackEncoder) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// MsgpackDecoder is an implementation of the Decoder interface which reads MessagePack data,
+// as produced by MsgpackEncoder
+type MsgpackDecoder struct {
+	buf []byte
+	pos int
+	err error
+
+	// remaining values of each list or dict being decoded, innermost last. A dict entry is two
+	// values; the key and the value. The first is the map of the ent, which is never removed
+	// so that Key can tell when all fields have been read.
+	remaining []int
+}
+
+func NewMsgpackDecoder(data []byte) *MsgpackDecoder {
+	return &MsgpackDecoder{buf: data}
+}
+
+func (c *MsgpackDecoder) Err() error { return c.err }
+
+// Key reads a key. Returns "" when all entries of the ent have been read.
+func (c *MsgpackDecoder) Key() string {
+	if c.err != nil || (len(c.remaining) > 0 && c.remaining[len(c.remaining)-1] <= 0) {
+		return ""
+	}
+	return c.Str()
+}
+
+func (c *MsgpackDecoder) ListHeader() int {
+	var n int
+	switch b := c.typ(); {
+	case b&0xf0 == 0x90:
+		n = int(b & 0x0f)
+	case b == 0xdc:
+		n = int(c.uint(2))
+	case b == 0xdd:
+		n = int(c.uint(4))
+	case b == 0xc0: // nil
+	default:
+		c.setErr(errMsgpackType)
+	}
+	c.begin(n)
+	return n
+}
+
+func (c *MsgpackDecoder) DictHeader() int {
+	var n int
+	switch b := c.typ(); {
+	case b&0xf0 == 0x80:
+		n = int(b & 0x0f)
+	case b == 0xde:
+		n = int(c.uint(2))
+	case b == 0xdf:
+		n = int(c.uint(4))
+	case b == 0xc0: // nil
+	default:
+		c.setErr(errMsgpackType)
+	}
+	c.begin(n * 2)
+	return n
+}
+
+func (c *MsgpackDecoder) More() bool {
+	return c.err == nil && len(c.remaining) > 0 && c.remaining[len(c.remaining)-1] > 0
+}
+
+func (c *MsgpackDecoder) Str() string {
+	switch b := c.typ(); {
+	case b&0xe0 == 0xa0:
+		return string(c.value(int(b & 0x1f)))
+	case b >= 0xd9 && b <= 0xdb:
+		return string(c.value(int(c.uint(1 << (b - 0xd9)))))
+	case b >= 0xc4 && b <= 0xc6:
+		return string(c.value(int(c.uint(1 << (b - 0xc4)))))
+	case b == 0xc0: // nil
+		c.value(0)
+		return ""
+	}
+	c.setErr(errMsgpackType)
+	return ""
+}
+
+func (c *MsgpackDecoder) Blob() []byte {
+	var v []byte
+	switch b := c.typ(); {
+	case b >= 0xc4 && b <= 0xc6:
+		v = c.value(int(c.uint(1 << (b - 0xc4))))
+	case b&0xe0 == 0xa0:
+		v = c.value(int(b & 0x1f))
+	case b >= 0xd9 && b <= 0xdb:
+		v = c.value(int(c.uint(1 << (b - 0xd9))))
+	case b == 0xc0: // nil
+		c.value(0)
+		return nil
+	default:
+		c.setErr(errMsgpackType)
+		return nil
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+func (c *MsgpackDecoder) Bool() bool {
+	switch c.typ() {
+	case 0xc3:
+		c.value(0)
+		return true
+	case 0xc2, 0xc0:
+		c.value(0)
+		return false
+	}
+	c.setErr(errMsgpackType)
+	return false
+}
+
+func (c *MsgpackDecoder) Int(bitsize int) int64 {
+	switch b := c.typ(); {
+	case b < 0x80 || b >= 0xe0: // positive or negative fixint
+		c.value(0)
+		return int64(int8(b))
+	case b >= 0xd0 && b <= 0xd3:
+		n := 1 << (b - 0xd0)
+		v := c.uint(n)
+		c.value(0)
+		shift := uint(64 - n*8)
+		return int64(v<<shift) >> shift // sign extend
+	case b >= 0xcc && b <= 0xcf:
+		v := c.uint(1 << (b - 0xcc))
+		c.value(0)
+		return int64(v)
+	case b == 0xc0: // nil
+		c.value(0)
+		return 0
+	}
+	c.setErr(errMsgpackType)
+	return 0
+}
+
+func (c *MsgpackDecoder) Uint(bitsize int) uint64 {
+	if b := c.peek(); b >= 0xcc && b <= 0xcf {
+		c.pos++
+		v := c.uint(1 << (b - 0xcc))
+		c.value(0)
+		return v
+	}
+	return uint64(c.Int(bitsize))
+}
+
+func (c *MsgpackDecoder) Float(bitsize int) float64 {
+	switch c.peek() {
+	case 0xca:
+		c.pos++
+		v := math.Float32frombits(uint32(c.uint(4)))
+		c.value(0)
+		return float64(v)
+	case 0xcb:
+		c.pos++
+		v := math.Float64frombits(c.uint(8))
+		c.value(0)
+		return v
+	}
+	return float64(c.Int(bitsize))
+}
+
+func (c *MsgpackDecoder) Discard() {
+	c.skip()
+	c.value(0)
+}
+
+// skip reads and discards a value, including all values of a list or dict
+func (c *MsgpackDecoder) skip() {
+	b := c.typ()
+	var n int // number of data bytes
+	switch {
+	case b < 0x80 || b >= 0xe0, b >= 0xc0 && b <= 0xc3: // fixint, nil, (unused), false, true
+	case b&0xf0 == 0x80:
+		c.skipValues(int(b&0x0f) * 2)
+	case b&0xf0 == 0x90:
+		c.skipValues(int(b & 0x0f))
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b >= 0xc4 && b <= 0xc6: // bin
+		n = int(c.uint(1 << (b - 0xc4)))
+	case b >= 0xc7 && b <= 0xc9: // ext
+		n = int(c.uint(1<<(b-0xc7))) + 1
+	case b == 0xca:
+		n = 4
+	case b == 0xcb:
+		n = 8
+	case b >= 0xcc && b <= 0xcf:
+		n = 1 << (b - 0xcc)
+	case b >= 0xd0 && b <= 0xd3:
+		n = 1 << (b - 0xd0)
+	case b >= 0xd4 && b <= 0xd8: // fixext
+		n = 1<<(b-0xd4) + 1
+	case b >= 0xd9 && b <= 0xdb:
+		n = int(c.uint(1 << (b - 0xd9)))
+	case b == 0xdc || b == 0xdd:
+		c.skipValues(int(c.uint(2 << (b - 0xdc))))
+	case b == 0xde || b == 0xdf:
+		c.skipValues(int(c.uint(2<<(b-0xde))) * 2)
+	}
+	c.next(n)
+}
+
+func (c *MsgpackDecoder) skipValues(n int) {
+	for i := 0; i < n && c.err == nil; i++ {
+		c.skip()
+	}
+}
+
+// begin is called after a list or dict header with the number of values which follow
+func (c *MsgpackDecoder) begin(n int) {
+	if n == 0 && len(c.remaining) > 0 {
+		c.value(0) // an empty list or dict is a complete value
+		return
+	}
+	c.remaining = append(c.remaining, n)
+}
+
+// value reads n bytes of data, completing a value. If the value is the last one of the list or
+// dict being decoded, that list or dict is complete, in turn completing a value of its parent.
+func (c *MsgpackDecoder) value(n int) []byte {
+	b := c.next(n)
+	for i := len(c.remaining) - 1; i >= 0; i-- {
+		c.remaining[i]--
+		if c.remaining[i] > 0 || i == 0 {
+			break
+		}
+		c.remaining = c.remaining[:i]
+	}
+	return b
+}
+
+// typ reads a type byte
+func (c *MsgpackDecoder) typ() byte {
+	if b := c.next(1); b != nil {
+		return b[0]
+	}
+	return 0xc1 // never used
+}
+
+// peek returns the next type byte without reading it
+func (c *MsgpackDecoder) peek() byte {
+	if c.pos < len(c.buf) {
+		return c.buf[c.pos]
+	}
+	return 0xc1
+}
+
+// uint reads a big-endian unsigned integer of n bytes
+func (c *MsgpackDecoder) uint(n int) uint64 {
+	var v uint64
+	for _, b := range c.next(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (c *MsgpackDecoder) next(n int) []byte {
+	if len(c.buf)-c.pos < n || n < 0 {
+		c.setErr(errMsgpackTrunc)
+		c.pos = len(c.buf)
+		return nil
+	}
+	b := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *MsgpackDecoder) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *MsgpackDecoder) setError(err error) { c.setErr(err) }
+
+func appendUint32BE(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64BE(b []byte, v uint64) []byte {
+	return appendUint32BE(appendUint32BE(b, uint32(v>>32)), uint32(v))
+}
+
+// -------------
+
+// MsgpackDecodeEntPartial is a utility function for decoding a partial ent.
+// It calls e.EntDecodePartial and thus is limited to fields that participate in indexes.
+func MsgpackDecodeEntPartial(e Ent, data []byte, fields FieldSet) (version uint64, err error) {
+	c := NewMsgpackDecoder(data)
+	if c.DictHeader() != 0 {
+		version = e.EntDecodePartial(c, fields)
+	}
+	if err = c.Err(); err != nil {
+		err = &MsgpackError{err}
+	}
+	return
+}
+
+// MsgpackEncodeEnt encodes e as MessagePack data. The data always starts with the byte 0xdf
+// (see MsgpackEncoder.BeginEnt), which neither JSON nor compressed data starts with.
+func MsgpackEncodeEnt(e Ent, id, version uint64, fields FieldSet) ([]byte, error) {
+	c := MsgpackEncoder{}
+	c.BeginEnt(version)
+
+	// include the id so that MsgpackDecodeEnt works as expected
+	c.Key(FieldNameId)
+	c.Uint(id, 64)
+
+	EncodeFieldVersions(e, &c)
+
+	e.EntEncode(&c, fields)
+	c.EndEnt()
+	if err := c.Err(); err != nil {
+		return nil, &MsgpackError{err}
+	}
+	return c.Bytes(), nil
+}
+
+func MsgpackDecodeEnt(e Ent, data []byte) (id, version uint64, err error) {
+	c := NewMsgpackDecoder(data)
+	if c.DictHeader() != 0 {
+		id, version = e.EntDecode(c)
+	}
+	if err = c.Err(); err != nil {
+		err = &MsgpackError{err}
+	}
+	return
+}
+
+// IsMsgpackData returns true if data was produced by MsgpackEncodeEnt
+func IsMsgpackData(data []byte) bool {
+	return len(data) > 0 && data[0] == 0xdf
+}
+
+type MsgpackError struct {
+	Underlying error
+}
+
+func (e *MsgpackError) Unwrap() error { return e.Underlying }
+func (e *MsgpackError) Error() string { return fmt.Sprintf("msgpack error: %v", e.Underlying) }
@@ -0,0 +1,86 @@
+package ent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestMsgpackCodec(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	long := strings.Repeat("x", 300)
+
+	c := &MsgpackEncoder{}
+	c.BeginEnt(3)
+	c.Key("name")
+	c.Str("Jo")
+	c.Key("nums")
+	c.BeginList(4)
+	c.Int(-1, 64)
+	c.Int(-200, 64)
+	c.Int(150, 64)
+	c.Uint(1<<40, 64)
+	c.EndList()
+	c.Key("score")
+	c.Float(1.5, 32)
+	c.Key("m")
+	c.BeginDict(2)
+	c.Key("k")
+	c.BeginList(1)
+	c.Str(long)
+	c.EndList()
+	c.Key("empty")
+	c.BeginList(0)
+	c.EndList()
+	c.EndDict()
+	c.Key("skip")
+	c.BeginDict(1)
+	c.Key("a")
+	c.Blob([]byte{1, 2})
+	c.EndDict()
+	c.Key("ok")
+	c.Bool(true)
+	c.EndEnt()
+	assert.NoErr("encode", c.Err())
+	assert.Eq("map header", c.Bytes()[:5], []byte{0xdf, 0, 0, 0, 7})
+
+	d := NewMsgpackDecoder(c.Bytes())
+	assert.Eq("ent", d.DictHeader(), 7)
+	assert.Eq("key", d.Key(), FieldNameVersion)
+	assert.Eq("version", d.Uint(64), uint64(3))
+	assert.Eq("key", d.Key(), "name")
+	assert.Eq("name", d.Str(), "Jo")
+	assert.Eq("key", d.Key(), "nums")
+	var nums []int64
+	for n := d.ListHeader(); n > 0; n-- {
+		nums = append(nums, d.Int(64))
+	}
+	assert.Eq("nums", fmt.Sprint(nums), "[-1 -200 150 1099511627776]")
+	assert.Eq("key", d.Key(), "score")
+	assert.Eq("score", d.Float(32), 1.5)
+	assert.Eq("key", d.Key(), "m")
+	assert.Eq("dict", d.DictHeader(), 2)
+	assert.Eq("dict key", d.Key(), "k")
+	assert.Eq("list", d.ListHeader(), 1)
+	assert.Eq("long", d.Str(), long)
+	assert.Eq("more", d.More(), true)
+	assert.Eq("dict key", d.Key(), "empty")
+	assert.Eq("empty list", d.ListHeader(), 0)
+	assert.Eq("key", d.Key(), "skip")
+	d.Discard()
+	assert.Eq("key", d.Key(), "ok")
+	assert.Eq("ok", d.Bool(), true)
+	assert.Eq("end", d.Key(), "")
+	assert.NoErr("decode", d.Err())
+
+	// truncated data
+	d = NewMsgpackDecoder(c.Bytes()[:12])
+	d.DictHeader()
+	d.Key()
+	d.Uint(64)
+	d.Key()
+	d.Str()
+	assert.Err("truncated", "truncated data", d.Err())
+}
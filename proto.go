@@ -0,0 +1,501 @@
+package ent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protocol buffers field numbers of the implicit id and version fields.
+// Other fields are numbered by their field index + 1.
+const (
+	ProtoFieldNumberId      = 100
+	ProtoFieldNumberVersion = 101
+)
+
+// protobuf wire types
+const (
+	protoVarint = 0
+	protoI64    = 1
+	protoLen    = 2
+	protoI32    = 5
+)
+
+var (
+	errProtoNested   = errors.New("nested lists and dicts are not supported")
+	errProtoWireType = errors.New("unexpected wire type")
+	errProtoTrunc    = errors.New("truncated data")
+)
+
+// ProtoEncoder is an implementation of the Encoder interface which produces protocol buffers
+// data, as described by .proto files generated by entgen.
+//
+// Lists are encoded as non-packed repeated fields and dicts as maps.
+// Lists and dicts can not be nested and dict values must be scalars.
+type ProtoEncoder struct {
+	names []string // field names, ordered by field index
+	buf   []byte
+	err   error
+
+	field  int // field number of the current key; 0 if the key has no field number
+	inList bool
+	inDict bool
+	key    string // current dict key
+
+	val   []byte // scratch buffer for a value
+	entry []byte // scratch buffer for a map entry
+}
+
+// NewProtoEncoder returns an encoder for an ent with the provided field names, i.e.
+// e.EntFields().Names
+func NewProtoEncoder(names []string) *ProtoEncoder {
+	return &ProtoEncoder{names: names}
+}
+
+func (c *ProtoEncoder) Err() error    { return c.err }
+func (c *ProtoEncoder) Bytes() []byte { return c.buf }
+
+func (c *ProtoEncoder) BeginEnt(version uint64) {
+	c.field = ProtoFieldNumberVersion
+	c.Uint(version, 64)
+}
+
+func (c *ProtoEncoder) EndEnt() {}
+
+func (c *ProtoEncoder) BeginList(length int) {
+	if c.inList || c.inDict {
+		c.setErr(errProtoNested)
+	}
+	c.inList = true
+}
+
+func (c *ProtoEncoder) EndList() { c.inList = false }
+
+func (c *ProtoEncoder) BeginDict(length int) {
+	if c.inList || c.inDict {
+		c.setErr(errProtoNested)
+	}
+	c.inDict = true
+}
+
+func (c *ProtoEncoder) EndDict() { c.inDict = false }
+
+func (c *ProtoEncoder) Key(k string) {
+	if c.inDict {
+		c.key = k
+		return
+	}
+	c.field = 0
+	switch k {
+	case FieldNameId:
+		c.field = ProtoFieldNumberId
+	case FieldNameVersion:
+		c.field = ProtoFieldNumberVersion
+	default:
+		for i, name := range c.names {
+			if name == k {
+				c.field = i + 1
+				break
+			}
+		}
+	}
+}
+
+func (c *ProtoEncoder) Str(v string) {
+	c.val = protoAppendVarint(c.val[:0], uint64(len(v)))
+	c.val = append(c.val, v...)
+	c.value(protoLen)
+}
+
+func (c *ProtoEncoder) Blob(v []byte) {
+	c.val = protoAppendVarint(c.val[:0], uint64(len(v)))
+	c.val = append(c.val, v...)
+	c.value(protoLen)
+}
+
+func (c *ProtoEncoder) Int(v int64, bitsize int) {
+	c.val = protoAppendVarint(c.val[:0], uint64(v))
+	c.value(protoVarint)
+}
+
+func (c *ProtoEncoder) Uint(v uint64, bitsize int) {
+	c.val = protoAppendVarint(c.val[:0], v)
+	c.value(protoVarint)
+}
+
+func (c *ProtoEncoder) Float(v float64, bitsize int) {
+	if bitsize == 32 {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v)))
+		c.val = append(c.val[:0], b[:]...)
+		c.value(protoI32)
+	} else {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		c.val = append(c.val[:0], b[:]...)
+		c.value(protoI64)
+	}
+}
+
+func (c *ProtoEncoder) Bool(v bool) {
+	var b uint64
+	if v {
+		b = 1
+	}
+	c.Uint(b, 1)
+}
+
+// value writes c.val (an encoded value of wire type wt) for the current field
+func (c *ProtoEncoder) value(wt int) {
+	if c.field == 0 || c.err != nil {
+		return
+	}
+	if !c.inDict {
+		c.buf = protoAppendTag(c.buf, c.field, wt)
+		c.buf = append(c.buf, c.val...)
+		return
+	}
+	// map entry: message { key = 1; value = 2; }
+	c.entry = protoAppendTag(c.entry[:0], 1, protoLen)
+	c.entry = protoAppendVarint(c.entry, uint64(len(c.key)))
+	c.entry = append(c.entry, c.key...)
+	c.entry = protoAppendTag(c.entry, 2, wt)
+	c.entry = append(c.entry, c.val...)
+	c.buf = protoAppendTag(c.buf, c.field, protoLen)
+	c.buf = protoAppendVarint(c.buf, uint64(len(c.entry)))
+	c.buf = append(c.buf, c.entry...)
+}
+
+func (c *ProtoEncoder) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// ProtoDecoder is an implementation of the Decoder interface which reads protocol buffers
+// data, as produced by ProtoEncoder.
+//
+// Values of a repeated field are expected to be encoded consecutively. Both packed and
+// non-packed repeated fields are supported.
+type ProtoDecoder struct {
+	names []string // field names, ordered by field index
+	buf   []byte
+	pos   int
+	err   error
+
+	field int // field number of the current value
+	wt    int // wire type of the current value
+
+	list   int  // field number of the list or dict being decoded, or 0
+	first  bool // true until More has been called for the first value of list
+	inDict bool
+
+	// while decoding the value of a map entry or the values of a packed list, buf holds the
+	// value or the packed values and outer & outerPos the data which contains them
+	inner    bool
+	key      string // key of the current map entry
+	outer    []byte
+	outerPos int
+}
+
+// protoNoField is returned by ProtoDecoder.Key for fields without a name.
+// It does not name any ent field, causing generated EntDecode methods to Discard the value.
+const protoNoField = "\x00"
+
+// protoNoValue is used as the wire type of the value of a map entry which lacks a value
+const protoNoValue = -1
+
+// NewProtoDecoder returns a decoder for an ent with the provided field names, i.e.
+// e.EntFields().Names
+func NewProtoDecoder(names []string, data []byte) *ProtoDecoder {
+	return &ProtoDecoder{names: names, buf: data}
+}
+
+func (c *ProtoDecoder) Err() error { return c.err }
+
+func (c *ProtoDecoder) Key() string {
+	if c.inDict {
+		return c.key
+	}
+	if c.err != nil || c.pos >= len(c.buf) {
+		return ""
+	}
+	c.tag()
+	switch {
+	case c.err != nil:
+		return ""
+	case c.field == ProtoFieldNumberId:
+		return FieldNameId
+	case c.field == ProtoFieldNumberVersion:
+		return FieldNameVersion
+	case c.field > 0 && c.field <= len(c.names):
+		return c.names[c.field-1]
+	}
+	return protoNoField
+}
+
+// ListHeader always returns -1 since the number of values of a repeated field is not known
+func (c *ProtoDecoder) ListHeader() int {
+	c.list = c.field
+	c.first = true
+	return -1
+}
+
+// DictHeader always returns -1 since the number of entries of a map is not known
+func (c *ProtoDecoder) DictHeader() int {
+	c.ListHeader()
+	c.inDict = true
+	return -1
+}
+
+func (c *ProtoDecoder) More() bool {
+	if c.inner {
+		if !c.inDict && c.pos < len(c.buf) && c.err == nil {
+			return true // next value of a packed list
+		}
+		c.buf, c.pos = c.outer, c.outerPos
+		c.inner = false
+	}
+	if c.list == 0 || c.err != nil {
+		return false
+	}
+	if c.first {
+		c.first = false
+	} else {
+		pos := c.pos
+		if pos < len(c.buf) {
+			c.tag()
+		}
+		if pos == len(c.buf) || c.field != c.list || c.err != nil {
+			c.pos = pos // not part of the list; leave it for Key
+			c.list = 0
+			c.inDict = false
+			return false
+		}
+	}
+	if c.inDict {
+		c.mapEntry()
+	}
+	return c.err == nil
+}
+
+// beginInner makes data the data being read, until the next call to More
+func (c *ProtoDecoder) beginInner(data []byte) {
+	c.outer, c.outerPos = c.buf, c.pos
+	c.buf, c.pos = data, 0
+	c.inner = true
+}
+
+// packed is called before reading a scalar value of wire type wt. If the current value is
+// a packed list, the packed values are read from here on.
+func (c *ProtoDecoder) packed(wt int) {
+	if c.wt == protoLen && c.list != 0 && !c.inner {
+		c.beginInner(c.lenValue())
+		c.wt = wt
+	}
+}
+
+// mapEntry reads a map entry and makes its value the current value
+func (c *ProtoDecoder) mapEntry() {
+	c.beginInner(c.lenValue())
+	c.key = ""
+	var value []byte
+	valuewt := protoNoValue
+	for c.pos < len(c.buf) && c.err == nil {
+		c.tag()
+		switch c.field {
+		case 1:
+			c.key = string(c.lenValue())
+		case 2:
+			start := c.pos
+			valuewt = c.wt
+			c.Discard()
+			value = c.buf[start:c.pos]
+		default:
+			c.Discard()
+		}
+	}
+	c.buf, c.pos, c.wt = value, 0, valuewt
+}
+
+func (c *ProtoDecoder) Str() string { return string(c.lenValue()) }
+
+func (c *ProtoDecoder) Blob() []byte {
+	if v := c.lenValue(); v != nil {
+		return append([]byte{}, v...)
+	}
+	return nil
+}
+
+func (c *ProtoDecoder) Bool() bool { return c.Uint(1) != 0 }
+
+func (c *ProtoDecoder) Int(bitsize int) int64 { return int64(c.Uint(bitsize)) }
+
+func (c *ProtoDecoder) Uint(bitsize int) uint64 {
+	c.packed(protoVarint)
+	switch c.wt {
+	case protoVarint:
+		return c.varint()
+	case protoNoValue:
+		return 0
+	}
+	c.setErr(errProtoWireType)
+	return 0
+}
+
+func (c *ProtoDecoder) Float(bitsize int) float64 {
+	if bitsize == 32 {
+		c.packed(protoI32)
+	} else {
+		c.packed(protoI64)
+	}
+	switch c.wt {
+	case protoI32:
+		if b := c.next(4); b != nil {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		}
+	case protoI64:
+		if b := c.next(8); b != nil {
+			return math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	case protoNoValue:
+	default:
+		c.setErr(errProtoWireType)
+	}
+	return 0
+}
+
+func (c *ProtoDecoder) Discard() {
+	switch c.wt {
+	case protoVarint:
+		c.varint()
+	case protoI64:
+		c.next(8)
+	case protoLen:
+		c.lenValue()
+	case protoI32:
+		c.next(4)
+	case protoNoValue:
+	default:
+		c.setErr(errProtoWireType)
+	}
+}
+
+// tag reads a field tag, setting c.field and c.wt
+func (c *ProtoDecoder) tag() {
+	v := c.varint()
+	c.field = int(v >> 3)
+	c.wt = int(v & 7)
+}
+
+func (c *ProtoDecoder) lenValue() []byte {
+	switch c.wt {
+	case protoLen:
+		// ok
+	case protoNoValue:
+		return nil
+	default:
+		c.setErr(errProtoWireType)
+		return nil
+	}
+	n := c.varint()
+	if n > uint64(len(c.buf)-c.pos) {
+		c.setErr(errProtoTrunc)
+		c.pos = len(c.buf)
+		return nil
+	}
+	return c.next(int(n))
+}
+
+func (c *ProtoDecoder) varint() uint64 {
+	v, n := binary.Uvarint(c.buf[c.pos:])
+	if n <= 0 {
+		c.setErr(errProtoTrunc)
+		c.pos = len(c.buf)
+		return 0
+	}
+	c.pos += n
+	return v
+}
+
+func (c *ProtoDecoder) next(n int) []byte {
+	if len(c.buf)-c.pos < n {
+		c.setErr(errProtoTrunc)
+		c.pos = len(c.buf)
+		return nil
+	}
+	b := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *ProtoDecoder) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func protoAppendTag(b []byte, field, wt int) []byte {
+	return protoAppendVarint(b, uint64(field)<<3|uint64(wt))
+}
+
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// -------------
+
+// The two following functions are used by ent.ProtoEncode and ent.ProtoDecode to implement
+// MarshalProto and UnmarshalProto for Ent types.
+
+func ProtoEncodeEnt(e Ent, id, version uint64, fields FieldSet) ([]byte, error) {
+	c := NewProtoEncoder(e.EntFields().Names)
+	c.BeginEnt(version)
+	c.Key(FieldNameId)
+	c.Uint(id, 64)
+	e.EntEncode(c, fields)
+	c.EndEnt()
+	if err := c.Err(); err != nil {
+		return nil, &ProtoError{err}
+	}
+	return c.Bytes(), nil
+}
+
+func ProtoDecodeEnt(e Ent, data []byte) (id, version uint64, err error) {
+	c := NewProtoDecoder(e.EntFields().Names, data)
+	id, version = e.EntDecode(c)
+	if err = c.Err(); err != nil {
+		err = &ProtoError{err}
+	}
+	return
+}
+
+// ProtoEncode encodes fields of e as protocol buffers data
+func ProtoEncode(e Ent, fields FieldSet) ([]byte, error) {
+	// Note: Used by generated code to implement MarshalProto
+	return ProtoEncodeEnt(e, e.Id(), e.Version(), fields)
+}
+
+// ProtoDecode populates e from protocol buffers data
+func ProtoDecode(e Ent, data []byte) error {
+	// Note: Used by generated code to implement UnmarshalProto
+	id, version, err := ProtoDecodeEnt(e, data)
+	if err == nil {
+		eb := entBase(e)
+		eb.id = id
+		eb.version = version
+	}
+	return err
+}
+
+type ProtoError struct {
+	Underlying error
+}
+
+func (e *ProtoError) Unwrap() error { return e.Underlying }
+func (e *ProtoError) Error() string { return fmt.Sprintf("protobuf error: %v", e.Underlying) }
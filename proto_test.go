@@ -0,0 +1,70 @@
+package ent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestProtoCodec(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	names := []string{"name", "nums", "score", "m"}
+
+	c := NewProtoEncoder(names)
+	c.BeginEnt(3)
+	c.Key("name")
+	c.Str("Jo")
+	c.Key("nums")
+	c.BeginList(2)
+	c.Int(-1, 64)
+	c.Int(150, 64)
+	c.EndList()
+	c.Key("score")
+	c.Float(1.5, 32)
+	c.Key("m")
+	c.BeginDict(1)
+	c.Key("k")
+	c.Uint(7, 64)
+	c.EndDict()
+	c.EndEnt()
+	assert.NoErr("encode", c.Err())
+
+	d := NewProtoDecoder(names, c.Bytes())
+	assert.Eq("key", d.Key(), FieldNameVersion)
+	assert.Eq("version", d.Uint(64), uint64(3))
+	assert.Eq("key", d.Key(), "name")
+	assert.Eq("name", d.Str(), "Jo")
+	assert.Eq("key", d.Key(), "nums")
+	var nums []int64
+	for d.ListHeader(); d.More(); {
+		nums = append(nums, d.Int(64))
+	}
+	assert.Eq("nums", fmt.Sprint(nums), "[-1 150]")
+	assert.Eq("key", d.Key(), "score")
+	assert.Eq("score", d.Float(32), 1.5)
+	assert.Eq("key", d.Key(), "m")
+	d.DictHeader()
+	assert.Eq("more", d.More(), true)
+	assert.Eq("dict key", d.Key(), "k")
+	assert.Eq("dict value", d.Uint(64), uint64(7))
+	assert.Eq("more", d.More(), false)
+	assert.Eq("end", d.Key(), "")
+	assert.NoErr("decode", d.Err())
+
+	// packed list, as produced by other protobuf implementations
+	d = NewProtoDecoder(names, []byte{0x12, 3, 1, 2, 3})
+	assert.Eq("key", d.Key(), "nums")
+	nums = nil
+	for d.ListHeader(); d.More(); {
+		nums = append(nums, d.Int(64))
+	}
+	assert.Eq("packed nums", fmt.Sprint(nums), "[1 2 3]")
+	assert.Eq("end", d.Key(), "")
+
+	// truncated data
+	d = NewProtoDecoder(names, []byte{0x0a, 5, 'J'})
+	d.Key()
+	d.Str()
+	assert.Err("truncated", "truncated data", d.Err())
+}
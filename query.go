@@ -0,0 +1,193 @@
+package ent
+
+import (
+	"reflect"
+	"sort"
+)
+
+// FindIdsByExample looks up ids of ents of the same type as example which field values are
+// equal to those set in example.
+//
+// The fields considered are the ones with unsaved changes in example (e.g. set with SetFIELD
+// methods) or, if example has no unsaved changes, all fields with non-zero values. This means
+// that a field can only be matched against its zero value by using its setter method, e.g.
+// to find accounts with kind=0: a := &Account{}; a.SetKind(0); FindAccountByExample(s, a, 0)
+//
+// Indexes which fields are all included in the example are used to narrow down the search.
+// When more than one index applies, the results are intersected. Fields not covered by any index
+// are matched by loading and comparing each candidate ent. If no index applies at all, all ents
+// of the type are scanned.
+//
+// The returned ids are sorted in ascending order. If limit > 0, at most limit ids are returned.
+func FindIdsByExample(s Storage, example Ent, limit int) ([]uint64, error) {
+	ids, _, err := findByExample(s, example, limit, false)
+	return ids, err
+}
+
+// LoadEntsByExample loads all ents matching example. See FindIdsByExample for details.
+// Note that example itself is never part of the result.
+func LoadEntsByExample(s Storage, example Ent, limit int) ([]Ent, error) {
+	_, ents, err := findByExample(s, example, limit, true)
+	return ents, err
+}
+
+// FilterEnts returns an iterator over the ents of it for which keep returns true.
+// Note that Next may modify its ent even when it returns false, like with IterateEnts.
+func FilterEnts(it EntIterator, keep func(e Ent) bool) EntIterator {
+	return &filteredEntIterator{it, keep}
+}
+
+type filteredEntIterator struct {
+	EntIterator
+	keep func(e Ent) bool
+}
+
+func (it *filteredEntIterator) Next(e Ent) bool {
+	for it.EntIterator.Next(e) {
+		if it.keep(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func findByExample(s Storage, example Ent, limit int, load bool) ([]uint64, []Ent, error) {
+	fields := exampleFields(example)
+	entTypeName := example.EntTypeName()
+
+	// find candidates using indexes
+	var candidates IdSet
+	var indexedFields FieldSet
+	var keyEncoder IndexKeyEncoder
+	useIndex := false
+	indexes := example.EntIndexes()
+	for i := range indexes {
+		x := &indexes[i]
+		if x.Fields&fields != x.Fields {
+			// example does not provide values for all fields of this index
+			continue
+		}
+		if x.IsMulti() || x.Where != 0 {
+			// entries are of list elements, not of whole lists, or
+			// not all ents have entries (partial index)
+			continue
+		}
+		key, err := keyEncoder.EncodeKey(example, x.Fields)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids, err := s.FindByIndex(entTypeName, x, key, 0, 0)
+		if err != nil && err != ErrNotFound {
+			return nil, nil, err
+		}
+		if useIndex {
+			candidates = intersectIds(candidates, ids)
+		} else {
+			candidates = ids
+			useIndex = true
+		}
+		indexedFields |= x.Fields
+		if len(candidates) == 0 {
+			return nil, nil, nil
+		}
+	}
+
+	// fields which needs to be compared by value
+	scanFields := fields &^ indexedFields
+
+	var ids IdSet
+	var ents []Ent
+	if !useIndex {
+		// no applicable index; scan all ents of the type
+		it := IterateEnts(s, example)
+		e := example.EntNew()
+		for it.Next(e) {
+			if entFieldsEqual(example, e, scanFields) {
+				ids = append(ids, e.Id())
+				if load {
+					ents = append(ents, e)
+					e = example.EntNew()
+				}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, nil, err
+		}
+	} else if scanFields != 0 || load {
+		for _, id := range candidates {
+			e := example.EntNew()
+			if err := LoadEntById(e, s, id); err != nil {
+				if err == ErrNotFound {
+					// deleted since we read the index
+					continue
+				}
+				return nil, nil, err
+			}
+			if entFieldsEqual(example, e, scanFields) {
+				ids = append(ids, id)
+				if load {
+					ents = append(ents, e)
+				}
+			}
+		}
+	} else {
+		ids = candidates
+	}
+
+	// sort results by id and apply limit
+	if load {
+		sort.Slice(ents, func(i, j int) bool { return ents[i].Id() < ents[j].Id() })
+		if limit > 0 && limit < len(ents) {
+			ents = ents[:limit]
+		}
+		return nil, ents, nil
+	}
+	ids.Sort()
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	return ids, nil, nil
+}
+
+// exampleFields returns the fields of e to be used as a query by example
+func exampleFields(e Ent) FieldSet {
+	if changes := entBase(e).changes; changes != 0 {
+		return changes
+	}
+	return e.EntFields().FieldSet &^ FieldsWithZeroValue(e)
+}
+
+// entFieldsEqual returns true if all fields of a and b are equal.
+// a and b must be of the same type.
+func entFieldsEqual(a, b Ent, fields FieldSet) bool {
+	if fields == 0 {
+		return true
+	}
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	n := av.NumField()
+	for i := 1; i < n; i++ {
+		if !fields.Has(i - 1) {
+			continue
+		}
+		// Note: ent fields are usually unexported, so we access them via their addresses
+		af, bf := av.Field(i), bv.Field(i)
+		ai := reflect.NewAt(af.Type(), pointer(af.UnsafeAddr())).Elem().Interface()
+		bi := reflect.NewAt(bf.Type(), pointer(bf.UnsafeAddr())).Elem().Interface()
+		if !reflect.DeepEqual(ai, bi) {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectIds returns the ids present in both a and b
+func intersectIds(a, b IdSet) IdSet {
+	var r IdSet
+	for _, id := range a {
+		if b.Has(id) {
+			r = append(r, id)
+		}
+	}
+	return r
+}
@@ -0,0 +1,288 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// CreateBatch creates all ents in one go, using a minimal number of round trips to redis.
+// This is much faster than calling Create for each ent when importing large amounts of data.
+//
+// Either all ents are created or none are. An ent which conflicts on a unique index, either
+// with an existing ent or with another ent in ents, causes the entire batch to fail with an
+// ent.IndexConflictErr. This includes a unique index key which another client takes while the
+// batch is being written. When another client changes a unique index key of the batch without
+// leaving it taken (e.g. creates and deletes an ent), the batch is retried up to s.MaxRetries
+// times before failing with ent.ErrVersionConflict.
+//
+// On success, each ent is assigned an id and version 1 and is bound to s, just like after
+// a successful call to TYPE.Create. Note that lifecycle hooks (e.g. ent.BeforeCreate) are not
+// called.
+func (s *EntStorage) CreateBatch(ents []ent.Ent) error {
+	return s.CreateBatchContext(context.Background(), ents)
+}
+
+// CreateBatchContext is a variant of CreateBatch which accepts a context
+func (s *EntStorage) CreateBatchContext(ctx context.Context, ents []ent.Ent) error {
+	if len(ents) == 0 {
+		return nil
+	}
+
+	// redis commands we will issue:
+	//
+	//   1. (pipelined) HINCRBY entid entType n (for each type of ent without an id)
+	//
+	//   2. (pipelined) WATCH uniqueIndexKey...; GET uniqueIndexKey (for each unique index key)
+	//      and if any key is taken: WATCH entKey...; EXISTS entKey (for each ent which took one)
+	//
+	//   3. (pipelined)
+	//      MULTI
+	//      (for each ent)
+	//         HSET entKey ...
+	//         (for each index)
+	//            SETNX uniqueIndexKey id  or  ZADD indexKey entry
+	//            SET revLookupKey entry (if the index has a reverse lookup)
+	//      EXEC
+	//
+	ids, err := s.allocIds(ctx, ents)
+	if err != nil {
+		return err
+	}
+
+	cmds := make([]radix.CmdAction, 1, 2+len(ents)*2)
+	cmds[0] = &CmdMULTI
+	var uniqueKeys [][]byte
+	var uniqueConflicts []*ent.IndexConflictErr // error to return if uniqueKeys[i] is taken
+	var uniqueCmds []int                        // index in cmds of SETNX for uniqueKeys[i]
+	claimed := make(map[string]uint64)          // unique index key => id of ent in the batch
+
+	for i, e := range ents {
+		entType := e.EntTypeName()
+		entKey := s.entKey(entType, ids[i])
+		fields := e.EntFields().FieldSet
+
+		var respData []byte
+		var packedFields ent.FieldSet
+		if s.Compression != ent.NoCompression {
+			respData, packedFields, err = encodeEntHSETCompressed(
+				e, make([]byte, 0, 128), entKey, 1, fields, s.Compression)
+		} else {
+			respData, err = encodeEntHSET(e, make([]byte, 0, 128), entKey, 1, fields)
+		}
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, &RawCmd{respData})
+		if packedFields != 0 {
+			cmds = append(cmds, makeHDELFieldsCmd(entKey, e, packedFields))
+		}
+
+		indexEdits, err := ent.ComputeIndexEdits(nil, nil, e, ids[i], fields)
+		if err != nil {
+			return err
+		}
+		for j := range indexEdits {
+			ed := &indexEdits[j]
+			if ed.Index.HasReverseLookup() {
+				_, cmd := s.makeRevLookupSETCmd(e, ed, ids[i])
+				cmds = append(cmds, cmd)
+			}
+			indexKey := s.indexKey(entType, ed.Index, []byte(ed.Key))
+			if !ed.Index.IsUnique() {
+				cmds = append(cmds, makeZADDIdCmd(indexKey, []byte(ed.Key), ids[i]))
+				if ed.Index.Score != 0 {
+					cmds = s.appendScoreCmd(cmds, entType, ed, ids[i])
+				}
+				continue
+			}
+			if id, ok := claimed[string(indexKey)]; ok && id != ids[i] {
+				return &ent.IndexConflictErr{
+					Underlying:  ent.ErrUniqueConflict,
+					EntTypeName: entType,
+					IndexName:   ed.Index.Name,
+					Key:         ed.Key,
+					ExistingId:  id,
+				}
+			}
+			claimed[string(indexKey)] = ids[i]
+			uniqueKeys = append(uniqueKeys, indexKey)
+			uniqueConflicts = append(uniqueConflicts, &ent.IndexConflictErr{
+				Underlying:  ent.ErrUniqueConflict,
+				EntTypeName: entType,
+				IndexName:   ed.Index.Name,
+				Key:         ed.Key,
+			})
+			uniqueCmds = append(uniqueCmds, len(cmds))
+			cmds = append(cmds, makeSETNXIdCmd(indexKey, ids[i]))
+		}
+	}
+
+	exec := &txExecCmd{RawCmd: CmdEXEC}
+	cmds = append(cmds, exec)
+
+	// With a Redis Cluster, all ents must be of the same type (see HashTags)
+	slotKey := s.entKey(ents[0].EntTypeName(), ids[0])
+
+	// checkUniqueKeys watches the unique index keys and checks that they are not taken by
+	// existing ents. Returns the indices in uniqueKeys of keys taken by ents which don't exist.
+	checkUniqueKeys := func(c radix.Conn) ([]int, error) {
+		existingIds := make([]uint64, len(uniqueKeys))
+		checkCmds := make([]radix.CmdAction, 1, 1+len(uniqueKeys))
+		checkCmds[0] = MakeBulkStringCmd("WATCH", uniqueKeys...)
+		for i, key := range uniqueKeys {
+			checkCmds = append(checkCmds, makeGETEntIdCmd(key, &existingIds[i]))
+		}
+		debugTrace(">> WATCH %q; GET ...", uniqueKeys)
+		if err := c.Do(radix.Pipeline(checkCmds...)); err != nil {
+			return nil, err
+		}
+		return s.findStaleIndexKeys(c, existingIds, uniqueConflicts)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = s.batchContext(ctx, slotKey, func(c radix.Conn) (err error) {
+			if len(uniqueKeys) > 0 {
+				// UNWATCH in case of error
+				defer func() {
+					if err != nil {
+						debugTrace(">> UNWATCH (reason: %v)", err)
+						c.Do(&CmdUNWATCH)
+					}
+				}()
+				stale, err := checkUniqueKeys(c)
+				if err != nil {
+					return err
+				}
+				for i, key := range uniqueKeys {
+					cmds[uniqueCmds[i]] = makeSETNXIdCmd(key, claimed[string(key)])
+				}
+				for _, i := range stale {
+					// the key is taken by an ent which no longer exists
+					cmds[uniqueCmds[i]] = makeSETIdCmd(uniqueKeys[i], claimed[string(uniqueKeys[i])])
+				}
+			}
+			debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
+			return c.Do(radix.Pipeline(cmds...))
+		})
+		if err != nil || !exec.aborted {
+			break
+		}
+		// A unique index key was changed by someone else in the meantime, since it is the only
+		// kind of key watched. Retry, which fails with an ent.IndexConflictErr if the key is now
+		// taken by an existing ent.
+		if attempt < s.MaxRetries {
+			debugTrace("EXEC aborted; retrying (attempt %d)", attempt+1)
+			continue
+		}
+		// find out which key was taken, without retrying
+		err = s.batchContext(ctx, slotKey, func(c radix.Conn) error {
+			_, err := checkUniqueKeys(c)
+			c.Do(&CmdUNWATCH)
+			return err
+		})
+		if err == nil {
+			err = ent.ErrVersionConflict // the key was freed again
+		}
+		break
+	}
+	if err != nil {
+		return err
+	}
+
+	// update write-through cache
+	if s.WClient() != s.RClient() {
+		err := s.RClient().Do(radix.Pipeline(cmds...))
+		if err != nil && s.Logger != nil {
+			s.Logger.Warn("write-through cache failure %v", err)
+		}
+	}
+
+	for i, e := range ents {
+		ent.SetEntBaseFieldsAfterLoad(e, s, ids[i], 1)
+	}
+	return nil
+}
+
+// findStaleIndexKeys checks if the ents which have taken unique index keys exist.
+// existingIds[i] is the id of the ent which has taken key i, or 0 if the key is free.
+// Returns the indices of keys taken by ents which do not exist, e.g. which have expired (see
+// CreateExpiring), or conflicts[i] if the ent of key i exists.
+func (s *EntStorage) findStaleIndexKeys(
+	c radix.Conn, existingIds []uint64, conflicts []*ent.IndexConflictErr,
+) ([]int, error) {
+	var entKeys [][]byte
+	var stale []int // index in existingIds of entKeys[i]
+	for i, id := range existingIds {
+		if id != 0 {
+			entKeys = append(entKeys, s.entKey(conflicts[i].EntTypeName, id))
+			stale = append(stale, i)
+		}
+	}
+	if len(entKeys) == 0 {
+		return nil, nil
+	}
+	exists := make([]int, len(entKeys))
+	cmds := make([]radix.CmdAction, 1, 1+len(entKeys))
+	cmds[0] = MakeBulkStringCmd("WATCH", entKeys...)
+	for i, key := range entKeys {
+		cmds = append(cmds, &RawCmdInt{RawCmd{respMakeStringArray2("EXISTS", key)}, &exists[i]})
+	}
+	if err := c.Do(radix.Pipeline(cmds...)); err != nil {
+		return nil, err
+	}
+	for i, n := range exists {
+		if n != 0 {
+			conflict := conflicts[stale[i]]
+			conflict.ExistingId = existingIds[stale[i]]
+			return nil, conflict
+		}
+	}
+	return stale, nil
+}
+
+// allocIds returns ids for ents; the ent's own id if it has one, else a newly allocated id.
+// New ids are allocated with one HINCRBY per ent type.
+func (s *EntStorage) allocIds(ctx context.Context, ents []ent.Ent) ([]uint64, error) {
+	ids := make([]uint64, len(ents))
+	count := make(map[string]int) // ent type => number of ids needed
+	var types []string            // ent types in order of appearance
+	for i, e := range ents {
+		if ids[i] = e.Id(); ids[i] == 0 {
+			entType := e.EntTypeName()
+			if count[entType] == 0 {
+				types = append(types, entType)
+			}
+			count[entType]++
+		}
+	}
+	if len(types) == 0 {
+		return ids, nil
+	}
+
+	// HINCRBY yields the last id of the range allocated
+	lastIds := make([]uint64, len(types))
+	cmds := make([]radix.CmdAction, len(types))
+	for i, entType := range types {
+		cmds[i] = radix.FlatCmd(&lastIds[i], "HINCRBY", s.idCounterKey(), entType, count[entType])
+	}
+	if err := s.doWriteContext(ctx, radix.Pipeline(cmds...)); err != nil {
+		return nil, err
+	}
+
+	nextId := make(map[string]uint64, len(types))
+	for i, entType := range types {
+		nextId[entType] = lastIds[i] - uint64(count[entType]) + 1
+	}
+	for i, e := range ents {
+		if ids[i] == 0 {
+			entType := e.EntTypeName()
+			ids[i] = nextId[entType]
+			nextId[entType]++
+		}
+	}
+	return ids, nil
+}
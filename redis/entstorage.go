@@ -1,10 +1,15 @@
 package redis
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mediocregopher/radix/v3"
 	"github.com/rsms/ent"
@@ -21,10 +26,39 @@ const (
 	entIndexKeySep = '#'
 )
 
+// entCompressedFieldsKey is the name of the hash field which holds compressed ent fields
+const entCompressedFieldsKey = "_z"
+
 type Ent = ent.Ent
 
 type EntStorage struct {
 	*Redis
+
+	// Compression, when not ent.NoCompression, causes the non-indexed fields of ents to be stored
+	// compressed in a single hash field. Indexed fields and the version are always stored
+	// uncompressed since they are read by partial loads during updates.
+	// Ents stored with a different setting (or none) are still readable.
+	Compression ent.Compression
+
+	// MaxRetries is the number of times Create, Save and CreateBatch retry writing an ent when its
+	// transaction is aborted because a watched key, e.g. a unique index key, was changed by
+	// another client. Each retry reloads the current version of the ent and recomputes its index
+	// changes, so a change to the ent itself still fails with ent.ErrVersionConflict.
+	MaxRetries int
+
+	// ScanCount, when larger than zero, is passed as the COUNT hint to the SCAN commands used
+	// by IterateIds, IterateEnts and ListIndexKeys of unique indexes. A larger value, e.g. 1000,
+	// means fewer round trips to redis when iterating over many keys, at the cost of more work
+	// per SCAN. When zero, redis uses its default (10).
+	ScanCount int
+
+	// ScriptedWrites, when true, makes Create and Save write ents and their index entries with a
+	// Lua script which checks the version of the ent on the server, instead of with a
+	// WATCH/MULTI/EXEC transaction. Writing an ent without indexes takes a single round trip to
+	// redis. Ents with indexes take additional round trips to load their previous index entries
+	// and to look up unique index entries. The script requires all keys of an ent type to be on
+	// the same node, which in a Redis Cluster is the case with HashTags.
+	ScriptedWrites bool
 }
 
 func NewEntStorage(r *Redis) *EntStorage {
@@ -42,15 +76,83 @@ func (s *EntStorage) Close() error {
 
 // LoadEntById is part of the ent.Storage interface, used by LoadTYPEById()
 func (s *EntStorage) LoadById(e Ent, id uint64) (version uint64, err error) {
-	err = s.doRead(s.makeEntLoadCmd(e, id, &version))
+	return s.LoadByIdContext(context.Background(), e, id)
+}
+
+// LoadByIdContext is part of the ent.ContextStorage interface
+func (s *EntStorage) LoadByIdContext(
+	ctx context.Context, e Ent, id uint64,
+) (version uint64, err error) {
+	return s.loadById(ctx, e, id, 0)
+}
+
+// Exists is part of the ent.Storage interface, used by ent.EntExists
+func (s *EntStorage) Exists(entType string, id uint64) (bool, error) {
+	return s.ExistsContext(context.Background(), entType, id)
+}
+
+// ExistsContext is part of the ent.ContextStorage interface
+func (s *EntStorage) ExistsContext(ctx context.Context, entType string, id uint64) (bool, error) {
+	var n int
+	err := s.doReadContext(ctx, radix.FlatCmd(&n, "EXISTS", string(s.entKey(entType, id))))
+	return n > 0, err
+}
+
+// LoadByIdConsistent is part of the ent.ConsistentLoader interface, used by LoadTYPEById with
+// ent.Consistent. The ent is read from the read-write server rather than from the read-only
+// server, which may not yet have received recent writes.
+func (s *EntStorage) LoadByIdConsistent(e Ent, id uint64) (version uint64, err error) {
+	return s.loadById(context.Background(), e, id, ent.Consistent)
+}
+
+// LoadByIdConsistentContext is a variant of LoadByIdConsistent which accepts a context
+func (s *EntStorage) LoadByIdConsistentContext(
+	ctx context.Context, e Ent, id uint64,
+) (version uint64, err error) {
+	return s.loadById(ctx, e, id, ent.Consistent)
+}
+
+func (s *EntStorage) loadById(
+	ctx context.Context, e Ent, id uint64, flags ent.LookupFlags,
+) (version uint64, err error) {
+	err = s.doReadFlags(ctx, flags, s.makeEntLoadCmd(e, id, &version, false))
 	return
 }
 
-func (s *EntStorage) makeEntLoadCmd(e Ent, id uint64, versionOut *uint64) *RCmd {
+// doReadFlags is like doReadContext but reads from the read-write server, like
+// doReadImportant, when flags contains ent.Consistent
+func (s *EntStorage) doReadFlags(ctx context.Context, flags ent.LookupFlags, a radix.Action) error {
+	if (flags & ent.Consistent) != 0 {
+		return doContext(ctx, s.WClient(), a)
+	}
+	return s.doReadContext(ctx, a)
+}
+
+// LoadByIds loads ents with ids in one round trip to redis. e is used for the first ent loaded
+// and new ents of the same type (see ent.Ent.EntNew) for the rest.
+// Ids which are not found are skipped; the result is in the order of ids.
+func (s *EntStorage) LoadByIds(e Ent, ids []uint64) ([]Ent, error) {
+	return s.LoadByIdsContext(context.Background(), e, ids)
+}
+
+// LoadByIdsContext is a variant of LoadByIds which accepts a context
+func (s *EntStorage) LoadByIdsContext(ctx context.Context, e Ent, ids []uint64) ([]Ent, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ents, _, err := s.loadEntsContext(ctx, e, ids, 0)
+	return ents, err
+}
+
+// makeEntLoadCmd creates a command which loads ent id into e.
+// If allowMissing is true, an ent which is not found is not an error and yields version 0.
+func (s *EntStorage) makeEntLoadCmd(
+	e Ent, id uint64, versionOut *uint64, allowMissing bool,
+) *RCmd {
 	return &RCmd{
 		func(w *RIOWriter) error {
 			// encode query
-			key := makeEntKey(e.EntTypeName(), id)
+			key := s.entKey(e.EntTypeName(), id)
 			w.ArrayHeader(2)
 			w.Str("HGETALL")
 			w.Blob(key)
@@ -62,6 +164,9 @@ func (s *EntStorage) makeEntLoadCmd(e Ent, id uint64, versionOut *uint64) *RCmd
 			if versionOut != nil {
 				*versionOut = version
 			}
+			if err == ent.ErrNotFound && allowMissing {
+				err = nil
+			}
 			return err
 		},
 	}
@@ -71,13 +176,32 @@ func (s *EntStorage) makeEntLoadCmd(e Ent, id uint64, versionOut *uint64) *RCmd
 func (s *EntStorage) FindByIndex(
 	entType string, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
 ) (ids []uint64, err error) {
-	indexKey := makeIndexKey(entType, x, key)
+	return s.FindByIndexContext(context.Background(), entType, x, key, limit, flags)
+}
+
+// FindByIndexContext is part of the ent.ContextStorage interface
+func (s *EntStorage) FindByIndexContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte, limit int,
+	flags ent.LookupFlags,
+) (ids []uint64, err error) {
+	if (flags & ent.IncludeDeleted) != 0 {
+		find := func(x *ent.EntIndex, flags ent.LookupFlags) ([]uint64, error) {
+			return s.FindByIndexContext(ctx, entType, x, key, limit, flags)
+		}
+		ids, err = ent.FindIdsIncludingDeleted(x, limit, flags, find)
+		if err == nil && len(ids) == 0 && x.IsUnique() {
+			err = ent.ErrNotFound
+		}
+		return
+	}
+
+	indexKey := s.indexKey(entType, x, key)
 	debugTrace("FindEntIdsByIndex %s.%s %q indexKey=%q", entType, x.Name, key, indexKey)
 
 	if x.IsUnique() {
 		var id uint64
 		cmd := makeGETEntIdCmd(indexKey, &id)
-		if err := s.doRead(cmd); err != nil {
+		if err := s.doReadFlags(ctx, flags, cmd); err != nil {
 			return nil, err
 		}
 		if id == 0 {
@@ -89,26 +213,217 @@ func (s *EntStorage) FindByIndex(
 
 	// ZRANGEBYLEX "type#index" "[value\xfe" "(value\xff"
 	cmd := makeZRangeEntIdsCmd(indexKey, key, limit, (flags&ent.Reverse) != 0)
-	err = s.doRead(cmd)
+	err = s.doReadFlags(ctx, flags, cmd)
 	ids = cmd.Result
 	return
 }
 
+// FindByIndexRange is part of the ent.Storage interface, used by FindTYPEByINDEXRange
+func (s *EntStorage) FindByIndexRange(
+	entType string, x *ent.EntIndex, lo, hi []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	return s.FindByIndexRangeContext(context.Background(), entType, x, lo, hi, limit, flags)
+}
+
+// FindByIndexRangeContext is part of the ent.ContextStorage interface
+func (s *EntStorage) FindByIndexRangeContext(
+	ctx context.Context, entType string, x *ent.EntIndex, lo, hi []byte, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	if x.IsUnique() {
+		return s.findByUniqueIndexRange(ctx, entType, x, lo, hi, limit, flags)
+	}
+	// ZRANGEBYLEX "type#index" "[lo" "(hi\xff"
+	rangeStart := append([]byte{'['}, lo...)
+	rangeEnd := append(append([]byte{'('}, hi...), '\xff')
+	indexKey := s.indexKey(entType, x, nil)
+	cmd := makeZRangeByLexEntIdsCmd(indexKey, rangeStart, rangeEnd, limit, (flags&ent.Reverse) != 0)
+	err := s.doReadFlags(ctx, flags, cmd)
+	return cmd.Result, err
+}
+
+// findByUniqueIndexRange finds ids in a unique index. Since each entry of a unique index is
+// a separate redis key, this scans all keys of the index (see ListIndexKeys).
+func (s *EntStorage) findByUniqueIndexRange(
+	ctx context.Context, entType string, x *ent.EntIndex, lo, hi []byte, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	keys, err := s.ListIndexKeysContext(ctx, entType, x)
+	if err != nil {
+		return nil, err
+	}
+	// keys are sorted
+	i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], lo) >= 0 })
+	j := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], hi) > 0 })
+	if i >= j {
+		return nil, nil
+	}
+	keys = keys[i:j]
+	if (flags & ent.Reverse) != 0 {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+
+	// GET "type#index:key" ...
+	ids := make([]uint64, len(keys))
+	cmds := make([]radix.CmdAction, len(keys))
+	for i, key := range keys {
+		cmds[i] = makeGETEntIdCmd(s.indexKey(entType, x, key), &ids[i])
+	}
+	if err := s.doReadFlags(ctx, flags, radix.Pipeline(cmds...)); err != nil {
+		return nil, err
+	}
+
+	// skip entries which were removed after the scan
+	n := 0
+	for _, id := range ids {
+		if id != 0 {
+			ids[n] = id
+			n++
+		}
+	}
+	return ids[:n], nil
+}
+
+// Count is part of the ent.Storage interface, used by CountTYPEByINDEX
+func (s *EntStorage) Count(entType string, x *ent.EntIndex, key []byte) (n int, err error) {
+	return s.CountContext(context.Background(), entType, x, key)
+}
+
+// CountContext is part of the ent.ContextStorage interface
+func (s *EntStorage) CountContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte,
+) (n int, err error) {
+	indexKey := s.indexKey(entType, x, key)
+	if x.IsUnique() {
+		// EXISTS "type#index:value"
+		cmd := &RawCmdInt{RawCmd{respMakeStringArray2("EXISTS", indexKey)}, &n}
+		err = s.doReadContext(ctx, cmd)
+	} else {
+		// ZLEXCOUNT "type#index" "[value\xfe" "(value\xff"
+		rangeStart, rangeEnd := makeLexRange(key)
+		data := respMakeStringArray("ZLEXCOUNT", indexKey, rangeStart, rangeEnd)
+		err = s.doReadContext(ctx, &RawCmdInt{RawCmd{data}, &n})
+	}
+	return
+}
+
 // LoadEntsByIndex is part of the ent.Storage interface, used by LoadTYPEByINDEX
 func (s *EntStorage) LoadByIndex(
 	e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, error) {
+	return s.LoadByIndexContext(context.Background(), e, x, key, limit, flags)
+}
+
+// LoadByIndexContext is part of the ent.ContextStorage interface
+func (s *EntStorage) LoadByIndexContext(
+	ctx context.Context, e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
 ) ([]Ent, error) {
 	entType := e.EntTypeName()
 	debugTrace("LoadEntsByIndex %s.%s %q", entType, x.Name, key)
 
-	ids, err := s.FindByIndex(entType, x, key, limit, flags)
+	ids, err := s.FindByIndexContext(ctx, entType, x, key, limit, flags)
 	if err != nil || len(ids) == 0 {
 		// Note: for x.IsUnique(), FindEntIdsByIndex returns ErrNotFound in case nothing is found
 		return nil, err
 	}
 	debugTrace("FindEntIdsByIndex => %v", ids)
-	ents := make([]Ent, 0, len(ids))
+	ents, missing, err := s.loadEntsContext(ctx, e, ids, flags)
+	s.cleanupIndex(ctx, entType, x, key, missing, flags)
+	return ents, err
+}
+
+// LoadByIndexPaged is part of the ent.Storage interface, used by LoadTYPEByINDEXPaged
+func (s *EntStorage) LoadByIndexPaged(
+	e Ent, x *ent.EntIndex, key, cursor []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	return s.LoadByIndexPagedContext(context.Background(), e, x, key, cursor, limit, flags)
+}
+
+// LoadByIndexPagedContext is part of the ent.ContextStorage interface
+func (s *EntStorage) LoadByIndexPagedContext(
+	ctx context.Context, e Ent, x *ent.EntIndex, key, cursor []byte, limit int,
+	flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	entType := e.EntTypeName()
+	var ids []uint64
+	var nextCursor []byte
+	if x.IsUnique() {
+		// at most one ent, unless soft-deleted ents are included
+		found, err := s.FindByIndexContext(
+			ctx, entType, x, key, 0, flags&(ent.IncludeDeleted|ent.Consistent))
+		if err == nil {
+			ids, nextCursor, err = ent.PageIds(found, cursor, limit, flags)
+		}
+		if err != nil {
+			if err == ent.ErrNotFound {
+				err = nil
+			}
+			return nil, nil, err
+		}
+	} else {
+		after, err := ent.ParseIndexCursor(cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+		// ZRANGEBYLEX "type#index" "(value\xfeIDIDIDID" "(value\xff" LIMIT 0 limit+1
+		// where IDIDIDID is the cursor id. The extra entry tells whether there is a next page.
+		rangeStart, rangeEnd := makeLexRange(key)
+		rev := (flags & ent.Reverse) != 0
+		if cursor != nil {
+			b := make([]byte, len(key)+10)
+			b[0] = '('
+			b[1+copy(b[1:], key)] = '\xfe'
+			writeUint64BE(b[len(key)+2:], after)
+			if rev {
+				rangeEnd = b
+			} else {
+				rangeStart = b
+			}
+		}
+		n := limit
+		if n > 0 {
+			n++
+		}
+		find := func(x *ent.EntIndex, flags ent.LookupFlags) ([]uint64, error) {
+			indexKey := s.indexKey(entType, x, nil)
+			cmd := makeZRangeByLexEntIdsCmd(indexKey, rangeStart, rangeEnd, n, rev)
+			err := s.doReadFlags(ctx, flags, cmd)
+			return cmd.Result, err
+		}
+		if (flags & ent.IncludeDeleted) != 0 {
+			ids, err = ent.FindIdsIncludingDeleted(x, n, flags, find)
+		} else {
+			ids, err = find(x, flags)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if limit > 0 && len(ids) > limit {
+			ids = ids[:limit]
+			nextCursor = ent.IndexCursor(ids[limit-1])
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	ents, missing, err := s.loadEntsContext(ctx, e, ids, flags)
+	s.cleanupIndex(ctx, entType, x, key, missing, flags)
+	return ents, nextCursor, err
+}
 
+// loadEntsContext loads ents with ids into e and new ents of the same type as e.
+// Ents which do not exist, for example because they have expired (see CreateExpiring), are left
+// out of the result and their ids are returned as missing. flags may contain ent.Consistent.
+func (s *EntStorage) loadEntsContext(
+	ctx context.Context, e Ent, ids []uint64, flags ent.LookupFlags,
+) (ents []Ent, missing []uint64, err error) {
+	ents = make([]Ent, 0, len(ids))
+	versions := make([]uint64, len(ids))
 	cmds := make([]radix.CmdAction, len(ids))
 	for i, id := range ids {
 		e2 := e
@@ -117,17 +432,67 @@ func (s *EntStorage) LoadByIndex(
 			e2 = e.EntNew()
 		}
 		ents = append(ents, e2)
-		cmds[i] = s.makeEntLoadCmd(e2, id, nil)
+		cmds[i] = s.makeEntLoadCmd(e2, id, &versions[i], true)
+	}
+
+	if err = s.doReadFlags(ctx, flags, radix.Pipeline(cmds...)); err != nil {
+		return nil, nil, err
 	}
 
-	if err = s.doRead(radix.Pipeline(cmds...)); err != nil {
-		err2 := errors.Unwrap(err)
-		if err2 == ent.ErrNotFound {
-			err = err2
+	// remove missing ents
+	n := 0
+	for i, e2 := range ents {
+		if versions[i] == 0 {
+			missing = append(missing, ids[i])
+		} else {
+			ents[n] = e2
+			n++
+		}
+	}
+	ents = ents[:n]
+	if n > 0 && ents[0] != e {
+		// e was not found; load the first ent into e instead
+		if _, err = s.loadById(ctx, e, ents[0].Id(), flags); err != nil {
+			return nil, nil, err
 		}
+		ents[0] = e
 	}
+	return ents, missing, nil
+}
 
-	return ents, err
+// cleanupIndex removes entries of ids, which are known not to exist, from the non-unique index
+// x. This lazily cleans up after ents which have expired (see CreateExpiring.)
+// Errors are ignored since the cleanup is merely an optimization.
+func (s *EntStorage) cleanupIndex(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte, ids []uint64,
+	flags ent.LookupFlags,
+) {
+	if len(ids) == 0 || x.IsUnique() {
+		// stale unique index entries are replaced when the key is used again
+		// (see computeIndexEdits)
+		return
+	}
+	indexKeys := [][]byte{s.indexKey(entType, x, nil)}
+	if (flags & ent.IncludeDeleted) != 0 {
+		// we don't know which of the indexes the entry is in
+		indexKeys = append(indexKeys, s.indexKey(entType, ent.DeletedIndex(x), nil))
+	}
+	cmds := make([]radix.CmdAction, 0, len(ids)*len(indexKeys))
+	for _, indexKey := range indexKeys {
+		for _, id := range ids {
+			cmds = append(cmds, makeZREMIdCmd(indexKey, key, id))
+		}
+	}
+	if x.Score != 0 {
+		for _, id := range ids {
+			cmds = s.appendScoreCmd(cmds, entType, &ent.StorageIndexEdit{
+				Index: x, Key: string(key), IsCleanup: true}, id)
+		}
+	}
+	debugTrace("cleanupIndex %s.%s %q %v", entType, x.Name, key, ids)
+	if err := s.doWriteContext(ctx, radix.Pipeline(cmds...)); err != nil && s.Logger != nil {
+		s.Logger.Warn("index cleanup failure %v", err)
+	}
 }
 
 func (s *EntStorage) IterateEnts(e Ent) ent.EntIterator {
@@ -135,116 +500,294 @@ func (s *EntStorage) IterateEnts(e Ent) ent.EntIterator {
 }
 
 func (s *EntStorage) IterateIds(entType string) ent.IdIterator {
-	return MakeIdIterator(entType, s.Redis)
+	it := &IdIterator{}
+	it.init(entType, s.Redis, s.ScanCount)
+	return it
 }
 
 // SaveEnt is part of the ent.Storage interface, used by TYPE.Save()
+// Only the changed fields are written (HSET); the other fields of the hash are left as is.
+// A field which was cleared is written with its empty value rather than removed with HDEL,
+// since decoding an ent (e.g. in Reload) only sets the fields present in the hash and would
+// otherwise leave a stale value in place of the cleared one.
 func (s *EntStorage) Save(e Ent, fields ent.FieldSet) (nextVersion uint64, err error) {
+	return s.SaveContext(context.Background(), e, fields)
+}
+
+// SaveContext is part of the ent.ContextStorage interface
+func (s *EntStorage) SaveContext(
+	ctx context.Context, e Ent, fields ent.FieldSet,
+) (nextVersion uint64, err error) {
 	prevVersion := e.Version()
 	nextVersion = prevVersion + 1
-	err = s.putEnt(e, e.Id(), prevVersion, nextVersion, fields)
+	err = s.putEnt(ctx, e, e.Id(), prevVersion, nextVersion, fields, 0)
 	return
 }
 
+// Put is part of the ent.Storage interface, used by ent.PutEnt
+func (s *EntStorage) Put(e Ent, id uint64) (version uint64, err error) {
+	return s.PutContext(context.Background(), e, id)
+}
+
+// PutContext is part of the ent.ContextStorage interface.
+// The current version of the ent is read and then the ent is written like with Save, which is
+// retried for as long as the ent is changed or deleted by someone else in the meantime, since
+// the last writer wins with Put (MaxRetries does not apply.)
+// When the ent is created, the id counter is advanced to id if it's lower, so that ids created
+// later do not collide with id.
+func (s *EntStorage) PutContext(ctx context.Context, e Ent, id uint64) (uint64, error) {
+	entKey := s.entKey(e.EntTypeName(), id)
+	for attempt := 0; ; attempt++ {
+		var prevVersion uint64
+		cmd := radix.FlatCmd(
+			&radix.MaybeNil{Rcv: &prevVersion}, "HGET", string(entKey), ent.FieldNameVersion)
+		if err := s.doWriteContext(ctx, cmd); err != nil {
+			return 0, err
+		}
+		if prevVersion == 0 {
+			if err := s.advanceIdCounter(ctx, e.EntTypeName(), id); err != nil {
+				return 0, err
+			}
+		}
+		err := s.putEnt(ctx, e, id, prevVersion, prevVersion+1, e.EntFields().FieldSet, 0)
+		if err == ent.ErrVersionConflict || err == ent.ErrNotFound {
+			debugTrace("Put %q: changed by someone else; retrying (attempt %d)", entKey, attempt+1)
+			continue
+		}
+		return prevVersion + 1, err
+	}
+}
+
+// advanceIdCounter sets the id counter of entType to id if it's lower
+func (s *EntStorage) advanceIdCounter(ctx context.Context, entType string, id uint64) error {
+	cmd := idCounterMaxScript.FlatCmd(nil, []string{s.idCounterKey()}, entType, id)
+	return s.doWriteContext(ctx, cmd)
+}
+
+// saveBatchConcurrency is the number of ents SaveBatch saves at once when the size of the
+// connection pool is unknown, e.g. with OpenCluster or SetClients
+const saveBatchConcurrency = 10
+
+// SaveBatch is part of the ent.BatchSaver interface, used by ent.SaveAll.
+// Each ent is saved with the same checks as Save. Ents are saved concurrently, by as many
+// goroutines as there are connections in the pool (see RedisOptions.PoolSize), while an ent
+// which appears more than once in ents is saved one time after another, in order.
+func (s *EntStorage) SaveBatch(ents []Ent, fields []ent.FieldSet) ([]uint64, []error) {
+	versions := make([]uint64, len(ents))
+	errs := make([]error, len(ents))
+
+	// group the indices of ents by ent, so that each ent is saved by one goroutine
+	var groups [][]int
+	groupOf := make(map[Ent]int, len(ents))
+	for i, e := range ents {
+		if g, ok := groupOf[e]; ok {
+			groups[g] = append(groups[g], i)
+		} else {
+			groupOf[e] = len(groups)
+			groups = append(groups, []int{i})
+		}
+	}
+
+	concurrency := s.opts.PoolSize
+	if concurrency <= 0 {
+		concurrency = saveBatchConcurrency
+	}
+	if concurrency > len(groups) {
+		concurrency = len(groups)
+	}
+	groupch := make(chan []int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for n := 0; n < concurrency; n++ {
+		go func() {
+			defer wg.Done()
+			for g := range groupch {
+				for _, i := range g {
+					versions[i], errs[i] = s.SaveContext(context.Background(), ents[i], fields[i])
+				}
+			}
+		}()
+	}
+	for _, g := range groups {
+		groupch <- g
+	}
+	close(groupch)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return versions, errs
+		}
+	}
+	return versions, nil
+}
+
 // CreateEnt is part of the ent.Storage interface, used by TYPE.Create()
 func (s *EntStorage) Create(e ent.Ent, fields ent.FieldSet) (id uint64, err error) {
+	return s.CreateContext(context.Background(), e, fields)
+}
+
+// CreateContext is part of the ent.ContextStorage interface
+func (s *EntStorage) CreateContext(
+	ctx context.Context, e ent.Ent, fields ent.FieldSet,
+) (id uint64, err error) {
+	return s.create(ctx, e, fields, 0)
+}
+
+// create creates e. If ttl is larger than zero, the ent expires after ttl.
+func (s *EntStorage) create(
+	ctx context.Context, e ent.Ent, fields ent.FieldSet, ttl time.Duration,
+) (id uint64, err error) {
 	id = e.Id()
 	if id == 0 {
 		// generate new ent id
 		// note: HINCRBY never yields 0, so we can use 0 to signify "no id"
-		if err = s.doWrite(radix.FlatCmd(&id, "HINCRBY", "entid", e.EntTypeName(), 1)); err != nil {
+		cmd := radix.FlatCmd(&id, "HINCRBY", s.idCounterKey(), e.EntTypeName(), 1)
+		if err = s.doWriteContext(ctx, cmd); err != nil {
 			return
 		}
 	}
-	return id, s.putEnt(e, id, 0, 1, fields)
+	return id, s.putEnt(ctx, e, id, 0, 1, fields, ttl)
 }
 
+// putEnt writes e to redis. If ttl is larger than zero, the ent and its unique index entries
+// expire after ttl (see CreateExpiring.)
 func (s *EntStorage) putEnt(
-	e ent.Ent, id, prevVersion, nextVersion uint64, fields ent.FieldSet,
+	ctx context.Context, e ent.Ent, id, prevVersion, nextVersion uint64, fields ent.FieldSet,
+	ttl time.Duration,
 ) error {
 	entType := e.EntTypeName()
-	entKey := makeEntKey(entType, id)
+	entKey := s.entKey(entType, id)
 
 	debugTrace("putEnt %q key=%q fields=%b (version %d -> %d)",
 		entType, entKey, fields, prevVersion, nextVersion)
 
 	// HSET fields
 	// respWriter := RWriter{buf: make([]byte, 0, 128)}
-	respData, err := encodeEntHSET(e, make([]byte, 0, 128), entKey, nextVersion, fields)
+	var respData []byte
+	var packedFields ent.FieldSet
+	var err error
+	if s.Compression != ent.NoCompression {
+		respData, packedFields, err = encodeEntHSETCompressed(
+			e, make([]byte, 0, 128), entKey, nextVersion, fields, s.Compression)
+	} else {
+		respData, err = encodeEntHSET(e, make([]byte, 0, 128), entKey, nextVersion, fields)
+	}
 	if err != nil {
 		return err
 	}
 
-	// cmds holds all "write" commands, to be run inside a MULTI (pipelined)
-	cmds := make([]radix.CmdAction, 2, 16) // commands to perform in MULTI
-	cmds[0] = &CmdMULTI
-	cmds[1] = &RawCmd{respData}
+	// entCmds holds the commands which write the ent itself
+	entCmds := []radix.CmdAction{&RawCmd{respData}}
+	if packedFields != 0 {
+		// remove any uncompressed copies of fields, e.g. written before compression was enabled
+		entCmds = append(entCmds, makeHDELFieldsCmd(entKey, e, packedFields))
+	}
 
-	// watchKeys contains all keys watched
-	watchKeys := make([][]byte, 1, 16)
-	watchKeys[0] = entKey
+	if s.ScriptedWrites {
+		return s.putEntScripted(ctx, e, id, entKey, prevVersion, fields, ttl, entCmds)
+	}
 
-	// pick a redis connection to the write client, with automatic "WATCH entKey"
-	err = s.entBatchWrite(entKey, func(c radix.Conn) (err error) {
-		// In case we are performing an update (e.g. SaveEnt) load current version of the ent
-		var currEnt ent.Ent
-		if prevVersion != 0 {
-			currEnt = e.EntNew()
-			currVersion, err := s.loadEntPartial(c, currEnt, entKey, fields)
-			debugTrace("loadEntPartial %q => version=%v %+v", entKey, currVersion, currEnt)
+	// cmds holds all "write" commands, to be run inside a MULTI (pipelined)
+	var cmds []radix.CmdAction
+
+	for attempt := 0; ; attempt++ {
+		cmds = make([]radix.CmdAction, 1, 16) // commands to perform in MULTI
+		cmds[0] = &CmdMULTI
+		cmds = append(cmds, entCmds...)
+
+		// watchKeys contains all keys watched
+		watchKeys := make([][]byte, 1, 16)
+		watchKeys[0] = entKey
+
+		exec := &txExecCmd{RawCmd: CmdEXEC}
+
+		// pick a redis connection to the write client, with automatic "WATCH entKey"
+		err = s.entBatchWrite(ctx, entKey, func(c radix.Conn) (err error) {
+			// In case we are performing an update (e.g. SaveEnt) load current version of the ent
+			var currEnt ent.Ent
+			var revs map[string][]byte
+			if prevVersion != 0 {
+				currEnt = e.EntNew()
+				var currVersion uint64
+				currVersion, revs, err = s.loadEntPartialRev(c, currEnt, id, entKey, fields)
+				debugTrace("loadEntPartial %q => version=%v %+v", entKey, currVersion, currEnt)
+				if err != nil {
+					return err
+				} else if currVersion == 0 {
+					// Ent has been deleted since the receiver was loaded.
+					// Caller should either call Create() to re-create the ent or abort the Save operation.
+					return ent.ErrNotFound
+				} else if prevVersion != currVersion {
+					// ent has changed since the receiver was loaded.
+					// The caller should Reload() and retry Save() (or Load() & merge.)
+					return ent.ErrVersionConflict
+				}
+			}
+
+			// update indexes
+			err = s.computeIndexEdits(currEnt, e, id, fields, &cmds, &watchKeys,
+				func(key []byte, cmd radix.CmdAction) error {
+					// Perform command right now. We watch the key since
+					debugTrace(">> WATCH %s; %+v", key, cmd)
+					return c.Do(radix.Pipeline(MakeSingleKeyCmd("WATCH", key), cmd))
+				}, revs, nil)
 			if err != nil {
-				return err
-			} else if currVersion == 0 {
-				// Ent has been deleted since the receiver was loaded.
-				// Caller should either call Create() to re-create the ent or abort the Save operation.
-				return ent.ErrNotFound
-			} else if prevVersion != currVersion {
-				// ent has changed since the receiver was loaded.
-				// The caller should Reload() and retry Save() (or Load() & merge.)
-				return ent.ErrVersionConflict
+				return
 			}
-		}
 
-		// update indexes
-		err = s.computeIndexEdits(currEnt, e, id, fields, &cmds, &watchKeys,
-			func(key []byte, cmd radix.CmdAction) error {
-				// Perform command right now. We watch the key since
-				debugTrace(">> WATCH %s; %+v", key, cmd)
-				return c.Do(radix.Pipeline(MakeSingleKeyCmd("WATCH", key), cmd))
-			})
-		if err != nil {
-			return
-		}
+			// prepend watch to cmds, unless only the ent key, which we watched separately, is watched
+			if len(watchKeys) > 1 {
+				cmds = prependWATCH(cmds, watchKeys)
+			}
 
-		// prepend watch to cmds, skipping the first that we issued separately
-		if len(watchKeys) > 1 {
-			cmds2 := make([]radix.CmdAction, len(cmds)+1, len(cmds)+2) // extra space for WATCH and EXEC
-			cmds2[0] = MakeBulkStringCmd("WATCH", watchKeys...)
-			for i := 1; i < len(cmds); i++ {
-				for i, cmd := range cmds {
-					cmds2[i+1] = cmd
+			// set expiration time of the ent and its unique index entries
+			if ttl > 0 {
+				for _, key := range watchKeys {
+					cmds = append(cmds, makePEXPIRECmd(key, ttl))
 				}
 			}
-			cmds = cmds2
-		}
 
-		// finally, append EXEC to cmds
-		cmds = append(cmds, &CmdEXEC)
+			// finally, append EXEC to cmds
+			cmds = append(cmds, exec)
 
-		// Perform cmds pipelined, meaning all commands are sent in one go, then all responses are
-		// read in one go, instead of write,read,write,read...
-		// First cmd is MULTI.
-		debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
-		err = c.Do(radix.Pipeline(cmds...))
-		return
-	}) // END s.entBatchWrite
+			// Perform cmds pipelined, meaning all commands are sent in one go, then all responses are
+			// read in one go, instead of write,read,write,read...
+			// First cmd is MULTI.
+			debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
+			err = c.Do(radix.Pipeline(cmds...))
+			return
+		}) // END s.entBatchWrite
+
+		if err == nil && exec.aborted {
+			// A watched key was changed by someone else. In case it was the ent itself, the next
+			// attempt fails with ent.ErrVersionConflict when loading its current version.
+			if attempt < s.MaxRetries {
+				debugTrace("EXEC aborted; retrying (attempt %d)", attempt+1)
+				continue
+			}
+			err = ent.ErrVersionConflict
+		}
+		break
+	}
+
+	return s.endPutEnt(ctx, e, id, fields, cmds, err)
+}
 
+// endPutEnt completes putEnt with err, the result of running the write commands cmds
+func (s *EntStorage) endPutEnt(
+	ctx context.Context, e ent.Ent, id uint64, fields ent.FieldSet, cmds []radix.CmdAction,
+	err error,
+) error {
 	if err != nil {
-		// Note: In case an index changes from unique to non-unique, or vice versa, we get this error:
+		// In case the key of an index holds a value of another type than expected, e.g. when an
+		// index has changed from unique to non-unique or vice versa, we get this error:
 		//   "WRONGTYPE Operation against a key holding the wrong kind of value"
-		// E.g. the "enttype:indexname" is either a Z or a H which are incompatible.
-		// TODO: consider either migration code for this case, or at least detect it and produce a
-		// better error message.
+		// Find out which index it is to produce a better error.
+		if isWrongTypeErr(err) {
+			if err2 := s.findIndexTypeChange(ctx, e, id, fields); err2 != nil {
+				return err2
+			}
+		}
 		return err
 	}
 
@@ -268,20 +811,142 @@ func (s *EntStorage) putEnt(
 
 // DeleteEnt is part of the ent.Storage interface, used by TYPE.PermanentlyDelete()
 func (s *EntStorage) Delete(e ent.Ent, id uint64) error {
+	return s.DeleteContext(context.Background(), e, id)
+}
+
+// DeleteContext is part of the ent.ContextStorage interface
+func (s *EntStorage) DeleteContext(ctx context.Context, e ent.Ent, id uint64) error {
 	if id == 0 {
 		return fmt.Errorf("attempt to delete non-existing %s (id 0)", e.EntTypeName())
 	}
-	entKey := makeEntKey(e.EntTypeName(), id)
+	entKey := s.entKey(e.EntTypeName(), id)
 	debugTrace("DeleteEnt #%d %q", id, entKey)
 	if len(e.EntIndexes()) == 0 {
-		return s.deleteEntWithoutIndexes(entKey)
+		return s.deleteEntWithoutIndexes(ctx, entKey)
+	}
+	return s.deleteEntWithIndexes(ctx, e, id, entKey)
+}
+
+// DeleteByIndex is part of the ent.Storage interface, used by DeleteTYPEByINDEX
+func (s *EntStorage) DeleteByIndex(e ent.Ent, x *ent.EntIndex, key []byte) (int, error) {
+	return s.DeleteByIndexContext(context.Background(), e, x, key)
+}
+
+// DeleteByIndexContext is part of the ent.ContextStorage interface.
+// All matching ents are deleted in a single MULTI/EXEC. If any of them is changed by someone
+// else while doing so, ent.ErrVersionConflict is returned and no ents are deleted.
+func (s *EntStorage) DeleteByIndexContext(
+	ctx context.Context, e ent.Ent, x *ent.EntIndex, key []byte,
+) (int, error) {
+	ids, err := s.FindByIndexContext(ctx, e.EntTypeName(), x, key, 0, 0)
+	if err != nil || len(ids) == 0 {
+		if err == ent.ErrNotFound {
+			err = nil
+		}
+		return 0, err
+	}
+	return s.deleteEnts(ctx, e, ids)
+}
+
+// DeleteAllOfType is part of the ent.BulkDeleter interface, used by ent.DeleteAllEntsOfType
+func (s *EntStorage) DeleteAllOfType(prototype Ent) error {
+	return s.DeleteAllOfTypeContext(context.Background(), prototype)
+}
+
+// DeleteAllOfTypeContext is a variant of DeleteAllOfType which accepts a context.
+// The keys of the ents and of their indexes are found with SCAN and each batch of keys found is
+// deleted with DEL. This is not atomic: an ent created while the keys are being deleted may or
+// may not be deleted.
+func (s *EntStorage) DeleteAllOfTypeContext(ctx context.Context, prototype Ent) error {
+	keyType := []byte(s.keyType(prototype.EntTypeName()))
+	return s.batchContext(ctx, keyType, func(c radix.Conn) error {
+		// ent keys "type:id", then keys of indexes "type#index..."
+		for _, sep := range []byte{entKeySep, entIndexKeySep} {
+			if err := s.scanDel(c, append(globEscape(keyType), sep, '*')); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanDel deletes all keys matching the glob pattern match, found with SCAN
+func (s *EntStorage) scanDel(c radix.Conn, match []byte) error {
+	count := scanCountArg(s.ScanCount)
+	rwc, roc := s.clients()
+	// SCAN cursor MATCH match [COUNT count]
+	cmd := &indexKeysCmd{unique: true, cursor: []byte{'0'}}
+	for cmd.cursor != nil {
+		cmd.Result = nil
+		cmd.RawCmd.Data = makeSCANCmd(cmd.cursor, match, count)
+		if err := c.Do(cmd); err != nil {
+			return err
+		}
+		if len(cmd.Result) == 0 {
+			continue
+		}
+		del := MakeBulkStringCmd("DEL", cmd.Result...)
+		if err := c.Do(del); err != nil {
+			return err
+		}
+		if roc != nil && roc != rwc {
+			// update write-through cache
+			if err := roc.Do(del); err != nil && s.Logger != nil {
+				s.Logger.Warn("write-through cache failure %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RebuildIndexes is part of the ent.IndexRebuilder interface, used by ent.RebuildIndexes
+func (s *EntStorage) RebuildIndexes(prototype Ent) error {
+	return s.RebuildIndexesContext(context.Background(), prototype)
+}
+
+// RebuildIndexesContext is a variant of RebuildIndexes which accepts a context.
+// The keys of the indexes are found with SCAN and deleted with DEL, like by DeleteAllOfType,
+// after which the index entries of each ent are written again. This is not atomic: lookups
+// made while the indexes are being rebuilt may not find all ents.
+func (s *EntStorage) RebuildIndexesContext(ctx context.Context, prototype Ent) error {
+	keyType := []byte(s.keyType(prototype.EntTypeName()))
+	err := s.batchContext(ctx, keyType, func(c radix.Conn) error {
+		// keys of indexes "type#index..."
+		return s.scanDel(c, append(globEscape(keyType), entIndexKeySep, '*'))
+	})
+	if err != nil {
+		return err
+	}
+	it := s.IterateEnts(prototype.EntNew())
+	for e := prototype.EntNew(); it.Next(e); e = prototype.EntNew() {
+		if err := s.writeIndexEntries(ctx, e); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// writeIndexEntries adds the entries of e to its indexes, which are assumed to not have any
+// entries of e (see RebuildIndexes)
+func (s *EntStorage) writeIndexEntries(ctx context.Context, e Ent) error {
+	fields := e.EntFields().FieldSet
+	var cmds []radix.CmdAction
+	var watchKeys [][]byte
+	err := s.computeIndexEdits(nil, e, e.Id(), fields, &cmds, &watchKeys,
+		func(key []byte, cmd radix.CmdAction) error {
+			return s.doWriteContext(ctx, cmd)
+		}, nil, nil)
+	if err != nil || len(cmds) == 0 {
+		return err
 	}
-	return s.deleteEntWithIndexes(e, id, entKey)
+	debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
+	err = s.doWriteContext(ctx, radix.Pipeline(cmds...))
+	return s.endPutEnt(ctx, e, e.Id(), fields, cmds, err)
 }
 
-func (s *EntStorage) deleteEntWithoutIndexes(entKey []byte) error {
+func (s *EntStorage) deleteEntWithoutIndexes(ctx context.Context, entKey []byte) error {
 	cmd := MakeSingleKeyCmd("DEL", entKey)
-	err := s.WClient().Do(cmd)
+	err := s.doWriteContext(ctx, cmd)
 	if err == nil && s.WClient() != s.RClient() {
 		// update write-through cache
 		err := s.RClient().Do(cmd)
@@ -292,7 +957,9 @@ func (s *EntStorage) deleteEntWithoutIndexes(entKey []byte) error {
 	return err
 }
 
-func (s *EntStorage) deleteEntWithIndexes(e ent.Ent, id uint64, entKey []byte) error {
+func (s *EntStorage) deleteEntWithIndexes(
+	ctx context.Context, e ent.Ent, id uint64, entKey []byte,
+) error {
 	allfields := e.EntFields().FieldSet
 	indexes := e.EntIndexes()
 	watchKeys := make([][]byte, 1, 1+len(indexes))
@@ -318,7 +985,7 @@ func (s *EntStorage) deleteEntWithIndexes(e ent.Ent, id uint64, entKey []byte) e
 	cmds[2] = MakeSingleKeyCmd("DEL", entKey)
 
 	// pick a redis connection to the write client, with automatic "WATCH entKey"
-	err := s.entBatchWrite(entKey, func(c radix.Conn) (err error) {
+	err := s.entBatchWrite(ctx, entKey, func(c radix.Conn) (err error) {
 		// Before continuing, make sure all indexed fields are loaded and up to date in the prevEnt.
 		// This is important since the way we clean up indexes is by comparing the current value.
 		if _, err = s.loadEntPartial(c, e, entKey, allfields); err != nil {
@@ -327,7 +994,8 @@ func (s *EntStorage) deleteEntWithIndexes(e ent.Ent, id uint64, entKey []byte) e
 		// ent.SetEntBaseFieldsAfterLoad(e, s, id, version)
 
 		// compute index cleanup
-		if err = s.computeIndexEdits(e, nil, id, allfields, &cmds, &watchKeys, nil); err != nil {
+		err = s.computeIndexEdits(e, nil, id, allfields, &cmds, &watchKeys, nil, nil, nil)
+		if err != nil {
 			return
 		}
 
@@ -362,8 +1030,109 @@ func (s *EntStorage) deleteEntWithIndexes(e ent.Ent, id uint64, entKey []byte) e
 	return err
 }
 
-func (s *EntStorage) entBatchWrite(entKey []byte, f func(radix.Conn) error) error {
-	return s.Batch(func(c radix.Conn) (err error) {
+// deleteEnts deletes ents of the type of e with ids, including their index entries.
+// Returns the number of ents deleted, which excludes ents that do not exist.
+func (s *EntStorage) deleteEnts(ctx context.Context, e ent.Ent, ids []uint64) (int, error) {
+	allfields := e.EntFields().FieldSet
+	entKeys := make([][]byte, len(ids))
+	for i, id := range ids {
+		entKeys[i] = s.entKey(e.EntTypeName(), id)
+	}
+
+	// redis commands we will issue:
+	//
+	//   1. WATCH entKey...
+	//
+	//   2. HMGET entKey ... (loadEntPartial, for each ent)
+	//
+	//   3. (pipelined)
+	//      WATCH indexKey...
+	//      MULTI
+	//      (for each ent)
+	//         DEL entKey
+	//         (for each index)
+	//            ZREM indexKey entry
+	//      EXEC
+	//
+	cmds := make([]radix.CmdAction, 2, 3+len(ids)*(1+len(e.EntIndexes())))
+	// cmds[0] = reserved for WATCH
+	cmds[1] = &CmdMULTI
+	var watchKeys [][]byte
+	exec := &txExecCmd{RawCmd: CmdEXEC}
+	n := 0
+
+	err := s.batchContext(ctx, entKeys[0], func(c radix.Conn) (err error) {
+		debugTrace(">> WATCH %q", entKeys)
+		if err = c.Do(MakeBulkStringCmd("WATCH", entKeys...)); err != nil {
+			return
+		}
+
+		// UNWATCH in case of error or when there's nothing to delete
+		defer func() {
+			if err != nil || n == 0 {
+				debugTrace(">> UNWATCH (reason: %v)", err)
+				c.Do(&CmdUNWATCH)
+			}
+		}()
+
+		for i, id := range ids {
+			e2 := e.EntNew()
+			var version uint64
+			if version, err = s.loadEntPartial(c, e2, entKeys[i], allfields); err != nil {
+				return
+			}
+			if version == 0 {
+				continue // not found
+			}
+			n++
+			cmds = append(cmds, MakeSingleKeyCmd("DEL", entKeys[i]))
+			err = s.computeIndexEdits(e2, nil, id, allfields, &cmds, &watchKeys, nil, nil, nil)
+			if err != nil {
+				return
+			}
+		}
+		if n == 0 {
+			return
+		}
+
+		// WATCH
+		if len(watchKeys) == 0 {
+			cmds = cmds[1:]
+		} else {
+			cmds[0] = MakeBulkStringCmd("WATCH", watchKeys...)
+		}
+
+		// EXEC
+		cmds = append(cmds, exec)
+
+		debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
+
+		// perform redis commands
+		if err = c.Do(radix.Pipeline(cmds...)); err == nil && exec.aborted {
+			// a watched key was modified
+			err = ent.ErrVersionConflict
+		}
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// update write-through cache
+	if n > 0 && s.WClient() != s.RClient() {
+		err := s.RClient().Do(radix.Pipeline(cmds...))
+		if err != nil && s.Logger != nil {
+			s.Logger.Warn("write-through cache failure %v", err)
+		}
+	}
+
+	return n, nil
+}
+
+func (s *EntStorage) entBatchWrite(
+	ctx context.Context, entKey []byte, f func(radix.Conn) error,
+) error {
+	return s.batchContext(ctx, entKey, func(c radix.Conn) (err error) {
 		// WATCH the ent entry key for changes by other clients (e.g. "typename:id")
 		debugTrace(">> WATCH %s", entKey)
 		if err = c.Do(MakeSingleKeyCmd("WATCH", entKey)); err != nil {
@@ -384,6 +1153,18 @@ func (s *EntStorage) entBatchWrite(entKey []byte, f func(radix.Conn) error) erro
 	})
 }
 
+// prependWATCH returns a copy of cmds with a WATCH of keys in front, with room for EXEC
+func prependWATCH(cmds []radix.CmdAction, keys [][]byte) []radix.CmdAction {
+	cmds2 := make([]radix.CmdAction, len(cmds)+1, len(cmds)+2)
+	cmds2[0] = MakeBulkStringCmd("WATCH", keys...)
+	copy(cmds2[1:], cmds)
+	return cmds2
+}
+
+// computeIndexEdits appends the commands which update the index entries of an ent changing
+// from prevEnt to nextEnt to *cmdsPtr. claims, if not nil, tracks the unique index keys written
+// by earlier commands of the same transaction (see Tx.commit): it maps a key to the id of the
+// ent which has claimed it, or to 0 if the key's entry has been deleted.
 func (s *EntStorage) computeIndexEdits(
 	prevEnt, nextEnt Ent,
 	id uint64,
@@ -391,8 +1172,13 @@ func (s *EntStorage) computeIndexEdits(
 	cmdsPtr *[]radix.CmdAction,
 	watchKeysPtr *[][]byte,
 	doNow func(key []byte, cmd radix.CmdAction) error, // only needed when nextEnt!=nil
+	revs map[string][]byte, // previous entries of indexes with a reverse lookup (loadEntPartialRev)
+	claims map[string]uint64,
 ) error {
 	indexEdits, err := ent.ComputeIndexEdits(nil, prevEnt, nextEnt, id, fields)
+	if err == nil && len(revs) > 0 {
+		indexEdits, err = revLookupIndexEdits(indexEdits, revs, nextEnt, id, fields)
+	}
 	if err != nil {
 		return err
 	}
@@ -407,18 +1193,46 @@ func (s *EntStorage) computeIndexEdits(
 		entType = prevEnt.EntTypeName()
 	}
 
+	// roEnt is the ent to use for read-only operations
+	roEnt := nextEnt
+	if roEnt == nil {
+		roEnt = prevEnt
+	}
+
 	debugTrace("indexEdits: %+v", indexEdits)
-	for _, ed := range indexEdits {
-		indexKey := makeIndexKey(entType, ed.Index, []byte(ed.Key))
+	for i := range indexEdits {
+		ed := &indexEdits[i]
+		if ed.Index.HasReverseLookup() {
+			if !ed.IsCleanup {
+				// SET "foo#kind#rev:XXXXXXXXXXXXXXXX" "0kind"
+				revKey, cmd := s.makeRevLookupSETCmd(roEnt, ed, id)
+				cmds = append(cmds, cmd)
+				watchKeys = append(watchKeys, revKey)
+			} else if !hasIndexAddEdit(roEnt, indexEdits, ed.Index) {
+				// the ent no longer has an entry in the index
+				x, _ := revLookupIndex(roEnt, ed.Index)
+				cmds = append(cmds, MakeSingleKeyCmd("DEL", s.revLookupKey(entType, x, id)))
+			}
+		}
+		indexKey := s.indexKey(entType, ed.Index, []byte(ed.Key))
 		if ed.IsCleanup {
 			if ed.Index.IsUnique() {
 				// DEL "foo#email:robin@gmail.com"
 				// Note: DEL returns an integer of the number of entries deleted (0 or 1) but we
 				// don't care about that.
 				cmds = append(cmds, MakeSingleKeyCmd("DEL", indexKey))
+				if claims != nil {
+					// free the key for later ops of the transaction, unless another ent claimed it
+					if claimedId, ok := claims[string(indexKey)]; !ok || claimedId == id {
+						claims[string(indexKey)] = 0
+					}
+				}
 			} else {
 				// ZREM foo#email 0 "robin@gmail.com\xfe123"
 				cmds = append(cmds, makeZREMIdCmd(indexKey, []byte(ed.Key), id))
+				if ed.Index.Score != 0 {
+					cmds = s.appendScoreCmd(cmds, entType, ed, id)
+				}
 			}
 		} else {
 			if ed.Index.IsUnique() {
@@ -429,17 +1243,51 @@ func (s *EntStorage) computeIndexEdits(
 				if err := doNow(indexKey, GETEntId); err != nil {
 					return err
 				}
-				if existingId == 0 {
+				if claimedId, ok := claims[string(indexKey)]; ok {
+					// the key was written earlier in the transaction
+					if claimedId != 0 && claimedId != id {
+						return &ent.IndexConflictErr{
+							Underlying:  ent.ErrUniqueConflict,
+							EntTypeName: entType,
+							IndexName:   ed.Index.Name,
+							Key:         ed.Key,
+							ExistingId:  claimedId,
+						}
+					}
+					// the entry is deleted before this command, or is already the ent's own
+					cmds = append(cmds, makeSETIdCmd(indexKey, id))
+				} else if existingId == 0 {
 					cmds = append(cmds, makeSETNXIdCmd(indexKey, id))
 				} else if existingId != id {
-					return &ent.IndexConflictErr{
-						Underlying:  ent.ErrUniqueConflict,
-						EntTypeName: entType,
-						IndexName:   ed.Index.Name,
+					// The index entry may be stale, left behind by an ent which has expired
+					// (see CreateExpiring), in which case we take it over. The ent key is watched
+					// (like in findStaleIndexKeys) in case the ent is written again before EXEC.
+					var exists int
+					existingEntKey := s.entKey(entType, existingId)
+					watchKeys = append(watchKeys, existingEntKey)
+					EXISTS := &RawCmdInt{RawCmd{respMakeStringArray2("EXISTS", existingEntKey)}, &exists}
+					if err := doNow(existingEntKey, EXISTS); err != nil {
+						return err
 					}
+					if exists != 0 {
+						return &ent.IndexConflictErr{
+							Underlying:  ent.ErrUniqueConflict,
+							EntTypeName: entType,
+							IndexName:   ed.Index.Name,
+							Key:         ed.Key,
+							ExistingId:  existingId,
+						}
+					}
+					cmds = append(cmds, makeSETIdCmd(indexKey, id))
+				}
+				if claims != nil {
+					claims[string(indexKey)] = id
 				}
 			} else {
 				cmds = append(cmds, makeZADDIdCmd(indexKey, []byte(ed.Key), id))
+				if ed.Index.Score != 0 {
+					cmds = s.appendScoreCmd(cmds, entType, ed, id)
+				}
 			}
 		}
 	} // end of update index
@@ -449,11 +1297,62 @@ func (s *EntStorage) computeIndexEdits(
 	return nil
 }
 
+// isWrongTypeErr returns true if err is a redis WRONGTYPE error
+func isWrongTypeErr(err error) bool {
+	return strings.Contains(err.Error(), "WRONGTYPE")
+}
+
+// findIndexTypeChange checks the keys of the indexes of e for fields. It returns an
+// ent.IndexConflictErr with ent.ErrIndexTypeChanged for the first index which key holds a value
+// of another type than what the index uses, i.e. a string for unique indexes and a sorted set
+// for others. Returns nil if there is no such index.
+func (s *EntStorage) findIndexTypeChange(
+	ctx context.Context, e Ent, id uint64, fields ent.FieldSet,
+) error {
+	indexEdits, err := ent.ComputeIndexEdits(nil, nil, e, id, fields)
+	if err != nil || len(indexEdits) == 0 {
+		return err
+	}
+	entType := e.EntTypeName()
+	types := make([]string, len(indexEdits))
+	cmds := make([]radix.CmdAction, len(indexEdits))
+	for i, ed := range indexEdits {
+		indexKey := s.indexKey(entType, ed.Index, []byte(ed.Key))
+		cmds[i] = radix.Cmd(&types[i], "TYPE", string(indexKey))
+	}
+	if err := s.doWriteContext(ctx, radix.Pipeline(cmds...)); err != nil {
+		return err
+	}
+	for i, ed := range indexEdits {
+		expectedType := "zset"
+		if ed.Index.IsUnique() {
+			expectedType = "string"
+		}
+		if types[i] != "none" && types[i] != expectedType {
+			return &ent.IndexConflictErr{
+				Underlying:  ent.ErrIndexTypeChanged,
+				EntTypeName: entType,
+				IndexName:   ed.Index.Name,
+			}
+		}
+	}
+	return nil
+}
+
 // loadEntPartial
 // Note: If an ent is not found, this returns version=0 (it does NOT return ent.ErrNotFound)
 func (s *EntStorage) loadEntPartial(
 	c radix.Conn, e Ent, entKey []byte, fields ent.FieldSet,
 ) (version uint64, err error) {
+	err = c.Do(makeEntPartialLoadCmd(e, entKey, fields, &version))
+	return
+}
+
+// makeEntPartialLoadCmd returns a HMGET command which decodes fields of e and stores the
+// version in versionOut (see loadEntPartial)
+func makeEntPartialLoadCmd(
+	e Ent, entKey []byte, fields ent.FieldSet, versionOut *uint64,
+) radix.CmdAction {
 	// list of keys to fetch
 	keys := make([]string, 1, fields.Len()+1)
 	keys[0] = ent.FieldNameVersion
@@ -462,8 +1361,7 @@ func (s *EntStorage) loadEntPartial(
 			keys = append(keys, fieldName)
 		}
 	}
-	// communicate with redis
-	err = c.Do(&RCmd{
+	return &RCmd{
 		func(w *RIOWriter) error {
 			// encode query
 			w.ArrayHeader(len(keys) + 2)
@@ -486,7 +1384,7 @@ func (s *EntStorage) loadEntPartial(
 				RReader: r,
 				keys:    keys,
 			}
-			version = e.EntDecodePartial(&c, fields)
+			*versionOut = e.EntDecodePartial(&c, fields)
 
 			// discard any remaining unread values
 			for n > c.nread {
@@ -495,14 +1393,38 @@ func (s *EntStorage) loadEntPartial(
 			}
 			return nil
 		},
-	})
-	return
+	}
 }
 
 // func makeEntKeyPrefix(entTypeName string) []byte {
 // 	return append([]byte(entTypeName), entKeySep)
 // }
 
+// keyType returns the ent type name as it appears in keys; wrapped in a hash tag if r.HashTags
+// and prefixed by r.KeyPrefix
+func (r *Redis) keyType(entType string) string {
+	if r.HashTags {
+		return r.KeyPrefix + "{" + entType + "}"
+	}
+	return r.KeyPrefix + entType
+}
+
+// idCounterKey returns the redis storage key of the hash which holds the last id allocated
+// for each ent type
+func (r *Redis) idCounterKey() string {
+	return r.KeyPrefix + "entid"
+}
+
+// entKey returns the redis storage key for an ent
+func (r *Redis) entKey(entType string, id uint64) []byte {
+	return makeEntKey(r.keyType(entType), id)
+}
+
+// indexKey returns the redis storage key for an index (see makeIndexKey)
+func (r *Redis) indexKey(entType string, x *ent.EntIndex, entryKey []byte) []byte {
+	return makeIndexKey(r.keyType(entType), x, entryKey)
+}
+
 // makeEntKey returns the canonical redis storage key for an ent
 func makeEntKey(entTypeName string, id uint64) []byte {
 	// Zero padded ID so that ents are ordered by creation time.
@@ -562,7 +1484,9 @@ func makeGETEntIdCmd(key []byte, idOut *uint64) *RawCmdHexUint {
 }
 
 // encodeEntHSET writes a HSET command on w with all fields for e.
+// Empty field values are written too (see Save.)
 // If version is not zero, then the ent.FieldNameVersion field is written as well.
+// If e tracks field versions, the ent.FieldNameFieldVersions field is always written.
 func encodeEntHSET(
 	e Ent, buf, entKey []byte, version uint64, fields ent.FieldSet,
 ) ([]byte, error) {
@@ -570,16 +1494,81 @@ func encodeEntHSET(
 	if version != 0 {
 		nfields++
 	}
+	if _, ok := e.(ent.FieldVersionTracker); ok {
+		nfields++
+	}
 	c := EntEncoder{buf: buf[:0]}
 	c.BeginHSET(entKey, nfields)
 	if version != 0 {
 		c.Str(ent.FieldNameVersion)
 		c.Uint(version, 64)
 	}
+	ent.EncodeFieldVersions(e, &c)
 	e.EntEncode(&c, fields)
 	return c.Buffer(), c.err
 }
 
+// encodeEntHSETCompressed is a variant of encodeEntHSET which stores all non-indexed fields
+// compressed in the entCompressedFieldsKey field. Since the compressed fields are written as a
+// whole, they are only written when at least one of them is in fields.
+// packedFields is the set of fields written in compressed form.
+func encodeEntHSETCompressed(
+	e Ent, buf, entKey []byte, version uint64, fields ent.FieldSet, compression ent.Compression,
+) (data []byte, packedFields ent.FieldSet, err error) {
+	var indexedFields ent.FieldSet
+	for _, x := range e.EntIndexes() {
+		indexedFields |= x.Fields | x.Where
+	}
+	if fields&^indexedFields != 0 {
+		packedFields = e.EntFields().FieldSet &^ indexedFields
+	}
+
+	// encode packed fields as a RESP array of key-value pairs, then compress it
+	var packed []byte
+	if packedFields != 0 {
+		c := EntEncoder{buf: respAppendArrayHeader(make([]byte, 0, 128), packedFields.Len()*2)}
+		e.EntEncode(&c, packedFields)
+		if c.err != nil {
+			return nil, 0, c.err
+		}
+		if packed, err = ent.CompressData(c.buf, compression); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	fields &= indexedFields
+	nfields := fields.Len() + 1 // +1 for version
+	if _, ok := e.(ent.FieldVersionTracker); ok {
+		nfields++
+	}
+	if packed != nil {
+		nfields++
+	}
+	c := EntEncoder{buf: buf[:0]}
+	c.BeginHSET(entKey, nfields)
+	c.Str(ent.FieldNameVersion)
+	c.Uint(version, 64)
+	ent.EncodeFieldVersions(e, &c)
+	if packed != nil {
+		c.Str(entCompressedFieldsKey)
+		c.Blob(packed)
+	}
+	e.EntEncode(&c, fields)
+	return c.Buffer(), packedFields, c.err
+}
+
+// makeHDELFieldsCmd creates a RawCmd{ HDEL entKey field ... } for the names of fields
+func makeHDELFieldsCmd(entKey []byte, e Ent, fields ent.FieldSet) *RawCmd {
+	names := make([][]byte, 1, fields.Len()+1)
+	names[0] = entKey
+	for fieldIndex, fieldName := range e.EntFields().Names {
+		if fields.Has(fieldIndex) {
+			names = append(names, []byte(fieldName))
+		}
+	}
+	return MakeBulkStringCmd("HDEL", names...)
+}
+
 // decodeEnt reads the result of a HGETALL command, populating e, id and version
 func decodeEnt(e Ent, r *RReader) (id, version uint64, err error) {
 	// decode result
@@ -617,9 +1606,14 @@ func decodeEnt(e Ent, r *RReader) (id, version uint64, err error) {
 // EntEncoder is an implementation of ent.Encoder
 // Since we store ents in Redis hashes (HSET, HGET, et al) values must all be strings, which
 // is why this is not really using RWriter.
+//
+// Compound values (lists and dicts) are encoded as RESP arrays, which are stored as a single
+// hash value. A dict is encoded as an array of keys and values interleaved.
 type EntEncoder struct {
-	buf []byte
-	err error
+	buf      []byte
+	err      error
+	outerBuf []byte // buf of the hash while encoding a compound value
+	depth    int    // nesting depth of compound values
 }
 
 var hsetCmdSlice = []byte("HSET")
@@ -674,38 +1668,111 @@ func (c *EntEncoder) Float(v float64, bitsize int) {
 func (c *EntEncoder) BeginEnt(version uint64) {} // unused
 func (c *EntEncoder) EndEnt()                 {} // unused
 
-func (c *EntEncoder) BeginList(length int) {
-	if c.err == nil {
-		c.err = fmt.Errorf("nested lists are not yet supported")
+func (c *EntEncoder) BeginList(length int) { c.beginCompound(length) }
+func (c *EntEncoder) EndList()             { c.endCompound() }
+func (c *EntEncoder) BeginDict(length int) { c.beginCompound(length * 2) }
+func (c *EntEncoder) EndDict()             { c.endCompound() }
+
+// beginCompound starts encoding a RESP array of length values. The outermost array is encoded
+// into a separate buffer which is written as a bulk string by endCompound.
+func (c *EntEncoder) beginCompound(length int) {
+	if c.depth == 0 {
+		c.outerBuf = c.buf
+		c.buf = make([]byte, 0, 64)
 	}
+	c.depth++
+	c.buf = respAppendArrayHeader(c.buf, length)
 }
-func (c *EntEncoder) EndList() {} // unused
 
-func (c *EntEncoder) BeginDict(length int) {
-	if c.err == nil {
-		c.err = fmt.Errorf("nested dicts are not yet supported")
+func (c *EntEncoder) endCompound() {
+	c.depth--
+	if c.depth == 0 {
+		c.buf = respAppendBulkString(c.outerBuf, c.buf)
+		c.outerBuf = nil
 	}
 }
-func (c *EntEncoder) EndDict() {} // unused
 
 // ————————————————————————————————————————————————————————————————————————————————————————————
 
 // DictEntDecoder is an implementation of ent.Decoder which reads keys and values interleaved.
 // E.g. "key1" "value1" "key2" "value2" ...
+//
+// Compressed fields (entCompressedFieldsKey) are decoded after all other fields, skipping any
+// fields which were also stored uncompressed.
 type DictEntDecoder struct {
 	*RReader
-	nfields int // number of fields to read (counts down)
+	nfields  int // number of fields to read (counts down)
+	compound compoundReader
+
+	packed []byte   // compressed fields, decoded after all other fields
+	outer  *RReader // non-nil while decoding packed fields
+	seen   []string // keys read, used to skip shadowed packed fields
 }
 
-func (r *DictEntDecoder) More() bool { return false } // unused
+func (r *DictEntDecoder) More() bool      { return false } // unused
+func (r *DictEntDecoder) ListHeader() int { return r.compound.ListHeader(&r.RReader) }
+func (r *DictEntDecoder) DictHeader() int { return r.compound.DictHeader(&r.RReader) }
 func (r *DictEntDecoder) Key() string {
-	// an ent.Decoder returns the empty string when it is done
-	if r.nfields == 0 {
-		// all fields have been read
-		return ""
+	if r.compound.reading(&r.RReader) {
+		return r.Str() // key of a dict
+	}
+	for {
+		// an ent.Decoder returns the empty string when it is done
+		if r.nfields == 0 {
+			if r.packed != nil && r.beginPacked() {
+				continue
+			}
+			if r.outer != nil {
+				// done with packed fields
+				r.outer.SetErr(r.RReader.Err())
+				r.RReader, r.outer = r.outer, nil
+			}
+			// all fields have been read
+			return ""
+		}
+		r.nfields--
+		key := r.Str()
+		if r.outer == nil {
+			if key == entCompressedFieldsKey {
+				r.packed = r.Blob()
+				continue
+			}
+			r.seen = append(r.seen, key)
+		} else if r.isSeen(key) {
+			r.Discard()
+			continue
+		}
+		return key
+	}
+}
+
+// beginPacked switches r to reading packed fields. Returns false on error.
+func (r *DictEntDecoder) beginPacked() bool {
+	data, err := ent.DecompressData(r.packed)
+	r.packed = nil
+	if err != nil {
+		r.SetErr(err)
+		return false
+	}
+	inner := &RReader{r: bufio.NewReader(bytes.NewReader(data)), buf: make([]byte, 0, 64)}
+	n := inner.ListHeader()
+	if inner.Err() != nil {
+		r.SetErr(inner.Err())
+		return false
+	}
+	r.outer = r.RReader
+	r.RReader = inner
+	r.nfields = n / 2
+	return true
+}
+
+func (r *DictEntDecoder) isSeen(key string) bool {
+	for _, k := range r.seen {
+		if k == key {
+			return true
+		}
 	}
-	r.nfields--
-	return r.Str()
+	return false
 }
 
 // ———————————————————————————————————————————————————————
@@ -714,12 +1781,18 @@ func (r *DictEntDecoder) Key() string {
 // E.g. with keys=["key1", "key2", "key3"], reads "value1" "value2" "value3".
 type ArrayEntDecoder struct {
 	*RReader
-	keys  []string // keys, in predetermined order that matches values to be decoded
-	nread int      // number of keys read
+	keys     []string // keys, in predetermined order that matches values to be decoded
+	nread    int      // number of keys read
+	compound compoundReader
 }
 
-func (r *ArrayEntDecoder) More() bool { return false } // unused
+func (r *ArrayEntDecoder) More() bool      { return false } // unused
+func (r *ArrayEntDecoder) ListHeader() int { return r.compound.ListHeader(&r.RReader) }
+func (r *ArrayEntDecoder) DictHeader() int { return r.compound.DictHeader(&r.RReader) }
 func (r *ArrayEntDecoder) Key() string {
+	if r.compound.reading(&r.RReader) {
+		return r.Str() // key of a dict
+	}
 	// an ent.Decoder returns the empty string when it is done
 	if len(r.keys) == 0 {
 		// all fields have been read
@@ -730,3 +1803,55 @@ func (r *ArrayEntDecoder) Key() string {
 	r.nread++
 	return key
 }
+
+// ———————————————————————————————————————————————————————
+
+// compoundReader reads compound values (lists and dicts) which are stored as RESP data in a
+// single hash value (see EntEncoder.) While reading a compound value, the reader of the
+// decoder is replaced by a reader of the RESP data.
+type compoundReader struct {
+	outer *RReader      // reader of hash values; non-nil while reading a compound value
+	data  *bytes.Reader // RESP data of the compound value
+}
+
+// ListHeader reads a list header, first switching *rp to the RESP data of the hash value if
+// not already reading a compound value.
+func (c *compoundReader) ListHeader(rp **RReader) int {
+	if c.outer == nil {
+		b := (*rp).Blob()
+		if (*rp).Err() != nil {
+			return -1
+		}
+		if len(b) == 0 {
+			// e.g. a field which does not exist, as returned by HMGET
+			return 0
+		}
+		c.outer = *rp
+		c.data = bytes.NewReader(b)
+		*rp = &RReader{r: bufio.NewReader(c.data), buf: make([]byte, 0, 64)}
+	}
+	return (*rp).ListHeader()
+}
+
+// DictHeader reads a dict header, which is encoded as a list of keys and values
+func (c *compoundReader) DictHeader(rp **RReader) int {
+	n := c.ListHeader(rp)
+	if n > 0 {
+		n /= 2
+	}
+	return n
+}
+
+// reading returns true if a compound value is being read which has more data.
+// Otherwise, if a compound value has been read, *rp is switched back to reading hash values.
+func (c *compoundReader) reading(rp **RReader) bool {
+	if c.outer == nil {
+		return false
+	}
+	if (*rp).Err() == nil && (c.data.Len() > 0 || (*rp).r.Buffered() > 0) {
+		return true
+	}
+	c.outer.SetErr((*rp).Err())
+	*rp, c.outer, c.data = c.outer, nil, nil
+	return false
+}
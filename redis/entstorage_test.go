@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+	"github.com/rsms/go-testutil"
+)
+
+func TestPrependWATCH(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	cmdStrings := func(cmds []radix.CmdAction) string {
+		var s []string
+		for _, cmd := range cmds {
+			rawCmd, ok := cmd.(*RawCmd)
+			if !ok {
+				return fmt.Sprintf("unexpected %T", cmd)
+			}
+			s = append(s, fmt.Sprintf("%s", respCommandArgs(rawCmd.Data)))
+		}
+		return strings.Join(s, ",")
+	}
+	keys := [][]byte{[]byte("acc:1"), []byte("acc#email:a")}
+
+	cmds := prependWATCH([]radix.CmdAction{&CmdMULTI}, keys)
+	assert.Eq("one cmd", cmdStrings(cmds), "[WATCH acc:1 acc#email:a],[MULTI]")
+	assert.Ok("room for EXEC", cap(cmds) > len(cmds))
+
+	cmds = prependWATCH([]radix.CmdAction{
+		&CmdMULTI,
+		MakeSingleKeyCmd("DEL", []byte("acc#email:b")),
+		MakeBulkStringCmd("SETNX", []byte("acc#email:a"), []byte("1")),
+	}, keys)
+	assert.Eq("cmds", cmdStrings(cmds),
+		"[WATCH acc:1 acc#email:a],[MULTI],[DEL acc#email:b],[SETNX acc#email:a 1]")
+}
+
+// hashTestEnt is an ent with a string field, a list field and an int field
+type hashTestEnt struct {
+	ent.EntBase
+	name string
+	tags []string
+	n    int
+}
+
+const (
+	hashTestEnt_f_name = iota
+	hashTestEnt_f_tags
+	hashTestEnt_f_n
+)
+
+var hashTestEntFields = ent.Fields{Names: []string{"name", "tags", "n"}, FieldSet: 0b111}
+
+func (e *hashTestEnt) EntTypeName() string        { return "hashtest" }
+func (e *hashTestEnt) EntNew() ent.Ent            { return &hashTestEnt{} }
+func (e *hashTestEnt) EntIndexes() []ent.EntIndex { return nil }
+func (e *hashTestEnt) EntFields() ent.Fields      { return hashTestEntFields }
+
+func (e *hashTestEnt) EntEncode(c ent.Encoder, fields ent.FieldSet) {
+	if fields.Has(hashTestEnt_f_name) {
+		c.Key("name")
+		c.Str(e.name)
+	}
+	if fields.Has(hashTestEnt_f_tags) {
+		c.Key("tags")
+		c.BeginList(len(e.tags))
+		for _, v := range e.tags {
+			c.Str(v)
+		}
+		c.EndList()
+	}
+	if fields.Has(hashTestEnt_f_n) {
+		c.Key("n")
+		c.Int(int64(e.n), 64)
+	}
+}
+
+func (e *hashTestEnt) EntDecode(c ent.Decoder) (id, version uint64) {
+	for {
+		switch c.Key() {
+		case "":
+			return
+		case ent.FieldNameVersion:
+			version = c.Uint(64)
+		case "name":
+			e.name = c.Str()
+		case "tags":
+			e.tags = nil
+			for i, n := 0, c.ListHeader(); i < n; i++ {
+				e.tags = append(e.tags, c.Str())
+			}
+		case "n":
+			e.n = int(c.Int(64))
+		default:
+			c.Discard()
+		}
+	}
+}
+
+func (e *hashTestEnt) EntDecodePartial(c ent.Decoder, fields ent.FieldSet) (version uint64) {
+	_, version = e.EntDecode(c)
+	return
+}
+
+// TestSaveClearedField checks that a field which is cleared and saved reads back as empty
+// rather than as its previous value. Saves write the changed fields with HSET, including empty
+// values, so no HDEL is needed.
+func TestSaveClearedField(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	entKey := []byte("hashtest:1")
+	hash := map[string][]byte{} // the redis hash of the ent
+	hset := func(version uint64, e Ent, fields ent.FieldSet) [][]byte {
+		data, err := encodeEntHSET(e, nil, entKey, version, fields)
+		assert.NoErr("encodeEntHSET", err)
+		args := respCommandArgs(data)
+		assert.Eq("HSET", string(args[0]), "HSET")
+		assert.Eq("key", string(args[1]), string(entKey))
+		for i := 2; i+1 < len(args); i += 2 {
+			hash[string(args[i])] = args[i+1]
+		}
+		return args[2:]
+	}
+	hgetall := func() *hashTestEnt {
+		keys := make([]string, 0, len(hash))
+		for k := range hash {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var reply [][]byte
+		for _, k := range keys {
+			reply = append(reply, []byte(k), hash[k])
+		}
+		data := respAppendArray(nil, reply)
+		e := &hashTestEnt{}
+		_, version, err := decodeEnt(e, &RReader{
+			r: bufio.NewReader(bytes.NewReader(data)), buf: make([]byte, 0, 32)})
+		assert.NoErr("decodeEnt", err)
+		ent.SetEntBaseFieldsAfterLoad(e, nil, 1, version)
+		return e
+	}
+
+	e := &hashTestEnt{name: "a", tags: []string{"x", "y"}, n: 3}
+	hset(1, e, hashTestEntFields.FieldSet)
+	e2 := hgetall()
+	assert.Eq("created", fmt.Sprintf("%s %v %d %d", e2.name, e2.tags, e2.n, e2.Version()),
+		"a [x y] 3 1")
+
+	// only the cleared fields (and the version) are written
+	e.name, e.tags = "", nil
+	fields := ent.FieldSet(0).With(hashTestEnt_f_name).With(hashTestEnt_f_tags)
+	args := hset(2, e, fields)
+	assert.Eq("written fields", len(args), 3*2)
+	e2 = hgetall()
+	assert.Eq("cleared", fmt.Sprintf("%q %d %d %d", e2.name, len(e2.tags), e2.n, e2.Version()),
+		`"" 0 3 2`)
+}
@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/rsms/ent"
+)
+
+// CreateExpiring creates e, like TYPE.Create, but makes the ent expire after ttl, after which
+// it is no longer found. This is useful for ephemeral ents like password-reset tokens.
+//
+// Saving an expiring ent does not change when it expires.
+//
+// Unique index entries of the ent expire together with the ent. Entries in non-unique indexes
+// are removed lazily when encountered by LoadByIndex or LoadByIndexPaged, which means that
+// FindByIndex and Count may include ents which have expired.
+func (s *EntStorage) CreateExpiring(e ent.Ent, ttl time.Duration) error {
+	return s.CreateExpiringContext(context.Background(), e, ttl)
+}
+
+// CreateExpiringContext is a variant of CreateExpiring which accepts a context
+func (s *EntStorage) CreateExpiringContext(ctx context.Context, e ent.Ent, ttl time.Duration) error {
+	if err := ent.CreateEnt(e, &expiringStorage{s, ctx, ttl}); err != nil {
+		return err
+	}
+	// bind e to s rather than to the expiringStorage
+	ent.SetEntBaseFieldsAfterLoad(e, s, e.Id(), e.Version())
+	return nil
+}
+
+// expiringStorage is used by CreateExpiring to create an ent with a ttl
+type expiringStorage struct {
+	*EntStorage
+	ctx context.Context
+	ttl time.Duration
+}
+
+func (s *expiringStorage) Create(e ent.Ent, fields ent.FieldSet) (uint64, error) {
+	return s.create(s.ctx, e, fields, s.ttl)
+}
@@ -0,0 +1,165 @@
+package redis
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// HealthStatus describes the state of the connection to redis, as of the latest health check
+// (see StartHealthCheck)
+type HealthStatus struct {
+	Healthy    bool      // true if the latest ping succeeded
+	Err        error     // error of the latest ping, or nil
+	CheckedAt  time.Time // time of the latest ping; zero if there has been no health check
+	Failures   int       // number of pings in a row which have failed
+	Reconnects int       // number of times the connections have been reopened
+	AvailConns int       // idle connections in the read-write pool; -1 if not a radix.Pool
+}
+
+// ErrNotConnected is returned by Ping when Redis has no connection
+var ErrNotConnected = errors.New("redis: not connected")
+
+// Ping sends a PING to the read-write server and to the read-only server, if there is one
+func (r *Redis) Ping() error {
+	rwc, roc := r.clients()
+	if rwc == nil {
+		return ErrNotConnected
+	}
+	if err := rwc.Do(radix.Cmd(nil, "PING")); err != nil {
+		return err
+	}
+	if roc != nil {
+		return roc.Do(radix.Cmd(nil, "PING"))
+	}
+	return nil
+}
+
+// Health returns the state of the connection as of the latest health check, which can be used
+// to implement a readiness probe. Healthy is false until the first check has been made.
+func (r *Redis) Health() HealthStatus {
+	r.mu.RLock()
+	h := r.health
+	rwc := r.rwc
+	r.mu.RUnlock()
+	h.AvailConns = -1
+	if p, ok := rwc.(*radix.Pool); ok {
+		h.AvailConns = p.NumAvailConns()
+	}
+	return h
+}
+
+// StartHealthCheck starts a goroutine which pings redis every interval and records the result
+// (see Health). A failed ping is logged to r.Logger.
+//
+// When the connection was opened with Open, a failed ping also makes the health check reopen
+// the connection pools, retrying every interval until it succeeds (like OpenRetry) and then
+// closing the old pools. This replaces all connections at once, where a pool would otherwise
+// only replace its broken connections as they are used. Commands which are in progress when the
+// old pools are closed may fail.
+//
+// Call the returned function to stop the health check. It returns when any check in progress
+// has finished.
+func (r *Redis) StartHealthCheck(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		r.checkHealth()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.checkHealth()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// checkHealth pings redis and, if that fails, tries to reconnect
+func (r *Redis) checkHealth() {
+	err := r.Ping()
+	r.mu.Lock()
+	wasHealthy := r.health.Healthy
+	r.health.Healthy = err == nil
+	r.health.Err = err
+	r.health.CheckedAt = time.Now()
+	if err == nil {
+		r.health.Failures = 0
+	} else {
+		r.health.Failures++
+	}
+	r.mu.Unlock()
+
+	if err == nil {
+		if !wasHealthy && r.Logger != nil {
+			r.Logger.Info("redis connection is healthy")
+		}
+		return
+	}
+	if r.Logger != nil {
+		r.Logger.Warn("redis health check failed: %v", err)
+	}
+	if r.opts.RWAddr != "" && err != ErrNotConnected {
+		r.reconnect()
+	}
+}
+
+// reconnect replaces the connection pools of Open with new ones
+func (r *Redis) reconnect() {
+	rwc, err := r.opts.newPool(r.opts.RWAddr)
+	if err != nil {
+		if r.Logger != nil {
+			r.Logger.Warn("failed to reconnect to %s: %v", r.opts.RWAddr, err)
+		}
+		return
+	}
+	var roc *radix.Pool
+	if r.opts.ROAddr != r.opts.RWAddr {
+		if roc, err = r.opts.newPool(r.opts.ROAddr); err != nil {
+			rwc.Close()
+			if r.Logger != nil {
+				r.Logger.Warn("failed to reconnect to %s: %v", r.opts.ROAddr, err)
+			}
+			return
+		}
+	}
+
+	r.mu.Lock()
+	if r.rwc == nil {
+		// closed while reconnecting
+		r.mu.Unlock()
+		rwc.Close()
+		if roc != nil {
+			roc.Close()
+		}
+		return
+	}
+	oldrwc, oldroc := r.rwc, r.roc
+	r.rwc, r.roc = rwc, nil
+	if roc != nil {
+		r.roc = roc
+	}
+	r.health.Reconnects++
+	r.mu.Unlock()
+
+	if r.Logger != nil {
+		r.Logger.Info("reconnected to %s", r.opts.RWAddr)
+		r.initErrLogging(rwc)
+		if roc != nil {
+			r.initErrLogging(roc)
+		}
+	}
+	oldrwc.Close()
+	if oldroc != nil {
+		oldroc.Close()
+	}
+}
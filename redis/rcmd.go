@@ -2,6 +2,7 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 
@@ -13,10 +14,19 @@ type RCmd struct { // conforms to radix.Marshaler
 	Decode func(r *RReader) error
 }
 
-func (a *RCmd) Keys() []string { return []string{} }
+// Keys returns the keys of the command, used to route the command in a Redis Cluster
+func (a *RCmd) Keys() []string {
+	var buf bytes.Buffer
+	w := RIOWriter{RWriter{buf: make([]byte, 0, 128)}, &buf}
+	if err := a.Encode(&w); err != nil {
+		return []string{}
+	}
+	w.Flush()
+	return respCommandKeys(buf.Bytes())
+}
 
 func (a *RCmd) String() string {
-	return fmt.Sprintf("RCmd{Encode:%v, Decode:%v}", a.Encode, a.Decode)
+	return fmt.Sprintf("RCmd{Encode:%p, Decode:%p}", a.Encode, a.Decode)
 }
 
 func (a *RCmd) Run(c radix.Conn) error {
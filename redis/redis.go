@@ -2,8 +2,13 @@ package redis
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/mediocregopher/radix/v3"
@@ -13,19 +18,106 @@ import (
 type Redis struct {
 	Logger *log.Logger
 
-	rwc *radix.Pool // read-write redis server connection
-	roc *radix.Pool // read-only redis server connection (if nil, use rwc for reads)
+	// HashTags, when true, makes all keys of ents of the same type hash to the same
+	// Redis Cluster slot, by wrapping the type name in a hash tag, e.g. "{account}:5" and
+	// "{account}#email:robin@foo.com". This is required when using a Redis Cluster (see
+	// OpenCluster) since updates to an ent and its indexes are made together in transactions,
+	// which Redis Cluster only supports for keys in the same slot. Note that this means that
+	// all ents of a type are stored on the same cluster node.
+	//
+	// Keys are named differently when HashTags is true; ents stored with one setting can not be
+	// read with another.
+	HashTags bool
+
+	// KeyPrefix is prepended to all keys, e.g. "app1:" for "app1:account:5", which isolates
+	// the ents of one application from those of others sharing the same redis database.
+	// Empty by default, meaning keys are not prefixed.
+	KeyPrefix string
+
+	mu     sync.RWMutex // protects rwc, roc and health (see StartHealthCheck)
+	rwc    radix.Client // read-write redis server connection
+	roc    radix.Client // read-only redis server connection (if nil, use rwc for reads)
+	opts   RedisOptions // options when connected with Open (used by Subscribe and reconnect)
+	health HealthStatus
+}
+
+// RedisOptions configures the connections made by OpenWithOptions
+type RedisOptions struct {
+	RWAddr   string // address of the read-write server
+	ROAddr   string // address of a read-only server (optional)
+	PoolSize int    // number of connections to each server
+
+	Username string      // user name of AUTH (redis 6 ACL); "default" if empty
+	Password string      // password of AUTH; no AUTH is made if empty
+	DB       int         // database to SELECT
+	TLS      *tls.Config // connect with TLS when not nil
+
+	// timeouts of connecting, reading and writing. Zero means the radix default of 10 seconds.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func (o *RedisOptions) dialOpts() []radix.DialOpt {
+	var opts []radix.DialOpt
+	if o.DialTimeout > 0 {
+		opts = append(opts, radix.DialConnectTimeout(o.DialTimeout))
+	}
+	if o.ReadTimeout > 0 {
+		opts = append(opts, radix.DialReadTimeout(o.ReadTimeout))
+	}
+	if o.WriteTimeout > 0 {
+		opts = append(opts, radix.DialWriteTimeout(o.WriteTimeout))
+	}
+	if o.Password != "" {
+		user := o.Username
+		if user == "" {
+			user = "default"
+		}
+		opts = append(opts, radix.DialAuthUser(user, o.Password))
+	}
+	if o.DB != 0 {
+		opts = append(opts, radix.DialSelectDB(o.DB))
+	}
+	if o.TLS != nil {
+		opts = append(opts, radix.DialUseTLS(o.TLS))
+	}
+	return opts
+}
+
+// connFunc returns a radix.ConnFunc which dials connections configured by o
+func (o *RedisOptions) connFunc() radix.ConnFunc {
+	opts := o.dialOpts()
+	return func(network, addr string) (radix.Conn, error) {
+		return radix.Dial(network, addr, opts...)
+	}
+}
+
+// newPool creates a connection pool to addr configured by o
+func (o *RedisOptions) newPool(addr string) (*radix.Pool, error) {
+	return radix.NewPool("tcp", addr, o.PoolSize, radix.PoolConnFunc(o.connFunc()))
 }
 
+// Open connects to the read-write server at rwaddr and, if roaddr is different, the read-only
+// server at roaddr, with connPoolSize connections to each. Either address may be empty to use
+// the other one for both.
 func (r *Redis) Open(rwaddr, roaddr string, connPoolSize int) error {
+	return r.OpenWithOptions(RedisOptions{RWAddr: rwaddr, ROAddr: roaddr, PoolSize: connPoolSize})
+}
+
+// OpenWithOptions is like Open but with options for authentication, database, TLS and
+// timeouts, e.g. for a managed redis service
+func (r *Redis) OpenWithOptions(opts RedisOptions) error {
+	rwaddr, roaddr := opts.RWAddr, opts.ROAddr
 	if roaddr == "" {
 		roaddr = rwaddr
 	} else if rwaddr == "" {
 		rwaddr = roaddr
 	}
+	opts.RWAddr, opts.ROAddr = rwaddr, roaddr
 
 	// connect to read-write server (LEADER)
-	rwc, err := radix.NewPool("tcp", rwaddr, connPoolSize)
+	rwc, err := opts.newPool(rwaddr)
 	if err != nil {
 		return err
 	}
@@ -33,7 +125,7 @@ func (r *Redis) Open(rwaddr, roaddr string, connPoolSize int) error {
 	// if a different address is provided for roc, connect to read-only server (FOLLOWER)
 	var roc *radix.Pool
 	if rwaddr != roaddr {
-		roc, err = radix.NewPool("tcp", roaddr, connPoolSize)
+		roc, err = opts.newPool(roaddr)
 		if err != nil {
 			rwc.Close()
 			return err
@@ -48,7 +140,11 @@ func (r *Redis) Open(rwaddr, roaddr string, connPoolSize int) error {
 		}
 	}
 
-	return r.SetConnections(rwc, roc)
+	if err := r.SetConnections(rwc, roc); err != nil {
+		return err
+	}
+	r.opts = opts
+	return nil
 }
 
 // OpenRetry calls Open until it succeeds, with a second delay in between
@@ -65,7 +161,35 @@ func (r *Redis) OpenRetry(rwaddr, roaddr string, connPoolSize int) {
 	}
 }
 
+// OpenCluster connects to a Redis Cluster via one or more of its nodes. HashTags is enabled
+// since all keys of an ent must be in the same cluster slot.
+func (r *Redis) OpenCluster(addrs []string, connPoolSize int) error {
+	poolFunc := func(network, addr string) (radix.Client, error) {
+		return radix.NewPool(network, addr, connPoolSize)
+	}
+	c, err := radix.NewCluster(addrs, radix.ClusterPoolFunc(poolFunc))
+	if err != nil {
+		return err
+	}
+	if r.Logger != nil {
+		r.Logger.Info("connected to cluster %v", addrs)
+	}
+	r.HashTags = true
+	return r.SetClients(c, nil)
+}
+
 func (r *Redis) SetConnections(rwc, roc *radix.Pool) error {
+	if roc == nil {
+		return r.SetClients(rwc, nil)
+	}
+	return r.SetClients(rwc, roc)
+}
+
+// SetClients is like SetConnections but accepts any kind of radix.Client, for example a
+// radix.Cluster. roc is optional and may be nil.
+func (r *Redis) SetClients(rwc, roc radix.Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.rwc != nil {
 		return fmt.Errorf("already connected")
 	}
@@ -74,9 +198,11 @@ func (r *Redis) SetConnections(rwc, roc *radix.Pool) error {
 
 	if r.Logger != nil {
 		// initialize logging for the connection(s)
-		r.initErrLogging(rwc)
-		if roc != nil {
-			r.initErrLogging(roc)
+		if p, ok := rwc.(*radix.Pool); ok {
+			r.initErrLogging(p)
+		}
+		if p, ok := roc.(*radix.Pool); ok {
+			r.initErrLogging(p)
 		}
 	}
 	return nil
@@ -99,6 +225,8 @@ func (r *Redis) initErrLogging(c *radix.Pool) {
 }
 
 func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	err := r.rwc.Close()
 	if r.roc != nil {
 		if err2 := r.roc.Close(); err2 != nil && err == nil {
@@ -111,7 +239,9 @@ func (r *Redis) Close() error {
 }
 
 // RClient returns a redis connection for reading
-func (r *Redis) RClient() *radix.Pool {
+func (r *Redis) RClient() radix.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if r.roc != nil {
 		return r.roc
 	}
@@ -119,40 +249,71 @@ func (r *Redis) RClient() *radix.Pool {
 }
 
 // WClient returns a redis connection for writing (can also read)
-func (r *Redis) WClient() *radix.Pool {
+func (r *Redis) WClient() radix.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.rwc
 }
 
+// clients returns the read-write connection and the read-only connection, which is nil when
+// there is no separate read-only connection
+func (r *Redis) clients() (rwc, roc radix.Client) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rwc, r.roc
+}
+
 // doRead runs action a on the most suitable redis server for reading.
 // "a" should NOT be a mutating action -- if it is, the modification may get lost from
 // data replication effects later on.
 func (r *Redis) doRead(a radix.Action) error {
-	c := r.rwc
-	if r.roc != nil {
-		c = r.roc
-	}
+	c := r.RClient()
 	return c.Do(a)
 }
 
+// doReadContext is like doRead but aborts a when ctx is done
+func (r *Redis) doReadContext(ctx context.Context, a radix.Action) error {
+	c := r.RClient()
+	return doContext(ctx, c, a)
+}
+
+// doReadSlot is like doReadContext but, with a Redis Cluster, runs a on the node which holds
+// key. Used for commands without keys, like SCAN.
+func (r *Redis) doReadSlot(ctx context.Context, key []byte, a radix.Action) error {
+	c := r.RClient()
+	if _, ok := c.(*radix.Cluster); !ok {
+		return doContext(ctx, c, a)
+	}
+	return c.Do(radix.WithConn(string(key), func(conn radix.Conn) error {
+		return runContext(ctx, conn, func(conn radix.Conn) error { return conn.Do(a) })
+	}))
+}
+
 // doReadImportant reads data from the leader redis server.
 // This is much slower than doRead on follower servers but
 // is always consistent following a doWrite call.
 func (r *Redis) doReadImportant(a radix.Action) error {
-	return r.rwc.Do(a)
+	return r.WClient().Do(a)
 }
 
 // doWrite runs action a on the read-write redis server
 func (r *Redis) doWrite(a radix.Action) error {
-	return r.rwc.Do(a)
+	return r.WClient().Do(a)
+}
+
+// doWriteContext is like doWrite but aborts a when ctx is done
+func (r *Redis) doWriteContext(ctx context.Context, a radix.Action) error {
+	return doContext(ctx, r.WClient(), a)
 }
 
 // doWriteIdempotent runs action a on the read-write redis server AND the read-only server.
 // Only idempotent actions like "SET" can use this.
 func (r *Redis) doWriteIdempotent(a radix.Action) error {
-	err := r.rwc.Do(a)
-	if err == nil && r.roc != nil {
+	rwc, roc := r.clients()
+	err := rwc.Do(a)
+	if err == nil && roc != nil {
 		// write-through cache
-		if err := r.roc.Do(a); err != nil && r.Logger != nil {
+		if err := roc.Do(a); err != nil && r.Logger != nil {
 			// failure only in local cache; log but don't return the error
 			r.Logger.Warn("write-through cache failure %v (likely harmless)", err)
 		}
@@ -197,13 +358,81 @@ func (r *Redis) GetString(key string) (value string, err error) {
 }
 
 func (r *Redis) Batch(f func(c radix.Conn) error) error {
+	return r.batchContext(context.Background(), nil, f)
+}
+
+// BatchContext is like Batch but aborts any communication with redis when ctx is done
+func (r *Redis) BatchContext(ctx context.Context, f func(c radix.Conn) error) error {
+	return r.batchContext(ctx, nil, f)
+}
+
+// batchContext calls f with a connection to the read-write server.
+// With a Redis Cluster, the connection is to the node which holds key.
+func (r *Redis) batchContext(ctx context.Context, key []byte, f func(c radix.Conn) error) error {
 	// https://godoc.org/github.com/mediocregopher/radix#WithConn
 	// Note: first arg is key which is only used for redis cluster
-	return r.rwc.Do(radix.WithConn("", f))
+	if ctx.Done() == nil {
+		return r.WClient().Do(radix.WithConn(string(key), f))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.WClient().Do(radix.WithConn(string(key), func(c radix.Conn) error {
+		return runContext(ctx, c, f)
+	}))
 }
 
 func (r *Redis) BatchOnRClient(f func(c radix.Conn) error) error {
-	return r.roc.Do(radix.WithConn("", f))
+	_, roc := r.clients()
+	return roc.Do(radix.WithConn("", f))
+}
+
+// doContext runs action a on a connection of c, aborting it when ctx is done
+func doContext(ctx context.Context, c radix.Client, a radix.Action) error {
+	if ctx.Done() == nil {
+		// ctx can never be done (e.g. context.Background)
+		return c.Do(a)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var key string
+	if _, ok := c.(*radix.Cluster); ok {
+		if keys := a.Keys(); len(keys) > 0 {
+			key = keys[0] // route to the cluster node which holds the key
+		}
+	}
+	return c.Do(radix.WithConn(key, func(conn radix.Conn) error {
+		return runContext(ctx, conn, func(conn radix.Conn) error { return conn.Do(a) })
+	}))
+}
+
+// runContext calls f with conn. When ctx is done before f returns, any ongoing read or write
+// on conn is interrupted by setting a deadline on the network connection, which causes f to
+// fail with ctx.Err(). A connection interrupted this way is discarded by its radix.Pool.
+func runContext(ctx context.Context, conn radix.Conn, f func(radix.Conn) error) error {
+	stop := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.NetConn().SetDeadline(time.Unix(1, 0)) // any time in the past
+			aborted <- true
+		case <-stop:
+			aborted <- false
+		}
+	}()
+	err := f(conn)
+	close(stop)
+	if <-aborted {
+		// f may have finished before the deadline took effect; make conn usable again
+		conn.NetConn().SetDeadline(time.Time{})
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			err = ctx.Err()
+		}
+	}
+	return err
 }
 
 // constant commands without results
@@ -221,7 +450,8 @@ type RawCmd struct { // conforms to radix.Marshaler
 	Data []byte // never mutated
 }
 
-func (c *RawCmd) Keys() []string { return []string{} }
+// Keys returns the keys of the command, used to route the command in a Redis Cluster
+func (c *RawCmd) Keys() []string { return respCommandKeys(c.Data) }
 
 func (c *RawCmd) Command() []byte {
 	if i, n := respFindCommand(c.Data); i > 0 {
@@ -287,23 +517,57 @@ func (c *RawCmdHexUint) UnmarshalRESP(r *bufio.Reader) error {
 	return reader.Err()
 }
 
+// RawCmdInt is a RawCmd which reply is an integer
+type RawCmdInt struct {
+	RawCmd
+	ResultPtr *int
+}
+
+func (c *RawCmdInt) Run(conn radix.Conn) error {
+	if err := conn.Encode(c); err != nil {
+		return err
+	}
+	return conn.Decode(c)
+}
+
+func (c *RawCmdInt) UnmarshalRESP(r *bufio.Reader) error {
+	var buf [32]byte
+	reader := RReader{r: r, buf: buf[:]}
+	*c.ResultPtr = int(reader.Int(64))
+	return reader.Err()
+}
+
 type ZRangeEntIdsCmd struct {
 	RawCmd
 	Result    []uint64
 	prefixLen int
 }
 
-func makeZRangeEntIdsCmd(key, lookupKey []byte, limit int, rev bool) *ZRangeEntIdsCmd {
+// makeLexRange returns the ZRANGEBYLEX range of all entries of a non-unique index which have
+// the value lookupKey, i.e. "[value\xfe" "(value\xff"
+func makeLexRange(lookupKey []byte) (rangeStart, rangeEnd []byte) {
 	buf := make([]byte, len(lookupKey)*2+4)
 
-	rangeStart := buf[:len(lookupKey)+2]
+	rangeStart = buf[:len(lookupKey)+2]
 	rangeStart[0] = '['
 	rangeStart[1+copy(rangeStart[1:], lookupKey)] = '\xfe'
 
-	rangeEnd := buf[len(lookupKey)+2:]
+	rangeEnd = buf[len(lookupKey)+2:]
 	rangeEnd[0] = '('
 	rangeEnd[1+copy(rangeEnd[1:], lookupKey)] = '\xff'
+	return
+}
 
+func makeZRangeEntIdsCmd(key, lookupKey []byte, limit int, rev bool) *ZRangeEntIdsCmd {
+	rangeStart, rangeEnd := makeLexRange(lookupKey)
+	return makeZRangeByLexEntIdsCmd(key, rangeStart, rangeEnd, limit, rev)
+}
+
+// makeZRangeByLexEntIdsCmd makes a ZRANGEBYLEX command reading the ids of all entries of a
+// non-unique index in the range [rangeStart, rangeEnd]
+func makeZRangeByLexEntIdsCmd(
+	key, rangeStart, rangeEnd []byte, limit int, rev bool,
+) *ZRangeEntIdsCmd {
 	cmd := "ZRANGEBYLEX"
 	argsa := [6][]byte{key, rangeStart, rangeEnd}
 	if rev {
@@ -337,13 +601,16 @@ func (c *ZRangeEntIdsCmd) UnmarshalRESP(r *bufio.Reader) error {
 	n := reader.ListHeader()
 	if n > 0 {
 		c.Result = make([]uint64, int(n))
-		// each entry is of the form "PREFIX\xfeIDIDIDID"
-		// where IDIDIDID is the id in big-endian byte order.
+		// each entry is of the form "PREFIX\xfeIDIDIDID", or "IDIDIDID" when prefixLen is 0
+		// (see makeZRangeByScoreEntIdsCmd), where IDIDIDID is the id in big-endian byte order.
 		readbuf := make([]byte, c.prefixLen+8)
 		for i := 0; i < n; i++ {
 			b := reader.AnyData(readbuf)
-			u := readUint64BE(b[c.prefixLen-1:])
-			c.Result[i] = u
+			if len(b) < 8 || (len(b) < 9 && c.prefixLen > 0) {
+				reader.SetErr(fmt.Errorf("invalid index entry %q", b))
+				break
+			}
+			c.Result[i] = readUint64BE(b[len(b)-8:])
 		}
 	}
 	return reader.Err()
@@ -380,3 +647,16 @@ func makeSETNXIdCmd(key []byte, id uint64) *RawCmd {
 	idstr := fmtint(scratch[:], id, 16)
 	return &RawCmd{respMakeStringArray("SETNX", key, idstr)}
 }
+
+func makeSETIdCmd(key []byte, id uint64) *RawCmd {
+	var scratch [16]byte
+	idstr := fmtint(scratch[:], id, 16)
+	return &RawCmd{respMakeStringArray("SET", key, idstr)}
+}
+
+// makePEXPIRECmd creates a RawCmd{ PEXPIRE key milliseconds }
+func makePEXPIRECmd(key []byte, ttl time.Duration) *RawCmd {
+	var scratch [20]byte
+	ms := fmtint(scratch[:], uint64(ttl/time.Millisecond), 10)
+	return &RawCmd{respMakeStringArray("PEXPIRE", key, ms)}
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"strconv"
@@ -265,3 +266,58 @@ func respFindCommand(b []byte) (start, length int) {
 	}
 	return
 }
+
+// respCommandKeys returns the keys of a command encoded as an array of bulk strings, e.g.
+// "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" => ["foo"]. Only the commands used by this package are
+// recognized; for other commands the first argument is assumed to be the key.
+func respCommandKeys(b []byte) []string {
+	args := respCommandArgs(b)
+	if len(args) < 2 {
+		return []string{}
+	}
+	keyArgs := args[1:2]
+	switch string(bytes.ToUpper(args[0])) {
+	case "MULTI", "EXEC", "DISCARD", "UNWATCH", "SCAN":
+		return []string{}
+	case "WATCH", "DEL", "EXISTS", "MGET":
+		keyArgs = args[1:]
+	case "EVAL", "EVALSHA":
+		// EVAL script numkeys key... arg...
+		if len(args) < 3 {
+			return []string{}
+		}
+		n, err := parseUint(args[2])
+		if err != nil || n > uint64(len(args)-3) {
+			return []string{}
+		}
+		keyArgs = args[3 : 3+n]
+	}
+	keys := make([]string, len(keyArgs))
+	for i, arg := range keyArgs {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+// respCommandArgs returns the arguments, including the command name, of a command encoded as
+// an array of bulk strings. The returned slices point into b.
+func respCommandArgs(b []byte) [][]byte {
+	var args [][]byte
+	if i := bytes.IndexByte(b, '\r'); i > 0 && b[0] == '*' {
+		n, _ := parseUint(b[1:i])
+		for i += 2; len(args) < int(n) && i < len(b) && b[i] == '$'; {
+			e := bytes.IndexByte(b[i:], '\r')
+			if e < 0 {
+				break
+			}
+			size, _ := parseUint(b[i+1 : i+e])
+			start := i + e + 2
+			if start+int(size) > len(b) {
+				break
+			}
+			args = append(args, b[start:start+int(size)])
+			i = start + int(size) + 2
+		}
+	}
+	return args
+}
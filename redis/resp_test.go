@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestRespCommandKeys(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	cmd := func(args ...string) []byte {
+		b := make([][]byte, len(args)-1)
+		for i, arg := range args[1:] {
+			b[i] = []byte(arg)
+		}
+		return respMakeStringArray(args[0], b...)
+	}
+	for _, test := range []struct {
+		cmd  []byte
+		keys string
+	}{
+		{cmd("GET", "foo"), "[foo]"},
+		{cmd("get", "foo"), "[foo]"},
+		{cmd("SET", "foo", "bar"), "[foo]"},
+		{cmd("HSET", "acc:1", "name", "Robin"), "[acc:1]"},
+		{cmd("WATCH", "a", "b"), "[a b]"},
+		{cmd("DEL", "a", "b", "c"), "[a b c]"},
+		{cmd("MULTI"), "[]"},
+		{cmd("EXEC"), "[]"},
+		{cmd("SCAN", "0", "MATCH", "acc:*"), "[]"},
+		{cmd("EVAL", "return 1", "2", "a", "b", "x"), "[a b]"},
+		{cmd("EVALSHA", "0123abcd", "1", "a", "x", "y"), "[a]"},
+		{cmd("EVAL", "return 1", "0", "x"), "[]"},
+		{cmd("EVAL", "return 1", "3", "a"), "[]"}, // numkeys larger than the number of args
+		{cmd("EVAL", "return 1", "n", "a"), "[]"},
+		{cmd("EVAL", "return 1"), "[]"},
+		{[]byte("*1\r\n$3\r\nGET"), "[]"}, // truncated
+	} {
+		assert.Eq(fmt.Sprintf("%q", test.cmd), fmt.Sprint(respCommandKeys(test.cmd)), test.keys)
+	}
+}
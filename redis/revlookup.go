@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// Reverse lookup of index entries (see ent.EntIndexReverseLookup)
+//
+// For an index with a reverse lookup, the key of an ent's entry in the index is stored at
+// "type#index#rev:XXXXXXXXXXXXXXXX" (XX = hex byte of the ent id) prefixed by one byte which
+// is '1' when the entry is in the index of soft-deleted ents (see ent.DeletedIndex) and '0'
+// otherwise. This allows an update to remove the previous entry without loading the previous
+// field values of the ent.
+
+// revLookupKeySuffix is appended to the index name of a reverse lookup key.
+// Index keys are not affected since they never contain entIndexKeySep after the index name.
+const revLookupKeySuffix = "#rev"
+
+// revLookupKey returns the redis storage key of the reverse lookup of an ent in index x
+func (r *Redis) revLookupKey(entType string, x *ent.EntIndex, id uint64) []byte {
+	return makeEntKey(r.keyType(entType)+string(entIndexKeySep)+x.Name+revLookupKeySuffix, id)
+}
+
+// revLookupIndex returns the index of e which x is, or is the DeletedIndex of, and true if x is
+// the DeletedIndex. Returns nil if x does not have a reverse lookup.
+func revLookupIndex(e Ent, x *ent.EntIndex) (*ent.EntIndex, bool) {
+	if !x.HasReverseLookup() {
+		return nil, false
+	}
+	indexes := e.EntIndexes()
+	for i := range indexes {
+		y := &indexes[i]
+		if y.Name == x.Name {
+			return y, false
+		}
+		if y.HasReverseLookup() && ent.DeletedIndex(y).Name == x.Name {
+			return y, true
+		}
+	}
+	return nil, false
+}
+
+// makeRevLookupSETCmd returns the key and a SET command of the reverse lookup of ed, an edit
+// which adds an entry to an index with a reverse lookup
+func (s *EntStorage) makeRevLookupSETCmd(
+	e Ent, ed *ent.StorageIndexEdit, id uint64,
+) ([]byte, radix.CmdAction) {
+	x, deleted := revLookupIndex(e, ed.Index)
+	key := s.revLookupKey(e.EntTypeName(), x, id)
+	value := make([]byte, 1, 1+len(ed.Key))
+	value[0] = '0'
+	if deleted {
+		value[0] = '1'
+	}
+	value = append(value, ed.Key...)
+	return key, MakeBulkStringCmd("SET", key, value)
+}
+
+// loadEntPartialRev is a variant of loadEntPartial for updates which, for indexes of e with a
+// reverse lookup, reads the previous entries from their reverse lookup keys instead of loading
+// the fields which only those indexes depend on. The reverse lookup keys are watched.
+// Returns the entries by index name, to be passed to computeIndexEdits.
+func (s *EntStorage) loadEntPartialRev(
+	c radix.Conn, e Ent, id uint64, entKey []byte, fields ent.FieldSet,
+) (version uint64, revs map[string][]byte, err error) {
+	var revIndexes []*ent.EntIndex
+	var revFields, keepFields ent.FieldSet
+	indexes := e.EntIndexes()
+	for i := range indexes {
+		x := &indexes[i]
+		if !fields.Intersects(x.Fields | x.Where) {
+			continue
+		}
+		// the predicate of a partial index is needed to tell if the ent should have an entry
+		keepFields |= x.Where
+		if x.HasReverseLookup() {
+			revIndexes = append(revIndexes, x)
+			revFields |= x.Fields
+		} else {
+			keepFields |= x.Fields
+		}
+	}
+	if len(revIndexes) == 0 {
+		version, err = s.loadEntPartial(c, e, entKey, fields)
+		return
+	}
+	if sd, ok := e.(ent.SoftDeleter); ok {
+		// needed to compute the edits of other indexes
+		keepFields |= 1 << uint(sd.EntDeletedField())
+	}
+	loadFields := fields &^ (revFields &^ keepFields)
+
+	// WATCH revKey...; GET revKey...; HMGET entKey ...
+	entType := e.EntTypeName()
+	revKeys := make([][]byte, len(revIndexes))
+	for i, x := range revIndexes {
+		revKeys[i] = s.revLookupKey(entType, x, id)
+	}
+	values := make([][]byte, len(revKeys))
+	cmds := make([]radix.CmdAction, 1, len(revKeys)+2)
+	cmds[0] = MakeBulkStringCmd("WATCH", revKeys...)
+	for i, key := range revKeys {
+		cmds = append(cmds, radix.Cmd(&radix.MaybeNil{Rcv: &values[i]}, "GET", string(key)))
+	}
+	cmds = append(cmds, makeEntPartialLoadCmd(e, entKey, loadFields, &version))
+	debugTrace(">> WATCH %q; GET ...; HMGET %s", revKeys, entKey)
+	if err = c.Do(radix.Pipeline(cmds...)); err != nil || version == 0 {
+		return
+	}
+
+	// There is no reverse lookup key for an ent which has no entry in the index, e.g. because
+	// of an empty key, or which was written before the index had a reverse lookup.
+	// Load the fields of such indexes instead.
+	var missingFields ent.FieldSet
+	revs = make(map[string][]byte, len(revIndexes))
+	for i, x := range revIndexes {
+		if len(values[i]) == 0 {
+			missingFields |= x.Fields
+		} else {
+			revs[x.Name] = values[i]
+		}
+	}
+	if missingFields &^= loadFields; missingFields != 0 {
+		version, err = s.loadEntPartial(c, e, entKey, missingFields)
+	}
+	return
+}
+
+// revLookupIndexEdits replaces the edits of the indexes in revs, computed by ComputeIndexEdits
+// without the previous field values, with edits computed from the previous entries in revs
+func revLookupIndexEdits(
+	edits []ent.StorageIndexEdit, revs map[string][]byte, nextEnt Ent, id uint64,
+	fields ent.FieldSet,
+) ([]ent.StorageIndexEdit, error) {
+	// Without a previous ent, ComputeIndexEdits yields the new entry of every index
+	nextEdits, err := ent.ComputeIndexEdits(nil, nil, nextEnt, id, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep edits of other indexes
+	n := 0
+	for _, ed := range edits {
+		if x, _ := revLookupIndex(nextEnt, ed.Index); x == nil || revs[x.Name] == nil {
+			edits[n] = ed
+			n++
+		}
+	}
+	edits = edits[:n]
+
+	indexes := nextEnt.EntIndexes()
+	for i := range indexes {
+		x := &indexes[i]
+		prev := revs[x.Name]
+		if prev == nil {
+			continue
+		}
+		prevDeleted, prevKey := prev[0] == '1', string(prev[1:])
+
+		var nextEdit *ent.StorageIndexEdit
+		for j := range nextEdits {
+			y, deleted := revLookupIndex(nextEnt, nextEdits[j].Index)
+			if y != nil && y.Name == x.Name {
+				if nextEdits[j].Key == prevKey && deleted == prevDeleted {
+					// identical entry; skip index changes
+					prevKey = ""
+				} else {
+					nextEdit = &nextEdits[j]
+				}
+				break
+			}
+		}
+		if prevKey != "" {
+			prevX := x
+			if prevDeleted {
+				prevX = ent.DeletedIndex(x)
+			}
+			edits = append(edits, ent.StorageIndexEdit{Index: prevX, Key: prevKey, IsCleanup: true})
+		}
+		if nextEdit != nil {
+			edits = append(edits, *nextEdit)
+		}
+	}
+	return edits, nil
+}
+
+// hasIndexAddEdit returns true if edits contains an edit which adds an entry to x, which has a
+// reverse lookup, or to the index which x is the DeletedIndex of or vice versa
+func hasIndexAddEdit(e Ent, edits []ent.StorageIndexEdit, x *ent.EntIndex) bool {
+	base, _ := revLookupIndex(e, x)
+	for i := range edits {
+		if !edits[i].IsCleanup {
+			if y, _ := revLookupIndex(e, edits[i].Index); y != nil && y.Name == base.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,8 +2,12 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 
 	"github.com/mediocregopher/radix/v3"
 	"github.com/rsms/ent"
@@ -13,7 +17,9 @@ type IdIterator struct {
 	RawCmd
 	r       *Redis
 	cursor  []byte   // nil when done
-	match   []byte   // entTypeName ":" "*"
+	match   []byte   // entTypeName ":" "*" (glob escaped)
+	idStart int      // length of entTypeName ":" in keys
+	count   []byte   // SCAN COUNT hint; nil for the redis default
 	idbuf   []uint64 // read, buffered ids to be iterated over next
 	readbuf []byte
 	err     error
@@ -21,23 +27,28 @@ type IdIterator struct {
 
 func MakeEntIterator(e Ent, s *EntStorage) *EntIterator {
 	it := &EntIterator{s: s, etype: reflect.TypeOf(e).Elem()}
-	it.init(e.EntTypeName(), s.Redis)
+	it.init(e.EntTypeName(), s.Redis, s.ScanCount)
 	return it
 }
 
 func MakeIdIterator(entType string, r *Redis) *IdIterator {
 	it := &IdIterator{}
-	it.init(entType, r)
+	it.init(entType, r, 0)
 	return it
 }
 
-func (it *IdIterator) init(entType string, r *Redis) {
+// init prepares the iterator. If count is larger than zero, it is passed as the COUNT hint to
+// SCAN (see EntStorage.ScanCount.)
+func (it *IdIterator) init(entType string, r *Redis, count int) {
 	it.r = r
 	it.cursor = make([]byte, 1, 20)
 	it.cursor[0] = '0'
-	it.match = append([]byte(entType), entKeySep, '*')
+	keyType := r.keyType(entType)
+	it.match = append(globEscape([]byte(keyType)), entKeySep, '*')
+	it.idStart = len(keyType) + 1
 	it.idbuf = make([]uint64, 0, 32)
 	it.readbuf = make([]byte, len(it.match)+15)
+	it.count = scanCountArg(count)
 }
 
 func (it *IdIterator) setErr(err error) {
@@ -67,9 +78,10 @@ func (it *IdIterator) Next(id *uint64) bool {
 
 func (it *IdIterator) fetchMore() {
 	for it.err == nil {
-		// SCAN cursor MATCH pattern
-		it.RawCmd.Data = respMakeStringArray("SCAN", it.cursor, []byte("MATCH"), it.match)
-		if err := it.r.doRead(it); err != nil {
+		// SCAN cursor MATCH pattern [COUNT count]
+		// Note that index keys never match since they use a different separator ("type#index")
+		it.RawCmd.Data = makeSCANCmd(it.cursor, it.match, it.count)
+		if err := it.r.doReadSlot(context.Background(), it.match, it); err != nil {
 			it.setErr(err)
 			it.cursor = nil
 			it.idbuf = nil
@@ -113,8 +125,8 @@ func (it *IdIterator) UnmarshalRESP(rs *bufio.Reader) error {
 	for i := 0; i < n; i++ {
 		// each ent key is of the form "typename:XXXXXXXXXXXXXXXX" (XX = hex byte)
 		b := r.AnyData(it.readbuf)
-		// fmt.Printf(">> read %q -> %q\n", b, b[len(it.match)-1:])
-		id, err := parseHexUint(b[len(it.match)-1:])
+		// fmt.Printf(">> read %q -> %q\n", b, b[it.idStart:])
+		id, err := parseHexUint(b[it.idStart:])
 		if err != nil {
 			i++
 			for ; i < n; i++ {
@@ -171,3 +183,131 @@ func (it *EntIterator) Next(e ent.Ent) bool {
 	}
 	return true
 }
+
+// ------
+
+// indexKeysCmd reads the keys of an index, either from SCAN of unique index keys
+// "type#index:value" or from ZRANGEBYLEX of a non-unique index with members "value\xfeIDIDIDID"
+type indexKeysCmd struct {
+	RawCmd
+	unique    bool
+	prefixLen int    // length of "type#index:" (unique only)
+	cursor    []byte // SCAN cursor; nil when done
+	Result    [][]byte
+}
+
+func (c *indexKeysCmd) Run(conn radix.Conn) error {
+	if err := conn.Encode(c); err != nil {
+		return err
+	}
+	return conn.Decode(c)
+}
+
+func (c *indexKeysCmd) UnmarshalRESP(rs *bufio.Reader) error {
+	r := RReader{r: rs, buf: make([]byte, 0, 256)}
+	if c.unique {
+		// reply from SCAN: cursor, keys
+		if n := r.ListHeader(); n != 2 {
+			for i := 0; i < n; i++ {
+				r.Discard()
+			}
+			return fmt.Errorf("bad response from SCAN (n=%d) %v", n, r.Err())
+		}
+		c.cursor = r.Blob()
+		if len(c.cursor) == 1 && c.cursor[0] == '0' {
+			c.cursor = nil
+		}
+	}
+	n := r.ListHeader()
+	for i := 0; i < n; i++ {
+		b := r.Blob()
+		if c.unique {
+			b = b[c.prefixLen:]
+		} else if len(b) > 8 {
+			b = b[:len(b)-9] // strip "\xfeIDIDIDID"
+		}
+		c.Result = append(c.Result, b)
+	}
+	return r.Err()
+}
+
+// ListIndexKeys is part of the ent.Storage interface
+func (s *EntStorage) ListIndexKeys(entType string, x *ent.EntIndex) ([][]byte, error) {
+	return s.ListIndexKeysContext(context.Background(), entType, x)
+}
+
+// ListIndexKeysContext is part of the ent.ContextStorage interface
+func (s *EntStorage) ListIndexKeysContext(
+	ctx context.Context, entType string, x *ent.EntIndex,
+) ([][]byte, error) {
+	indexKey := s.indexKey(entType, x, nil)
+	cmd := &indexKeysCmd{unique: x.IsUnique(), prefixLen: len(indexKey)}
+	if !cmd.unique {
+		// ZRANGEBYLEX "type#index" - +
+		cmd.RawCmd.Data = respMakeStringArray("ZRANGEBYLEX", indexKey, []byte("-"), []byte("+"))
+		if err := s.doReadContext(ctx, cmd); err != nil {
+			return nil, err
+		}
+		return uniqSortedKeys(cmd.Result), nil
+	}
+	// SCAN cursor MATCH "type#index:*" [COUNT count]
+	match := append(globEscape(indexKey), '*')
+	count := scanCountArg(s.ScanCount)
+	cmd.cursor = []byte{'0'}
+	for cmd.cursor != nil {
+		cmd.RawCmd.Data = makeSCANCmd(cmd.cursor, match, count)
+		if err := s.doReadSlot(ctx, indexKey, cmd); err != nil {
+			return nil, err
+		}
+	}
+	// SCAN may return a key more than once and in any order
+	sort.Slice(cmd.Result, func(i, j int) bool {
+		return bytes.Compare(cmd.Result[i], cmd.Result[j]) < 0
+	})
+	return uniqSortedKeys(cmd.Result), nil
+}
+
+// makeSCANCmd returns the RESP data of "SCAN cursor MATCH pattern", with "COUNT count" appended
+// if count is not nil
+func makeSCANCmd(cursor, pattern, count []byte) []byte {
+	if count == nil {
+		return respMakeStringArray("SCAN", cursor, []byte("MATCH"), pattern)
+	}
+	return respMakeStringArray("SCAN", cursor, []byte("MATCH"), pattern, []byte("COUNT"), count)
+}
+
+// scanCountArg returns the COUNT argument for SCAN, or nil if count is not larger than zero
+func scanCountArg(count int) []byte {
+	if count <= 0 {
+		return nil
+	}
+	return strconv.AppendInt(nil, int64(count), 10)
+}
+
+// uniqSortedKeys removes adjacent duplicates from keys
+func uniqSortedKeys(keys [][]byte) [][]byte {
+	if len(keys) < 2 {
+		return keys
+	}
+	j := 1
+	for i := 1; i < len(keys); i++ {
+		if !bytes.Equal(keys[i], keys[j-1]) {
+			keys[j] = keys[i]
+			j++
+		}
+	}
+	return keys[:j]
+}
+
+// globEscape escapes characters in s which have special meaning in a SCAN MATCH pattern
+func globEscape(s []byte) []byte {
+	b := make([]byte, 0, len(s)+4)
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return b
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// Scores of index entries (see ent.EntIndex.Score)
+//
+// Entries of a non-unique index are stored in a sorted set with a score of 0 (see
+// makeZADDIdCmd) which is ordered by key and looked up with ZRANGEBYLEX. For an index with a
+// score field, each entry is also stored in a sorted set per key of the index,
+// "type#index#score:value", with the ent id in big-endian byte order as the member and the value
+// of the score field as the score. FindByIndexScoreRange looks these up with ZRANGEBYSCORE.
+
+// scoreIndexKeySuffix is appended to the index name of a score key
+const scoreIndexKeySuffix = "#score"
+
+// scoreIndexKey returns the redis storage key of the sorted set of scores of the entries with
+// entryKey in index x
+func (r *Redis) scoreIndexKey(entType string, x *ent.EntIndex, entryKey []byte) []byte {
+	prefix := r.keyType(entType) + string(entIndexKeySep) + x.Name + scoreIndexKeySuffix
+	b := make([]byte, len(prefix)+1+len(entryKey))
+	i := copy(b, prefix)
+	b[i] = entKeySep
+	copy(b[i+1:], entryKey)
+	return b
+}
+
+// appendScoreCmd appends to cmds a command which adds the score of ed, an edit of an index with
+// a score field, or removes it when ed is a cleanup
+func (s *EntStorage) appendScoreCmd(
+	cmds []radix.CmdAction, entType string, ed *ent.StorageIndexEdit, id uint64,
+) []radix.CmdAction {
+	key := s.scoreIndexKey(entType, ed.Index, []byte(ed.Key))
+	var member [8]byte
+	writeUint64BE(member[:], id)
+	if ed.IsCleanup {
+		return append(cmds, MakeBulkStringCmd("ZREM", key, member[:]))
+	}
+	return append(cmds, MakeBulkStringCmd("ZADD", key, fmtScore(ed.Score), member[:]))
+}
+
+// fmtScore formats f as a redis sorted set score
+func fmtScore(f float64) []byte {
+	if math.IsInf(f, 1) {
+		return []byte("+inf")
+	} else if math.IsInf(f, -1) {
+		return []byte("-inf")
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, 64)
+}
+
+// FindByIndexScoreRange is part of the ent.Storage interface, used by
+// FindTYPEByINDEXScoreRange
+func (s *EntStorage) FindByIndexScoreRange(
+	entType string, x *ent.EntIndex, key []byte, min, max float64, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	return s.FindByIndexScoreRangeContext(
+		context.Background(), entType, x, key, min, max, limit, flags)
+}
+
+// FindByIndexScoreRangeContext is part of the ent.ContextStorage interface
+func (s *EntStorage) FindByIndexScoreRangeContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte, min, max float64,
+	limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	// ZRANGEBYSCORE "type#index#score:value" min max LIMIT 0 limit
+	cmd := makeZRangeByScoreEntIdsCmd(
+		s.scoreIndexKey(entType, x, key), min, max, limit, (flags&ent.Reverse) != 0)
+	err := s.doReadFlags(ctx, flags, cmd)
+	return cmd.Result, err
+}
+
+// makeZRangeByScoreEntIdsCmd makes a ZRANGEBYSCORE command reading the ids of the entries of a
+// score key (see scoreIndexKey) with a score in the range [min, max]
+func makeZRangeByScoreEntIdsCmd(
+	key []byte, min, max float64, limit int, rev bool,
+) *ZRangeEntIdsCmd {
+	cmd := "ZRANGEBYSCORE"
+	argsa := [6][]byte{key, fmtScore(min), fmtScore(max)}
+	if rev {
+		cmd = "ZREVRANGEBYSCORE"
+		argsa[1], argsa[2] = argsa[2], argsa[1]
+	}
+	args := argsa[:3]
+	if limit > 0 {
+		// add "LIMIT 0 limit"
+		argsa[3] = []byte("LIMIT")
+		argsa[4] = []byte("0")
+		var scratch [intBase10MaxLen]byte
+		argsa[5] = fmtint(scratch[:], uint64(limit), 10)
+		args = argsa[:]
+	}
+	return &ZRangeEntIdsCmd{RawCmd: RawCmd{respMakeStringArray(cmd, args...)}}
+}
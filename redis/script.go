@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// putEntScriptSrc runs the commands which write an ent and its index entries, after checking
+// the version of the ent and that the keys which the commands were computed from are unchanged.
+// KEYS[1] is the ent key, KEYS[2] to KEYS[N+1] are the keys of N guards and the remaining keys
+// are the other keys written by the commands, which are only passed so that all keys the
+// script accesses are declared (as required by Redis Cluster.) ARGV holds the name of the
+// version field (ent.FieldNameVersion), the expected current version ("0" when creating the
+// ent, which skips the check), N and the values of the N guards, followed by the commands,
+// each as its number of arguments followed by the arguments. A guard fails when the string
+// value of its key differs from the guard's value, or when the key exists and the guard's value
+// is empty. Returns 0 on success, -1 if the ent does not exist, -2 if its version is not as
+// expected and -3 if a guard failed.
+const putEntScriptSrc = `
+if ARGV[2] ~= "0" then
+  local ver = redis.call("HGET", KEYS[1], ARGV[1])
+  if not ver then
+    return -1
+  elseif ver ~= ARGV[2] then
+    return -2
+  end
+end
+local nguards = tonumber(ARGV[3])
+for n = 1, nguards do
+  local key, value = KEYS[n+1], ARGV[n+3]
+  if value == "" then
+    if redis.call("EXISTS", key) == 1 then
+      return -3
+    end
+  elseif redis.call("GET", key) ~= value then
+    return -3
+  end
+end
+local i = nguards + 4
+while i <= #ARGV do
+  local argc = tonumber(ARGV[i])
+  redis.call(unpack(ARGV, i + 1, i + argc))
+  i = i + argc + 1
+end
+return 0
+`
+
+// putEntScripts holds a putEntScriptSrc radix.EvalScript for each number of keys, since the
+// number of keys of an EvalScript is fixed
+var putEntScripts sync.Map // int => radix.EvalScript
+
+// putEntScriptCmd returns a command which runs putEntScriptSrc with keys and args
+func putEntScriptCmd(rcv interface{}, keys []string, args ...interface{}) radix.Action {
+	script, ok := putEntScripts.Load(len(keys))
+	if !ok {
+		script, _ = putEntScripts.LoadOrStore(
+			len(keys), radix.NewEvalScript(len(keys), putEntScriptSrc))
+	}
+	return script.(radix.EvalScript).FlatCmd(rcv, keys, args...)
+}
+
+// idCounterMaxScript sets the id counter ARGV[1] in the hash KEYS[1] to ARGV[2] if the counter
+// is lower. Ids are compared as decimal strings since Lua numbers can't represent all uint64s.
+var idCounterMaxScript = radix.NewEvalScript(1, `
+local n = redis.call("HGET", KEYS[1], ARGV[1]) or "0"
+if #n < #ARGV[2] or (#n == #ARGV[2] and n < ARGV[2]) then
+  redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// putEntScripted is the variant of putEnt used with ScriptedWrites. entCmds are the commands
+// which write the ent itself.
+func (s *EntStorage) putEntScripted(
+	ctx context.Context, e ent.Ent, id uint64, entKey []byte, prevVersion uint64,
+	fields ent.FieldSet, ttl time.Duration, entCmds []radix.CmdAction,
+) error {
+	hasIndexes := len(e.EntIndexes()) > 0
+	for attempt := 0; ; attempt++ {
+		cmds := append(make([]radix.CmdAction, 0, len(entCmds)+8), entCmds...)
+		keys := [][]byte{entKey} // keys written by cmds, which expire with ttl
+
+		// guards are the keys read to compute the index edits and their values
+		var guardKeys []string
+		var guards []interface{}
+		if hasIndexes {
+			// In case we are performing an update load the current index entries of the ent
+			var currEnt ent.Ent
+			var revs map[string][]byte
+			if prevVersion != 0 {
+				currEnt = e.EntNew()
+				var currVersion uint64
+				err := s.WClient().Do(radix.WithConn(string(entKey), func(c radix.Conn) (err error) {
+					currVersion, revs, err = s.loadEntPartialRev(c, currEnt, id, entKey, fields)
+					return
+				}))
+				if err != nil {
+					return err
+				} else if currVersion == 0 {
+					return ent.ErrNotFound
+				} else if prevVersion != currVersion {
+					return ent.ErrVersionConflict
+				}
+			}
+			err := s.computeIndexEdits(currEnt, e, id, fields, &cmds, &keys,
+				func(key []byte, cmd radix.CmdAction) error {
+					if err := s.doWriteContext(ctx, cmd); err != nil {
+						return err
+					}
+					var value string
+					if c, ok := cmd.(*RawCmdHexUint); ok && *c.ResultPtr != 0 {
+						var scratch [16]byte
+						value = string(fmtint(scratch[:], *c.ResultPtr, 16))
+					}
+					guardKeys = append(guardKeys, string(key))
+					guards = append(guards, value)
+					return nil
+				}, revs, nil)
+			if err != nil {
+				return s.endPutEnt(ctx, e, id, fields, nil, err)
+			}
+		}
+		if ttl > 0 {
+			for _, key := range keys {
+				cmds = append(cmds, makePEXPIRECmd(key, ttl))
+			}
+		}
+
+		// encode commands as script arguments, declaring the keys they write
+		scriptKeys := append([]string{string(entKey)}, guardKeys...)
+		declared := make(map[string]bool, len(scriptKeys))
+		for _, key := range scriptKeys {
+			declared[key] = true
+		}
+		args := make([]interface{}, 0, 3+len(guards)+len(cmds)*4)
+		args = append(args, ent.FieldNameVersion, prevVersion, len(guards))
+		args = append(args, guards...)
+		for _, cmd := range cmds {
+			rawCmd := cmd.(*RawCmd)
+			for _, key := range rawCmd.Keys() {
+				if !declared[key] {
+					declared[key] = true
+					scriptKeys = append(scriptKeys, key)
+				}
+			}
+			cmdArgs := respCommandArgs(rawCmd.Data)
+			args = append(args, len(cmdArgs), cmdArgs)
+		}
+
+		var result int
+		err := s.doWriteContext(ctx, putEntScriptCmd(&result, scriptKeys, args...))
+		if err == nil {
+			switch result {
+			case -1:
+				// the ent has been deleted since it was loaded
+				err = ent.ErrNotFound
+			case -2:
+				err = ent.ErrVersionConflict
+			case -3:
+				// An index entry was changed by someone else. In case it was the ent itself, the
+				// next attempt fails with ent.ErrVersionConflict when loading its current version.
+				if attempt < s.MaxRetries {
+					debugTrace("putEntScript guard failed; retrying (attempt %d)", attempt+1)
+					continue
+				}
+				err = ent.ErrVersionConflict
+			}
+		}
+		return s.endPutEnt(ctx, e, id, fields, cmds, err)
+	}
+}
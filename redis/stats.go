@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// EntStats describes the redis keys of an ent type, as returned by Stats
+type EntStats struct {
+	Ents    int                   // number of ents
+	LastId  uint64                // last id allocated for the ent type
+	Indexes map[string]IndexStats // keyed by index name
+}
+
+// IndexStats describes the redis keys of an index
+type IndexStats struct {
+	UniqueKeys int // number of keys "type#index:value" of a unique index
+	Entries    int // number of entries in the sorted set "type#index" of a non-unique index
+	OtherKeys  int // number of reverse lookup and score keys
+}
+
+// Stats counts the keys of ents of type entType and of their indexes, e.g. for monitoring.
+// An index with both UniqueKeys and Entries has changed between unique and non-unique, leaving
+// stale index entries behind (see ent.ErrIndexTypeChanged.)
+func (s *EntStorage) Stats(entType string) (EntStats, error) {
+	return s.StatsContext(context.Background(), entType)
+}
+
+// StatsContext is a variant of Stats which accepts a context.
+// The keys are found with SCAN, which takes a while when there are many ents. The counts are
+// approximate when ents are written while counting, since SCAN may then miss a key or return a
+// key more than once.
+func (s *EntStorage) StatsContext(ctx context.Context, entType string) (EntStats, error) {
+	st := EntStats{Indexes: map[string]IndexStats{}}
+	cmd := radix.FlatCmd(&radix.MaybeNil{Rcv: &st.LastId}, "HGET", s.idCounterKey(), entType)
+	if err := s.doReadContext(ctx, cmd); err != nil {
+		return EntStats{}, err
+	}
+
+	// ent keys "type:id"
+	keyType := []byte(s.keyType(entType))
+	err := s.scanKeys(ctx, keyType, entKeySep, func(key []byte) { st.Ents++ })
+	if err != nil {
+		return EntStats{}, err
+	}
+
+	// index keys "type#index", "type#index:value", "type#index#rev:id", "type#index#score:value"
+	var sortedSets []string // names of non-unique indexes
+	err = s.scanKeys(ctx, keyType, entIndexKeySep, func(key []byte) {
+		i := bytes.IndexAny(key, ":#")
+		if i == -1 {
+			sortedSets = append(sortedSets, string(key))
+			return
+		}
+		name := string(key[:i])
+		x := st.Indexes[name]
+		if key[i] == entKeySep {
+			x.UniqueKeys++
+		} else {
+			x.OtherKeys++
+		}
+		st.Indexes[name] = x
+	})
+	if err != nil {
+		return EntStats{}, err
+	}
+	for _, name := range sortedSets {
+		x := st.Indexes[name]
+		key := string(keyType) + string(entIndexKeySep) + name
+		if err := s.doReadContext(ctx, radix.FlatCmd(&x.Entries, "ZCARD", key)); err != nil {
+			return EntStats{}, err
+		}
+		st.Indexes[name] = x
+	}
+	return st, nil
+}
+
+// scanKeys calls f for each key "keyType<sep>..." found with SCAN, with "keyType<sep>" removed
+func (s *EntStorage) scanKeys(
+	ctx context.Context, keyType []byte, sep byte, f func(key []byte),
+) error {
+	// SCAN cursor MATCH "type:*" [COUNT count]
+	match := append(globEscape(keyType), sep, '*')
+	cmd := &indexKeysCmd{unique: true, prefixLen: len(keyType) + 1, cursor: []byte{'0'}}
+	count := scanCountArg(s.ScanCount)
+	for cmd.cursor != nil {
+		cmd.Result = nil
+		cmd.RawCmd.Data = makeSCANCmd(cmd.cursor, match, count)
+		if err := s.doReadSlot(ctx, keyType, cmd); err != nil {
+			return err
+		}
+		for _, key := range cmd.Result {
+			f(key)
+		}
+	}
+	return nil
+}
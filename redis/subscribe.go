@@ -0,0 +1,172 @@
+package redis
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// subscriberBufferSize is the number of events buffered for each subscriber
+const subscriberBufferSize = 64
+
+// keyspaceEventFlags are the notify-keyspace-events flags needed by Subscribe:
+// K=keyspace events, g=generic commands (e.g. DEL), h=hash commands, x=expired events
+const keyspaceEventFlags = "Kghx"
+
+// Subscribe returns a channel which receives a ChangeEvent after every create, save and delete
+// of an ent of type entType, or of any type if entType is "", made by any client of the redis
+// server. This lets multiple processes react to changes made by each other.
+//
+// Subscribe uses redis keyspace notifications, which it enables on the server with
+// CONFIG SET notify-keyspace-events as needed, on a dedicated connection which is re-established
+// if lost. Events are delivered to the channel as they are received from redis; the Version of
+// a created or saved ent is read when its event is received and may thus be newer.
+// An ent which expires (see CreateExpiring) yields a delete event.
+//
+// Events are buffered. When a subscriber does not keep up and its buffer is full, events are
+// dropped for that subscriber.
+//
+// Call the returned function to unsubscribe, which closes the dedicated connection and the
+// channel. Subscribe requires a connection made with Open (or OpenRetry.)
+func (s *EntStorage) Subscribe(entType string) (<-chan ent.ChangeEvent, func(), error) {
+	if s.opts.RWAddr == "" {
+		return nil, nil, errors.New("redis: Subscribe requires a connection made with Open")
+	}
+	if err := s.enableKeyspaceEvents(); err != nil {
+		return nil, nil, err
+	}
+
+	opts := []radix.PersistentPubSubOpt{radix.PersistentPubSubConnFunc(s.opts.connFunc())}
+	if s.Logger != nil {
+		// log errors, e.g. when reconnecting (errCh is closed by ps.Close)
+		errCh := make(chan error, 1)
+		opts = append(opts, radix.PersistentPubSubErrCh(errCh))
+		go func() {
+			for err := range errCh {
+				s.Logger.Warn("subscription failure %v", err)
+			}
+		}()
+	}
+	ps, err := radix.PersistentPubSubWithOpts("tcp", s.opts.RWAddr, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// e.g. "__keyspace@*__:account:*"
+	pattern := "__keyspace@*__:" + string(globEscape([]byte(s.KeyPrefix))) + "*"
+	if entType != "" {
+		pattern = "__keyspace@*__:" + string(globEscape([]byte(s.keyType(entType)))) + ":*"
+	}
+	msgCh := make(chan radix.PubSubMessage, subscriberBufferSize)
+	if err := ps.PSubscribe(msgCh, pattern); err != nil {
+		ps.Close()
+		return nil, nil, err
+	}
+
+	c := make(chan ent.ChangeEvent, subscriberBufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(c)
+		for {
+			select {
+			case m := <-msgCh:
+				if ev, ok := s.parseKeyspaceEvent(m); ok {
+					select {
+					case c <- ev:
+					default: // subscriber is not keeping up
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			// close ps before stopping to read msgCh since ps may be blocked sending to msgCh
+			ps.Close()
+			close(done)
+		})
+	}
+	return c, unsubscribe, nil
+}
+
+// enableKeyspaceEvents adds keyspaceEventFlags to the notify-keyspace-events setting of the
+// redis server, if needed
+func (s *EntStorage) enableKeyspaceEvents() error {
+	var config []string // ["notify-keyspace-events", flags]
+	err := s.WClient().Do(radix.Cmd(&config, "CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return err
+	}
+	var flags string
+	if len(config) == 2 {
+		flags = config[1]
+	}
+	newFlags := flags
+	for _, c := range keyspaceEventFlags {
+		// "A" is an alias for "g$lshzxe"
+		if !strings.ContainsRune(newFlags, c) && !(c != 'K' && strings.ContainsRune(flags, 'A')) {
+			newFlags += string(c)
+		}
+	}
+	if newFlags == flags {
+		return nil
+	}
+	return s.WClient().Do(radix.Cmd(nil, "CONFIG", "SET", "notify-keyspace-events", newFlags))
+}
+
+// parseKeyspaceEvent returns the ChangeEvent of a keyspace notification, e.g. channel
+// "__keyspace@0__:account:5" with message "hset". Returns false if m is not about an ent.
+func (s *EntStorage) parseKeyspaceEvent(m radix.PubSubMessage) (ent.ChangeEvent, bool) {
+	var ev ent.ChangeEvent
+	i := strings.Index(m.Channel, "__:")
+	if i == -1 {
+		return ev, false
+	}
+	entKey := m.Channel[i+3:]
+	if !strings.HasPrefix(entKey, s.KeyPrefix) {
+		return ev, false
+	}
+	key := entKey[len(s.KeyPrefix):]
+
+	// ent keys are of the form "type:XXXXXXXXXXXXXXXX" (index keys are "type#index...")
+	i = strings.LastIndexByte(key, entKeySep)
+	if i == -1 || strings.IndexByte(key[:i], entIndexKeySep) != -1 {
+		return ev, false
+	}
+	id, err := parseHexUint([]byte(key[i+1:]))
+	if err != nil || id == 0 {
+		return ev, false
+	}
+	ev.Id = id
+	ev.EntTypeName = key[:i]
+	if s.HashTags {
+		ev.EntTypeName = strings.TrimSuffix(strings.TrimPrefix(ev.EntTypeName, "{"), "}")
+	}
+
+	switch string(m.Message) {
+	case "hset":
+		if err := s.WClient().Do(
+			radix.Cmd(&radix.MaybeNil{Rcv: &ev.Version}, "HGET", entKey, ent.FieldNameVersion),
+		); err != nil || ev.Version == 0 {
+			// the ent is gone already; we will get a "del" event
+			return ev, false
+		}
+		ev.Op = ent.OpSave
+		if ev.Version == 1 {
+			ev.Op = ent.OpCreate
+		}
+	case "del", "expired":
+		ev.Op = ent.OpDelete
+	default:
+		// e.g. "hdel" and "pexpire" which are part of a create or save
+		return ev, false
+	}
+	return ev, true
+}
@@ -0,0 +1,573 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rsms/ent"
+)
+
+// Tx is a transaction of EntStorage, implementing ent.Tx.
+//
+// Writes (Create, Save and Delete) are queued up and performed by Commit in a single
+// MULTI/EXEC, watching all affected keys. Version and unique index checks are performed by
+// Commit as well, meaning that errors like ent.ErrVersionConflict are returned by Commit.
+// If any watched key is changed by someone else before the transaction is executed, Commit
+// fails with ent.ErrVersionConflict and no changes are made. Ops which claim the same unique
+// index key make Commit fail with an ent.IndexConflictErr, unless an earlier op frees the key
+// by deleting or changing the ent which holds it.
+//
+// Reads in a transaction do not observe the transaction's own pending writes.
+// With ent.WithContext, a context aborts reads while queued writes only check the context.
+// A Tx must not be used by multiple goroutines at once.
+type Tx struct {
+	s    *EntStorage
+	ops  []*txOp
+	ents ent.TxEnts
+	done bool
+}
+
+type txOp struct {
+	e            Ent    // snapshot of ent to put (e.EntNew for delete)
+	id           uint64 // ent id
+	prevVersion  uint64 // expected version in storage (0 for create)
+	fields       ent.FieldSet
+	hset         []byte       // encoded HSET command (nil for delete)
+	packedFields ent.FieldSet // fields stored compressed (see encodeEntHSETCompressed)
+}
+
+// Capabilities is part of the ent.Storage interface
+func (s *EntStorage) Capabilities() ent.StorageCaps {
+	return ent.CapTx | ent.CapRange | ent.CapScoreRange | ent.CapExpiring | ent.CapSubscribe
+}
+
+// Capabilities is part of the ent.Storage interface. Transactions can't be nested.
+func (tx *Tx) Capabilities() ent.StorageCaps {
+	return ent.CapRange | ent.CapScoreRange
+}
+
+// Begin starts a new transaction
+func (s *EntStorage) Begin() (ent.Tx, error) {
+	return &Tx{s: s}, nil
+}
+
+// Begin always fails with ent.ErrTxNested
+func (tx *Tx) Begin() (ent.Tx, error) {
+	return nil, ent.ErrTxNested
+}
+
+// Commit performs all queued writes of the transaction
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ent.ErrTxDone
+	}
+	tx.done = true
+	err := tx.commit()
+	if err != nil {
+		tx.ents.Rollback(tx, tx.s)
+	} else {
+		tx.ents.Commit(tx, tx.s)
+	}
+	tx.ops = nil
+	return err
+}
+
+// Rollback discards all queued writes of the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ent.ErrTxDone
+	}
+	tx.done = true
+	tx.ents.Rollback(tx, tx.s)
+	tx.ops = nil
+	return nil
+}
+
+func (tx *Tx) Create(e Ent, fields ent.FieldSet) (id uint64, err error) {
+	return tx.CreateContext(context.Background(), e, fields)
+}
+
+func (tx *Tx) CreateContext(
+	ctx context.Context, e Ent, fields ent.FieldSet,
+) (id uint64, err error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	id = e.Id()
+	if id == 0 {
+		// generate new ent id (ids are not reused if the transaction is rolled back)
+		cmd := radix.FlatCmd(&id, "HINCRBY", tx.s.idCounterKey(), e.EntTypeName(), 1)
+		if err = tx.s.doWriteContext(ctx, cmd); err != nil {
+			return
+		}
+	}
+	tx.ents.Add(e, true)
+	err = tx.put(e, id, 0, 1, fields)
+	return
+}
+
+func (tx *Tx) Save(e Ent, fields ent.FieldSet) (nextVersion uint64, err error) {
+	return tx.SaveContext(context.Background(), e, fields)
+}
+
+// SaveContext only checks ctx since writes are performed by Commit
+func (tx *Tx) SaveContext(
+	ctx context.Context, e Ent, fields ent.FieldSet,
+) (nextVersion uint64, err error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	tx.ents.Add(e, true)
+	prevVersion := e.Version()
+	nextVersion = prevVersion + 1
+	err = tx.put(e, e.Id(), prevVersion, nextVersion, fields)
+	return
+}
+
+func (tx *Tx) Put(e Ent, id uint64) (version uint64, err error) {
+	return tx.PutContext(context.Background(), e, id)
+}
+
+// PutContext reads the current version of the ent, which Commit then checks like for Save
+// (see EntStorage.PutContext).
+// That is, unlike EntStorage.Put, the transaction fails with ent.ErrVersionConflict if the ent
+// is changed by someone else before Commit.
+func (tx *Tx) PutContext(ctx context.Context, e Ent, id uint64) (version uint64, err error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	var prevVersion uint64
+	entKey := string(tx.s.entKey(e.EntTypeName(), id))
+	cmd := radix.FlatCmd(&radix.MaybeNil{Rcv: &prevVersion}, "HGET", entKey, ent.FieldNameVersion)
+	if err = tx.s.doWriteContext(ctx, cmd); err != nil {
+		return
+	}
+	if prevVersion == 0 {
+		// like ids created in the transaction, id is not reused if the transaction is rolled back
+		if err = tx.s.advanceIdCounter(ctx, e.EntTypeName(), id); err != nil {
+			return
+		}
+	}
+	tx.ents.Add(e, true)
+	version = prevVersion + 1
+	err = tx.put(e, id, prevVersion, version, e.EntFields().FieldSet)
+	return
+}
+
+func (tx *Tx) put(e Ent, id, prevVersion, nextVersion uint64, fields ent.FieldSet) error {
+	// merge with an earlier write to the same ent in this transaction
+	if i := tx.findOp(e.EntTypeName(), id); i != -1 {
+		if op := tx.ops[i]; op.hset != nil {
+			prevVersion = op.prevVersion
+			fields |= op.fields
+			tx.ops = append(tx.ops[:i], tx.ops[i+1:]...)
+		}
+	}
+
+	op := &txOp{e: e, id: id, prevVersion: prevVersion, fields: fields}
+	entKey := tx.s.entKey(e.EntTypeName(), id)
+	var err error
+	if tx.s.Compression != ent.NoCompression {
+		op.hset, op.packedFields, err = encodeEntHSETCompressed(
+			e, nil, entKey, nextVersion, fields, tx.s.Compression)
+	} else {
+		op.hset, err = encodeEntHSET(e, nil, entKey, nextVersion, fields)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Index edits are computed by Commit from the values of e.
+	// Since e may change before then, keep a copy of it.
+	if len(e.EntIndexes()) > 0 {
+		if op.e, err = copyEnt(e); err != nil {
+			return err
+		}
+	}
+
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func (tx *Tx) Delete(e Ent, id uint64) error {
+	return tx.DeleteContext(context.Background(), e, id)
+}
+
+// DeleteContext only checks ctx since writes are performed by Commit
+func (tx *Tx) DeleteContext(ctx context.Context, e Ent, id uint64) error {
+	if tx.done {
+		return ent.ErrTxDone
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 0 {
+		return fmt.Errorf("attempt to delete non-existing %s (id 0)", e.EntTypeName())
+	}
+	tx.ents.Add(e, true)
+	tx.delete(e, id)
+	return nil
+}
+
+func (tx *Tx) DeleteByIndex(e Ent, x *ent.EntIndex, key []byte) (int, error) {
+	return tx.DeleteByIndexContext(context.Background(), e, x, key)
+}
+
+// DeleteByIndexContext queues up deletes of the ents found in the index x.
+// Returns the number of ents found; ents which no longer exist at the time of Commit are
+// skipped by Commit.
+func (tx *Tx) DeleteByIndexContext(
+	ctx context.Context, e Ent, x *ent.EntIndex, key []byte,
+) (int, error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	ids, err := tx.s.FindByIndexContext(ctx, e.EntTypeName(), x, key, 0, 0)
+	if err != nil {
+		if err == ent.ErrNotFound {
+			err = nil
+		}
+		return 0, err
+	}
+	for _, id := range ids {
+		tx.delete(e, id)
+	}
+	return len(ids), nil
+}
+
+// delete queues up a delete of ent of the type of e with id
+func (tx *Tx) delete(e Ent, id uint64) {
+	if i := tx.findOp(e.EntTypeName(), id); i != -1 {
+		op := tx.ops[i]
+		tx.ops = append(tx.ops[:i], tx.ops[i+1:]...)
+		if op.hset != nil && op.prevVersion == 0 {
+			// ent was created in this transaction; nothing to delete
+			return
+		}
+	}
+	tx.ops = append(tx.ops, &txOp{e: e.EntNew(), id: id})
+}
+
+// findOp returns the index of the queued operation on ent entType:id, or -1 if there is none
+func (tx *Tx) findOp(entType string, id uint64) int {
+	for i, op := range tx.ops {
+		if op.id == id && op.e.EntTypeName() == entType {
+			return i
+		}
+	}
+	return -1
+}
+
+func (tx *Tx) LoadById(e Ent, id uint64) (version uint64, err error) {
+	return tx.LoadByIdContext(context.Background(), e, id)
+}
+
+func (tx *Tx) LoadByIdContext(ctx context.Context, e Ent, id uint64) (version uint64, err error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	tx.ents.Add(e, false)
+	return tx.s.LoadByIdContext(ctx, e, id)
+}
+
+func (tx *Tx) Exists(entType string, id uint64) (bool, error) {
+	return tx.ExistsContext(context.Background(), entType, id)
+}
+
+func (tx *Tx) ExistsContext(ctx context.Context, entType string, id uint64) (bool, error) {
+	if tx.done {
+		return false, ent.ErrTxDone
+	}
+	return tx.s.ExistsContext(ctx, entType, id)
+}
+
+func (tx *Tx) LoadByIndex(
+	e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, error) {
+	return tx.LoadByIndexContext(context.Background(), e, x, key, limit, flags)
+}
+
+func (tx *Tx) LoadByIndexContext(
+	ctx context.Context, e Ent, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, error) {
+	if tx.done {
+		return nil, ent.ErrTxDone
+	}
+	ents, err := tx.s.LoadByIndexContext(ctx, e, x, key, limit, flags)
+	for _, e := range ents {
+		tx.ents.Add(e, false)
+		ent.SetEntBaseFieldsAfterLoad(e, tx, e.Id(), e.Version())
+	}
+	return ents, err
+}
+
+func (tx *Tx) LoadByIndexPaged(
+	e Ent, x *ent.EntIndex, key, cursor []byte, limit int, flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	return tx.LoadByIndexPagedContext(context.Background(), e, x, key, cursor, limit, flags)
+}
+
+func (tx *Tx) LoadByIndexPagedContext(
+	ctx context.Context, e Ent, x *ent.EntIndex, key, cursor []byte, limit int,
+	flags ent.LookupFlags,
+) ([]Ent, []byte, error) {
+	if tx.done {
+		return nil, nil, ent.ErrTxDone
+	}
+	ents, nextCursor, err := tx.s.LoadByIndexPagedContext(ctx, e, x, key, cursor, limit, flags)
+	for _, e := range ents {
+		tx.ents.Add(e, false)
+		ent.SetEntBaseFieldsAfterLoad(e, tx, e.Id(), e.Version())
+	}
+	return ents, nextCursor, err
+}
+
+func (tx *Tx) FindByIndex(
+	entType string, x *ent.EntIndex, key []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	return tx.FindByIndexContext(context.Background(), entType, x, key, limit, flags)
+}
+
+func (tx *Tx) FindByIndexContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.done {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.FindByIndexContext(ctx, entType, x, key, limit, flags)
+}
+
+func (tx *Tx) FindByIndexRange(
+	entType string, x *ent.EntIndex, lo, hi []byte, limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	return tx.FindByIndexRangeContext(context.Background(), entType, x, lo, hi, limit, flags)
+}
+
+func (tx *Tx) FindByIndexRangeContext(
+	ctx context.Context, entType string, x *ent.EntIndex, lo, hi []byte, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.done {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.FindByIndexRangeContext(ctx, entType, x, lo, hi, limit, flags)
+}
+
+func (tx *Tx) FindByIndexScoreRange(
+	entType string, x *ent.EntIndex, key []byte, min, max float64, limit int,
+	flags ent.LookupFlags,
+) ([]uint64, error) {
+	return tx.FindByIndexScoreRangeContext(
+		context.Background(), entType, x, key, min, max, limit, flags)
+}
+
+func (tx *Tx) FindByIndexScoreRangeContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte, min, max float64,
+	limit int, flags ent.LookupFlags,
+) ([]uint64, error) {
+	if tx.done {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.FindByIndexScoreRangeContext(ctx, entType, x, key, min, max, limit, flags)
+}
+
+func (tx *Tx) Count(entType string, x *ent.EntIndex, key []byte) (int, error) {
+	return tx.CountContext(context.Background(), entType, x, key)
+}
+
+func (tx *Tx) CountContext(
+	ctx context.Context, entType string, x *ent.EntIndex, key []byte,
+) (int, error) {
+	if tx.done {
+		return 0, ent.ErrTxDone
+	}
+	return tx.s.CountContext(ctx, entType, x, key)
+}
+
+func (tx *Tx) ListIndexKeys(entType string, x *ent.EntIndex) ([][]byte, error) {
+	return tx.ListIndexKeysContext(context.Background(), entType, x)
+}
+
+func (tx *Tx) ListIndexKeysContext(
+	ctx context.Context, entType string, x *ent.EntIndex,
+) ([][]byte, error) {
+	if tx.done {
+		return nil, ent.ErrTxDone
+	}
+	return tx.s.ListIndexKeysContext(ctx, entType, x)
+}
+
+func (tx *Tx) IterateIds(entType string) ent.IdIterator {
+	return tx.s.IterateIds(entType)
+}
+
+func (tx *Tx) IterateEnts(e Ent) ent.EntIterator {
+	return &txEntIterator{tx.s.IterateEnts(e), tx}
+}
+
+// txEntIterator binds ents loaded by an iterator to a transaction
+type txEntIterator struct {
+	ent.EntIterator
+	tx *Tx
+}
+
+func (it *txEntIterator) Next(e Ent) bool {
+	if it.tx.done {
+		return false
+	}
+	if !it.EntIterator.Next(e) {
+		return false
+	}
+	it.tx.ents.Add(e, false)
+	ent.SetEntBaseFieldsAfterLoad(e, it.tx, e.Id(), e.Version())
+	return true
+}
+
+func (tx *Tx) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	s := tx.s
+
+	// cmds holds all "write" commands, to be run inside a MULTI (pipelined)
+	cmds := make([]radix.CmdAction, 1, 2+len(tx.ops)*2)
+	cmds[0] = &CmdMULTI
+	watchKeys := make([][]byte, 0, len(tx.ops))
+	exec := &txExecCmd{RawCmd: CmdEXEC}
+
+	// claims holds the unique index keys written by the ops, since the keys are only read and
+	// checked against what is stored before anything is written (see computeIndexEdits)
+	claims := make(map[string]uint64)
+
+	// With a Redis Cluster, all ents of the transaction must be of the same type (see HashTags)
+	slotKey := s.entKey(tx.ops[0].e.EntTypeName(), tx.ops[0].id)
+
+	err := s.batchContext(context.Background(), slotKey, func(c radix.Conn) (err error) {
+		// UNWATCH in case of error
+		defer func() {
+			if err != nil {
+				debugTrace(">> UNWATCH (reason: %v)", err)
+				c.Do(&CmdUNWATCH)
+			}
+		}()
+
+		doNow := func(key []byte, cmd radix.CmdAction) error {
+			debugTrace(">> WATCH %s; %+v", key, cmd)
+			return c.Do(radix.Pipeline(MakeSingleKeyCmd("WATCH", key), cmd))
+		}
+
+		for _, op := range tx.ops {
+			entKey := tx.s.entKey(op.e.EntTypeName(), op.id)
+			debugTrace(">> WATCH %s", entKey)
+			if err = c.Do(MakeSingleKeyCmd("WATCH", entKey)); err != nil {
+				return
+			}
+			watchKeys = append(watchKeys, entKey)
+
+			if op.hset == nil {
+				// delete
+				cmds = append(cmds, MakeSingleKeyCmd("DEL", entKey))
+				if len(op.e.EntIndexes()) > 0 {
+					allfields := op.e.EntFields().FieldSet
+					if _, err = s.loadEntPartial(c, op.e, entKey, allfields); err != nil {
+						return
+					}
+					err = s.computeIndexEdits(
+						op.e, nil, op.id, allfields, &cmds, &watchKeys, nil, nil, claims)
+					if err != nil {
+						return
+					}
+				}
+				continue
+			}
+
+			// load current version of the ent, if updating
+			var currEnt Ent
+			var revs map[string][]byte
+			if op.prevVersion != 0 {
+				currEnt = op.e.EntNew()
+				var currVersion uint64
+				currVersion, revs, err = s.loadEntPartialRev(c, currEnt, op.id, entKey, op.fields)
+				if err != nil {
+					return err
+				} else if currVersion == 0 {
+					return ent.ErrNotFound
+				} else if currVersion != op.prevVersion {
+					return ent.ErrVersionConflict
+				}
+			}
+
+			cmds = append(cmds, &RawCmd{op.hset})
+			if op.packedFields != 0 {
+				cmds = append(cmds, makeHDELFieldsCmd(entKey, op.e, op.packedFields))
+			}
+			err = s.computeIndexEdits(
+				currEnt, op.e, op.id, op.fields, &cmds, &watchKeys, doNow, revs, claims)
+			if err != nil {
+				return
+			}
+		}
+
+		cmds = append(cmds, exec)
+		debugTrace(">> %s", strings.ReplaceAll(fmt.Sprintf("%+v", cmds), "RawCmd(", "\n  RawCmd("))
+		if err = c.Do(radix.Pipeline(cmds...)); err == nil && exec.aborted {
+			// a watched key was modified
+			err = ent.ErrVersionConflict
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	// write-through, like EntStorage.putEnt
+	if s.RClient() != s.WClient() {
+		err := s.RClient().Do(radix.Pipeline(cmds...))
+		if err != nil && s.Logger != nil {
+			s.Logger.Warn("write-through cache failure %v", err)
+		}
+	}
+	return nil
+}
+
+// txExecCmd is an EXEC command which records if the transaction was aborted
+type txExecCmd struct {
+	RawCmd
+	aborted bool
+}
+
+func (c *txExecCmd) Run(conn radix.Conn) error {
+	if err := conn.Encode(c); err != nil {
+		return err
+	}
+	return conn.Decode(c)
+}
+
+func (c *txExecCmd) UnmarshalRESP(r *bufio.Reader) error {
+	reader := RReader{r: r, buf: make([]byte, 0, 32)}
+	n := reader.ListHeader()
+	// EXEC replies with a nil array when the transaction was aborted
+	c.aborted = n == -1 && reader.Err() == nil
+	for i := 0; i < n; i++ {
+		reader.Discard()
+	}
+	return reader.Err()
+}
+
+// copyEnt returns a copy of e's fields, id and version
+func copyEnt(e Ent) (Ent, error) {
+	data, err := ent.JsonEncodeEnt(e, e.Id(), e.Version(), e.EntFields().FieldSet, "")
+	if err != nil {
+		return nil, err
+	}
+	e2 := e.EntNew()
+	_, _, err = ent.JsonDecodeEnt(e2, data)
+	return e2, err
+}
@@ -6,6 +6,12 @@ type ReprFlags int
 const (
 	// ReprOmitEmpty causes empty, non-numeric fields to be excluded
 	ReprOmitEmpty = ReprFlags(1 << iota)
+
+	// ReprCompact produces a single line without indentation, e.g. for logging
+	ReprCompact
+
+	// ReprOmitMeta causes the id and version of the ent to be excluded
+	ReprOmitMeta
 )
 
 // Repr formats a human-readable representation of an ent. It only includes fields.
@@ -14,11 +20,19 @@ func Repr(e Ent, fields FieldSet, flags ReprFlags) ([]byte, error) {
 		fields &= ^FieldsWithEmptyValue(e)
 	}
 	c := JsonEncoder{BareKeys: true}
-	c.Builder.Indent = "  "
-	c.BeginEnt(e.Version())
-	c.Key(FieldNameId)
-	c.Uint(e.Id(), 64)
-	e.EntEncode(&c, fields)
-	c.EndEnt()
+	if (flags & ReprCompact) == 0 {
+		c.Builder.Indent = "  "
+	}
+	if (flags & ReprOmitMeta) != 0 {
+		c.StartObject()
+		e.EntEncode(&c, fields)
+		c.EndObject()
+	} else {
+		c.BeginEnt(e.Version())
+		c.Key(FieldNameId)
+		c.Uint(e.Id(), 64)
+		e.EntEncode(&c, fields)
+		c.EndEnt()
+	}
 	return c.Bytes(), c.Err()
 }
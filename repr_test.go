@@ -0,0 +1,22 @@
+package ent
+
+import (
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestRepr(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &sizeIndexTestEnt{w: 1, h: 2}
+	SetEntBaseFieldsAfterLoad(e, nil, 3, 4)
+	repr := func(flags ReprFlags) string {
+		b, err := Repr(e, e.EntFields().FieldSet, flags)
+		assert.NoErr("Repr", err)
+		return string(b)
+	}
+	assert.Eq("default", repr(ReprOmitEmpty), "{\n  _ver: \"4\",\n  _id: \"3\",\n  w: \"1\",\n  h: \"2\"\n}")
+	assert.Eq("compact", repr(ReprOmitEmpty|ReprCompact), `{_ver:"4",_id:"3",w:"1",h:"2"}`)
+	assert.Eq("omit meta", repr(ReprCompact|ReprOmitMeta), `{w:"1",h:"2",name:""}`)
+	assert.Eq("EntStringCompact", EntStringCompact(e), `{_ver:"4",_id:"3",w:"1",h:"2"}`)
+}
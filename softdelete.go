@@ -0,0 +1,124 @@
+package ent
+
+// SoftDeleter is implemented by ents which have a soft-delete marker field. entgen generates
+// this for ents with a bool or time.Time field with the "softdelete" tag, e.g.
+// "deleted bool `ent:\",softdelete\"`".
+//
+// Index entries of soft-deleted ents are kept separate from those of other ents (see
+// DeletedIndex) which means that soft-deleted ents are excluded from index lookups unless the
+// IncludeDeleted lookup flag is used.
+type SoftDeleter interface {
+	Ent
+	EntIsDeleted() bool   // true if the ent is soft-deleted
+	EntDeletedField() int // field index of the soft-delete marker
+}
+
+// IsDeleted returns true if e is a SoftDeleter which is soft-deleted
+func IsDeleted(e Ent) bool {
+	sd, ok := e.(SoftDeleter)
+	return ok && sd.EntIsDeleted()
+}
+
+// deletedIndexSuffix is appended to the name of an index to form its DeletedIndex
+const deletedIndexSuffix = "~deleted"
+
+// DeletedIndex returns the index which holds the entries of soft-deleted ents for index x.
+// A deleted index is never unique since any number of soft-deleted ents may share a key.
+// Used by ComputeIndexEdits and by Storage implementations to implement IncludeDeleted.
+func DeletedIndex(x *EntIndex) *EntIndex {
+	return &EntIndex{
+		Name:   x.Name + deletedIndexSuffix,
+		Fields: x.Fields,
+		Flags:  x.Flags &^ EntIndexUnique,
+		Where:  x.Where,
+		Score:  x.Score,
+	}
+}
+
+// FindIdsIncludingDeleted calls find with x and with DeletedIndex(x) and returns the merged
+// ids, ordered by id. find should return ids in ascending order, or descending order if flags
+// contains Reverse. ErrNotFound returned by find is ignored.
+// Meant to be used by Storage implementations to implement the IncludeDeleted lookup flag.
+func FindIdsIncludingDeleted(
+	x *EntIndex, limit int, flags LookupFlags,
+	find func(x *EntIndex, flags LookupFlags) ([]uint64, error),
+) ([]uint64, error) {
+	flags &^= IncludeDeleted
+	ids, err := find(x, flags)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	deleted, err := find(DeletedIndex(x), flags)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return mergeIds(ids, deleted, limit, (flags&Reverse) != 0), nil
+}
+
+// mergeIds merges two sorted lists of ids into one of at most limit ids
+func mergeIds(a, b []uint64, limit int, reverse bool) []uint64 {
+	if len(b) == 0 || len(a) == 0 {
+		a = append(a, b...)
+	} else {
+		v := make([]uint64, 0, len(a)+len(b))
+		for len(a) > 0 && len(b) > 0 {
+			if (a[0] < b[0]) != reverse {
+				v, a = append(v, a[0]), a[1:]
+			} else {
+				v, b = append(v, b[0]), b[1:]
+			}
+		}
+		a = append(append(v, a...), b...)
+	}
+	if limit > 0 && len(a) > limit {
+		a = a[:limit]
+	}
+	return a
+}
+
+// softDeleteFields returns the fields to save for e, given changed fields.
+// For a SoftDeleter, a change to the soft-delete marker includes all indexed fields and a
+// change to an indexed field includes the marker. This way a storage loading the current
+// version of the ent with fields has what ComputeIndexEdits needs to move its index entries.
+func softDeleteFields(e Ent, fields FieldSet) FieldSet {
+	sd, ok := e.(SoftDeleter)
+	if !ok {
+		return fields
+	}
+	var indexed FieldSet
+	for _, x := range e.EntIndexes() {
+		indexed |= x.Fields | x.Where
+	}
+	if fields.Has(sd.EntDeletedField()) {
+		return fields | indexed
+	}
+	if fields.Intersects(indexed) {
+		return fields.With(sd.EntDeletedField())
+	}
+	return fields
+}
+
+// IterateEnts returns an iterator over all ents of the type of proto in s.
+// Soft-deleted ents (see SoftDeleter) are skipped unless flags contains IncludeDeleted.
+// Note that when skipping soft-deleted ents, Next may modify its ent even when it returns false.
+func IterateEnts(s Storage, proto Ent, flags ...LookupFlags) EntIterator {
+	it := s.IterateEnts(proto)
+	if _, ok := proto.(SoftDeleter); ok && (mergeLookupFlags(flags)&IncludeDeleted) == 0 {
+		it = &undeletedEntIterator{it}
+	}
+	return it
+}
+
+// undeletedEntIterator skips soft-deleted ents
+type undeletedEntIterator struct {
+	EntIterator
+}
+
+func (it *undeletedEntIterator) Next(e Ent) bool {
+	for it.EntIterator.Next(e) {
+		if !IsDeleted(e) {
+			return true
+		}
+	}
+	return false
+}
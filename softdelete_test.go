@@ -0,0 +1,39 @@
+package ent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+func TestFindIdsIncludingDeleted(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	x := &EntIndex{Name: "email", Flags: EntIndexUnique}
+	index := map[string][]uint64{
+		"email":         {4},
+		"email~deleted": {2, 7},
+	}
+	find := func(x *EntIndex, flags LookupFlags) ([]uint64, error) {
+		assert.Eq("flags", flags&IncludeDeleted, LookupFlags(0))
+		if x.Name != "email" {
+			assert.Eq("deleted index is not unique", x.IsUnique(), false)
+		}
+		ids := index[x.Name]
+		if (flags & Reverse) != 0 {
+			v := make([]uint64, len(ids))
+			for i, id := range ids {
+				v[len(ids)-1-i] = id
+			}
+			ids = v
+		}
+		return ids, nil
+	}
+	ids, err := FindIdsIncludingDeleted(x, 0, IncludeDeleted, find)
+	assert.NoErr("find", err)
+	assert.Eq("ids", fmt.Sprint(ids), "[2 4 7]")
+
+	ids, err = FindIdsIncludingDeleted(x, 2, IncludeDeleted|Reverse, find)
+	assert.NoErr("find", err)
+	assert.Eq("ids", fmt.Sprint(ids), "[7 4]")
+}
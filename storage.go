@@ -4,18 +4,51 @@ import (
 	"fmt"
 )
 
-// Storage is the interface for persistent storage of ents
+// Storage is the interface for persistent storage of ents.
+// Index keys passed to its methods are only valid for the duration of the call; their memory
+// is reused afterwards.
 type Storage interface {
 	Create(e Ent, fields FieldSet) (id uint64, err error)
 	Save(e Ent, fields FieldSet) (version uint64, err error)
+	Put(e Ent, id uint64) (version uint64, err error) // see PutEnt
 	LoadById(e Ent, id uint64) (version uint64, err error)
+	Exists(entType string, id uint64) (bool, error) // see EntExists
 	LoadByIndex(e Ent, x *EntIndex, key []byte, limit int, fl LookupFlags) ([]Ent, error)
+	LoadByIndexPaged( // see LoadEntsByIndexKeyPaged
+		e Ent, x *EntIndex, key, cursor []byte, limit int, fl LookupFlags,
+	) (ents []Ent, nextCursor []byte, err error)
 	FindByIndex(entType string, x *EntIndex, key []byte, limit int, fl LookupFlags) ([]uint64, error)
+	FindByIndexRange( // see FindIdsByIndexKeyRange
+		entType string, x *EntIndex, lo, hi []byte, limit int, fl LookupFlags) ([]uint64, error)
+	FindByIndexScoreRange( // see FindIdsByIndexKeyScoreRange
+		entType string, x *EntIndex, key []byte, min, max float64, limit int, fl LookupFlags,
+	) ([]uint64, error)
+	Count(entType string, x *EntIndex, key []byte) (int, error)
+	ListIndexKeys(entType string, x *EntIndex) ([][]byte, error) // sorted, without duplicates
 	IterateIds(entType string) IdIterator
 	IterateEnts(proto Ent) EntIterator
 	Delete(e Ent, id uint64) error
+	DeleteByIndex( // see DeleteEntsByIndexKey
+		e Ent, x *EntIndex, key []byte) (n int, err error)
+	Begin() (Tx, error)        // begin a transaction (see Tx)
+	Capabilities() StorageCaps // optional features of the storage
 }
 
+// StorageCaps is a set of optional features of a storage (see Storage.Capabilities).
+// Lookups which need a feature the storage lacks return ErrUnsupported.
+type StorageCaps uint32
+
+const (
+	CapTx         StorageCaps = 1 << iota // Begin starts a transaction
+	CapRange                              // FindByIndexRange, used by range and prefix lookups
+	CapScoreRange                         // FindByIndexScoreRange (see EntIndex.Score)
+	CapExpiring                           // ents can be created with a time to live
+	CapSubscribe                          // changes to ents can be subscribed to
+)
+
+// Has returns true if c includes all of caps
+func (c StorageCaps) Has(caps StorageCaps) bool { return c&caps == caps }
+
 type IdIterator interface {
 	// Next reads the next id. Returns false when the iterator has reached its end.
 	Next(id *uint64) bool
@@ -29,60 +62,22 @@ type EntIterator interface {
 	Err() error // returns non-nil if an error occured
 }
 
-// Encoder is the interface for ent field encoders.
-// ent.JsonEncoder is an example of an implementation.
-type Encoder interface {
-	Err() error // returns the error state of the encoder
-
-	BeginEnt(version uint64) // start encoding an ent
-	EndEnt()                 // finalize encoding of an ent
-
-	BeginList(length int) // start encoding a list of length
-	EndList()             // end encoding a list
-
-	BeginDict(length int) // start encoding a dictionary with length entries
-	EndDict()             // end encoding of a dict
-
-	Key(k string) // encode key for a field (value call should follow)
-
-	Str(v string)                 // encode a string value
-	Blob(v []byte)                // encode a raw-bytes value
-	Int(v int64, bitsize int)     // advisory size
-	Uint(v uint64, bitsize int)   // advisory size
-	Float(v float64, bitsize int) // advisory size
-	Bool(v bool)                  // encode a boolean value
-}
-
-// Decoder is the interface for ent field decoders.
-// ent.JsonDecoder is an example of an implementation.
-type Decoder interface {
-	Err() error // returns the error state of the decoder
-
-	// Key reads & returns the next key. Returns "" in case there are no more fields.
-	Key() string
-
-	ListHeader() int // decode a list header. Returns known size or -1 if unknown
-	DictHeader() int // decode a dict header. Returns known size or -1 if unknown
-
-	// More reports whether there is another element in the current list or dict being decoded.
-	// Only used when ListHeader and DictHeader returns -1.
-	More() bool
-
-	Str() string  // decode a string field
-	Blob() []byte // decode a byte array field
-	Bool() bool
-	Int(bitsize int) int64     // advisory size
-	Uint(bitsize int) uint64   // advisory size
-	Float(bitsize int) float64 // advisory size
-	Discard()                  // read and discard any value
-}
-
 // LookupFlags describe options for lookup
 type LookupFlags int
 
 const (
-	// Reverse returns results in reverse order. Useful in combination with a limit.
+	// Reverse returns results in reverse (descending) order. A limit is applied after reversing,
+	// i.e. a lookup with Reverse and a limit of N returns the last N results.
 	Reverse = LookupFlags(1 << iota)
+
+	// IncludeDeleted includes soft-deleted ents (see SoftDeleter) in results.
+	// Not supported by range lookups, which only include ents that are not soft-deleted.
+	IncludeDeleted
+
+	// Consistent makes a storage which reads from replicas, like redis with a read-only server,
+	// read from its primary instead, so that the result reflects all writes made before the
+	// lookup, e.g. right after a Create. Other storages ignore it.
+	Consistent
 )
 
 // EntIndexFlag describes properties of an EntIndex
@@ -90,6 +85,15 @@ type EntIndexFlag int
 
 const (
 	EntIndexUnique = 1 << iota // a unique index entry points to exactly one ent
+
+	// EntIndexReverseLookup asks storage to maintain a reverse lookup from ent id to the ent's
+	// key in the index, so that the previous entry can be removed on update without loading
+	// the previous field values. Storage implementations may ignore this flag.
+	EntIndexReverseLookup
+
+	// EntIndexMulti makes an index of a list field have one entry per element of the list, so
+	// that ents can be looked up by any one of their elements (see IndexKeyEncoder.EncodeKeys)
+	EntIndexMulti
 )
 
 // EntIndex describes a secondary index and are usually generated by entgen
@@ -97,11 +101,28 @@ type EntIndex struct {
 	Name   string
 	Fields FieldSet // bitmap of field indices which this index depends on
 	Flags  EntIndexFlag
+
+	// Where makes the index partial: only ents which bool fields in Where are all true have
+	// entries in the index. Zero for a regular index.
+	Where FieldSet
+
+	// Score is the numeric field which value is the score of the entries of a non-unique index,
+	// used to look up ents ordered by score with FindByIndexScoreRange. Zero for an index
+	// without a score field.
+	Score FieldSet
 }
 
 // IsUnique is true if a key in index maps to exactly one ent (i.e. keys are unique)
 func (x EntIndex) IsUnique() bool { return (x.Flags & EntIndexUnique) != 0 }
 
+// HasReverseLookup is true if storage should maintain a reverse lookup for the index
+// (see EntIndexReverseLookup)
+func (x EntIndex) HasReverseLookup() bool { return (x.Flags & EntIndexReverseLookup) != 0 }
+
+// IsMulti is true if the index has an entry for each element of its list field
+// (see EntIndexMulti)
+func (x EntIndex) IsMulti() bool { return (x.Flags & EntIndexMulti) != 0 }
+
 // VersionConflictErr is returned when a Save call fails because the ent has changed
 // by someone else since it was loaded.
 type VersionConflictErr struct {
@@ -130,9 +151,61 @@ type IndexConflictErr struct {
 	Underlying  error  // i.e. ErrUniqueConflict
 	EntTypeName string // typename of subject ent (== TYPE.EntTypeName())
 	IndexName   string // name of subject index
+	Key         string // index key which is taken; empty if unknown
+	ExistingId  uint64 // id of the ent which has Key; 0 if unknown
 }
 
+// Unwrap returns e.Underlying, so that errors.Is(err, ErrUniqueConflict) is true for a
+// conflict on a unique index
 func (e *IndexConflictErr) Unwrap() error { return e.Underlying }
+
+// Error describes the conflict, e.g.
+// `unique index conflict on account.email (key "jane@example.com" taken by id 1)`
 func (e *IndexConflictErr) Error() string {
-	return fmt.Sprintf("index conflict on %s.%s", e.EntTypeName, e.IndexName)
+	if e.Underlying == ErrIndexTypeChanged {
+		return fmt.Sprintf("%v: %s.%s", e.Underlying, e.EntTypeName, e.IndexName)
+	}
+	msg := "index conflict"
+	if e.Underlying != nil {
+		msg = e.Underlying.Error()
+	}
+	msg += fmt.Sprintf(" on %s.%s", e.EntTypeName, e.IndexName)
+	if e.Key != "" {
+		msg += fmt.Sprintf(" (key %q", e.Key)
+		if e.ExistingId != 0 {
+			msg += fmt.Sprintf(" taken by id %d", e.ExistingId)
+		}
+		msg += ")"
+	}
+	return msg
+}
+
+// ChangeOp is the kind of change described by a ChangeEvent
+type ChangeOp int
+
+const (
+	OpCreate ChangeOp = iota + 1
+	OpSave
+	OpDelete
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case OpCreate:
+		return "create"
+	case OpSave:
+		return "save"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", int(op))
+}
+
+// ChangeEvent describes a change made to an ent in a storage, for example as delivered to
+// subscribers of mem.EntStorage.Subscribe and redis.EntStorage.Subscribe
+type ChangeEvent struct {
+	Op          ChangeOp
+	EntTypeName string
+	Id          uint64
+	Version     uint64 // version after the change; 0 for OpDelete
 }
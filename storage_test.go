@@ -0,0 +1,133 @@
+package ent
+
+import (
+	"fmt"
+)
+
+// testStorage is a Storage which records the calls made to it in calls, e.g. "Put 7", and
+// otherwise stores nothing: writes succeed and lookups find no ents. Tests embed it and override
+// the methods they need, so that calls to other methods don't panic like they would with an
+// embedded nil Storage.
+type testStorage struct {
+	calls []string
+	ids   []uint64    // returned by IterateIds
+	caps  StorageCaps // returned by Capabilities
+}
+
+func (s *testStorage) record(format string, args ...interface{}) {
+	s.calls = append(s.calls, fmt.Sprintf(format, args...))
+}
+
+func (s *testStorage) Create(e Ent, fields FieldSet) (uint64, error) {
+	s.record("Create")
+	return 1, nil
+}
+
+func (s *testStorage) Save(e Ent, fields FieldSet) (uint64, error) {
+	s.record("Save %d", e.Id())
+	return e.Version() + 1, nil
+}
+
+func (s *testStorage) Put(e Ent, id uint64) (uint64, error) {
+	s.record("Put %d", id)
+	return 1, nil
+}
+
+func (s *testStorage) LoadById(e Ent, id uint64) (uint64, error) {
+	s.record("LoadById %d", id)
+	return 0, ErrNotFound
+}
+
+func (s *testStorage) Exists(entType string, id uint64) (bool, error) {
+	s.record("Exists %d", id)
+	return false, nil
+}
+
+func (s *testStorage) LoadByIndex(
+	e Ent, x *EntIndex, key []byte, limit int, fl LookupFlags,
+) ([]Ent, error) {
+	s.record("LoadByIndex %s", x.Name)
+	return nil, nil
+}
+
+func (s *testStorage) LoadByIndexPaged(
+	e Ent, x *EntIndex, key, cursor []byte, limit int, fl LookupFlags,
+) ([]Ent, []byte, error) {
+	s.record("LoadByIndexPaged %s", x.Name)
+	return nil, nil, nil
+}
+
+func (s *testStorage) FindByIndex(
+	entType string, x *EntIndex, key []byte, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	s.record("FindByIndex %s", x.Name)
+	return nil, nil
+}
+
+func (s *testStorage) FindByIndexRange(
+	entType string, x *EntIndex, lo, hi []byte, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	s.record("FindByIndexRange %s", x.Name)
+	return nil, nil
+}
+
+func (s *testStorage) FindByIndexScoreRange(
+	entType string, x *EntIndex, key []byte, min, max float64, limit int, fl LookupFlags,
+) ([]uint64, error) {
+	s.record("FindByIndexScoreRange %s", x.Name)
+	return nil, nil
+}
+
+func (s *testStorage) Count(entType string, x *EntIndex, key []byte) (int, error) {
+	s.record("Count %s", x.Name)
+	return 0, nil
+}
+
+func (s *testStorage) ListIndexKeys(entType string, x *EntIndex) ([][]byte, error) {
+	s.record("ListIndexKeys %s", x.Name)
+	return nil, nil
+}
+
+func (s *testStorage) IterateIds(entType string) IdIterator {
+	s.record("IterateIds")
+	return &testIdIterator{s.ids}
+}
+
+func (s *testStorage) IterateEnts(proto Ent) EntIterator {
+	s.record("IterateEnts")
+	return &testEntIterator{}
+}
+
+func (s *testStorage) Delete(e Ent, id uint64) error {
+	s.record("Delete %d", id)
+	return nil
+}
+
+func (s *testStorage) DeleteByIndex(e Ent, x *EntIndex, key []byte) (int, error) {
+	s.record("DeleteByIndex %s", x.Name)
+	return 0, nil
+}
+
+func (s *testStorage) Begin() (Tx, error) {
+	s.record("Begin")
+	return nil, ErrUnsupported
+}
+
+func (s *testStorage) Capabilities() StorageCaps { return s.caps }
+
+type testIdIterator struct{ ids []uint64 }
+
+func (it *testIdIterator) Next(id *uint64) bool {
+	if len(it.ids) == 0 {
+		return false
+	}
+	*id, it.ids = it.ids[0], it.ids[1:]
+	return true
+}
+
+func (it *testIdIterator) Err() error { return nil }
+
+type testEntIterator struct{}
+
+func (it *testEntIterator) Next(e Ent) bool { return false }
+func (it *testEntIterator) Err() error      { return nil }
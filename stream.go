@@ -0,0 +1,95 @@
+package ent
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// StreamEncoder writes ents to an io.Writer as newline-delimited JSON, one ent per line.
+// Each ent is written as soon as it has been encoded, so that any number of ents can be
+// written, e.g. to a file or a HTTP response, with bounded memory.
+type StreamEncoder struct {
+	w   io.Writer
+	err error
+}
+
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w}
+}
+
+// Encode writes e, including its id and version.
+// Once writing has failed, Encode keeps returning the same error.
+func (c *StreamEncoder) Encode(e Ent) error {
+	if c.err != nil {
+		return c.err
+	}
+	data, err := JsonEncode(e, "")
+	if err == nil {
+		_, err = c.w.Write(append(data, '\n'))
+	}
+	c.err = err
+	return err
+}
+
+// EncodeAll writes all ents of it, loading each into e, and returns the number of ents written.
+// For example, to write all accounts:
+//
+//	n, err := enc.EncodeAll(ent.IterateEnts(estore, &Account{}), &Account{})
+func (c *StreamEncoder) EncodeAll(it EntIterator, e Ent) (n int, err error) {
+	for it.Next(e) {
+		if err = c.Encode(e); err != nil {
+			return
+		}
+		n++
+	}
+	err = it.Err()
+	return
+}
+
+// StreamDecoder reads ents written by StreamEncoder from an io.Reader, one at a time.
+// It implements EntIterator, reading the next ent with each call to Next.
+//
+// Note that fields which are not present in the data of an ent keep the value they had in the
+// receiving ent. Use a new ent in each call in case the data may lack fields.
+type StreamDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next ent into e, including its id and version.
+// Returns io.EOF when there are no more ents.
+func (c *StreamDecoder) Decode(e Ent) error {
+	for c.err == nil {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			c.err = err
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue // skip empty lines
+		}
+		if err = JsonDecode(e, line); err != nil {
+			c.err = err
+		}
+		return err
+	}
+	return c.err
+}
+
+// Next is part of the EntIterator interface
+func (c *StreamDecoder) Next(e Ent) bool {
+	return c.Decode(e) == nil
+}
+
+// Err is part of the EntIterator interface. Returns nil when the end of input has been reached.
+func (c *StreamDecoder) Err() error {
+	if c.err == io.EOF {
+		return nil
+	}
+	return c.err
+}
@@ -0,0 +1,69 @@
+package ent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+type streamTestEnt struct {
+	EntBase
+	name string
+}
+
+func (e *streamTestEnt) EntTypeName() string { return "streamtest" }
+func (e *streamTestEnt) EntNew() Ent         { return &streamTestEnt{} }
+func (e *streamTestEnt) EntEncode(c Encoder, fields FieldSet) {
+	c.Key("name")
+	c.Str(e.name)
+}
+func (e *streamTestEnt) EntDecode(c Decoder) (id, version uint64) {
+	for {
+		switch c.Key() {
+		case "":
+			return
+		case FieldNameId:
+			id = c.Uint(64)
+		case FieldNameVersion:
+			version = c.Uint(64)
+		case "name":
+			e.name = c.Str()
+		default:
+			c.Discard()
+		}
+	}
+}
+func (e *streamTestEnt) EntDecodePartial(c Decoder, fields FieldSet) uint64 { return 0 }
+func (e *streamTestEnt) EntIndexes() []EntIndex                             { return nil }
+func (e *streamTestEnt) EntFields() Fields {
+	return Fields{Names: []string{"name"}, FieldSet: 1}
+}
+
+func TestStreamCodec(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf)
+	for i, name := range []string{"a", "b\nc"} {
+		e := &streamTestEnt{name: name}
+		e.id, e.version = uint64(i+1), 1
+		assert.NoErr("encode", enc.Encode(e))
+	}
+	assert.Eq("lines", bytes.Count(buf.Bytes(), []byte("\n")), 2)
+
+	dec := NewStreamDecoder(&buf)
+	var names []string
+	e := &streamTestEnt{}
+	for dec.Next(e) {
+		assert.Eq("id", e.Id(), uint64(len(names)+1))
+		names = append(names, e.name)
+	}
+	assert.NoErr("decode", dec.Err())
+	assert.Eq("names", strings.Join(names, ","), "a,b\nc")
+
+	dec = NewStreamDecoder(bytes.NewReader([]byte("{\"name\":\"x\"}\n{bad")))
+	assert.Eq("first", dec.Next(e), true)
+	assert.Eq("second", dec.Next(e), false)
+	assert.Err("bad data", "json", dec.Err())
+}
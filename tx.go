@@ -0,0 +1,148 @@
+package ent
+
+import (
+	"errors"
+)
+
+// Tx is a transaction spanning multiple ents, returned by Storage.Begin.
+//
+// A Tx is itself a Storage: ents created, saved, deleted or loaded with a Tx as their storage
+// are part of the transaction. For example a.Create(tx) creates a in the transaction tx.
+// Changes take effect all at once when Commit is called, or not at all, in which case
+// Commit returns an error. Rollback discards all changes.
+//
+// When a transaction ends, ents which are bound to it are bound to the storage that began it.
+// Ents which were created, saved or deleted in a transaction which is rolled back (or which
+// fails to commit) are restored to the state they were in before the transaction.
+type Tx interface {
+	Storage
+	Commit() error
+	Rollback() error
+}
+
+var (
+	ErrTxDone   = errors.New("transaction has already been committed or rolled back")
+	ErrTxNested = errors.New("nested transactions are not supported")
+)
+
+// TxEnts keeps track of ents used with a transaction.
+// It is meant to be used by Tx implementations.
+type TxEnts struct {
+	ents []txEntState
+	m    map[Ent]int // ent => index in ents
+}
+
+type txEntState struct {
+	e             Ent
+	restore       bool // restore state on rollback
+	id            uint64
+	version       uint64
+	storage       Storage
+	changes       FieldSet
+	fieldVersions []uint64
+	deleted       bool
+}
+
+// Add records the current state of e, if e is not already tracked.
+// modify should be true when e is about to be created, saved or deleted and false when e is
+// only being loaded; only ents that were modified are restored by Rollback.
+// When e is tracked but has only been loaded so far, modify records its current state, which
+// is then restored by Rollback.
+func (t *TxEnts) Add(e Ent, modify bool) {
+	if i, ok := t.m[e]; ok {
+		if modify && !t.ents[i].restore {
+			t.ents[i] = newTxEntState(e, true)
+		}
+		return
+	}
+	if t.m == nil {
+		t.m = make(map[Ent]int)
+	}
+	t.m[e] = len(t.ents)
+	t.ents = append(t.ents, newTxEntState(e, modify))
+}
+
+func newTxEntState(e Ent, restore bool) txEntState {
+	eb := entBase(e)
+	return txEntState{
+		e:             e,
+		restore:       restore,
+		id:            eb.id,
+		version:       eb.version,
+		storage:       eb.storage,
+		changes:       eb.changes,
+		fieldVersions: eb.fieldVersions,
+		deleted:       eb.deleted,
+	}
+}
+
+// Commit binds all tracked ents which are bound to tx to s and stops tracking them
+func (t *TxEnts) Commit(tx, s Storage) {
+	for _, st := range t.ents {
+		if eb := entBase(st.e); eb.storage == tx {
+			eb.storage = s
+		}
+	}
+	t.reset()
+}
+
+// CommitNested is like Commit but for a transaction tx nested in the transaction outerTx:
+// ents are bound to outerTx and tracking of them is handed over to outer.
+func (t *TxEnts) CommitNested(tx, outerTx Storage, outer *TxEnts) {
+	for _, st := range t.ents {
+		if eb := entBase(st.e); eb.storage == tx {
+			eb.storage = outerTx
+		}
+		if st.storage == tx {
+			st.storage = outerTx // restored by outer
+		}
+		if i, ok := outer.m[st.e]; !ok {
+			if outer.m == nil {
+				outer.m = make(map[Ent]int)
+			}
+			outer.m[st.e] = len(outer.ents)
+			outer.ents = append(outer.ents, st)
+		} else if st.restore && !outer.ents[i].restore {
+			// only loaded in outer; the state before tx modified it is the one to restore
+			outer.ents[i] = st
+		}
+	}
+	t.reset()
+}
+
+// Rollback restores the state of all tracked ents which were modified and binds the
+// tracked ents which are bound to tx to s. Tracking stops for all ents.
+func (t *TxEnts) Rollback(tx, s Storage) {
+	for _, st := range t.ents {
+		eb := entBase(st.e)
+		if st.restore {
+			eb.id = st.id
+			eb.version = st.version
+			eb.storage = st.storage
+			eb.changes = st.changes
+			eb.fieldVersions = st.fieldVersions
+			eb.deleted = st.deleted
+		}
+		if eb.storage == tx {
+			eb.storage = s
+		}
+	}
+	t.reset()
+}
+
+// RollbackNested is like Rollback but for a transaction tx nested in the transaction outerTx:
+// ents which are bound to outerTx after rollback are tracked by outer.
+func (t *TxEnts) RollbackNested(tx, outerTx Storage, outer *TxEnts) {
+	ents := t.ents
+	t.Rollback(tx, outerTx)
+	for _, st := range ents {
+		if entBase(st.e).storage == outerTx {
+			outer.Add(st.e, false)
+		}
+	}
+}
+
+func (t *TxEnts) reset() {
+	t.ents = nil
+	t.m = nil
+}
@@ -0,0 +1,62 @@
+package ent
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Unknown fields
+//
+// Ents with the "keepunknown" tag on their EntBase field, e.g. "ent.EntBase `account,keepunknown`",
+// keep fields which they don't know about when decoded from JSON and write them back when
+// encoded to JSON. This way a program with an older version of an ent type which loads and saves
+// an ent written by a newer version (which has more fields) does not drop the newer fields,
+// which is useful while rolling out a new version of a program.
+//
+// Unknown fields are only kept by the JSON codec (e.g. mem storage); other codecs discard them.
+
+// DecodeEntUnknownField keeps the value of the unknown field key read from c, if c is a
+// JsonDecoder, and otherwise discards it.
+// Used by generated EntDecode methods of ents with the "keepunknown" tag.
+func (e *EntBase) DecodeEntUnknownField(c Decoder, key string) {
+	jc, ok := c.(*JsonDecoder)
+	if !ok {
+		c.Discard()
+		return
+	}
+	v := jc.rawValue()
+	if jc.Err() != nil {
+		return
+	}
+	if e.unknownFields == nil {
+		e.unknownFields = make(map[string]json.RawMessage)
+	}
+	e.unknownFields[key] = v
+}
+
+// ClearEntUnknownFields forgets all unknown fields.
+// Used by generated EntDecode methods of ents with the "keepunknown" tag.
+func (e *EntBase) ClearEntUnknownFields() { e.unknownFields = nil }
+
+// UnknownFields returns the unknown fields of e as JSON values, keyed by field name.
+// Returns nil if there are none.
+func UnknownFields(e Ent) map[string]json.RawMessage {
+	return entBase(e).unknownFields
+}
+
+// encodeUnknownFields writes the unknown fields of e to c, sorted by name
+func encodeUnknownFields(e Ent, c *JsonEncoder) {
+	m := entBase(e).unknownFields
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c.Key(k)
+		c.Raw(m[k])
+	}
+}
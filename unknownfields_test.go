@@ -0,0 +1,75 @@
+package ent
+
+import (
+	"testing"
+
+	"github.com/rsms/go-testutil"
+)
+
+type unknownFieldsTestEnt struct {
+	EntBase
+	name string
+}
+
+func (e *unknownFieldsTestEnt) EntTypeName() string { return "unknowntest" }
+func (e *unknownFieldsTestEnt) EntNew() Ent         { return &unknownFieldsTestEnt{} }
+func (e *unknownFieldsTestEnt) EntEncode(c Encoder, fields FieldSet) {
+	if fields.Has(0) {
+		c.Key("name")
+		c.Str(e.name)
+	}
+}
+func (e *unknownFieldsTestEnt) EntDecode(c Decoder) (id, version uint64) {
+	e.EntBase.ClearEntUnknownFields()
+	for {
+		switch k := string(c.Key()); k {
+		case "":
+			return
+		case FieldNameId:
+			id = c.Uint(64)
+		case FieldNameVersion:
+			version = c.Uint(64)
+		case "name":
+			e.name = c.Str()
+		default:
+			e.EntBase.DecodeEntUnknownField(c, k)
+		}
+	}
+}
+func (e *unknownFieldsTestEnt) EntDecodePartial(c Decoder, fields FieldSet) uint64 { return 0 }
+func (e *unknownFieldsTestEnt) EntIndexes() []EntIndex                             { return nil }
+func (e *unknownFieldsTestEnt) EntFields() Fields {
+	return Fields{Names: []string{"name"}, FieldSet: 1}
+}
+
+func TestUnknownFields(t *testing.T) {
+	assert := testutil.NewAssert(t)
+	e := &unknownFieldsTestEnt{}
+	err := JsonDecode(e, []byte(`{"_ver":"2","_id":"1","b":[1,{"c":null}],"name":"a","a":"x"}`))
+	assert.NoErr("JsonDecode", err)
+	assert.Eq("name", e.name, "a")
+	assert.Eq("unknown fields", len(UnknownFields(e)), 2)
+
+	e.name = "b"
+	data, err := JsonEncode(e, "")
+	assert.NoErr("JsonEncode", err)
+	assert.Eq("round trip", string(data),
+		`{"_ver":"2","_id":"1","name":"b","a":"x","b":[1,{"c":null}]}`)
+
+	// only full encodings include unknown fields
+	data, err = JsonEncodeEnt(e, 1, 2, 0, "")
+	assert.NoErr("JsonEncodeEnt", err)
+	assert.Eq("partial", string(data), `{"_ver":"2","_id":"1"}`)
+
+	// decoding again replaces unknown fields
+	assert.NoErr("JsonDecode", JsonDecode(e, []byte(`{"_ver":"3","_id":"1","name":"a"}`)))
+	assert.Eq("cleared", len(UnknownFields(e)), 0)
+
+	// other codecs discard unknown fields
+	data, err = MsgpackEncodeEnt(&sizeIndexTestEnt{w: 1, name: "c"}, 1, 4, 1|4)
+	assert.NoErr("MsgpackEncodeEnt", err)
+	_, _, err = MsgpackDecodeEnt(e, data)
+	assert.NoErr("MsgpackDecodeEnt", err)
+	assert.Eq("msgpack name", e.name, "c")
+	assert.Eq("msgpack unknown fields", len(UnknownFields(e)), 0)
+}